@@ -0,0 +1,284 @@
+// Package analysis 在执行之前检查 Monkey 程序，找出没有使用的 let、
+// return 之后执行不到的代码、遮蔽外层变量的定义、参数个数不对的内置函数调用
+// 和未定义的名字。名字的解析规则与编译器相同，由 compiler.SymbolTable 完成。
+package analysis
+
+import (
+	"fmt"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/object"
+	"interpreter/token"
+	"sort"
+)
+
+type Severity int
+
+const (
+	// Warning 表示代码可以执行，但很可能不是作者的本意
+	Warning Severity = iota
+	// Error 表示代码执行到这里一定会出错
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// 诊断的类别，保存在 Diagnostic.Code 中
+const (
+	CodeUnused      = "unused"
+	CodeUnreachable = "unreachable"
+	CodeShadow      = "shadow"
+	CodeArity       = "arity"
+	CodeUndefined   = "undefined"
+)
+
+// Diagnostic 是一条分析结果，Line 和 Column 从 1 开始
+type Diagnostic struct {
+	Line     int
+	Column   int
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Column, d.Severity, d.Message)
+}
+
+// binding 是一个 let 或者参数定义的名字
+type binding struct {
+	name  string
+	tok   token.Token
+	param bool
+	used  bool
+}
+
+// scope 对应编译器的一层符号表，也就是主程序或者一个函数体
+type scope struct {
+	table    *compiler.SymbolTable
+	bindings map[string]*binding
+	// all 按定义的顺序保存所有绑定，同名的重新定义也会保留下来
+	all []*binding
+}
+
+type analyzer struct {
+	scopes      []*scope
+	diagnostics []Diagnostic
+}
+
+// Analyze 分析整个程序，全局作用域中只有内置函数
+func Analyze(program *ast.Program) []Diagnostic {
+	return AnalyzeWithSymbols(program, compiler.New().SymbolTable())
+}
+
+// AnalyzeWithSymbols 在已有的全局符号表上分析程序，例如 REPL 之前输入定义的变量。
+// 符号表会被修改，调用者需要保留原来的内容时应该传入 Copy 的结果。
+func AnalyzeWithSymbols(program *ast.Program, symbols *compiler.SymbolTable) []Diagnostic {
+	a := &analyzer{}
+	a.enterScope(symbols)
+	a.statements(program.Statements)
+	a.leaveScope()
+	sort.SliceStable(a.diagnostics, func(i, j int) bool {
+		di, dj := a.diagnostics[i], a.diagnostics[j]
+		if di.Line != dj.Line {
+			return di.Line < dj.Line
+		}
+		return di.Column < dj.Column
+	})
+	return a.diagnostics
+}
+
+func (a *analyzer) report(tok token.Token, severity Severity, code string, format string, args ...interface{}) {
+	a.diagnostics = append(a.diagnostics, Diagnostic{
+		Line:     tok.Line,
+		Column:   tok.Column,
+		Severity: severity,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (a *analyzer) current() *scope {
+	return a.scopes[len(a.scopes)-1]
+}
+
+func (a *analyzer) enterScope(table *compiler.SymbolTable) {
+	a.scopes = append(a.scopes, &scope{table: table, bindings: map[string]*binding{}})
+}
+
+// leaveScope 报告这一层中从未读取过的 let
+func (a *analyzer) leaveScope() {
+	for _, b := range a.current().all {
+		if !b.used && !b.param {
+			a.report(b.tok, Warning, CodeUnused, "%s declared and not used", b.name)
+		}
+	}
+	a.scopes = a.scopes[:len(a.scopes)-1]
+}
+
+// define 在当前作用域中定义名字，遮蔽外层作用域的名字或者内置函数时给出警告
+func (a *analyzer) define(ident *ast.Identifier, param bool) {
+	s := a.current()
+	if outer := a.lookupOuter(ident.Value); outer != nil {
+		a.report(ident.Token, Warning, CodeShadow, "declaration of %q shadows declaration at line %d", ident.Value, outer.tok.Line)
+	} else if _, ok := s.bindings[ident.Value]; !ok && object.GetBuiltinByName(ident.Value) != nil {
+		a.report(ident.Token, Warning, CodeShadow, "declaration of %q shadows the builtin", ident.Value)
+	}
+	s.table.Define(ident.Value)
+	b := &binding{name: ident.Value, tok: ident.Token, param: param}
+	s.bindings[ident.Value] = b
+	s.all = append(s.all, b)
+}
+
+// lookupOuter 在外层作用域中查找名字
+func (a *analyzer) lookupOuter(name string) *binding {
+	for i := len(a.scopes) - 2; i >= 0; i-- {
+		if b, ok := a.scopes[i].bindings[name]; ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// use 解析一个被读取的名字，把对应的绑定标记为已使用
+func (a *analyzer) use(ident *ast.Identifier) {
+	symbol, ok := a.current().table.Resolve(ident.Value)
+	if !ok {
+		a.report(ident.Token, Error, CodeUndefined, "undefined variable %s", ident.Value)
+		return
+	}
+	if symbol.Scope == compiler.FunctionScope {
+		// 函数在自己内部递归调用不算使用
+		return
+	}
+	for i := len(a.scopes) - 1; i >= 0; i-- {
+		if b, ok := a.scopes[i].bindings[ident.Value]; ok {
+			b.used = true
+			return
+		}
+	}
+}
+
+// statements 依次分析语句，return 之后的第一条语句报告为执行不到
+func (a *analyzer) statements(list []ast.Statement) {
+	returned := false
+	for _, s := range list {
+		if returned {
+			a.report(statementToken(s), Warning, CodeUnreachable, "unreachable code")
+			returned = false
+		}
+		a.node(s)
+		if _, ok := s.(*ast.ReturnStatement); ok {
+			returned = true
+		}
+	}
+}
+
+func statementToken(s ast.Statement) token.Token {
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		return s.Token
+	case *ast.ReturnStatement:
+		return s.Token
+	case *ast.ExpressionStatement:
+		return s.Token
+	case *ast.BlockStatement:
+		return s.Token
+	}
+	return token.Token{}
+}
+
+func (a *analyzer) node(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		// 与编译器一样先处理右边的值再定义名字
+		a.expression(node.Value)
+		if node.Name != nil {
+			a.define(node.Name, false)
+		}
+	case *ast.ReturnStatement:
+		a.expression(node.ReturnValue)
+	case *ast.ExpressionStatement:
+		a.expression(node.Expression)
+	case *ast.BlockStatement:
+		a.statements(node.Statements)
+	case *ast.Identifier:
+		a.use(node)
+	case *ast.PrefixExpression:
+		a.expression(node.Right)
+	case *ast.InfixExpression:
+		a.expression(node.Left)
+		a.expression(node.Right)
+	case *ast.IfExpression:
+		a.expression(node.Condition)
+		if node.Consequence != nil {
+			a.node(node.Consequence)
+		}
+		if node.Alternative != nil {
+			a.node(node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		a.enterScope(compiler.NewEnclosedSymbolTable(a.current().table))
+		if node.Name != "" {
+			a.current().table.DefineFunctionName(node.Name)
+		}
+		for _, p := range node.Parameters {
+			a.define(p, true)
+		}
+		if node.Body != nil {
+			a.node(node.Body)
+		}
+		a.leaveScope()
+	case *ast.CallExpression:
+		a.call(node)
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			a.expression(el)
+		}
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			a.expression(pair.Key)
+			a.expression(pair.Value)
+		}
+	case *ast.IndexExpression:
+		a.expression(node.Left)
+		a.expression(node.Index)
+	case *ast.MacroLiteral:
+		// 宏体操作的是未求值的代码，其中的名字在展开之后才有意义
+	}
+}
+
+func (a *analyzer) expression(e ast.Expression) {
+	if e != nil {
+		a.node(e)
+	}
+}
+
+func (a *analyzer) call(node *ast.CallExpression) {
+	ident, ok := node.Function.(*ast.Identifier)
+	if ok && (ident.Value == "quote" || ident.Value == "unquote") {
+		// quote 和 unquote 是求值器处理的特殊形式
+		return
+	}
+	a.expression(node.Function)
+	for _, arg := range node.Arguments {
+		a.expression(arg)
+	}
+	if !ok {
+		return
+	}
+	symbol, ok := a.current().table.Resolve(ident.Value)
+	if !ok || symbol.Scope != compiler.BuiltinScope {
+		return
+	}
+	builtin := object.Builtins[symbol.Index]
+	if !builtin.Arity.Accepts(len(node.Arguments)) {
+		a.report(ident.Token, Error, CodeArity, "wrong number of arguments to `%s`: got=%d, want=%s",
+			builtin.Name, len(node.Arguments), builtin.Arity)
+	}
+}
@@ -0,0 +1,110 @@
+package analysis
+
+import (
+	"interpreter/compiler"
+	"interpreter/lexer"
+	"interpreter/parser"
+	"strings"
+	"testing"
+)
+
+func analyze(t *testing.T, input string) []string {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parse errors in %q: %v", input, p.Errors())
+	}
+	var result []string
+	for _, d := range Analyze(program) {
+		result = append(result, d.String())
+	}
+	return result
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"let a = 1; a", nil},
+		{"let a = 1;", []string{"1:5: warning: a declared and not used"}},
+		{
+			"let a = 1; let a = 2; a",
+			[]string{"1:5: warning: a declared and not used"},
+		},
+		{"let a = 1; let a = a + 1; a", nil},
+		{
+			"let f = fn(x) { let y = x; x }; f(1)",
+			[]string{"1:21: warning: y declared and not used"},
+		},
+		{
+			// 只在自己内部递归调用的函数也算没有使用
+			"let f = fn(n) { f(n - 1) };",
+			[]string{"1:5: warning: f declared and not used"},
+		},
+		{
+			"let f = fn(x) {\n  return x;\n  x + 1;\n  x + 2\n}; f(1)",
+			[]string{"3:3: warning: unreachable code"},
+		},
+		{
+			"if (true) { return 1; let b = 2; b }",
+			[]string{"1:23: warning: unreachable code"},
+		},
+		{
+			"let x = 1; let f = fn(x) { x }; f(x)",
+			[]string{`1:23: warning: declaration of "x" shadows declaration at line 1`},
+		},
+		{
+			"let x = 1; let f = fn() { let x = 2; x }; f() + x",
+			[]string{`1:31: warning: declaration of "x" shadows declaration at line 1`},
+		},
+		{
+			"let len = fn(a) { 0 }; len(1, 2)",
+			[]string{`1:5: warning: declaration of "len" shadows the builtin`},
+		},
+		{
+			`len("a", "b"); push([]); put(); format("%d", 1); range(1, 2, 3, 4)`,
+			[]string{
+				"1:1: error: wrong number of arguments to `len`: got=2, want=1",
+				"1:16: error: wrong number of arguments to `push`: got=1, want=2",
+				"1:50: error: wrong number of arguments to `range`: got=4, want=1..3",
+			},
+		},
+		{
+			"let f = fn() { g() }; let g = fn() { 1 }; f() + g() + missing",
+			[]string{
+				"1:16: error: undefined variable g",
+				"1:55: error: undefined variable missing",
+			},
+		},
+		{
+			// 闭包读取外层的变量也算使用
+			"let make = fn(n) { let step = 2; fn(x) { x + n * step } }; make(1)",
+			nil,
+		},
+		{
+			"let unless = macro(c, a, b) { quote(if (!(unquote(c))) { unquote(a) } else { unquote(b) }) }; unless(true, 1, 2)",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		got := analyze(t, tt.input)
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%q:\nwant=%q\ngot=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestAnalyzeWithSymbols(t *testing.T) {
+	symbols := compiler.New().SymbolTable()
+	symbols.Define("config")
+	program := parser.New(lexer.New(`config["name"] + other`)).ParseProgram()
+	diagnostics := AnalyzeWithSymbols(program, symbols)
+	if len(diagnostics) != 1 || diagnostics[0].Code != CodeUndefined || diagnostics[0].Severity != Error {
+		t.Fatalf("expected one undefined error, got=%v", diagnostics)
+	}
+	if diagnostics[0].Line != 1 || diagnostics[0].Column != 18 {
+		t.Errorf("wrong position %d:%d", diagnostics[0].Line, diagnostics[0].Column)
+	}
+}
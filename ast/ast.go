@@ -183,6 +183,8 @@ func (ie *IfExpression) String() string {
 type BlockStatement struct {
 	Token      token.Token
 	Statements []Statement
+	// Rbrace 是结束的右花括号，格式化工具用它判断注释属于哪个块
+	Rbrace token.Token
 }
 
 func (bs *BlockStatement) statementNode()       {}
@@ -199,6 +201,8 @@ type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	// Name 是 let 语句绑定的名字，编译器用它支持递归调用
+	Name string
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -222,6 +226,8 @@ type CallExpression struct {
 	Token     token.Token
 	Function  Expression
 	Arguments []Expression
+	// Rparen 是参数列表的右括号，格式化工具用它确定表达式结束的行
+	Rparen token.Token
 }
 
 func (ce *CallExpression) expressionNode()      {}
@@ -252,6 +258,8 @@ func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 type ArrayLiteral struct {
 	Token    token.Token
 	Elements []Expression
+	// Rbracket 是结束的右方括号
+	Rbracket token.Token
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
@@ -272,6 +280,8 @@ type IndexExpression struct {
 	Token token.Token
 	Left  Expression
 	Index Expression
+	// Rbracket 是结束的右方括号
+	Rbracket token.Token
 }
 
 func (ie *IndexExpression) expressionNode()      {}
@@ -286,9 +296,17 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// HashPair 保存哈希字面量中的一个键值对，Pairs 按源码中出现的顺序排列
+type HashPair struct {
+	Key   Expression
+	Value Expression
+}
+
 type HashLiteral struct {
 	Token token.Token
-	Pairs map[Expression]Expression
+	Pairs []HashPair
+	// Rbrace 是结束的右花括号
+	Rbrace token.Token
 }
 
 func (hl *HashLiteral) expressionNode()      {}
@@ -296,8 +314,8 @@ func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	var pairs []string
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, pair := range hl.Pairs {
+		pairs = append(pairs, pair.Key.String()+":"+pair.Value.String())
 	}
 	out.WriteString("{")
 	out.WriteString(strings.Join(pairs, ", "))
@@ -1,54 +1,189 @@
 package ast
 
+import "fmt"
+
 type ModifierFunc func(Node) Node
 
-func Modify(node Node, modifier ModifierFunc) Node {
+// ModifyError 表示 modifier 返回的节点不能放回原来的位置，
+// 例如把表达式的位置替换成了语句或者 nil。
+type ModifyError struct {
+	Parent Node
+	Want   string
+	Got    Node
+}
+
+func (e *ModifyError) Error() string {
+	return fmt.Sprintf("cannot modify %T: want %s, got %T", e.Parent, e.Want, e.Got)
+}
+
+func Modify(node Node, modifier ModifierFunc) (Node, error) {
+	var err error
 	switch node := node.(type) {
 	case *Program:
 		for i, statement := range node.Statements {
-			node.Statements[i], _ = Modify(statement, modifier).(Statement)
+			if node.Statements[i], err = modifyStatement(node, statement, modifier); err != nil {
+				return nil, err
+			}
 		}
 	case *ExpressionStatement:
-		node.Expression, _ = Modify(node.Expression, modifier).(Expression)
+		if node.Expression, err = modifyExpression(node, node.Expression, modifier); err != nil {
+			return nil, err
+		}
 	case *InfixExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		if node.Left, err = modifyExpression(node, node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Right, err = modifyExpression(node, node.Right, modifier); err != nil {
+			return nil, err
+		}
 	case *PrefixExpression:
-		node.Right, _ = Modify(node.Right, modifier).(Expression)
+		if node.Right, err = modifyExpression(node, node.Right, modifier); err != nil {
+			return nil, err
+		}
 	case *IndexExpression:
-		node.Left, _ = Modify(node.Left, modifier).(Expression)
-		node.Index, _ = Modify(node.Index, modifier).(Expression)
+		if node.Left, err = modifyExpression(node, node.Left, modifier); err != nil {
+			return nil, err
+		}
+		if node.Index, err = modifyExpression(node, node.Index, modifier); err != nil {
+			return nil, err
+		}
 	case *IfExpression:
-		node.Condition, _ = Modify(node.Condition, modifier).(Expression)
-		node.Consequence, _ = Modify(node.Consequence, modifier).(*BlockStatement)
-		if node.Alternative != nil {
-			node.Alternative, _ = Modify(node.Alternative, modifier).(*BlockStatement)
+		if node.Condition, err = modifyExpression(node, node.Condition, modifier); err != nil {
+			return nil, err
+		}
+		if node.Consequence, err = modifyBlock(node, node.Consequence, modifier); err != nil {
+			return nil, err
+		}
+		if node.Alternative, err = modifyBlock(node, node.Alternative, modifier); err != nil {
+			return nil, err
 		}
 	case *BlockStatement:
-		for i, _ := range node.Statements {
-			node.Statements[i], _ = Modify(node.Statements[i], modifier).(Statement)
+		for i, statement := range node.Statements {
+			if node.Statements[i], err = modifyStatement(node, statement, modifier); err != nil {
+				return nil, err
+			}
 		}
 	case *ReturnStatement:
-		node.ReturnValue, _ = Modify(node.ReturnValue, modifier).(Expression)
+		if node.ReturnValue, err = modifyExpression(node, node.ReturnValue, modifier); err != nil {
+			return nil, err
+		}
 	case *LetStatement:
-		node.Value, _ = Modify(node.Value, modifier).(Expression)
+		if node.Name, err = modifyIdentifier(node, node.Name, modifier); err != nil {
+			return nil, err
+		}
+		if node.Value, err = modifyExpression(node, node.Value, modifier); err != nil {
+			return nil, err
+		}
 	case *FunctionLiteral:
-		for i, _ := range node.Parameters {
-			node.Parameters[i], _ = Modify(node.Parameters[i], modifier).(*Identifier)
+		if err = modifyIdentifiers(node, node.Parameters, modifier); err != nil {
+			return nil, err
+		}
+		if node.Body, err = modifyBlock(node, node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *MacroLiteral:
+		if err = modifyIdentifiers(node, node.Parameters, modifier); err != nil {
+			return nil, err
+		}
+		if node.Body, err = modifyBlock(node, node.Body, modifier); err != nil {
+			return nil, err
+		}
+	case *CallExpression:
+		if node.Function, err = modifyExpression(node, node.Function, modifier); err != nil {
+			return nil, err
+		}
+		for i, argument := range node.Arguments {
+			if node.Arguments[i], err = modifyExpression(node, argument, modifier); err != nil {
+				return nil, err
+			}
 		}
-		node.Body, _ = Modify(node.Body, modifier).(*BlockStatement)
 	case *ArrayLiteral:
-		for i, _ := range node.Elements {
-			node.Elements[i], _ = Modify(node.Elements[i], modifier).(Expression)
+		for i, element := range node.Elements {
+			if node.Elements[i], err = modifyExpression(node, element, modifier); err != nil {
+				return nil, err
+			}
 		}
 	case *HashLiteral:
-		newPairs := make(map[Expression]Expression)
-		for key, val := range node.Pairs {
-			newKey, _ := Modify(key, modifier).(Expression)
-			newVal, _ := Modify(val, modifier).(Expression)
-			newPairs[newKey] = newVal
+		for i, pair := range node.Pairs {
+			if node.Pairs[i].Key, err = modifyExpression(node, pair.Key, modifier); err != nil {
+				return nil, err
+			}
+			if node.Pairs[i].Value, err = modifyExpression(node, pair.Value, modifier); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return modifier(node), nil
+}
+
+// 子节点为 nil 时保持原样，不交给 modifier
+func modifyExpression(parent Node, exp Expression, modifier ModifierFunc) (Expression, error) {
+	if exp == nil {
+		return nil, nil
+	}
+	modified, err := Modify(exp, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := modified.(Expression)
+	if !ok {
+		return nil, &ModifyError{Parent: parent, Want: "Expression", Got: modified}
+	}
+	return result, nil
+}
+
+func modifyStatement(parent Node, stmt Statement, modifier ModifierFunc) (Statement, error) {
+	if stmt == nil {
+		return nil, nil
+	}
+	modified, err := Modify(stmt, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := modified.(Statement)
+	if !ok {
+		return nil, &ModifyError{Parent: parent, Want: "Statement", Got: modified}
+	}
+	return result, nil
+}
+
+func modifyBlock(parent Node, block *BlockStatement, modifier ModifierFunc) (*BlockStatement, error) {
+	if block == nil {
+		return nil, nil
+	}
+	modified, err := Modify(block, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := modified.(*BlockStatement)
+	if !ok || result == nil {
+		return nil, &ModifyError{Parent: parent, Want: "*BlockStatement", Got: modified}
+	}
+	return result, nil
+}
+
+func modifyIdentifier(parent Node, ident *Identifier, modifier ModifierFunc) (*Identifier, error) {
+	if ident == nil {
+		return nil, nil
+	}
+	modified, err := Modify(ident, modifier)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := modified.(*Identifier)
+	if !ok || result == nil {
+		return nil, &ModifyError{Parent: parent, Want: "*Identifier", Got: modified}
+	}
+	return result, nil
+}
+
+func modifyIdentifiers(parent Node, idents []*Identifier, modifier ModifierFunc) error {
+	for i, ident := range idents {
+		modified, err := modifyIdentifier(parent, ident, modifier)
+		if err != nil {
+			return err
 		}
-		node.Pairs = newPairs
+		idents[i] = modified
 	}
-	return modifier(node)
+	return nil
 }
@@ -103,30 +103,107 @@ func TestModify(t *testing.T) {
 			&ArrayLiteral{Elements: []Expression{one(), one()}},
 			&ArrayLiteral{Elements: []Expression{two(), two()}},
 		},
+		{
+			&CallExpression{Function: one(), Arguments: []Expression{one(), two()}},
+			&CallExpression{Function: two(), Arguments: []Expression{two(), two()}},
+		},
+		{
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
 	}
 	hashLiteral := &HashLiteral{
-		Pairs: map[Expression]Expression{
-			one(): one(),
-			one(): one(),
+		Pairs: []HashPair{
+			{Key: one(), Value: one()},
+			{Key: one(), Value: one()},
 		},
 	}
-	Modify(hashLiteral, turnOneIntoTwo)
+	if _, err := Modify(hashLiteral, turnOneIntoTwo); err != nil {
+		t.Fatalf("Modify returned error: %s", err)
+	}
 	for _, tt := range tests {
-		modified := Modify(tt.input, turnOneIntoTwo)
+		modified, err := Modify(tt.input, turnOneIntoTwo)
+		if err != nil {
+			t.Fatalf("Modify returned error: %s", err)
+		}
 		equal := reflect.DeepEqual(modified, tt.expected)
 		if !equal {
 			t.Errorf("not equal. got=%#v, wang=%#v",
 				modified, tt.expected)
 		}
 	}
-	for k, v := range hashLiteral.Pairs {
-		k, _ := k.(*IntegerLiteral)
+	for _, pair := range hashLiteral.Pairs {
+		k, _ := pair.Key.(*IntegerLiteral)
 		if k.Value != 2 {
 			t.Errorf("value is not %d, got=%d", 2, k.Value)
 		}
-		v, _ := v.(*IntegerLiteral)
+		v, _ := pair.Value.(*IntegerLiteral)
 		if v.Value != 2 {
 			t.Errorf("value is not %d, got=%d", 2, v.Value)
 		}
 	}
 }
+
+func TestModifyTypeError(t *testing.T) {
+	tests := []struct {
+		input    Node
+		modifier ModifierFunc
+	}{
+		{
+			&ArrayLiteral{Elements: []Expression{&IntegerLiteral{Value: 1}}},
+			func(node Node) Node {
+				if _, ok := node.(*IntegerLiteral); ok {
+					return nil
+				}
+				return node
+			},
+		},
+		{
+			&Program{Statements: []Statement{
+				&ExpressionStatement{Expression: &IntegerLiteral{Value: 1}},
+			}},
+			func(node Node) Node {
+				if _, ok := node.(*ExpressionStatement); ok {
+					return &IntegerLiteral{Value: 2}
+				}
+				return node
+			},
+		},
+		{
+			&IfExpression{
+				Condition:   &Boolean{Value: true},
+				Consequence: &BlockStatement{},
+			},
+			func(node Node) Node {
+				if _, ok := node.(*BlockStatement); ok {
+					return &ExpressionStatement{}
+				}
+				return node
+			},
+		},
+	}
+	for _, tt := range tests {
+		modified, err := Modify(tt.input, tt.modifier)
+		if err == nil {
+			t.Errorf("expected error, got node %#v", modified)
+			continue
+		}
+		if _, ok := err.(*ModifyError); !ok {
+			t.Errorf("error is not *ModifyError. got=%T", err)
+		}
+	}
+}
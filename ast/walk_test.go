@@ -0,0 +1,91 @@
+package ast
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Name: &Identifier{Value: "add"},
+				Value: &FunctionLiteral{
+					Parameters: []*Identifier{{Value: "a"}},
+					Body: &BlockStatement{
+						Statements: []Statement{
+							&ReturnStatement{ReturnValue: &InfixExpression{
+								Left:     &Identifier{Value: "a"},
+								Operator: "+",
+								Right:    &IntegerLiteral{Value: 1},
+							}},
+						},
+					},
+				},
+			},
+			&ExpressionStatement{Expression: &CallExpression{
+				Function:  &Identifier{Value: "add"},
+				Arguments: []Expression{&IndexExpression{Left: &Identifier{Value: "xs"}, Index: &IntegerLiteral{Value: 2}}},
+			}},
+			&ExpressionStatement{Expression: &MacroLiteral{
+				Parameters: []*Identifier{{Value: "m"}},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: &PrefixExpression{Operator: "!", Right: &Boolean{Value: true}}},
+				}},
+			}},
+		},
+	}
+
+	var got []string
+	Inspect(program, func(node Node) bool {
+		switch node := node.(type) {
+		case *Identifier:
+			got = append(got, node.Value)
+		case *IntegerLiteral:
+			got = append(got, strconv.FormatInt(node.Value, 10))
+		case *Boolean:
+			got = append(got, "bool")
+		}
+		return true
+	})
+	expected := []string{"add", "a", "a", "1", "add", "xs", "2", "m", "bool"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong visit order. want=%q, got=%q", expected, got)
+	}
+}
+
+type countVisitor map[string]int
+
+func (c countVisitor) Visit(node Node) Visitor {
+	if node == nil {
+		c["nil"]++
+		return nil
+	}
+	c["node"]++
+	if _, ok := node.(*FunctionLiteral); ok {
+		return nil
+	}
+	return c
+}
+
+func TestWalkSkipsChildren(t *testing.T) {
+	program := &Program{
+		Statements: []Statement{
+			&ExpressionStatement{Expression: &FunctionLiteral{
+				Parameters: []*Identifier{{Value: "x"}},
+				Body:       &BlockStatement{},
+			}},
+		},
+	}
+	counts := countVisitor{}
+	Walk(counts, program)
+	// Program, ExpressionStatement, FunctionLiteral
+	if counts["node"] != 3 {
+		t.Errorf("wrong number of visited nodes. want=3, got=%d", counts["node"])
+	}
+	// 只有 Program 和 ExpressionStatement 在访问完子节点后收到 nil
+	if counts["nil"] != 2 {
+		t.Errorf("wrong number of nil visits. want=2, got=%d", counts["nil"])
+	}
+}
@@ -0,0 +1,176 @@
+// Package bench 用几个有代表性的程序比较求值器和虚拟机的性能，
+// 同一组程序既用于 go test -bench，也用于 monkey bench 命令。
+package bench
+
+import (
+	"fmt"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/evaluator"
+	"interpreter/lexer"
+	"interpreter/object"
+	"interpreter/parser"
+	"interpreter/vm"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Engines 是可以测试的引擎
+var Engines = []string{"eval", "vm"}
+
+// Workload 是一个基准测试程序，Expected 是最后一个表达式的值的 Inspect()
+type Workload struct {
+	Name     string
+	Source   string
+	Expected string
+}
+
+// Workloads 是内置的基准测试程序。Monkey 没有循环，重复的工作都用递归表达
+var Workloads = []Workload{
+	{
+		Name: "fib",
+		Source: `let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+fib(20)`,
+		Expected: "6765",
+	},
+	{
+		// 只有小整数的算术和比较，用来观察整数对象的分配
+		Name: "arith",
+		Source: `let step = fn(n, acc) { if (n == 0) { acc } else { if (acc < n) { step(n - 1, (acc * 3 + n) / 4) } else { step(n - 1, acc - n / 2) } } };
+let run = fn(k, acc) { if (k == 0) { acc } else { run(k - 1, acc + step(500, 0)) } };
+run(10, 0)`,
+		Expected: "10",
+	},
+	{
+		// push 每次都复制数组，所以总的工作量是数组长度的平方
+		Name: "push",
+		Source: `let build = fn(arr, n) { if (n == 0) { arr } else { build(push(arr, n), n - 1) } };
+let arr = build([], 500);
+len(arr) + arr[0] + arr[499]`,
+		Expected: "1001",
+	},
+	{
+		// 哈希不能修改，每个单词都重新构造一个计数的哈希，并查找所有的键
+		Name:     "wordcount",
+		Source:   wordCountSource,
+		Expected: "{the: 200,quick: 100,brown: 100,fox: 100,jumps: 100,over: 100,lazy: 100,dog: 100}",
+	},
+	{
+		Name: "concat",
+		Source: `let build = fn(s, n) { if (n == 0) { s } else { build(s + "monkey", n - 1) } };
+len(build("", 500))`,
+		Expected: "3000",
+	},
+}
+
+var wordCountSource = `let text = "` + strings.TrimSpace(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100)) + `";
+let one = fn(word, w) { if (word == w) { 1 } else { 0 } };
+let count = fn(c, w) {
+  {"the": c["the"] + one("the", w), "quick": c["quick"] + one("quick", w),
+   "brown": c["brown"] + one("brown", w), "fox": c["fox"] + one("fox", w),
+   "jumps": c["jumps"] + one("jumps", w), "over": c["over"] + one("over", w),
+   "lazy": c["lazy"] + one("lazy", w), "dog": c["dog"] + one("dog", w)}
+};
+let zero = {"the": 0, "quick": 0, "brown": 0, "fox": 0, "jumps": 0, "over": 0, "lazy": 0, "dog": 0};
+reduce(split(text, " "), zero, count)`
+
+// Lookup 按名字查找内置的程序
+func Lookup(name string) (Workload, bool) {
+	for _, w := range Workloads {
+		if w.Name == name {
+			return w, true
+		}
+	}
+	return Workload{}, false
+}
+
+// Prepare 解析并编译程序，返回用 engine 执行一次程序的函数。
+// 解析和编译只做一次，不计入每次执行的时间
+func Prepare(w Workload, engine string) (func() (object.Object, error), error) {
+	p := parser.New(lexer.New(w.Source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	switch engine {
+	case "eval":
+		return func() (object.Object, error) {
+			return evaluate(program)
+		}, nil
+	case "vm":
+		comp := compiler.New()
+		comp.SetOptimization(compiler.OptimizeFull)
+		if err := comp.Compile(program); err != nil {
+			return nil, fmt.Errorf("compile error: %s", err)
+		}
+		bytecode := comp.ByteCode()
+		return func() (object.Object, error) {
+			machine := vm.New(bytecode)
+			if err := machine.Run(); err != nil {
+				return nil, err
+			}
+			return machine.LastPoppedStackElem(), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown engine %q", engine)
+}
+
+func evaluate(program *ast.Program) (object.Object, error) {
+	result := evaluator.Eval(program, object.NewEnvironment())
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, fmt.Errorf("%s", errObj.Message)
+	}
+	return result, nil
+}
+
+// Result 是一次测量的结果
+type Result struct {
+	// N 是执行的次数
+	N           int
+	NsPerOp     int64
+	AllocsPerOp int64
+	BytesPerOp  int64
+}
+
+// Measure 反复执行 run，次数按倍数增加，直到总时间至少为 d，
+// 与 testing.B 的做法相同
+func Measure(run func() (object.Object, error), d time.Duration) (Result, error) {
+	// 先执行一次，检查错误并预热
+	if _, err := run(); err != nil {
+		return Result{}, err
+	}
+	n := 1
+	for {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if _, err := run(); err != nil {
+				return Result{}, err
+			}
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		if elapsed >= d || n >= 1e9 {
+			return Result{
+				N:           n,
+				NsPerOp:     elapsed.Nanoseconds() / int64(n),
+				AllocsPerOp: int64(after.Mallocs-before.Mallocs) / int64(n),
+				BytesPerOp:  int64(after.TotalAlloc-before.TotalAlloc) / int64(n),
+			}, nil
+		}
+		// 按已经用掉的时间估计还需要的次数，最多增加到 100 倍
+		next := n * 100
+		if elapsed > 0 {
+			if estimate := int(int64(n) * int64(d) / int64(elapsed) * 6 / 5); estimate < next {
+				next = estimate
+			}
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
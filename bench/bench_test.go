@@ -0,0 +1,87 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkloads(t *testing.T) {
+	for _, w := range Workloads {
+		for _, engine := range Engines {
+			run, err := Prepare(w, engine)
+			if err != nil {
+				t.Fatalf("%s: %s", w.Name, err)
+			}
+			result, err := run()
+			if err != nil {
+				t.Fatalf("%s with %s: %s", w.Name, engine, err)
+			}
+			if result.Inspect() != w.Expected {
+				t.Errorf("%s with %s: wrong result. want=%s, got=%s", w.Name, engine, w.Expected, result.Inspect())
+			}
+		}
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	w, ok := Lookup("concat")
+	if !ok {
+		t.Fatal("concat not found")
+	}
+	run, err := Prepare(w, "vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Measure(run, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.N < 1 || result.NsPerOp <= 0 || result.AllocsPerOp <= 0 || result.BytesPerOp <= 0 {
+		t.Errorf("wrong result %+v", result)
+	}
+	if _, ok := Lookup("missing"); ok {
+		t.Error("expected missing workload not to be found")
+	}
+}
+
+// benchmark 对两种引擎分别执行名为 name 的程序
+func benchmark(b *testing.B, name string) {
+	w, ok := Lookup(name)
+	if !ok {
+		b.Fatalf("unknown workload %q", name)
+	}
+	for _, engine := range Engines {
+		run, err := Prepare(w, engine)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(engine, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmark(b, "fib")
+}
+
+func BenchmarkArith(b *testing.B) {
+	benchmark(b, "arith")
+}
+
+func BenchmarkPush(b *testing.B) {
+	benchmark(b, "push")
+}
+
+func BenchmarkWordCount(b *testing.B) {
+	benchmark(b, "wordcount")
+}
+
+func BenchmarkConcat(b *testing.B) {
+	benchmark(b, "concat")
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 )
 
 type Instructions []byte
@@ -32,8 +33,30 @@ const (
 
 	OpGetGlobal
 	OpSetGlobal
+
+	OpArray
+	OpHash
+	OpIndex
+
+	OpCall
+	OpReturnValue
+	OpReturn
+
+	OpGetLocal
+	OpSetLocal
+	OpGetBuiltin
+
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+
+	// OpWide 是前缀，后面那条指令的每个操作数都占 4 个字节
+	OpWide
 )
 
+// WideWidth 是 OpWide 前缀之后每个操作数的字节数
+const WideWidth = 4
+
 type Definition struct {
 	Name         string
 	OprandWidths []int
@@ -59,6 +82,32 @@ var definitions = map[Opcode]*Definition{
 	OpNull:          {"OpNull", []int{}},
 	OpGetGlobal:     {"OpGetGlobal", []int{2}},
 	OpSetGlobal:     {"OpSetGlobal", []int{2}},
+	// 数组和哈希的操作数为元素个数，哈希的键和值各算一个
+	OpArray:       {"OpArray", []int{2}},
+	OpHash:        {"OpHash", []int{2}},
+	OpIndex:       {"OpIndex", []int{}},
+	OpCall:        {"OpCall", []int{2}},
+	OpReturnValue: {"OpReturnValue", []int{}},
+	OpReturn:      {"OpReturn", []int{}},
+	OpGetLocal:    {"OpGetLocal", []int{2}},
+	OpSetLocal:    {"OpSetLocal", []int{2}},
+	OpGetBuiltin:  {"OpGetBuiltin", []int{2}},
+	// OpClosure 的操作数为常量池中函数的下标和自由变量的个数
+	OpClosure:        {"OpClosure", []int{2, 2}},
+	OpGetFree:        {"OpGetFree", []int{2}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	// 操作数超出宽度时 Make 自动加上 OpWide，例如超过 65535 的常量下标和跳转目标
+	OpWide: {"OpWide", []int{}},
+}
+
+// Widenable 判断虚拟机是否支持 op 带 OpWide 前缀的形式。其他指令的操作数受栈的大小限制，
+// 不会超过两个字节
+func Widenable(op Opcode) bool {
+	switch op {
+	case OpConstant, OpJump, OpJumpNotTruthy, OpGetGlobal, OpSetGlobal, OpClosure:
+		return true
+	}
+	return false
 }
 
 func LookUp(op byte) (*Definition, error) {
@@ -69,11 +118,18 @@ func LookUp(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// Make 生成一条指令，有操作数超出定义的宽度时生成带 OpWide 前缀的形式。
+// 操作码没有定义，或者操作数放不下而 op 不能加 OpWide 前缀时返回空的指令
 func Make(op Opcode, oprands ...int) []byte {
 	def, ok := definitions[Opcode(op)]
 	if !ok {
 		return []byte{}
 	}
+	for i, o := range oprands {
+		if i < len(def.OprandWidths) && !fits(o, def.OprandWidths[i]) {
+			return MakeWide(op, oprands...)
+		}
+	}
 	// 操作符长度
 	instructionLen := 1
 	// 操作符长度+操作数位数为实际所需长度
@@ -82,30 +138,79 @@ func Make(op Opcode, oprands ...int) []byte {
 	}
 	instruction := make([]byte, instructionLen)
 	instruction[0] = byte(op)
+	putOperands(instruction[1:], def.OprandWidths, oprands)
+	return instruction
+}
+
+// MakeWide 生成带 OpWide 前缀的指令，没有操作数的指令不需要前缀，返回普通的形式。
+// 虚拟机不支持 op 的 OpWide 形式时返回空的指令
+func MakeWide(op Opcode, oprands ...int) []byte {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return []byte{}
+	}
+	if len(def.OprandWidths) == 0 || op == OpWide {
+		return Make(op)
+	}
+	if !Widenable(op) {
+		return []byte{}
+	}
+	wide := Widen(def)
+	instruction := make([]byte, 2+len(wide.OprandWidths)*WideWidth)
+	instruction[0] = byte(OpWide)
+	instruction[1] = byte(op)
+	putOperands(instruction[2:], wide.OprandWidths, oprands)
+	return instruction
+}
+
+// Widen 返回 OpWide 前缀之后的指令的定义，所有操作数都是 WideWidth 个字节
+func Widen(def *Definition) *Definition {
+	widths := make([]int, len(def.OprandWidths))
+	for i := range widths {
+		widths[i] = WideWidth
+	}
+	return &Definition{Name: def.Name, OprandWidths: widths}
+}
+
+func fits(operand int, width int) bool {
+	return operand >= 0 && operand < 1<<(8*uint(width))
+}
 
-	offset := 1
+func putOperands(ins []byte, widths []int, oprands []int) {
+	offset := 0
 	for i, o := range oprands {
-		width := def.OprandWidths[i]
+		if i >= len(widths) {
+			break
+		}
+		width := widths[i]
 		switch width {
+		case 1:
+			ins[offset] = byte(o)
 		case 2:
-			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+			binary.BigEndian.PutUint16(ins[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(ins[offset:], uint32(o))
 		}
 		offset += width
 	}
-	return instruction
 }
 
 func (ins Instructions) String() string {
 	var out bytes.Buffer
 	i := 0
 	for i < len(ins) {
-		def, err := LookUp(ins[i])
+		instruction, err := ReadInstruction(ins, i)
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			// 无法确定指令的长度，后面的字节不能再解码
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			break
+		}
+		prefix := ""
+		if instruction.Wide {
+			prefix = "OpWide "
 		}
-		operands, read := ReadOperands(def, ins[i+1:])
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
-		i += 1 + read
+		fmt.Fprintf(&out, "%04d %s%s\n", i, prefix, ins.fmtInstruction(instruction.Def, instruction.Operands))
+		i += instruction.Width
 	}
 	return out.String()
 }
@@ -116,13 +221,57 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return fmt.Sprintf("Error: operand len %d does not match defined %d\n",
 			len(operands), operandCount)
 	}
-	switch operandCount {
-	case 0:
-		return def.Name
-	case 1:
-		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	var out strings.Builder
+	out.WriteString(def.Name)
+	for _, o := range operands {
+		fmt.Fprintf(&out, " %d", o)
+	}
+	return out.String()
+}
+
+// Instruction 是解码后的一条指令。Def 是指令本身的定义，带 OpWide 前缀时 Wide 为 true，
+// Width 是包括前缀在内的字节数
+type Instruction struct {
+	Op       Opcode
+	Def      *Definition
+	Operands []int
+	Wide     bool
+	Width    int
+}
+
+// ReadInstruction 解码 offset 处的一条指令，OpWide 前缀和后面的指令算作一条。
+// 操作码未定义或者操作数不完整时返回错误
+func ReadInstruction(ins Instructions, offset int) (Instruction, error) {
+	def, err := LookUp(ins[offset])
+	if err != nil {
+		return Instruction{}, err
+	}
+	instruction := Instruction{Op: Opcode(ins[offset]), Def: def, Width: 1}
+	if instruction.Op == OpWide {
+		if offset+1 >= len(ins) {
+			return Instruction{}, fmt.Errorf("OpWide at %d is not followed by an instruction", offset)
+		}
+		inner, err := LookUp(ins[offset+1])
+		if err != nil {
+			return Instruction{}, err
+		}
+		if len(inner.OprandWidths) == 0 || Opcode(ins[offset+1]) == OpWide {
+			return Instruction{}, fmt.Errorf("OpWide at %d cannot prefix %s", offset, inner.Name)
+		}
+		instruction = Instruction{Op: Opcode(ins[offset+1]), Def: inner, Wide: true, Width: 2}
+		def = Widen(inner)
+	}
+	need := 0
+	for _, w := range def.OprandWidths {
+		need += w
 	}
-	return fmt.Sprintf("Error: unhandled operandCount for %s\n", def.Name)
+	if offset+instruction.Width+need > len(ins) {
+		return Instruction{}, fmt.Errorf("%s at %d is truncated", instruction.Def.Name, offset)
+	}
+	operands, read := ReadOperands(def, ins[offset+instruction.Width:])
+	instruction.Operands = operands
+	instruction.Width += read
+	return instruction, nil
 }
 
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
@@ -130,13 +279,26 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	offset := 0
 	for i, width := range def.OprandWidths {
 		switch width {
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		}
 		offset += width
 	}
 	return operands, offset
 }
+
+func ReadUint8(ins Instructions) uint8 {
+	return ins[0]
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
@@ -23,6 +23,33 @@ func TestMake(t *testing.T) {
 			[]int{},
 			[]byte{byte(OpAdd)},
 		},
+		{
+			OpClosure,
+			[]int{65534, 255},
+			[]byte{byte(OpClosure), 255, 254, 0, 255},
+		},
+		// 放不下的操作数使用 OpWide 前缀，所有操作数都变成 4 个字节
+		{
+			OpConstant,
+			[]int{65536},
+			[]byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0},
+		},
+		{
+			OpClosure,
+			[]int{70000, 1},
+			[]byte{byte(OpWide), byte(OpClosure), 0, 1, 17, 112, 0, 0, 0, 1},
+		},
+		// 虚拟机不支持 OpWide 形式的指令放不下时返回空的指令
+		{
+			OpArray,
+			[]int{65536},
+			[]byte{},
+		},
+		{
+			OpGetLocal,
+			[]int{70000},
+			[]byte{},
+		},
 	}
 	for _, tt := range tests {
 		instruction := Make(tt.op, tt.operands...)
@@ -39,6 +66,17 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestMakeWide(t *testing.T) {
+	for _, op := range []Opcode{OpArray, OpHash, OpCall, OpGetLocal, OpSetLocal, OpGetBuiltin, OpGetFree} {
+		if Widenable(op) {
+			t.Errorf("%s should not be widenable", definitions[op].Name)
+		}
+		if instruction := MakeWide(op, 1); len(instruction) != 0 {
+			t.Errorf("MakeWide(%s) want an empty instruction, got=%v", definitions[op].Name, instruction)
+		}
+	}
+}
+
 func TestInstructionString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpConstant, 1),
@@ -46,12 +84,20 @@ func TestInstructionString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpAdd),
+		Make(OpClosure, 65535, 255),
+		Make(OpConstant, 70000),
+		MakeWide(OpJump, 3),
+		MakeWide(OpPop),
 	}
 	expected := `0000 OpConstant 1
 0003 OpAdd
 0004 OpConstant 2
 0007 OpConstant 65535
 0010 OpAdd
+0011 OpClosure 65535 255
+0016 OpWide OpConstant 70000
+0022 OpWide OpJump 3
+0028 OpPop
 `
 	concated := Instructions{}
 	for _, ins := range instructions {
@@ -70,6 +116,7 @@ func TestReadOperands(t *testing.T) {
 		bytesRead int
 	}{
 		{OpConstant, []int{65535}, 2},
+		{OpClosure, []int{65535, 255}, 4},
 	}
 	for _, tt := range tests {
 		instruction := Make(tt.op, tt.operands...)
@@ -88,3 +135,84 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestOperandWidths(t *testing.T) {
+	def := &Definition{Name: "OpTest", OprandWidths: []int{1, 2, 4}}
+	ins := make([]byte, 7)
+	putOperands(ins, def.OprandWidths, []int{255, 65535, 1 << 31})
+	operands, n := ReadOperands(def, ins)
+	if n != 7 {
+		t.Fatalf("n wrong. want=7, got=%d", n)
+	}
+	for i, want := range []int{255, 65535, 1 << 31} {
+		if operands[i] != want {
+			t.Errorf("operand %d wrong. want=%d, got=%d", i, want, operands[i])
+		}
+	}
+	if got := (Instructions{}).fmtInstruction(def, operands); got != "OpTest 255 65535 2147483648" {
+		t.Errorf("wrong format %q", got)
+	}
+}
+
+func TestReadInstruction(t *testing.T) {
+	tests := []struct {
+		ins      Instructions
+		op       Opcode
+		operands []int
+		wide     bool
+		width    int
+		err      string
+	}{
+		{Instructions(Make(OpAdd)), OpAdd, []int{}, false, 1, ""},
+		{Instructions(Make(OpClosure, 1, 2)), OpClosure, []int{1, 2}, false, 5, ""},
+		{Instructions(Make(OpJump, 1<<20)), OpJump, []int{1 << 20}, true, 6, ""},
+		{Instructions{255}, 0, nil, false, 0, "opcode 255 undefined"},
+		{Instructions{byte(OpConstant), 0}, 0, nil, false, 0, "OpConstant at 0 is truncated"},
+		{Instructions{byte(OpWide)}, 0, nil, false, 0, "OpWide at 0 is not followed by an instruction"},
+		{Instructions{byte(OpWide), byte(OpPop)}, 0, nil, false, 0, "OpWide at 0 cannot prefix OpPop"},
+		{Instructions{byte(OpWide), byte(OpJump), 0, 0}, 0, nil, false, 0, "OpJump at 0 is truncated"},
+	}
+	for _, tt := range tests {
+		instruction, err := ReadInstruction(tt.ins, 0)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("wrong error for %v. want=%q, got=%v", tt.ins, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %s", tt.ins, err)
+		}
+		if instruction.Op != tt.op || instruction.Wide != tt.wide || instruction.Width != tt.width {
+			t.Errorf("wrong instruction for %v: %+v", tt.ins, instruction)
+		}
+		for i, want := range tt.operands {
+			if instruction.Operands[i] != want {
+				t.Errorf("operand %d wrong for %v. want=%d, got=%d", i, tt.ins, want, instruction.Operands[i])
+			}
+		}
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	lines := LineTable{{Offset: 0, Line: 1}, {Offset: 4, Line: 3}, {Offset: 9, Line: 2}}
+	tests := []struct {
+		offset   int
+		expected int
+	}{
+		{0, 1},
+		{3, 1},
+		{4, 3},
+		{8, 3},
+		{9, 2},
+		{100, 2},
+	}
+	for _, tt := range tests {
+		if got := lines.Line(tt.offset); got != tt.expected {
+			t.Errorf("wrong line for offset %d. want=%d, got=%d", tt.offset, tt.expected, got)
+		}
+	}
+	if got := (LineTable{}).Line(0); got != 0 {
+		t.Errorf("empty table should return 0, got=%d", got)
+	}
+}
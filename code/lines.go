@@ -0,0 +1,21 @@
+package code
+
+import "sort"
+
+// LineInfo 表示从 Offset 开始的指令由源码第 Line 行编译而来
+type LineInfo struct {
+	Offset int
+	Line   int
+}
+
+// LineTable 是按 Offset 递增排列的行号表，只用于调试和报错
+type LineTable []LineInfo
+
+// Line 返回 offset 处的指令对应的源码行号，没有记录时返回 0
+func (lt LineTable) Line(offset int) int {
+	i := sort.Search(len(lt), func(i int) bool { return lt[i].Offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return lt[i-1].Line
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"interpreter/analysis"
+	"interpreter/ast"
+	"interpreter/bench"
+	"interpreter/compiler"
+	"interpreter/dap"
+	"interpreter/evaluator"
+	"interpreter/format"
+	"interpreter/lexer"
+	"interpreter/lsp"
+	"interpreter/object"
+	"interpreter/parser"
+	"interpreter/profile"
+	"interpreter/trace"
+	"interpreter/vm"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand 执行一个脚本，.mbc 文件总是交给虚拟机执行
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("run", stderr)
+	engine := fs.String("engine", "vm", "execution engine: eval or vm")
+	level := optimizationFlag(fs)
+	traceFormat := traceFlag(fs)
+	profileFile := fs.String("profile", "", "write a pprof profile to the file and a report to standard error")
+	files, ok := parseFlags(fs, args)
+	if !ok || !validEngine(*engine, stderr) || !validOptimization(*level, stderr) {
+		return exitUsage
+	}
+	tr, ok := newTracer(*traceFormat, stderr)
+	if !ok {
+		return exitUsage
+	}
+	if len(files) != 1 {
+		fmt.Fprintf(stderr, "run: expected exactly one file\n")
+		return exitUsage
+	}
+	name := files[0]
+	data, err := readInput(name, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	mbc := strings.HasSuffix(name, ".mbc")
+	var prof *profile.Profiler
+	if *profileFile != "" {
+		prof = newProfiler(*engine, mbc, name)
+	}
+	if mbc {
+		// .mbc 文件可能不是编译器生成的，Load 在执行之前先校验
+		bytecode, err := vm.Load(data)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			return exitError
+		}
+		_, err = runByteCode(bytecode, tr, prof, stdout)
+		return finishRun(name, err, prof, *profileFile, stderr)
+	}
+	_, err = execute(string(data), *engine, compiler.OptimizationLevel(*level), tr, prof, stdout)
+	return finishRun(name, err, prof, *profileFile, stderr)
+}
+
+// newProfiler 创建 run --profile 使用的性能分析器，虚拟机按指令计数，求值器按节点计数
+func newProfiler(engine string, mbc bool, name string) *profile.Profiler {
+	unit := "instructions"
+	if engine == "eval" && !mbc {
+		unit = "nodes"
+	}
+	prof := profile.New(unit)
+	if name != "-" {
+		prof.File = name
+	}
+	return prof
+}
+
+// finishRun 报告脚本的错误，设置了性能分析器时即使脚本出错也输出分析结果
+func finishRun(name string, runErr error, prof *profile.Profiler, profileFile string, stderr io.Writer) int {
+	status := exitOK
+	if runErr != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, runErr)
+		status = exitError
+	}
+	if prof == nil {
+		return status
+	}
+	prof.Stop()
+	var out bytes.Buffer
+	if err := prof.WriteProto(&out); err != nil {
+		fmt.Fprintf(stderr, "profile: %s\n", err)
+		return exitError
+	}
+	if err := ioutil.WriteFile(profileFile, out.Bytes(), 0644); err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	prof.WriteText(stderr)
+	return status
+}
+
+// evalCommand 处理 monkey -e 'expr'，打印表达式的值
+func evalCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("monkey", stderr)
+	engine := fs.String("engine", "vm", "execution engine: eval or vm")
+	expr := fs.String("e", "", "program to run")
+	level := optimizationFlag(fs)
+	traceFormat := traceFlag(fs)
+	rest, ok := parseFlags(fs, args)
+	if !ok || !validEngine(*engine, stderr) || !validOptimization(*level, stderr) {
+		return exitUsage
+	}
+	tr, ok := newTracer(*traceFormat, stderr)
+	if !ok {
+		return exitUsage
+	}
+	if len(rest) == 1 && *expr == "" {
+		// monkey file.mk 是 monkey run file.mk 的简写
+		flags := []string{"--engine=" + *engine, fmt.Sprintf("-O=%d", *level), "--trace=" + *traceFormat}
+		return runCommand(append(flags, rest...), stdin, stdout, stderr)
+	}
+	if len(rest) == 0 && *expr == "" {
+		return startREPL(*engine, stdin, stdout)
+	}
+	if len(rest) != 0 || *expr == "" {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	result, err := execute(*expr, *engine, compiler.OptimizationLevel(*level), tr, nil, stdout)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	if result != nil {
+		fmt.Fprintln(stdout, result.Inspect())
+	}
+	return exitOK
+}
+
+func compileCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("compile", stderr)
+	output := fs.String("o", "", "output file, defaults to the input name with a .mbc extension")
+	level := optimizationFlag(fs)
+	files, ok := parseFlags(fs, args)
+	if !ok || !validOptimization(*level, stderr) {
+		return exitUsage
+	}
+	if len(files) != 1 {
+		fmt.Fprintf(stderr, "compile: expected exactly one file\n")
+		return exitUsage
+	}
+	name := files[0]
+	out := *output
+	if out == "" {
+		if name == "-" {
+			fmt.Fprintf(stderr, "compile: -o is required when reading from standard input\n")
+			return exitUsage
+		}
+		out = strings.TrimSuffix(name, filepath.Ext(name)) + ".mbc"
+	}
+	data, err := readInput(name, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	bytecode, err := compileSource(string(data), compiler.OptimizationLevel(*level))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return exitError
+	}
+	encoded, err := compiler.Marshal(bytecode)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return exitError
+	}
+	if out == "-" {
+		_, err = stdout.Write(encoded)
+	} else {
+		err = ioutil.WriteFile(out, encoded, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func disasmCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("disasm", stderr)
+	level := optimizationFlag(fs)
+	files, ok := parseFlags(fs, args)
+	if !ok || !validOptimization(*level, stderr) {
+		return exitUsage
+	}
+	if len(files) != 1 {
+		fmt.Fprintf(stderr, "disasm: expected exactly one file\n")
+		return exitUsage
+	}
+	name := files[0]
+	data, err := readInput(name, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	var bytecode *compiler.ByteCode
+	if strings.HasSuffix(name, ".mbc") {
+		bytecode, err = compiler.Unmarshal(data)
+	} else {
+		bytecode, err = compileSource(string(data), compiler.OptimizationLevel(*level))
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return exitError
+	}
+	fmt.Fprint(stdout, compiler.Disassemble(bytecode))
+	return exitOK
+}
+
+// checkCommand 对每个文件做静态分析，有任何诊断时返回 exitError
+func checkCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("check", stderr)
+	files, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(stderr, "check: expected at least one file\n")
+		return exitUsage
+	}
+	status := exitOK
+	for _, name := range files {
+		data, err := readInput(name, stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			status = exitError
+			continue
+		}
+		program, err := parse(string(data))
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			status = exitError
+			continue
+		}
+		for _, d := range analysis.Analyze(program) {
+			fmt.Fprintf(stdout, "%s:%s\n", name, d)
+			status = exitError
+		}
+	}
+	return status
+}
+
+// fmtCommand 把文件改写成统一的格式。标准输入的结果写到标准输出；
+// 指定 --check 时不修改文件，只列出需要格式化的文件
+func fmtCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("fmt", stderr)
+	check := fs.Bool("check", false, "list files whose formatting differs")
+	files, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	status := exitOK
+	for _, name := range files {
+		data, err := readInput(name, stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			status = exitError
+			continue
+		}
+		formatted, err := format.Source(data)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err)
+			status = exitError
+			continue
+		}
+		switch {
+		case *check:
+			if !bytes.Equal(data, formatted) {
+				fmt.Fprintln(stdout, name)
+				status = exitError
+			}
+		case name == "-":
+			stdout.Write(formatted)
+		case !bytes.Equal(data, formatted):
+			if err := ioutil.WriteFile(name, formatted, 0644); err != nil {
+				fmt.Fprintf(stderr, "%s\n", err)
+				status = exitError
+			}
+		}
+	}
+	return status
+}
+
+// lspCommand 启动语言服务器，客户端没有先发送 shutdown 就退出时返回 exitError
+func lspCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("lsp", stderr)
+	rest, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	if len(rest) != 0 {
+		fmt.Fprintf(stderr, "lsp: unexpected arguments %s\n", strings.Join(rest, " "))
+		return exitUsage
+	}
+	if err := lsp.NewServer(stdin, stdout).Run(); err != nil {
+		fmt.Fprintf(stderr, "lsp: %s\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// dapCommand 启动调试适配器，启动参数中的 engine 选择虚拟机或者求值器
+func dapCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("dap", stderr)
+	rest, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	if len(rest) != 0 {
+		fmt.Fprintf(stderr, "dap: unexpected arguments %s\n", strings.Join(rest, " "))
+		return exitUsage
+	}
+	if err := dap.NewServer(stdin, stdout).Run(); err != nil {
+		fmt.Fprintf(stderr, "dap: %s\n", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// benchCommand 用两种引擎（或者 --engine 指定的一种）反复执行内置的基准测试程序
+// 或者指定的脚本，打印每次执行的时间和内存分配
+func benchCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("bench", stderr)
+	engine := fs.String("engine", "", "engine to benchmark: eval or vm, both by default")
+	duration := fs.Duration("time", time.Second, "minimum running time of each benchmark")
+	names, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	engines := bench.Engines
+	if *engine != "" {
+		if !validEngine(*engine, stderr) {
+			return exitUsage
+		}
+		engines = []string{*engine}
+	}
+	if *duration <= 0 {
+		fmt.Fprintf(stderr, "bench: --time must be positive\n")
+		return exitUsage
+	}
+	workloads := bench.Workloads
+	if len(names) != 0 {
+		workloads = nil
+		for _, name := range names {
+			// 不是内置程序的名字时当作脚本文件
+			if w, ok := bench.Lookup(name); ok {
+				workloads = append(workloads, w)
+				continue
+			}
+			data, err := readInput(name, stdin)
+			if err != nil {
+				fmt.Fprintf(stderr, "%s\n", err)
+				return exitError
+			}
+			workloads = append(workloads, bench.Workload{Name: name, Source: string(data)})
+		}
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "workload\tengine\truns\tns/op\tB/op\tallocs/op\n")
+	for _, workload := range workloads {
+		for _, e := range engines {
+			run, err := bench.Prepare(workload, e)
+			if err == nil {
+				var result bench.Result
+				if result, err = bench.Measure(run, *duration); err == nil {
+					fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n",
+						workload.Name, e, result.N, result.NsPerOp, result.BytesPerOp, result.AllocsPerOp)
+					continue
+				}
+			}
+			w.Flush()
+			fmt.Fprintf(stderr, "%s (%s): %s\n", workload.Name, e, err)
+			return exitError
+		}
+	}
+	w.Flush()
+	return exitOK
+}
+
+// execute 用指定的引擎执行源码，返回最后一个表达式的值，优化级别只对虚拟机有效。
+// tr 不为 nil 时跟踪执行过程，prof 不为 nil 时记录性能分析数据，put 写到 out
+func execute(src string, engine string, level compiler.OptimizationLevel, tr tracer, prof *profile.Profiler, out io.Writer) (object.Object, error) {
+	if engine == "eval" {
+		program, err := parse(src)
+		if err != nil {
+			return nil, err
+		}
+		macroEnv := object.NewEnvironment()
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacro(program, macroEnv)
+		if err != nil {
+			return nil, err
+		}
+		e := evaluator.New()
+		e.Tracer = tr
+		e.Profiler = prof
+		e.Out = out
+		result := e.Eval(expanded, object.NewEnvironment())
+		if errObj, ok := result.(*object.Error); ok {
+			return nil, fmt.Errorf("runtime error: %s", errObj.Message)
+		}
+		return result, nil
+	}
+	bytecode, err := compileSource(src, level)
+	if err != nil {
+		return nil, err
+	}
+	return runByteCode(bytecode, tr, prof, out)
+}
+
+func runByteCode(bytecode *compiler.ByteCode, tr tracer, prof *profile.Profiler, out io.Writer) (object.Object, error) {
+	machine := vm.New(bytecode)
+	machine.SetTracer(tr)
+	machine.SetProfiler(prof)
+	machine.SetOutput(out)
+	if err := machine.Run(); err != nil {
+		return nil, fmt.Errorf("runtime error: %s", err)
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+func compileSource(src string, level compiler.OptimizationLevel) (*compiler.ByteCode, error) {
+	program, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	comp := compiler.New()
+	comp.SetOptimization(level)
+	if err := comp.Compile(program); err != nil {
+		return nil, fmt.Errorf("compile error: %s", err)
+	}
+	return comp.ByteCode(), nil
+}
+
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	return program, nil
+}
+
+func readInput(name string, stdin io.Reader) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	return fs
+}
+
+// parseFlags 允许选项出现在文件名之后，例如 monkey run file.mk --engine=eval
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, bool) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, true
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func validEngine(engine string, stderr io.Writer) bool {
+	if engine != "eval" && engine != "vm" {
+		fmt.Fprintf(stderr, "unknown engine %q, want eval or vm\n", engine)
+		return false
+	}
+	return true
+}
+
+// optimizationFlag 定义 -O 选项，默认进行所有优化
+func optimizationFlag(fs *flag.FlagSet) *int {
+	return fs.Int("O", int(compiler.OptimizeFull), "optimisation level: 0 (none), 1 (constant folding) or 2 (also jump threading)")
+}
+
+// tracer 是 trace 包中同时支持两种引擎的跟踪器
+type tracer interface {
+	vm.Tracer
+	evaluator.Tracer
+}
+
+func traceFlag(fs *flag.FlagSet) *string {
+	return fs.String("trace", "", "write an execution trace to standard error: text or json")
+}
+
+// newTracer 按格式创建写到 stderr 的跟踪器，格式为空时返回 nil
+func newTracer(format string, stderr io.Writer) (tracer, bool) {
+	switch format {
+	case "":
+		return nil, true
+	case "text":
+		return trace.NewText(stderr), true
+	case "json":
+		return trace.NewJSON(stderr), true
+	}
+	fmt.Fprintf(stderr, "unknown trace format %q, want text or json\n", format)
+	return nil, false
+}
+
+func validOptimization(level int, stderr io.Writer) bool {
+	if level < int(compiler.OptimizeNone) || level > int(compiler.OptimizeFull) {
+		fmt.Fprintf(stderr, "unknown optimisation level %d, want 0, 1 or 2\n", level)
+		return false
+	}
+	return true
+}
@@ -5,14 +5,22 @@ import (
 	"interpreter/ast"
 	"interpreter/code"
 	"interpreter/object"
+	"math"
 )
 
 type Compiler struct {
-	instructions        code.Instructions
-	constants           []object.Object
-	lastInstruction     EmittedInstruction
-	previousInstruction EmittedInstruction
-	symbolTable         *SymbolTable
+	constants   []object.Object
+	symbolTable *SymbolTable
+
+	scopes     []CompilationScope
+	scopeIndex int
+
+	// line 是正在编译的语句所在的源码行
+	line int
+
+	optimization OptimizationLevel
+	// constantIndex 记录常量池中整数和字符串的下标，相同的常量只保存一份
+	constantIndex map[constantKey]int
 }
 
 type EmittedInstruction struct {
@@ -20,17 +28,48 @@ type EmittedInstruction struct {
 	Position int
 }
 
+// CompilationScope 保存正在编译的函数体的指令，每进入一个函数字面量就压入一层
+type CompilationScope struct {
+	instructions        code.Instructions
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+	lines               code.LineTable
+	// farJumps 记录目标超过两个字节的跳转的位置和目标，由 widenJumps 改成 OpWide 的形式
+	farJumps map[int]int
+}
+
 func New() *Compiler {
-	return &Compiler{
+	mainScope := CompilationScope{
 		instructions:        code.Instructions{},
-		constants:           []object.Object{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
-		symbolTable:         NewSymbolTable(),
 	}
+	symbolTable := NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: symbolTable,
+		scopes:      []CompilationScope{mainScope},
+		scopeIndex:  0,
+	}
+}
+
+// NewWithState 复用之前的符号表和常量池，REPL 用它在多次输入之间保留全局变量
+func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
+	compiler := New()
+	compiler.symbolTable = s
+	compiler.constants = constants
+	return compiler
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	if line := statementLine(node); line != 0 {
+		previous := c.line
+		c.line = line
+		defer func() { c.line = previous }()
+	}
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -46,6 +85,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpPop)
 	case *ast.PrefixExpression:
+		if c.optimization >= OptimizeBasic {
+			if obj, ok := fold(node); ok {
+				c.emitFolded(obj)
+				return nil
+			}
+		}
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -59,6 +104,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 	case *ast.InfixExpression:
+		if c.optimization >= OptimizeBasic {
+			if obj, ok := fold(node); ok {
+				c.emitFolded(obj)
+				return nil
+			}
+		}
 		if node.Operator == "<" {
 			err := c.Compile(node.Right)
 			if err != nil {
@@ -98,9 +149,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
 	case *ast.IntegerLiteral:
-		integer := &object.Integer{Value: node.Value}
+		integer := object.NewInteger(node.Value)
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.StringLiteral:
+		str := &object.String{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(str))
 	case *ast.IfExpression:
+		if c.optimization >= OptimizeBasic {
+			if condition, ok := fold(node.Condition); ok {
+				return c.compileConstantIf(node, isTruthy(condition))
+			}
+		}
 		err := c.Compile(node.Condition)
 		if err != nil {
 			return err
@@ -110,11 +169,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIsPop() {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
 		jumpPos := c.emit(code.OpJump, 9999)
-		afterConsequencePos := len(c.instructions)
+		afterConsequencePos := len(c.currentInstructions())
 		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
@@ -124,11 +181,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
-			if c.lastInstructionIsPop() {
-				c.removeLastPop()
-			}
+			c.keepBlockValue()
 		}
-		afterAlternativePos := len(c.instructions)
+		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
 	case *ast.Boolean:
 		if node.Value {
@@ -137,6 +192,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpFalse)
 		}
 	case *ast.BlockStatement:
+		if len(node.Statements) == 0 {
+			// 空的块和求值器一样得到 null
+			c.emit(code.OpNull)
+			c.emit(code.OpPop)
+		}
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
@@ -149,13 +209,130 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 		symbol := c.symbolTable.Define(node.Name.Value)
-		c.emit(code.OpSetGlobal, symbol.Index)
+		if symbol.Scope == GlobalScope {
+			c.emit(code.OpSetGlobal, symbol.Index)
+		} else {
+			c.emit(code.OpSetLocal, symbol.Index)
+		}
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
 			return fmt.Errorf("undefined variable %s", node.Value)
 		}
-		c.emit(code.OpGetGlobal, symbol.Index)
+		c.loadSymbol(symbol)
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			err := c.Compile(el)
+			if err != nil {
+				return err
+			}
+		}
+		if err := checkCount("array elements", len(node.Elements)); err != nil {
+			return err
+		}
+		c.emit(code.OpArray, len(node.Elements))
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			err := c.Compile(pair.Key)
+			if err != nil {
+				return err
+			}
+			err = c.Compile(pair.Value)
+			if err != nil {
+				return err
+			}
+		}
+		if err := checkCount("hash keys and values", len(node.Pairs)*2); err != nil {
+			return err
+		}
+		c.emit(code.OpHash, len(node.Pairs)*2)
+	case *ast.IndexExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(node.Index)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpIndex)
+	case *ast.FunctionLiteral:
+		c.enterScope()
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+		for _, p := range node.Parameters {
+			c.symbolTable.Define(p.Value)
+		}
+		err := c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		}
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			c.emit(code.OpReturn)
+		}
+		c.finishScope()
+		freeSymbols := c.symbolTable.FreeSymbols
+		numLocals := c.symbolTable.NumDefinitions()
+		if err := checkCount("local variables", numLocals); err != nil {
+			return err
+		}
+		if err := checkCount("free variables", len(freeSymbols)); err != nil {
+			return err
+		}
+		lines := c.scopes[c.scopeIndex].lines
+		var localNames, freeNames []string
+		if numLocals > 0 {
+			// 重新定义的变量占用新的位置，旧的位置没有名字
+			localNames = make([]string, numLocals)
+			for _, s := range c.symbolTable.Symbols(LocalScope) {
+				localNames[s.Index] = s.Name
+			}
+		}
+		for _, s := range freeSymbols {
+			freeNames = append(freeNames, s.Name)
+		}
+		instructions := c.leaveScope()
+		for _, s := range freeSymbols {
+			c.loadSymbol(s)
+		}
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			Lines:         lines,
+			LocalNames:    localNames,
+			FreeNames:     freeNames,
+		}
+		fnIndex := c.addConstant(compiledFn)
+		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	case *ast.ReturnStatement:
+		err := c.Compile(node.ReturnValue)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+	case *ast.CallExpression:
+		err := c.Compile(node.Function)
+		if err != nil {
+			return err
+		}
+		for _, a := range node.Arguments {
+			err := c.Compile(a)
+			if err != nil {
+				return err
+			}
+		}
+		if err := checkCount("call arguments", len(node.Arguments)); err != nil {
+			return err
+		}
+		c.emit(code.OpCall, len(node.Arguments))
+	case *ast.MacroLiteral:
+		return fmt.Errorf("macros are not supported by the compiler")
 	}
 	return nil
 }
@@ -163,61 +340,202 @@ func (c *Compiler) Compile(node ast.Node) error {
 type ByteCode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	// Lines 是主程序的行号表，为空表示没有调试信息
+	Lines code.LineTable
 }
 
 func (c *Compiler) ByteCode() *ByteCode {
+	c.finishScope()
 	return &ByteCode{
-		Instructions: c.instructions,
+		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		Lines:        c.scopes[c.scopeIndex].lines,
+	}
+}
+
+// statementLine 返回语句的起始行，其他节点返回 0
+func statementLine(node ast.Node) int {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		return node.Token.Line
+	case *ast.ReturnStatement:
+		return node.Token.Line
+	case *ast.ExpressionStatement:
+		return node.Token.Line
 	}
+	return 0
+}
+
+// SymbolTable 返回全局符号表，与 NewWithState 配合使用
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
 }
 
+// addConstant 把常量加入常量池并返回下标，已经存在的整数和字符串直接复用
 func (c *Compiler) addConstant(obj object.Object) int {
+	if c.constantIndex == nil {
+		// 常量池可能来自 NewWithState，第一次使用时为已有的常量建立索引
+		c.constantIndex = map[constantKey]int{}
+		for i, constant := range c.constants {
+			if key, ok := keyOf(constant); ok {
+				if _, exists := c.constantIndex[key]; !exists {
+					c.constantIndex[key] = i
+				}
+			}
+		}
+	}
+	key, ok := keyOf(obj)
+	if ok {
+		if index, exists := c.constantIndex[key]; exists {
+			return index
+		}
+	}
 	c.constants = append(c.constants, obj)
+	if ok {
+		c.constantIndex[key] = len(c.constants) - 1
+	}
 	return len(c.constants) - 1
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
+	c.addLine(pos)
 
 	c.setLastInstruction(op, pos)
 	return pos
 }
 
+// checkCount 检查个数放得进两个字节的操作数，虚拟机不支持 OpArray、OpHash、OpCall
+// 以及局部变量和自由变量指令的 OpWide 形式
+func checkCount(what string, n int) error {
+	if n > math.MaxUint16 {
+		return fmt.Errorf("too many %s: %d, the limit is %d", what, n, math.MaxUint16)
+	}
+	return nil
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
-	previous := c.lastInstruction
+	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{
 		Opcode:   op,
 		Position: pos,
 	}
-	c.previousInstruction = previous
-	c.lastInstruction = last
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
 }
 
 func (c *Compiler) addInstruction(ins []byte) int {
-	posNewInstruction := len(c.instructions)
-	c.instructions = append(c.instructions, ins...)
+	posNewInstruction := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].instructions = append(c.currentInstructions(), ins...)
 	return posNewInstruction
 }
 
-func (c *Compiler) lastInstructionIsPop() bool {
-	return c.lastInstruction.Opcode == code.OpPop
+// addLine 在行号变化时往当前作用域的行号表追加一项
+func (c *Compiler) addLine(pos int) {
+	if c.line == 0 {
+		return
+	}
+	lines := c.scopes[c.scopeIndex].lines
+	if len(lines) > 0 && lines[len(lines)-1].Line == c.line {
+		return
+	}
+	c.scopes[c.scopeIndex].lines = append(lines, code.LineInfo{Offset: pos, Line: c.line})
+}
+
+func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == op
 }
 
 func (c *Compiler) removeLastPop() {
-	c.instructions = c.instructions[:c.lastInstruction.Position]
-	c.previousInstruction = c.lastInstruction
+	last := c.scopes[c.scopeIndex].lastInstruction
+	previous := c.scopes[c.scopeIndex].previousInstruction
+
+	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:last.Position]
+	c.scopes[c.scopeIndex].lastInstruction = previous
+
+	lines := c.scopes[c.scopeIndex].lines
+	for len(lines) > 0 && lines[len(lines)-1].Offset >= last.Position {
+		lines = lines[:len(lines)-1]
+	}
+	c.scopes[c.scopeIndex].lines = lines
+}
+
+// keepBlockValue 让块的最后一个值留在栈上作为 if 表达式的结果，
+// 块以 let 等不产生值的语句结尾时补一个 null
+func (c *Compiler) keepBlockValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
 }
 
 func (c *Compiler) replaceInstructions(pos int, newInstructions []byte) {
+	ins := c.currentInstructions()
 	for i := 0; i < len(newInstructions); i++ {
-		c.instructions[pos+i] = newInstructions[i]
+		ins[pos+i] = newInstructions[i]
 	}
 }
 
 func (c *Compiler) changeOperand(opPos int, operand int) {
-	op := code.Opcode(c.instructions[opPos])
+	op := code.Opcode(c.currentInstructions()[opPos])
 	newInstructions := code.Make(op, operand)
+	if code.Opcode(newInstructions[0]) == code.OpWide {
+		// 原来的位置放不下，作用域编译完成后再统一修改
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = map[int]int{}
+		}
+		scope.farJumps[opPos] = operand
+		return
+	}
 	c.replaceInstructions(opPos, newInstructions)
 }
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstructions(lastPos, code.Make(code.OpReturnValue))
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+func (c *Compiler) enterScope() {
+	scope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+	c.scopes = append(c.scopes, scope)
+	c.scopeIndex++
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+	c.symbolTable = c.symbolTable.Outer
+	return instructions
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"interpreter/lexer"
 	"interpreter/object"
 	"interpreter/parser"
+	"strings"
 	"testing"
 )
 
@@ -195,6 +196,23 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 				return fmt.Errorf("constant %d -testIntegerObject failed: %s",
 					i, err)
 			}
+		case string:
+			str, ok := actual[i].(*object.String)
+			if !ok || str.Value != constant {
+				return fmt.Errorf("constant %d - not String %q. got=%T (%+v)",
+					i, constant, actual[i], actual[i])
+			}
+		case []code.Instructions:
+			fn, ok := actual[i].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("constant %d - not a function: %T",
+					i, actual[i])
+			}
+			err := testInstructions(constant, fn.Instructions)
+			if err != nil {
+				return fmt.Errorf("constant %d - testInstructions failed: %s",
+					i, err)
+			}
 		}
 	}
 	return nil
@@ -282,6 +300,90 @@ if(true) { 10 } else { 20 }; 3333;
 	runCompileTests(t, tests)
 }
 
+// 跳转目标超过 65535 时作用域中所有的跳转都改成 OpWide 的形式，后面的指令和行号随之移动
+func TestWideJumps(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("let x = true;\nif (x) {\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&input, "%d;\n", i)
+	}
+	input.WriteString("1 } else { 2 };\nx;\n")
+	for _, level := range []OptimizationLevel{OptimizeNone, OptimizeFull} {
+		comp := New()
+		comp.SetOptimization(level)
+		if err := comp.Compile(parse(input.String())); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.ByteCode()
+		ins := bytecode.Instructions
+		boundaries := map[int]bool{len(ins): true}
+		var jumps []code.Instruction
+		for i := 0; i < len(ins); {
+			instruction, err := code.ReadInstruction(ins, i)
+			if err != nil {
+				t.Fatalf("level %d: %s", level, err)
+			}
+			boundaries[i] = true
+			if instruction.Op == code.OpJump || instruction.Op == code.OpJumpNotTruthy {
+				if !instruction.Wide {
+					t.Errorf("level %d: narrow %s at %d", level, instruction.Def.Name, i)
+				}
+				jumps = append(jumps, instruction)
+			}
+			i += instruction.Width
+		}
+		if len(jumps) != 2 || jumps[0].Operands[0] <= 65535 {
+			t.Fatalf("level %d: wrong jumps %+v", level, jumps)
+		}
+		for _, j := range jumps {
+			if !boundaries[j.Operands[0]] {
+				t.Errorf("level %d: jump target %d is not an instruction", level, j.Operands[0])
+			}
+		}
+		// 最后一行的 x 在 OpJump 的目标之后
+		last := bytecode.Lines[len(bytecode.Lines)-1]
+		if last.Line != 20004 || last.Offset != jumps[1].Operands[0]+1 || !boundaries[last.Offset] {
+			t.Errorf("level %d: wrong last line %+v, jumps %+v", level, last, jumps)
+		}
+	}
+}
+
+// 虚拟机不支持这些指令的 OpWide 形式，个数超过两个字节时报告编译错误
+func TestTooManyOperands(t *testing.T) {
+	list := func(n int) string {
+		return strings.TrimSuffix(strings.Repeat("1,", n), ",")
+	}
+	var locals strings.Builder
+	locals.WriteString("fn() {")
+	for i := 0; i <= 65535; i++ {
+		// 标识符中不能有数字
+		name := []byte("aaaa")
+		for j, n := len(name)-1, i; n > 0; j, n = j-1, n/26 {
+			name[j] = byte('a' + n%26)
+		}
+		fmt.Fprintf(&locals, "let %s = 1;", name)
+	}
+	locals.WriteString("}")
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[" + list(65535) + "]", ""},
+		{"[" + list(65536) + "]", "too many array elements: 65536, the limit is 65535"},
+		{"len(" + list(65536) + ")", "too many call arguments: 65536, the limit is 65535"},
+		{locals.String(), "too many local variables: 65536, the limit is 65535"},
+	}
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		switch {
+		case tt.expected == "" && err != nil:
+			t.Errorf("unexpected error %s", err)
+		case tt.expected != "" && (err == nil || err.Error() != tt.expected):
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
 func TestGlobaLetStatement(t *testing.T) {
 	tests := []compilerTestCast{
 		{
@@ -329,3 +431,139 @@ func TestGlobaLetStatement(t *testing.T) {
 	}
 	runCompileTests(t, tests)
 }
+
+func TestCollectionLiterals(t *testing.T) {
+	tests := []compilerTestCast{
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2][0]",
+			expectedConstants: []interface{}{1, 2, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2, 3: 4}",
+			expectedConstants: []interface{}{1, 2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpHash, 4),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompileTests(t, tests)
+}
+
+func TestFunctionsAndClosures(t *testing.T) {
+	tests := []compilerTestCast{
+		{
+			input: `fn() { return 5 + 10 }`,
+			expectedConstants: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `let one = fn(a) { let b = a; len(b) }; one(1);`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a) { fn(b) { a + b } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `let countDown = fn(x) { countDown(x - 1); };`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+	}
+	runCompileTests(t, tests)
+}
@@ -0,0 +1,46 @@
+package compiler
+
+import (
+	"fmt"
+	"interpreter/object"
+	"strings"
+)
+
+// Disassemble 输出主程序的指令以及常量池，编译函数的指令缩进显示在常量下面
+func Disassemble(bytecode *ByteCode) string {
+	var out strings.Builder
+	out.WriteString("== main ==\n")
+	out.WriteString(bytecode.Instructions.String())
+	if len(bytecode.Constants) == 0 {
+		return out.String()
+	}
+	out.WriteString("== constants ==\n")
+	for i, constant := range bytecode.Constants {
+		switch constant := constant.(type) {
+		case *object.CompiledFunction:
+			name := constant.Name
+			if name == "" {
+				name = "<anonymous>"
+			}
+			fmt.Fprintf(&out, "%04d %s %s params=%d locals=%d\n", i, constant.Type(),
+				name, constant.NumParameters, constant.NumLocals)
+			out.WriteString(indent(constant.Instructions.String(), "     "))
+		case *object.String:
+			fmt.Fprintf(&out, "%04d %s %q\n", i, constant.Type(), constant.Value)
+		default:
+			fmt.Fprintf(&out, "%04d %s %s\n", i, constant.Type(), constant.Inspect())
+		}
+	}
+	return out.String()
+}
+
+func indent(s, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	var out strings.Builder
+	for _, line := range lines {
+		if line != "" {
+			out.WriteString(prefix + line)
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,321 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"interpreter/code"
+	"interpreter/object"
+)
+
+// .mbc 文件的布局：
+//
+//	magic    4 字节 "MBC\x1a"
+//	version  uint16
+//	flags    uint16，flagDebugInfo 表示包含调试信息
+//	checksum uint32，payload 的 CRC-32 (IEEE)
+//	length   uint32，payload 的字节数
+//	payload  主程序指令、[主程序行号表]、常量池
+//
+// 多字节整数都是大端序，payload 内部的长度和数值使用 varint 编码。
+// 每个常量以一个类型字节开头，编译函数的调试信息是函数名和行号表，
+// 从版本 2 开始还包括局部变量和自由变量的名字。版本 1 的文件仍然可以读取。
+const (
+	FormatVersion = 2
+
+	flagDebugInfo = 1 << 0
+
+	constInteger  byte = 1
+	constString   byte = 2
+	constFunction byte = 3
+
+	headerSize = 4 + 2 + 2 + 4 + 4
+
+	// maxLocals 是函数的局部变量和参数个数的上限，局部变量的下标是两个字节的操作数
+	maxLocals = 1 << 16
+)
+
+var magic = []byte("MBC\x1a")
+
+var ErrBadMagic = errors.New("not a monkey bytecode file")
+
+// Marshal 把字节码编码成 .mbc 格式，只要有任何行号信息就会写入调试信息
+func Marshal(bytecode *ByteCode) ([]byte, error) {
+	debug := hasDebugInfo(bytecode)
+	w := &writer{}
+	w.instructions(bytecode.Instructions)
+	if debug {
+		w.lines(bytecode.Lines)
+	}
+	w.uvarint(uint64(len(bytecode.Constants)))
+	for i, constant := range bytecode.Constants {
+		switch constant := constant.(type) {
+		case *object.Integer:
+			w.buf.WriteByte(constInteger)
+			w.varint(constant.Value)
+		case *object.String:
+			w.buf.WriteByte(constString)
+			w.str(constant.Value)
+		case *object.CompiledFunction:
+			w.buf.WriteByte(constFunction)
+			w.uvarint(uint64(constant.NumLocals))
+			w.uvarint(uint64(constant.NumParameters))
+			w.instructions(constant.Instructions)
+			if debug {
+				w.str(constant.Name)
+				w.lines(constant.Lines)
+				w.names(constant.LocalNames)
+				w.names(constant.FreeNames)
+			}
+		default:
+			return nil, fmt.Errorf("cannot marshal constant %d of type %s", i, constant.Type())
+		}
+	}
+
+	payload := w.buf.Bytes()
+	var flags uint16
+	if debug {
+		flags |= flagDebugInfo
+	}
+	out := make([]byte, headerSize, headerSize+len(payload))
+	copy(out, magic)
+	binary.BigEndian.PutUint16(out[4:], FormatVersion)
+	binary.BigEndian.PutUint16(out[6:], flags)
+	binary.BigEndian.PutUint32(out[8:], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(out[12:], uint32(len(payload)))
+	return append(out, payload...), nil
+}
+
+// Unmarshal 解析 Marshal 生成的数据，不检查指令本身，不信任的数据应该用 vm.Load 读入
+func Unmarshal(data []byte) (*ByteCode, error) {
+	if len(data) < headerSize || !bytes.Equal(data[:4], magic) {
+		return nil, ErrBadMagic
+	}
+	version := binary.BigEndian.Uint16(data[4:])
+	if version != FormatVersion && version != 1 {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d", version, FormatVersion)
+	}
+	flags := binary.BigEndian.Uint16(data[6:])
+	checksum := binary.BigEndian.Uint32(data[8:])
+	length := binary.BigEndian.Uint32(data[12:])
+	payload := data[headerSize:]
+	if uint64(len(payload)) != uint64(length) {
+		return nil, fmt.Errorf("bytecode payload has %d bytes, header says %d", len(payload), length)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("bytecode checksum mismatch")
+	}
+
+	debug := flags&flagDebugInfo != 0
+	r := &reader{data: payload}
+	bytecode := &ByteCode{Instructions: r.instructions()}
+	if debug {
+		bytecode.Lines = r.lines()
+	}
+	count := r.length()
+	bytecode.Constants = make([]object.Object, 0, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		switch tag := r.byte(); tag {
+		case constInteger:
+			bytecode.Constants = append(bytecode.Constants, object.NewInteger(r.varint()))
+		case constString:
+			bytecode.Constants = append(bytecode.Constants, &object.String{Value: r.str()})
+		case constFunction:
+			fn := &object.CompiledFunction{
+				NumLocals:     r.count("locals", maxLocals),
+				NumParameters: r.count("parameters", maxLocals),
+				Instructions:  r.instructions(),
+			}
+			if debug {
+				fn.Name = r.str()
+				fn.Lines = r.lines()
+			}
+			if debug && version >= 2 {
+				fn.LocalNames = r.names()
+				fn.FreeNames = r.names()
+			}
+			bytecode.Constants = append(bytecode.Constants, fn)
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown constant tag %d", tag)
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed bytecode: %s", r.err)
+	}
+	if r.pos != len(r.data) {
+		return nil, fmt.Errorf("malformed bytecode: %d trailing bytes", len(r.data)-r.pos)
+	}
+	return bytecode, nil
+}
+
+func hasDebugInfo(bytecode *ByteCode) bool {
+	if len(bytecode.Lines) > 0 {
+		return true
+	}
+	for _, constant := range bytecode.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && (fn.Name != "" || len(fn.Lines) > 0 || len(fn.LocalNames) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+type writer struct {
+	buf bytes.Buffer
+}
+
+func (w *writer) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	w.buf.Write(tmp[:n])
+}
+
+func (w *writer) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	w.buf.Write(tmp[:n])
+}
+
+func (w *writer) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *writer) instructions(ins code.Instructions) {
+	w.uvarint(uint64(len(ins)))
+	w.buf.Write(ins)
+}
+
+func (w *writer) lines(lines code.LineTable) {
+	w.uvarint(uint64(len(lines)))
+	for _, l := range lines {
+		w.uvarint(uint64(l.Offset))
+		w.uvarint(uint64(l.Line))
+	}
+}
+
+func (w *writer) names(names []string) {
+	w.uvarint(uint64(len(names)))
+	for _, name := range names {
+		w.str(name)
+	}
+}
+
+// reader 在第一次出错后记下错误，之后的读取都返回零值
+type reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *reader) fail(format string, a ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.fail("unexpected end of data at offset %d", r.pos)
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail("bad varint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.fail("bad varint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// length 读取一个长度，并保证它不超过剩余的数据量，避免恶意文件导致巨大的内存分配
+func (r *reader) length() int {
+	v := r.uvarint()
+	if v > uint64(len(r.data)-r.pos) {
+		r.fail("length %d exceeds remaining %d bytes", v, len(r.data)-r.pos)
+		return 0
+	}
+	return int(v)
+}
+
+// count 读取一个不超过 limit 的个数，超出时（包括转换成 int 后为负数的值）报告错误
+func (r *reader) count(what string, limit int) int {
+	v := r.uvarint()
+	if v > uint64(limit) {
+		r.fail("%d %s exceed the limit of %d", v, what, limit)
+		return 0
+	}
+	return int(v)
+}
+
+func (r *reader) bytes() []byte {
+	n := r.length()
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.data[r.pos:r.pos+n])
+	r.pos += n
+	return b
+}
+
+func (r *reader) str() string {
+	return string(r.bytes())
+}
+
+func (r *reader) instructions() code.Instructions {
+	return code.Instructions(r.bytes())
+}
+
+func (r *reader) lines() code.LineTable {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	lines := make(code.LineTable, n)
+	for i := range lines {
+		lines[i] = code.LineInfo{Offset: int(r.uvarint()), Line: int(r.uvarint())}
+	}
+	return lines
+}
+
+func (r *reader) names() []string {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = r.str()
+	}
+	return names
+}
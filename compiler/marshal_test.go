@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"interpreter/code"
+	"interpreter/object"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	input := `let greeting = "hello";
+let add = fn(a, b) {
+	let c = a + b;
+	c
+};
+add(-1, 2);
+fn() { greeting }();`
+	program := parse(input)
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	original := compiler.ByteCode()
+
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	if !bytes.Equal(decoded.Instructions, original.Instructions) {
+		t.Errorf("wrong instructions.\nwant=%s\ngot=%s", original.Instructions, decoded.Instructions)
+	}
+	if !reflect.DeepEqual(decoded.Lines, original.Lines) {
+		t.Errorf("wrong lines. want=%v, got=%v", original.Lines, decoded.Lines)
+	}
+	if len(decoded.Constants) != len(original.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d",
+			len(original.Constants), len(decoded.Constants))
+	}
+	for i, want := range original.Constants {
+		if !reflect.DeepEqual(decoded.Constants[i], want) {
+			t.Errorf("constant %d wrong. want=%+v, got=%+v", i, want, decoded.Constants[i])
+		}
+	}
+	fn, ok := decoded.Constants[1].(*object.CompiledFunction)
+	if !ok || fn.Name != "add" || fn.NumParameters != 2 || fn.NumLocals != 3 {
+		t.Fatalf("wrong compiled function. got=%+v", decoded.Constants[1])
+	}
+	if len(fn.Lines) == 0 || fn.Lines[0].Line != 3 {
+		t.Errorf("wrong function lines. got=%v", fn.Lines)
+	}
+	if !reflect.DeepEqual(fn.LocalNames, []string{"a", "b", "c"}) {
+		t.Errorf("wrong local names. got=%v", fn.LocalNames)
+	}
+	closure := decoded.Constants[4].(*object.CompiledFunction)
+	if closure.FreeNames != nil || len(closure.LocalNames) != 0 {
+		t.Errorf("wrong names for closure. got=%v %v", closure.LocalNames, closure.FreeNames)
+	}
+}
+
+// 版本 1 的文件没有变量名，仍然可以读取
+func TestUnmarshalVersionOne(t *testing.T) {
+	w := &writer{}
+	w.instructions(code.Make(code.OpClosure, 0, 0))
+	w.lines(code.LineTable{{Offset: 0, Line: 1}})
+	w.uvarint(1)
+	w.buf.WriteByte(constFunction)
+	w.uvarint(1)
+	w.uvarint(1)
+	w.instructions(code.Make(code.OpGetLocal, 0))
+	w.str("id")
+	w.lines(code.LineTable{{Offset: 0, Line: 1}})
+	payload := w.buf.Bytes()
+
+	data := make([]byte, headerSize)
+	copy(data, magic)
+	binary.BigEndian.PutUint16(data[4:], 1)
+	binary.BigEndian.PutUint16(data[6:], flagDebugInfo)
+	binary.BigEndian.PutUint32(data[8:], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(data[12:], uint32(len(payload)))
+	data = append(data, payload...)
+
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	fn := decoded.Constants[0].(*object.CompiledFunction)
+	if fn.Name != "id" || fn.NumLocals != 1 || fn.LocalNames != nil {
+		t.Errorf("wrong function. got=%+v", fn)
+	}
+}
+
+func TestMarshalWithoutDebugInfo(t *testing.T) {
+	original := &ByteCode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants: []object.Object{
+			&object.CompiledFunction{Instructions: code.Make(code.OpReturn)},
+		},
+	}
+	data, err := Marshal(original)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if data[7]&flagDebugInfo != 0 {
+		t.Errorf("debug flag should not be set")
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Errorf("wrong bytecode. want=%+v, got=%+v", original, decoded)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	valid, err := Marshal(&ByteCode{
+		Instructions: code.Make(code.OpConstant, 0),
+		Constants:    []object.Object{&object.String{Value: "monkey"}},
+	})
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	// 局部变量和参数的个数有上限，大于 MaxInt64 的值也不能变成负数
+	function := func(fn *object.CompiledFunction) []byte {
+		fn.Instructions = code.Make(code.OpReturn)
+		data, err := Marshal(&ByteCode{Constants: []object.Object{fn}})
+		if err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+		return data
+	}
+	corrupt := func(f func(data []byte) []byte) []byte {
+		data := make([]byte, len(valid))
+		copy(data, valid)
+		return f(data)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"empty", []byte{}, "not a monkey bytecode file"},
+		{"magic", corrupt(func(d []byte) []byte { d[0] = 'X'; return d }),
+			"not a monkey bytecode file"},
+		{"version", corrupt(func(d []byte) []byte { d[5] = 99; return d }),
+			"unsupported bytecode version 99, want 2"},
+		{"checksum", corrupt(func(d []byte) []byte { d[len(d)-1] ^= 0xff; return d }),
+			"bytecode checksum mismatch"},
+		{"truncated", corrupt(func(d []byte) []byte { return d[:len(d)-1] }),
+			"bytecode payload has 12 bytes, header says 13"},
+		{"locals", function(&object.CompiledFunction{NumLocals: maxLocals + 1}),
+			"malformed bytecode: 65537 locals exceed the limit of 65536"},
+		{"parameters", function(&object.CompiledFunction{NumParameters: -1}),
+			"malformed bytecode: 18446744073709551615 parameters exceed the limit of 65536"},
+	}
+	for _, tt := range tests {
+		_, err := Unmarshal(tt.data)
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestMarshalUnsupportedConstant(t *testing.T) {
+	_, err := Marshal(&ByteCode{Constants: []object.Object{object.TRUE}})
+	if err == nil || err.Error() != "cannot marshal constant 0 of type BOOLEAN" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
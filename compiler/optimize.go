@@ -0,0 +1,294 @@
+package compiler
+
+import (
+	"interpreter/ast"
+	"interpreter/code"
+	"interpreter/object"
+)
+
+// OptimizationLevel 控制编译器做哪些优化，常量池去重在所有级别都会进行
+type OptimizationLevel int
+
+const (
+	// OptimizeNone 按照语法树逐个生成指令
+	OptimizeNone OptimizationLevel = iota
+	// OptimizeBasic 折叠常量表达式，删除永远不会执行的分支
+	OptimizeBasic
+	// OptimizeFull 在 OptimizeBasic 的基础上把跳转到跳转的指令直接指向最终目标
+	OptimizeFull
+)
+
+// SetOptimization 设置优化级别，需要在 Compile 之前调用
+func (c *Compiler) SetOptimization(level OptimizationLevel) {
+	c.optimization = level
+}
+
+// fold 计算只由字面量组成的表达式，结果和虚拟机执行时完全一致；
+// 运行时会出错的表达式（例如除以零或者类型不匹配）不折叠，留给虚拟机报错
+func fold(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return object.NewInteger(node.Value), true
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+	case *ast.Boolean:
+		return nativeBool(node.Value), true
+	case *ast.PrefixExpression:
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+	case *ast.InfixExpression:
+		left, ok := fold(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := fold(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	}
+	return nil, false
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		// 与 OpBang 相同：只有 false 和 null 取反为 true
+		return nativeBool(right == object.FALSE || right == object.NULL), true
+	case "-":
+		if integer, ok := right.(*object.Integer); ok {
+			return object.NewInteger(-integer.Value), true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "+":
+			return object.NewInteger(left.Value + right.Value), true
+		case "-":
+			return object.NewInteger(left.Value - right.Value), true
+		case "*":
+			return object.NewInteger(left.Value * right.Value), true
+		case "/":
+			if right.Value == 0 {
+				return nil, false
+			}
+			return object.NewInteger(left.Value / right.Value), true
+		case "<":
+			return nativeBool(left.Value < right.Value), true
+		case ">":
+			return nativeBool(left.Value > right.Value), true
+		case "==":
+			return nativeBool(left.Value == right.Value), true
+		case "!=":
+			return nativeBool(left.Value != right.Value), true
+		}
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "+":
+			return &object.String{Value: left.Value + right.Value}, true
+		case "<":
+			return nativeBool(left.Value < right.Value), true
+		case ">":
+			return nativeBool(left.Value > right.Value), true
+		case "==":
+			return nativeBool(left.Value == right.Value), true
+		case "!=":
+			return nativeBool(left.Value != right.Value), true
+		}
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+		switch operator {
+		case "==":
+			return nativeBool(left == right), true
+		case "!=":
+			return nativeBool(left != right), true
+		}
+	}
+	return nil, false
+}
+
+func nativeBool(value bool) *object.Boolean {
+	if value {
+		return object.TRUE
+	}
+	return object.FALSE
+}
+
+// isTruthy 与虚拟机的 OpJumpNotTruthy 使用相同的规则
+func isTruthy(obj object.Object) bool {
+	return obj != object.FALSE && obj != object.NULL
+}
+
+// emitFolded 生成把折叠结果压栈的指令
+func (c *Compiler) emitFolded(obj object.Object) {
+	switch obj {
+	case object.TRUE:
+		c.emit(code.OpTrue)
+	case object.FALSE:
+		c.emit(code.OpFalse)
+	default:
+		c.emit(code.OpConstant, c.addConstant(obj))
+	}
+}
+
+// compileConstantIf 编译条件是常量的 if 表达式，只保留会执行的分支。
+// 不执行的分支仍然会被编译再丢弃，这样其中的 let 定义和编译错误都和不优化时一样，
+// 但是它引用的外层变量不会成为闭包的自由变量。
+func (c *Compiler) compileConstantIf(node *ast.IfExpression, truthy bool) error {
+	taken, skipped := node.Consequence, node.Alternative
+	if !truthy {
+		taken, skipped = node.Alternative, node.Consequence
+	}
+	if skipped != nil {
+		mark := c.mark()
+		if err := c.Compile(skipped); err != nil {
+			return err
+		}
+		c.rewind(mark)
+	}
+	if taken == nil {
+		c.emit(code.OpNull)
+		return nil
+	}
+	if err := c.Compile(taken); err != nil {
+		return err
+	}
+	c.keepBlockValue()
+	return nil
+}
+
+// scopeMark 记录当前作用域和常量池的状态，rewind 可以丢弃之后生成的指令和常量
+type scopeMark struct {
+	position            int
+	numConstants        int
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+	// numFree 是从当前作用域到最外层每个符号表的自由变量个数
+	numFree []int
+}
+
+func (c *Compiler) mark() scopeMark {
+	scope := c.scopes[c.scopeIndex]
+	m := scopeMark{
+		position:            len(scope.instructions),
+		numConstants:        len(c.constants),
+		lastInstruction:     scope.lastInstruction,
+		previousInstruction: scope.previousInstruction,
+	}
+	for s := c.symbolTable; s != nil; s = s.Outer {
+		m.numFree = append(m.numFree, len(s.FreeSymbols))
+	}
+	return m
+}
+
+func (c *Compiler) rewind(m scopeMark) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.instructions = scope.instructions[:m.position]
+	scope.lastInstruction = m.lastInstruction
+	scope.previousInstruction = m.previousInstruction
+	for pos := range scope.farJumps {
+		if pos >= m.position {
+			delete(scope.farJumps, pos)
+		}
+	}
+	for len(scope.lines) > 0 && scope.lines[len(scope.lines)-1].Offset >= m.position {
+		scope.lines = scope.lines[:len(scope.lines)-1]
+	}
+	i := 0
+	for s := c.symbolTable; s != nil; s = s.Outer {
+		s.truncateFree(m.numFree[i])
+		i++
+	}
+	c.constants = c.constants[:m.numConstants]
+	for key, index := range c.constantIndex {
+		if index >= m.numConstants {
+			delete(c.constantIndex, key)
+		}
+	}
+}
+
+// finishScope 在作用域编译完成后修改放不下的跳转目标，再做优化
+func (c *Compiler) finishScope() {
+	c.widenJumps()
+	c.optimizeScope()
+}
+
+// optimizeScope 对编译完成的作用域做窥孔优化，指令长度不变，行号表仍然有效
+func (c *Compiler) optimizeScope() {
+	if c.optimization >= OptimizeFull {
+		threadJumps(c.currentInstructions())
+	}
+}
+
+// threadJumps 把目标是 OpJump 的跳转直接指向最终的目标
+func threadJumps(ins code.Instructions) {
+	for i := 0; i < len(ins); {
+		instruction, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return
+		}
+		if op := instruction.Op; op == code.OpJump || op == code.OpJumpNotTruthy {
+			target := finalTarget(ins, instruction.Operands[0])
+			replacement := code.Make(op, target)
+			if instruction.Wide {
+				replacement = code.MakeWide(op, target)
+			}
+			// 新的目标放不下时保留原来的跳转
+			if len(replacement) == instruction.Width {
+				copy(ins[i:], replacement)
+			}
+		}
+		i += instruction.Width
+	}
+}
+
+// finalTarget 沿着 OpJump 链找到最终的目标，跳转次数有上限以免死循环
+func finalTarget(ins code.Instructions, target int) int {
+	for hops := 0; hops < len(ins); hops++ {
+		if target >= len(ins) {
+			break
+		}
+		instruction, err := code.ReadInstruction(ins, target)
+		if err != nil || instruction.Op != code.OpJump {
+			break
+		}
+		target = instruction.Operands[0]
+	}
+	return target
+}
+
+// constantKey 用于在常量池中查找相同的整数和字符串
+type constantKey struct {
+	typ     object.ObjectType
+	integer int64
+	str     string
+}
+
+func keyOf(obj object.Object) (constantKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return constantKey{typ: obj.Type(), integer: obj.Value}, true
+	case *object.String:
+		return constantKey{typ: obj.Type(), str: obj.Value}, true
+	}
+	return constantKey{}, false
+}
@@ -0,0 +1,237 @@
+package compiler
+
+import (
+	"interpreter/code"
+	"testing"
+)
+
+func runOptimizedCompileTests(t *testing.T, level OptimizationLevel, tests []compilerTestCast) {
+	t.Helper()
+	for _, tt := range tests {
+		compiler := New()
+		compiler.SetOptimization(level)
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("%q: compile error: %s", tt.input, err)
+		}
+		bytecode := compiler.ByteCode()
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("%q: testInstructions failed: %s", tt.input, err)
+		}
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("%q: testConstants failed: %s", tt.input, err)
+		}
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCast{
+		{
+			input:             "1 + 2 * 3",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `!true; -5; "a" + "b" == "ab"; 2 < 1; !!3`,
+			expectedConstants: []interface{}{-5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 运行时才会报错的表达式保持原样
+			input:             "1 / 0; 1 + true",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpTrue),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = 2; a * (3 - 1)",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizedCompileTests(t, OptimizeBasic, tests)
+}
+
+func TestBranchPruning(t *testing.T) {
+	tests := []compilerTestCast{
+		{
+			input:             "if (1 < 2) { 10 } else { 20 }; 3333;",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (false) { 10 }; 1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 被删除的分支中的 let 仍然定义了变量
+			input:             "if (false) { let a = 1; }; a",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// 被删除的分支引用的外层变量不是自由变量
+			input: "fn(a) { fn() { if (false) { a } else { 1 } } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (true) { let a = 1; }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizedCompileTests(t, OptimizeBasic, tests)
+
+	compiler := New()
+	compiler.SetOptimization(OptimizeBasic)
+	err := compiler.Compile(parse("if (true) { 1 } else { missing }"))
+	if err == nil || err.Error() != "undefined variable missing" {
+		t.Errorf("expected error from the pruned branch, got=%v", err)
+	}
+}
+
+func TestJumpThreading(t *testing.T) {
+	input := "let x = true; let y = true; if (x) { if (y) { 1 } else { 2 } } else { 3 }"
+	expected := func(innerJump int) []code.Instructions {
+		return []code.Instructions{
+			// 0000
+			code.Make(code.OpTrue),
+			code.Make(code.OpSetGlobal, 0),
+			// 0004
+			code.Make(code.OpTrue),
+			code.Make(code.OpSetGlobal, 1),
+			// 0008
+			code.Make(code.OpGetGlobal, 0),
+			code.Make(code.OpJumpNotTruthy, 32),
+			// 0014
+			code.Make(code.OpGetGlobal, 1),
+			code.Make(code.OpJumpNotTruthy, 26),
+			// 0020
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpJump, innerJump),
+			// 0026
+			code.Make(code.OpConstant, 1),
+			// 0029
+			code.Make(code.OpJump, 35),
+			// 0032
+			code.Make(code.OpConstant, 2),
+			// 0035
+			code.Make(code.OpPop),
+		}
+	}
+	runOptimizedCompileTests(t, OptimizeBasic, []compilerTestCast{
+		{input, []interface{}{1, 2, 3}, expected(29)},
+	})
+	runOptimizedCompileTests(t, OptimizeFull, []compilerTestCast{
+		{input, []interface{}{1, 2, 3}, expected(35)},
+	})
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCast{
+		{
+			input:             `1; 1; "a"; "a"; fn() { 1 }`,
+			expectedConstants: []interface{}{1, "a", []code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpReturnValue)}},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizedCompileTests(t, OptimizeNone, tests)
+
+	// 复用之前的常量池时同样去重
+	compiler := New()
+	if err := compiler.Compile(parse(`"x"; 2`)); err != nil {
+		t.Fatal(err)
+	}
+	next := NewWithState(compiler.SymbolTable(), compiler.ByteCode().Constants)
+	if err := next.Compile(parse(`2; "x"; 3`)); err != nil {
+		t.Fatal(err)
+	}
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpPop),
+	}, next.ByteCode().Instructions)
+	if err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+	if len(next.ByteCode().Constants) != 3 {
+		t.Errorf("wrong number of constants. got=%d, want=3", len(next.ByteCode().Constants))
+	}
+}
@@ -1,9 +1,15 @@
 package compiler
 
+import "sort"
+
 type SymbolScope string
 
 const (
-	GlobalScope SymbolScope = "GLOBAL"
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
@@ -13,29 +19,113 @@ type Symbol struct {
 }
 
 type SymbolTable struct {
+	Outer *SymbolTable
+
 	store          map[string]Symbol
 	numDefinitions int
+	// FreeSymbols 为内层函数引用的外层局部变量，按 OpGetFree 的下标排列
+	FreeSymbols []Symbol
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	return &SymbolTable{
-		store: s,
+		store:       s,
+		FreeSymbols: []Symbol{},
 	}
 }
 
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
 func (s *SymbolTable) Define(name string) Symbol {
 	symbol := Symbol{
 		Name:  name,
-		Scope: GlobalScope,
 		Index: s.numDefinitions,
 	}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+	} else {
+		symbol.Scope = LocalScope
+	}
 	s.store[name] = symbol
 	s.numDefinitions++
 	return symbol
 }
 
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Scope: FreeScope}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// truncateFree 只保留前 n 个自由变量，用于丢弃已经编译的代码引用的外层变量
+func (s *SymbolTable) truncateFree(n int) {
+	for i := n; i < len(s.FreeSymbols); i++ {
+		name := s.FreeSymbols[i].Name
+		// 之后又被 let 重新定义的名字保留新的定义
+		if symbol := s.store[name]; symbol.Scope == FreeScope && symbol.Index == i {
+			delete(s.store, name)
+		}
+	}
+	s.FreeSymbols = s.FreeSymbols[:n]
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
+	if !ok && s.Outer != nil {
+		obj, ok = s.Outer.Resolve(name)
+		if !ok {
+			return obj, ok
+		}
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+		return s.defineFree(obj), true
+	}
 	return obj, ok
 }
+
+// NumDefinitions 返回当前作用域定义的变量个数，即函数需要的局部变量槽数
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
+// Symbols 返回当前作用域中属于 scope 的符号，按下标排列
+func (s *SymbolTable) Symbols(scope SymbolScope) []Symbol {
+	symbols := []Symbol{}
+	for _, symbol := range s.store {
+		if symbol.Scope == scope {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].Index < symbols[j].Index })
+	return symbols
+}
+
+// Copy 复制当前作用域，编译到副本上的定义不会影响原来的符号表
+func (s *SymbolTable) Copy() *SymbolTable {
+	c := NewEnclosedSymbolTable(s.Outer)
+	for name, symbol := range s.store {
+		c.store[name] = symbol
+	}
+	c.numDefinitions = s.numDefinitions
+	c.FreeSymbols = append(c.FreeSymbols, s.FreeSymbols...)
+	return c
+}
@@ -52,3 +52,60 @@ func TestResolveGlobal(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveNestedLocalAndFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.DefineBuiltin(0, "len")
+	first := NewEnclosedSymbolTable(global)
+	first.Define("b")
+	second := NewEnclosedSymbolTable(first)
+	second.Define("c")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+		{Name: "b", Scope: FreeScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 0},
+	}
+	for _, sym := range expected {
+		result, ok := second.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+	if len(second.FreeSymbols) != 1 || second.FreeSymbols[0] != (Symbol{Name: "b", Scope: LocalScope, Index: 0}) {
+		t.Errorf("wrong free symbols. got=%+v", second.FreeSymbols)
+	}
+	if _, ok := second.Resolve("d"); ok {
+		t.Errorf("name d resolved, but was expected not to")
+	}
+}
+
+func TestSymbolsAndCopy(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	global.Define("b")
+	global.Define("a")
+
+	symbols := global.Symbols(GlobalScope)
+	if len(symbols) != 2 || symbols[0].Name != "b" || symbols[1].Name != "a" {
+		t.Errorf("wrong global symbols. got=%+v", symbols)
+	}
+
+	copied := global.Copy()
+	c := copied.Define("c")
+	if c.Index != 2 {
+		t.Errorf("wrong index in copy. want=2, got=%d", c.Index)
+	}
+	if _, ok := global.Resolve("c"); ok {
+		t.Errorf("definition in copy leaked into original table")
+	}
+	if global.NumDefinitions() != 2 {
+		t.Errorf("wrong number of definitions. want=2, got=%d", global.NumDefinitions())
+	}
+}
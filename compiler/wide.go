@@ -0,0 +1,51 @@
+package compiler
+
+import "interpreter/code"
+
+// widenJumps 在作用域中有跳转目标超过两个字节时把所有跳转改成 OpWide 的形式。
+// 跳转变长以后后面的指令都会移动，所以重新计算跳转目标、行号表和最后两条指令的位置
+func (c *Compiler) widenJumps() {
+	scope := &c.scopes[c.scopeIndex]
+	if len(scope.farJumps) == 0 {
+		return
+	}
+	ins := scope.instructions
+	// offsets[i] 是原来位置 i 的指令的新位置，最后一项是末尾
+	offsets := make([]int, len(ins)+1)
+	type jump struct {
+		op     code.Opcode
+		pos    int
+		target int
+	}
+	var jumps []jump
+	out := make(code.Instructions, 0, len(ins))
+	for i := 0; i < len(ins); {
+		instruction, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return
+		}
+		offsets[i] = len(out)
+		if op := instruction.Op; op == code.OpJump || op == code.OpJumpNotTruthy {
+			target := instruction.Operands[0]
+			if far, ok := scope.farJumps[i]; ok {
+				target = far
+			}
+			jumps = append(jumps, jump{op: op, pos: len(out), target: target})
+			out = append(out, code.MakeWide(op, target)...)
+		} else {
+			out = append(out, ins[i:i+instruction.Width]...)
+		}
+		i += instruction.Width
+	}
+	offsets[len(ins)] = len(out)
+	for _, j := range jumps {
+		copy(out[j.pos:], code.MakeWide(j.op, offsets[j.target]))
+	}
+	for i := range scope.lines {
+		scope.lines[i].Offset = offsets[scope.lines[i].Offset]
+	}
+	scope.lastInstruction.Position = offsets[scope.lastInstruction.Position]
+	scope.previousInstruction.Position = offsets[scope.previousInstruction.Position]
+	scope.instructions = out
+	scope.farJumps = nil
+}
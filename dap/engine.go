@@ -0,0 +1,53 @@
+package dap
+
+import (
+	"interpreter/ast"
+	"interpreter/debug"
+	"interpreter/object"
+)
+
+// engine 是 vm.Debugger 和 evaluator.Debugger 共有的方法，两者使用 debug 包中相同的类型
+type engine interface {
+	SetBreakpoint(line int)
+	ClearBreakpoint(line int)
+	SetFunctionBreakpoint(name string)
+	ClearFunctionBreakpoint(name string)
+	Breakpoints() (lines []int, functions []string)
+	Continue() debug.Stop
+	StepInto() debug.Stop
+	StepOver() debug.Stop
+	StepOut() debug.Stop
+	Exited() bool
+	Close()
+
+	Frames() []debug.FrameInfo
+	Locals(frame int) []debug.Variable
+	Globals() []debug.Variable
+	Evaluate(frame int, program *ast.Program) (object.Object, error)
+}
+
+// runCommand 执行 command（continue、next、stepIn 或 stepOut）直到下一次暂停
+func runCommand(e engine, command string) debug.Stop {
+	switch command {
+	case "next":
+		return e.StepOver()
+	case "stepIn":
+		return e.StepInto()
+	case "stepOut":
+		return e.StepOut()
+	default:
+		return e.Continue()
+	}
+}
+
+// stopReason 返回 DAP stopped 事件使用的暂停原因
+func stopReason(reason debug.StopReason) string {
+	switch reason {
+	case debug.StopBreakpoint:
+		return "breakpoint"
+	case debug.StopFunction:
+		return "function breakpoint"
+	default:
+		return "step"
+	}
+}
@@ -0,0 +1,628 @@
+// Package dap 实现 Monkey 的 Debug Adapter Protocol 适配器，通过标准输入输出
+// 与编辑器通信。它可以用虚拟机或者求值器执行程序，支持行断点、函数断点、
+// 继续和单步执行、调用栈、变量查看以及在暂停的帧中对表达式求值。
+//
+// 程序只有一个线程，执行是同步的：continue 和单步请求的响应发出之后，
+// 适配器一直等到程序暂停或者结束才处理下一条请求，所以不支持 pause。
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/debug"
+	"interpreter/evaluator"
+	"interpreter/internal/transport"
+	"interpreter/lexer"
+	"interpreter/object"
+	"interpreter/parser"
+	"interpreter/vm"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// threadID 是唯一一个线程的编号
+const threadID = 1
+
+var (
+	errNotLaunched = errors.New("the program has not been launched")
+	errNotPaused   = errors.New("the program is not paused")
+)
+
+type handler func(s *Server, args json.RawMessage) (interface{}, error)
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"initialize":              (*Server).initialize,
+		"launch":                  (*Server).launch,
+		"setBreakpoints":          (*Server).setBreakpoints,
+		"setFunctionBreakpoints":  (*Server).setFunctionBreakpoints,
+		"setExceptionBreakpoints": (*Server).setExceptionBreakpoints,
+		"configurationDone":       (*Server).configurationDone,
+		"threads":                 (*Server).threads,
+		"stackTrace":              (*Server).stackTrace,
+		"scopes":                  (*Server).scopes,
+		"variables":               (*Server).variables,
+		"evaluate":                (*Server).evaluate,
+		"continue":                resume("continue"),
+		"next":                    resume("next"),
+		"stepIn":                  resume("stepIn"),
+		"stepOut":                 resume("stepOut"),
+		"disconnect":              (*Server).disconnect,
+	}
+}
+
+// scopeRef 是 scopes 返回的变量引用，global 为 false 时表示第 frame 帧的局部变量
+type scopeRef struct {
+	frame  int
+	global bool
+}
+
+// Server 一次处理一条请求，同一时间只调试一个程序
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	mu  sync.Mutex
+	seq int
+	// err 是第一次写出消息失败的原因
+	err error
+
+	path   string
+	engine engine
+	// statements 和 functions 是程序中语句所在的行和函数名，用来验证断点
+	statements  map[int]bool
+	functions   map[string]bool
+	stopOnEntry bool
+	noDebug     bool
+
+	breakLines     []int
+	breakFunctions []string
+
+	paused bool
+	// refs 保存暂停期间分配的变量引用，引用 n 对应 refs[n-1]，继续执行后全部失效
+	refs []interface{}
+	// after 在当前请求的响应发出之后执行，用来发送事件或者开始执行程序
+	after        func()
+	disconnected bool
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{in: bufio.NewReader(in), out: out}
+}
+
+// Run 处理请求直到收到 disconnect 或者输入结束，返回的错误表示读写消息失败
+func (s *Server) Run() error {
+	defer s.close()
+	for !s.disconnected {
+		body, err := transport.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return fmt.Errorf("invalid message: %s", err)
+		}
+		s.handle(&req)
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return nil
+}
+
+// close 中止还在调试的程序
+func (s *Server) close() {
+	if s.engine != nil {
+		s.engine.Close()
+		s.engine = nil
+	}
+}
+
+func (s *Server) handle(req *request) {
+	h, ok := handlers[req.Command]
+	if !ok {
+		s.respond(req, nil, fmt.Errorf("unsupported command %s", req.Command))
+		return
+	}
+	body, err := h(s, req.Arguments)
+	s.respond(req, body, err)
+	if after := s.after; after != nil {
+		s.after = nil
+		after()
+	}
+}
+
+// message 是要发出的响应或事件，发出时才分配序号
+type message interface {
+	setSeq(seq int)
+}
+
+func (r *response) setSeq(seq int) { r.Seq = seq }
+func (e *event) setSeq(seq int)    { e.Seq = seq }
+
+// send 写出一条消息。put 的输出在执行程序的 goroutine 中发出，所以需要加锁
+func (s *Server) send(msg message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	msg.setSeq(s.seq)
+	if s.err == nil {
+		s.err = transport.WriteMessage(s.out, msg)
+	}
+}
+
+func (s *Server) respond(req *request, body interface{}, err error) {
+	resp := &response{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+		resp.Body = nil
+	}
+	s.send(resp)
+}
+
+func (s *Server) emit(name string, body interface{}) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+// outputWriter 把 put 的输出作为 output 事件发给客户端
+type outputWriter struct {
+	s *Server
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.s.emit("output", OutputEvent{Category: "stdout", Output: string(p)})
+	return len(p), nil
+}
+
+func decode(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, v)
+}
+
+func (s *Server) initialize(args json.RawMessage) (interface{}, error) {
+	return Capabilities{
+		SupportsConfigurationDoneRequest: true,
+		SupportsFunctionBreakpoints:      true,
+		SupportsEvaluateForHovers:        true,
+	}, nil
+}
+
+// launch 加载程序，程序在 configurationDone 之后才开始执行
+func (s *Server) launch(raw json.RawMessage) (interface{}, error) {
+	var args LaunchArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	if s.engine != nil {
+		return nil, errors.New("a program has already been launched")
+	}
+	if args.Program == "" {
+		return nil, errors.New("missing program")
+	}
+	data, err := ioutil.ReadFile(args.Program)
+	if err != nil {
+		return nil, err
+	}
+	program, err := parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", args.Program, err)
+	}
+	statements, functions := collect(program)
+
+	switch args.Engine {
+	case "", "vm":
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			return nil, fmt.Errorf("%s: compile error: %s", args.Program, err)
+		}
+		machine := vm.New(comp.ByteCode())
+		machine.SetOutput(outputWriter{s})
+		d := vm.NewDebugger(machine)
+		d.SetGlobalNames(comp.SymbolTable())
+		s.engine = d
+	case "eval":
+		macroEnv := object.NewEnvironment()
+		evaluator.DefineMacros(program, macroEnv)
+		expanded, err := evaluator.ExpandMacro(program, macroEnv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", args.Program, err)
+		}
+		e := evaluator.New()
+		e.Out = outputWriter{s}
+		d := evaluator.NewDebugger(e, expanded.(*ast.Program), object.NewEnvironment())
+		s.engine = d
+	default:
+		return nil, fmt.Errorf("unknown engine %q, want vm or eval", args.Engine)
+	}
+	s.path = args.Program
+	s.statements = statements
+	s.functions = functions
+	s.stopOnEntry = args.StopOnEntry
+	s.noDebug = args.NoDebug
+	s.applyBreakpoints()
+	// 程序加载之后才能验证断点，所以这时才请客户端发送配置
+	s.after = func() { s.emit("initialized", nil) }
+	return nil, nil
+}
+
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors: %s", strings.Join(p.Errors(), "; "))
+	}
+	return program, nil
+}
+
+// collector 记录语句所在的行和 let 绑定的函数名
+type collector struct {
+	statements map[int]bool
+	functions  map[string]bool
+}
+
+func (c *collector) Visit(node ast.Node) ast.Visitor {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		c.statements[node.Token.Line] = true
+	case *ast.ReturnStatement:
+		c.statements[node.Token.Line] = true
+	case *ast.ExpressionStatement:
+		c.statements[node.Token.Line] = true
+	case *ast.FunctionLiteral:
+		if node.Name != "" {
+			c.functions[node.Name] = true
+		}
+	}
+	return c
+}
+
+func collect(program *ast.Program) (statements map[int]bool, functions map[string]bool) {
+	c := &collector{statements: map[int]bool{}, functions: map[string]bool{}}
+	ast.Walk(c, program)
+	return c.statements, c.functions
+}
+
+// setBreakpoints 替换程序中的所有行断点，没有语句的行上的断点不生效
+func (s *Server) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args SetBreakpointsArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	breakpoints := []Breakpoint{}
+	if s.path != "" && filepath.Clean(args.Source.Path) != filepath.Clean(s.path) {
+		for _, bp := range args.Breakpoints {
+			breakpoints = append(breakpoints, Breakpoint{Line: bp.Line, Message: "not the launched program"})
+		}
+		return BreakpointsResponse{Breakpoints: breakpoints}, nil
+	}
+	s.breakLines = nil
+	for _, bp := range args.Breakpoints {
+		verified := s.statements == nil || s.statements[bp.Line]
+		b := Breakpoint{Verified: verified, Line: bp.Line}
+		if verified {
+			s.breakLines = append(s.breakLines, bp.Line)
+		} else {
+			b.Message = "no statement on this line"
+		}
+		breakpoints = append(breakpoints, b)
+	}
+	s.applyBreakpoints()
+	return BreakpointsResponse{Breakpoints: breakpoints}, nil
+}
+
+// setFunctionBreakpoints 替换所有函数断点
+func (s *Server) setFunctionBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var args SetFunctionBreakpointsArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	breakpoints := []Breakpoint{}
+	s.breakFunctions = nil
+	for _, bp := range args.Breakpoints {
+		verified := s.functions == nil || s.functions[bp.Name]
+		b := Breakpoint{Verified: verified}
+		if verified {
+			s.breakFunctions = append(s.breakFunctions, bp.Name)
+		} else {
+			b.Message = fmt.Sprintf("no function named %s", bp.Name)
+		}
+		breakpoints = append(breakpoints, b)
+	}
+	s.applyBreakpoints()
+	return BreakpointsResponse{Breakpoints: breakpoints}, nil
+}
+
+// applyBreakpoints 让调试器的断点与客户端设置的一致，noDebug 时不设置任何断点
+func (s *Server) applyBreakpoints() {
+	if s.engine == nil {
+		return
+	}
+	lines, functions := s.engine.Breakpoints()
+	for _, line := range lines {
+		s.engine.ClearBreakpoint(line)
+	}
+	for _, name := range functions {
+		s.engine.ClearFunctionBreakpoint(name)
+	}
+	if s.noDebug {
+		return
+	}
+	for _, line := range s.breakLines {
+		s.engine.SetBreakpoint(line)
+	}
+	for _, name := range s.breakFunctions {
+		s.engine.SetFunctionBreakpoint(name)
+	}
+}
+
+// setExceptionBreakpoints 没有可以设置的选项，只是为了让客户端的配置流程完整
+func (s *Server) setExceptionBreakpoints(raw json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+// configurationDone 开始执行程序，stopOnEntry 时停在第一条语句
+func (s *Server) configurationDone(raw json.RawMessage) (interface{}, error) {
+	if s.engine == nil {
+		return nil, errNotLaunched
+	}
+	if s.engine.Exited() || s.paused {
+		return nil, errors.New("the program is already running")
+	}
+	if s.stopOnEntry && !s.noDebug {
+		s.after = func() { s.run("stepIn", "entry") }
+	} else {
+		s.after = func() { s.run("continue", "") }
+	}
+	return nil, nil
+}
+
+// resume 返回 continue、next、stepIn 和 stepOut 的处理函数，响应发出之后才继续执行
+func resume(command string) handler {
+	return func(s *Server, raw json.RawMessage) (interface{}, error) {
+		if !s.paused {
+			return nil, errNotPaused
+		}
+		s.after = func() { s.run(command, "") }
+		if command == "continue" {
+			return ContinueResponse{AllThreadsContinued: true}, nil
+		}
+		return nil, nil
+	}
+}
+
+// run 执行到下一次暂停，发出 stopped 事件；程序结束时发出 exited 和 terminated 事件。
+// reason 不为空时代替调试器给出的暂停原因
+func (s *Server) run(command, reason string) {
+	s.paused = false
+	s.refs = nil
+	st := runCommand(s.engine, command)
+	if st.Reason != debug.StopExit {
+		s.paused = true
+		if reason == "" {
+			reason = stopReason(st.Reason)
+		}
+		s.emit("stopped", StoppedEvent{Reason: reason, ThreadID: threadID, AllThreadsStopped: true})
+		return
+	}
+	exitCode := 0
+	if st.Err != nil {
+		exitCode = 1
+		s.emit("output", OutputEvent{Category: "stderr", Output: fmt.Sprintf("runtime error: %s\n", st.Err)})
+	}
+	s.emit("exited", ExitedEvent{ExitCode: exitCode})
+	s.emit("terminated", nil)
+}
+
+func (s *Server) threads(raw json.RawMessage) (interface{}, error) {
+	return ThreadsResponse{Threads: []Thread{{ID: threadID, Name: "main"}}}, nil
+}
+
+// stackTrace 返回调用栈，帧的编号从 1 开始，1 是最内层的帧
+func (s *Server) stackTrace(raw json.RawMessage) (interface{}, error) {
+	var args StackTraceArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	frames := s.engine.Frames()
+	source := &Source{Name: filepath.Base(s.path), Path: s.path}
+	stackFrames := []StackFrame{}
+	for i, f := range frames {
+		if i < args.StartFrame || args.Levels > 0 && i >= args.StartFrame+args.Levels {
+			continue
+		}
+		stackFrames = append(stackFrames, StackFrame{ID: i + 1, Name: f.Function, Source: source, Line: f.Line, Column: 1})
+	}
+	return StackTraceResponse{StackFrames: stackFrames, TotalFrames: len(frames)}, nil
+}
+
+// frameIndex 把帧的编号转换成调试器使用的下标
+func (s *Server) frameIndex(id int) (int, error) {
+	if !s.paused {
+		return 0, errNotPaused
+	}
+	if id < 1 || id > len(s.engine.Frames()) {
+		return 0, fmt.Errorf("invalid frame %d", id)
+	}
+	return id - 1, nil
+}
+
+func (s *Server) scopes(raw json.RawMessage) (interface{}, error) {
+	var args ScopesArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	index, err := s.frameIndex(args.FrameID)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []Scope
+	// 最外层的帧是主程序，它只有全局变量
+	if index < len(s.engine.Frames())-1 {
+		scopes = append(scopes, Scope{Name: "Locals", VariablesReference: s.reference(scopeRef{frame: index})})
+	}
+	scopes = append(scopes, Scope{Name: "Globals", VariablesReference: s.reference(scopeRef{global: true})})
+	return ScopesResponse{Scopes: scopes}, nil
+}
+
+// reference 为作用域或者数组、哈希表分配一个变量引用
+func (s *Server) reference(v interface{}) int {
+	s.refs = append(s.refs, v)
+	return len(s.refs)
+}
+
+func (s *Server) variables(raw json.RawMessage) (interface{}, error) {
+	var args VariablesArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	if args.VariablesReference < 1 || args.VariablesReference > len(s.refs) {
+		return nil, fmt.Errorf("invalid variables reference %d", args.VariablesReference)
+	}
+	vars := []Variable{}
+	switch ref := s.refs[args.VariablesReference-1].(type) {
+	case scopeRef:
+		list := s.engine.Globals()
+		if !ref.global {
+			list = s.engine.Locals(ref.frame)
+		}
+		for _, v := range list {
+			vars = append(vars, s.variable(v.Name, v.Value))
+		}
+	case *object.Array:
+		for i, element := range ref.Element {
+			vars = append(vars, s.variable(fmt.Sprintf("[%d]", i), element))
+		}
+	case *object.Hash:
+		for _, pair := range ref.Pairs() {
+			vars = append(vars, s.variable(display(pair.Key), pair.Value))
+		}
+	}
+	return VariablesResponse{Variables: vars}, nil
+}
+
+// variable 描述一个值，非空的数组和哈希表可以展开
+func (s *Server) variable(name string, value object.Object) Variable {
+	return Variable{
+		Name:               name,
+		Value:              display(value),
+		Type:               typeName(value),
+		VariablesReference: s.children(value),
+	}
+}
+
+func (s *Server) children(value object.Object) int {
+	switch value := value.(type) {
+	case *object.Array:
+		if len(value.Element) > 0 {
+			return s.reference(value)
+		}
+	case *object.Hash:
+		if value.Len() > 0 {
+			return s.reference(value)
+		}
+	}
+	return 0
+}
+
+// evaluate 在暂停的帧中对表达式求值，没有指定帧时使用最内层的帧
+func (s *Server) evaluate(raw json.RawMessage) (interface{}, error) {
+	var args EvaluateArguments
+	if err := decode(raw, &args); err != nil {
+		return nil, err
+	}
+	if !s.paused {
+		return nil, errNotPaused
+	}
+	index := 0
+	if args.FrameID != nil {
+		var err error
+		if index, err = s.frameIndex(*args.FrameID); err != nil {
+			return nil, err
+		}
+	}
+	program, err := parse(args.Expression)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.engine.Evaluate(index, program)
+	if err != nil {
+		return nil, err
+	}
+	return EvaluateResponse{Result: display(value), Type: typeName(value), VariablesReference: s.children(value)}, nil
+}
+
+// disconnect 中止程序并结束会话
+func (s *Server) disconnect(raw json.RawMessage) (interface{}, error) {
+	s.close()
+	s.paused = false
+	s.disconnected = true
+	return nil, nil
+}
+
+// display 返回值在调试器中的显示形式，字符串带引号，函数只显示参数
+func display(obj object.Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "null"
+	case *object.String:
+		return strconv.Quote(obj.Value)
+	case *object.Array:
+		elements := make([]string, len(obj.Element))
+		for i, e := range obj.Element {
+			elements[i] = display(e)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.Hash:
+		var pairs []string
+		for _, pair := range obj.Pairs() {
+			pairs = append(pairs, display(pair.Key)+": "+display(pair.Value))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case *object.Function:
+		params := make([]string, len(obj.Parameters))
+		for i, p := range obj.Parameters {
+			params[i] = p.Value
+		}
+		return "fn(" + strings.Join(params, ", ") + ")"
+	case *object.Closure:
+		return displayCompiled(obj.Fn)
+	case *object.CompiledFunction:
+		return displayCompiled(obj)
+	}
+	return obj.Inspect()
+}
+
+func displayCompiled(fn *object.CompiledFunction) string {
+	if len(fn.LocalNames) < fn.NumParameters {
+		return "fn(...)"
+	}
+	return "fn(" + strings.Join(fn.LocalNames[:fn.NumParameters], ", ") + ")"
+}
+
+func typeName(obj object.Object) string {
+	if obj == nil {
+		return string(object.NULL_OBJ)
+	}
+	return string(obj.Type())
+}
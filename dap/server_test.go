@@ -0,0 +1,153 @@
+package dap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"interpreter/internal/transport"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected messages in testdata/*.txt")
+
+// step 是记录中的一条请求和适配器处理它时发出的所有消息
+type step struct {
+	comments []string
+	request  string
+	replies  []string
+}
+
+// readTranscript 解析记录文件。"->" 开头的行是客户端的请求，
+// 之后 "<-" 开头的行是适配器按顺序发出的响应和事件，"#" 开头的行是注释
+func readTranscript(t *testing.T, path string) []*step {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []*step
+	var comments []string
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "-> "):
+			steps = append(steps, &step{comments: comments, request: line[3:]})
+			comments = nil
+		case strings.HasPrefix(line, "<- "):
+			if len(steps) == 0 {
+				t.Fatalf("%s: reply before the first request", path)
+			}
+			s := steps[len(steps)-1]
+			s.replies = append(s.replies, line[3:])
+		case strings.TrimSpace(line) != "":
+			comments = append(comments, line)
+		}
+	}
+	return steps
+}
+
+func writeTranscript(t *testing.T, path string, steps []*step) {
+	var out bytes.Buffer
+	for _, s := range steps {
+		for _, c := range s.comments {
+			fmt.Fprintln(&out, c)
+		}
+		fmt.Fprintf(&out, "-> %s\n", s.request)
+		for _, r := range s.replies {
+			fmt.Fprintf(&out, "<- %s\n", r)
+		}
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replay 把请求逐条交给适配器，返回每条请求对应的输出
+func replay(t *testing.T, steps []*step) [][]string {
+	var output bytes.Buffer
+	s := NewServer(strings.NewReader(""), &output)
+	defer s.close()
+	var actual [][]string
+	for _, st := range steps {
+		var req request
+		if err := json.Unmarshal([]byte(st.request), &req); err != nil {
+			t.Fatalf("invalid request %s: %s", st.request, err)
+		}
+		s.handle(&req)
+		var replies []string
+		r := bufio.NewReader(&output)
+		for {
+			body, err := transport.ReadMessage(r)
+			if err != nil {
+				break
+			}
+			replies = append(replies, string(body))
+		}
+		output.Reset()
+		actual = append(actual, replies)
+	}
+	return actual
+}
+
+func sameJSON(a, b string) bool {
+	var x, y interface{}
+	if json.Unmarshal([]byte(a), &x) != nil || json.Unmarshal([]byte(b), &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestTranscripts(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.txt")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no transcripts: %v", err)
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			steps := readTranscript(t, path)
+			actual := replay(t, steps)
+			if *update {
+				for i, s := range steps {
+					s.replies = actual[i]
+				}
+				writeTranscript(t, path, steps)
+				return
+			}
+			for i, s := range steps {
+				if len(s.replies) != len(actual[i]) {
+					t.Fatalf("request %s: expected %d messages, got %d:\n%s",
+						s.request, len(s.replies), len(actual[i]), strings.Join(actual[i], "\n"))
+				}
+				for j, want := range s.replies {
+					if !sameJSON(want, actual[i][j]) {
+						t.Errorf("request %s: wrong message.\nwant=%s\ngot= %s", s.request, want, actual[i][j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	var input, output bytes.Buffer
+	for i, command := range []string{"initialize", "disconnect", "threads"} {
+		transport.WriteMessage(&input, map[string]interface{}{"seq": i + 1, "type": "request", "command": command})
+	}
+	if err := NewServer(&input, &output).Run(); err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+	// disconnect 之后的请求不再处理
+	if n := strings.Count(output.String(), "Content-Length"); n != 2 {
+		t.Errorf("expected 2 responses, got=%d:\n%s", n, output.String())
+	}
+
+	input.Reset()
+	input.WriteString("Content-Length: 5\r\n\r\nnope!")
+	if err := NewServer(&input, &output).Run(); err == nil {
+		t.Errorf("expected an error for an invalid message")
+	}
+}
@@ -0,0 +1,3 @@
+let x = 0;
+put("dividing");
+10 / x
@@ -0,0 +1,8 @@
+let scale = 10;
+let add = fn(a, b) {
+    let sum = a + b;
+    sum * scale
+};
+let items = [1, "two", {"k": add}];
+put(add(1, 2));
+add(3, 4)
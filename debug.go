@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"interpreter/compiler"
+	"interpreter/debug"
+	"interpreter/object"
+	"interpreter/vm"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `Commands:
+  break|b LINE|NAME     stop at a source line or when entering a function
+  clear LINE|NAME       remove a breakpoint
+  breakpoints           list breakpoints
+  continue|c            run until the next breakpoint
+  step|s                run to the next statement, entering calls
+  next|n                run to the next statement in the current function
+  out|o                 run until the current function returns
+  backtrace|bt          show the call stack
+  locals [FRAME]        show the variables of a frame, 0 is the innermost
+  globals               show the global variables
+  print|p NAME          show the value of a variable
+  stack                 show the operand stack
+  list|l                show the source around the current line
+  help|h                show this help
+  quit|q                stop debugging
+`
+
+// debugCommand 在虚拟机上以交互方式调试一个 .mk 脚本，脚本出错时返回 exitError
+func debugCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("debug", stderr)
+	files, ok := parseFlags(fs, args)
+	if !ok {
+		return exitUsage
+	}
+	// 命令从标准输入读取，所以脚本不能来自标准输入
+	if len(files) != 1 || files[0] == "-" || strings.HasSuffix(files[0], ".mbc") {
+		fmt.Fprintf(stderr, "debug: expected exactly one .mk file\n")
+		return exitUsage
+	}
+	name := files[0]
+	data, err := readInput(name, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+	program, err := parse(string(data))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return exitError
+	}
+	// 不做优化，让每条语句都有对应的指令
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(stderr, "%s: compile error: %s\n", name, err)
+		return exitError
+	}
+	machine := vm.New(comp.ByteCode())
+	machine.SetOutput(stdout)
+	d := vm.NewDebugger(machine)
+	defer d.Close()
+	d.SetGlobalNames(comp.SymbolTable())
+
+	s := &debugSession{
+		debugger: d,
+		source:   strings.Split(string(data), "\n"),
+		out:      stdout,
+	}
+	fmt.Fprintf(stdout, "Debugging %s. Type help for a list of commands.\n", name)
+	scanner := bufio.NewScanner(stdin)
+	for {
+		fmt.Fprint(stdout, "(debug) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(stdout)
+			break
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "q" {
+			break
+		}
+		s.execute(fields[0], fields[1:])
+	}
+	return s.status()
+}
+
+type debugSession struct {
+	debugger *vm.Debugger
+	source   []string
+	out      io.Writer
+	// stop 是最近一次暂停，running 表示程序已经开始并且还没有结束
+	stop    debug.Stop
+	running bool
+}
+
+func (s *debugSession) status() int {
+	if s.debugger.Exited() && s.stop.Err != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+func (s *debugSession) execute(command string, args []string) {
+	d := s.debugger
+	switch command {
+	case "break", "b", "clear":
+		if len(args) != 1 {
+			fmt.Fprintf(s.out, "usage: %s LINE|NAME\n", command)
+			return
+		}
+		line, err := strconv.Atoi(args[0])
+		switch {
+		case err == nil && command == "clear":
+			d.ClearBreakpoint(line)
+		case err == nil:
+			d.SetBreakpoint(line)
+			fmt.Fprintf(s.out, "breakpoint at line %d\n", line)
+		case command == "clear":
+			d.ClearFunctionBreakpoint(args[0])
+		default:
+			d.SetFunctionBreakpoint(args[0])
+			fmt.Fprintf(s.out, "breakpoint at function %s\n", args[0])
+		}
+	case "breakpoints":
+		lines, functions := d.Breakpoints()
+		for _, line := range lines {
+			fmt.Fprintf(s.out, "line %d\n", line)
+		}
+		for _, name := range functions {
+			fmt.Fprintf(s.out, "function %s\n", name)
+		}
+	case "continue", "c":
+		s.resume(d.Continue)
+	case "step", "s":
+		s.resume(d.StepInto)
+	case "next", "n":
+		s.resume(d.StepOver)
+	case "out", "o":
+		s.resume(d.StepOut)
+	case "backtrace", "bt":
+		if s.paused() {
+			for i, f := range d.Frames() {
+				fmt.Fprintf(s.out, "#%d %s at line %d\n", i, f.Function, f.Line)
+			}
+		}
+	case "locals":
+		frame := 0
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				fmt.Fprintf(s.out, "invalid frame %q\n", args[0])
+				return
+			}
+			frame = n
+		}
+		if s.paused() {
+			s.variables(d.Locals(frame))
+		}
+	case "globals":
+		if s.paused() {
+			s.variables(d.Globals())
+		}
+	case "print", "p":
+		if len(args) != 1 {
+			fmt.Fprintf(s.out, "usage: print NAME\n")
+			return
+		}
+		if !s.paused() {
+			return
+		}
+		if value, ok := d.Lookup(0, args[0]); ok {
+			fmt.Fprintf(s.out, "%s = %s\n", args[0], inspect(value))
+		} else {
+			fmt.Fprintf(s.out, "no variable named %s\n", args[0])
+		}
+	case "stack":
+		if s.paused() {
+			stack := d.Stack()
+			for i := len(stack) - 1; i >= 0; i-- {
+				fmt.Fprintf(s.out, "[%d] %s\n", i, inspect(stack[i]))
+			}
+		}
+	case "list", "l":
+		if s.paused() {
+			s.list(s.stop.Line, 2)
+		}
+	case "help", "h":
+		fmt.Fprint(s.out, debugHelp)
+	default:
+		fmt.Fprintf(s.out, "unknown command %q, type help for a list of commands\n", command)
+	}
+}
+
+// paused 判断程序是否停在某个位置，不是时打印原因
+func (s *debugSession) paused() bool {
+	if s.running {
+		return true
+	}
+	if s.debugger.Exited() {
+		fmt.Fprintln(s.out, "the program has exited")
+	} else {
+		fmt.Fprintln(s.out, "the program is not running, use continue, step or next to start it")
+	}
+	return false
+}
+
+func (s *debugSession) resume(command func() debug.Stop) {
+	if s.debugger.Exited() {
+		fmt.Fprintln(s.out, "the program has exited")
+		return
+	}
+	s.show(command())
+}
+
+func (s *debugSession) show(stop debug.Stop) {
+	s.stop = stop
+	s.running = stop.Reason != debug.StopExit
+	switch {
+	case s.running:
+		fmt.Fprintf(s.out, "stopped in %s at line %d (%s)\n", stop.Function, stop.Line, stop.Reason)
+		s.list(stop.Line, 0)
+	case stop.Err != nil:
+		fmt.Fprintf(s.out, "program exited with error: %s\n", stop.Err)
+	default:
+		fmt.Fprintf(s.out, "program exited: %s\n", inspect(stop.Result))
+	}
+}
+
+// list 打印 line 前后各 context 行源码，当前行用 => 标出
+func (s *debugSession) list(line, context int) {
+	if line == 0 {
+		return
+	}
+	for n := line - context; n <= line+context; n++ {
+		if n < 1 || n > len(s.source) {
+			continue
+		}
+		marker := "  "
+		if n == line {
+			marker = "=>"
+		}
+		fmt.Fprintf(s.out, "%s %4d  %s\n", marker, n, strings.TrimRight(s.source[n-1], "\r"))
+	}
+}
+
+func (s *debugSession) variables(vars []debug.Variable) {
+	for _, v := range vars {
+		fmt.Fprintf(s.out, "%s = %s\n", v.Name, inspect(v.Value))
+	}
+}
+
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return "null"
+	}
+	return obj.Inspect()
+}
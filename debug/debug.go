@@ -0,0 +1,242 @@
+// Package debug 是求值器和虚拟机的调试器共用的部分：暂停的结果、调用栈和变量的类型，
+// 以及断点、单步命令和执行程序的 goroutine 之间的交接。
+// 两种引擎的 Debugger 嵌入 Controller，只负责在自己的执行过程中调用 ShouldStop 和 Pause，
+// 以及在暂停时检查调用栈和变量。
+package debug
+
+import (
+	"errors"
+	"interpreter/object"
+	"sort"
+)
+
+// ErrClosed 表示执行被 Debugger.Close 中止
+var ErrClosed = errors.New("debugger closed")
+
+// EvaluateSteps 限制暂停时 Evaluate 执行的步数，避免表达式中的死循环卡住调试器
+const EvaluateSteps = 1000000
+
+// StopReason 说明程序为什么暂停
+type StopReason int
+
+const (
+	// StopBreakpoint 表示执行到了设置断点的行
+	StopBreakpoint StopReason = iota
+	// StopFunction 表示进入了设置断点的函数
+	StopFunction
+	// StopStep 表示单步执行完成
+	StopStep
+	// StopExit 表示程序已经结束，不能再继续执行
+	StopExit
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopFunction:
+		return "function breakpoint"
+	case StopStep:
+		return "step"
+	default:
+		return "exit"
+	}
+}
+
+// Stop 描述一次暂停，Line 为 0 表示没有行号信息
+type Stop struct {
+	Reason   StopReason
+	Function string
+	Line     int
+	// Result 和 Err 只在 StopExit 时有意义，是程序的结果和出错的原因
+	Result object.Object
+	Err    error
+}
+
+// FrameInfo 是调用栈中的一帧
+type FrameInfo struct {
+	Function string
+	Line     int
+	// Offset 是正在执行的指令在函数中的位置，只有虚拟机设置
+	Offset int
+}
+
+// Variable 是一个有名字的值
+type Variable struct {
+	Name  string
+	Value object.Object
+}
+
+type stepMode int
+
+const (
+	runToBreakpoint stepMode = iota
+	stepInto
+	stepOver
+	stepOut
+)
+
+// Controller 保存断点和单步状态，程序在单独的 goroutine 中运行，暂停时等待下一条命令。
+// Controller 的方法不能并发调用
+type Controller struct {
+	lines     map[int]bool
+	functions map[string]bool
+
+	// callDepth 返回引擎当前调用栈的深度，主程序为 1
+	callDepth func() int
+	// run 执行整个程序，返回 StopExit
+	run func() Stop
+
+	mode stepMode
+	// depth 是开始单步时调用栈的深度
+	depth int
+
+	started bool
+	exited  bool
+	closed  bool
+	last    Stop
+	resume  chan struct{}
+	stops   chan Stop
+}
+
+// NewController 创建一个 Controller，callDepth 返回引擎当前调用栈的深度，
+// run 在第一次执行命令时在新的 goroutine 中调用，执行整个程序
+func NewController(callDepth func() int, run func() Stop) *Controller {
+	return &Controller{
+		lines:     map[int]bool{},
+		functions: map[string]bool{},
+		callDepth: callDepth,
+		run:       run,
+		resume:    make(chan struct{}),
+		stops:     make(chan Stop),
+	}
+}
+
+// SetBreakpoint 在源码的第 line 行设置断点
+func (c *Controller) SetBreakpoint(line int) {
+	c.lines[line] = true
+}
+
+func (c *Controller) ClearBreakpoint(line int) {
+	delete(c.lines, line)
+}
+
+// SetFunctionBreakpoint 在进入名为 name 的函数时暂停，名字是定义函数的 let 绑定
+func (c *Controller) SetFunctionBreakpoint(name string) {
+	c.functions[name] = true
+}
+
+func (c *Controller) ClearFunctionBreakpoint(name string) {
+	delete(c.functions, name)
+}
+
+// Breakpoints 返回排好序的断点行号和函数名
+func (c *Controller) Breakpoints() (lines []int, functions []string) {
+	for line := range c.lines {
+		lines = append(lines, line)
+	}
+	for name := range c.functions {
+		functions = append(functions, name)
+	}
+	sort.Ints(lines)
+	sort.Strings(functions)
+	return lines, functions
+}
+
+// Continue 执行到下一个断点或者程序结束
+func (c *Controller) Continue() Stop {
+	return c.resumeWith(runToBreakpoint)
+}
+
+// StepInto 执行到下一条语句，遇到函数调用时进入函数
+func (c *Controller) StepInto() Stop {
+	return c.resumeWith(stepInto)
+}
+
+// StepOver 执行到当前函数的下一条语句，不在被调用的函数中暂停
+func (c *Controller) StepOver() Stop {
+	return c.resumeWith(stepOver)
+}
+
+// StepOut 执行到当前函数返回到调用者
+func (c *Controller) StepOut() Stop {
+	return c.resumeWith(stepOut)
+}
+
+// Exited 报告程序是否已经结束
+func (c *Controller) Exited() bool {
+	return c.exited
+}
+
+// Close 中止还没有结束的程序，程序以 ErrClosed 结束，之后的命令都返回这次结束的结果
+func (c *Controller) Close() {
+	if c.started && !c.exited {
+		c.closed = true
+		c.resume <- struct{}{}
+		c.last = <-c.stops
+		c.exited = true
+	}
+}
+
+func (c *Controller) resumeWith(mode stepMode) Stop {
+	if c.exited {
+		return c.last
+	}
+	c.mode = mode
+	c.depth = c.callDepth()
+	if c.started {
+		c.resume <- struct{}{}
+	} else {
+		c.started = true
+		go func() { c.stops <- c.run() }()
+	}
+	c.last = <-c.stops
+	if c.last.Reason == StopExit {
+		c.exited = true
+	}
+	return c.last
+}
+
+// ShouldStop 由引擎在执行之前调用，判断是否需要暂停。depth 是当前调用栈的深度，
+// entering 是刚刚进入、还没有执行任何语句的函数的名字，其他时候为空；
+// statement 表示这里是一条语句的开始，只在语句开始的位置检查断点和单步
+func (c *Controller) ShouldStop(depth int, entering string, line int, statement bool) (StopReason, bool) {
+	if entering != "" && depth > 1 && c.functions[entering] {
+		return StopFunction, true
+	}
+	switch c.mode {
+	case stepInto:
+		if statement || depth < c.depth {
+			return StopStep, true
+		}
+	case stepOver:
+		if statement && depth <= c.depth || depth < c.depth {
+			return StopStep, true
+		}
+	case stepOut:
+		if depth < c.depth {
+			return StopStep, true
+		}
+	}
+	if statement && c.lines[line] {
+		return StopBreakpoint, true
+	}
+	return 0, false
+}
+
+// Returned 由引擎在函数返回之后调用，depth 是返回之后调用栈的深度。
+// 单步执行时回到调用者就要暂停，这时调用者停在还没有执行完的语句中
+func (c *Controller) Returned(depth int) bool {
+	return c.mode != runToBreakpoint && depth < c.depth
+}
+
+// Pause 把 stop 交给等待命令结果的一方，阻塞到下一条命令。
+// 返回 ErrClosed 表示调试器已经关闭，引擎应该停止执行
+func (c *Controller) Pause(stop Stop) error {
+	c.stops <- stop
+	<-c.resume
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package debug
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShouldStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      stepMode
+		depth     int
+		entering  string
+		line      int
+		statement bool
+		reason    StopReason
+		stop      bool
+	}{
+		{"breakpoint", runToBreakpoint, 1, "", 3, true, StopBreakpoint, true},
+		{"breakpoint inside a statement", runToBreakpoint, 1, "", 3, false, 0, false},
+		{"no breakpoint", runToBreakpoint, 1, "", 4, true, 0, false},
+		{"function", runToBreakpoint, 2, "add", 9, true, StopFunction, true},
+		{"function name in main", runToBreakpoint, 1, "add", 9, true, 0, false},
+		{"step into a call", stepInto, 3, "", 9, true, StopStep, true},
+		{"step into returns", stepInto, 1, "", 9, false, StopStep, true},
+		{"step over skips calls", stepOver, 3, "", 9, true, 0, false},
+		{"step over next statement", stepOver, 2, "", 9, true, StopStep, true},
+		{"step over returns", stepOver, 1, "", 9, false, StopStep, true},
+		{"step out stays", stepOut, 2, "", 9, true, 0, false},
+		{"step out returns", stepOut, 1, "", 9, false, StopStep, true},
+	}
+	for _, tt := range tests {
+		c := NewController(nil, nil)
+		c.SetBreakpoint(3)
+		c.SetFunctionBreakpoint("add")
+		c.mode = tt.mode
+		c.depth = 2
+		reason, stop := c.ShouldStop(tt.depth, tt.entering, tt.line, tt.statement)
+		if stop != tt.stop || stop && reason != tt.reason {
+			t.Errorf("%s: want=%v %s, got=%v %s", tt.name, tt.stop, tt.reason, stop, reason)
+		}
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	c := NewController(nil, nil)
+	for _, line := range []int{7, 2, 5} {
+		c.SetBreakpoint(line)
+	}
+	c.ClearBreakpoint(5)
+	c.SetFunctionBreakpoint("b")
+	c.SetFunctionBreakpoint("a")
+	lines, functions := c.Breakpoints()
+	if !reflect.DeepEqual(lines, []int{2, 7}) || !reflect.DeepEqual(functions, []string{"a", "b"}) {
+		t.Errorf("wrong breakpoints. got=%v %v", lines, functions)
+	}
+}
+
+// 用一个假的引擎检查暂停、继续和关闭的交接
+func TestController(t *testing.T) {
+	var c *Controller
+	c = NewController(func() int { return 1 }, func() Stop {
+		for line := 1; line <= 3; line++ {
+			if _, ok := c.ShouldStop(1, "", line, true); ok {
+				if err := c.Pause(Stop{Reason: StopBreakpoint, Line: line}); err != nil {
+					return Stop{Reason: StopExit, Err: err}
+				}
+			}
+		}
+		return Stop{Reason: StopExit}
+	})
+	c.SetBreakpoint(2)
+	c.SetBreakpoint(3)
+	if stop := c.Continue(); stop.Reason != StopBreakpoint || stop.Line != 2 {
+		t.Fatalf("wrong stop. got=%+v", stop)
+	}
+	if stop := c.Continue(); stop.Reason != StopBreakpoint || stop.Line != 3 {
+		t.Fatalf("wrong stop. got=%+v", stop)
+	}
+	c.Close()
+	if stop := c.Continue(); !c.Exited() || stop.Reason != StopExit || stop.Err != ErrClosed {
+		t.Errorf("expected the program to be aborted, got=%+v", stop)
+	}
+}
@@ -0,0 +1,200 @@
+package evaluator
+
+import (
+	"errors"
+	"interpreter/ast"
+	"interpreter/debug"
+	"interpreter/object"
+)
+
+// debugFrame 记录一次函数调用，entered 表示还没有执行函数体中的任何语句
+type debugFrame struct {
+	name    string
+	env     *object.Environment
+	line    int
+	entered bool
+}
+
+// Debugger 控制求值器的执行，用法与 vm.Debugger 相同。程序在单独的 goroutine 中求值，
+// 在每条语句之前检查断点和单步条件，暂停时等待下一条命令。
+// 断点和单步命令由嵌入的 debug.Controller 提供，
+// Debugger 的方法不能并发调用，检查状态的方法只能在暂停时使用。
+type Debugger struct {
+	*debug.Controller
+	e       *Evaluator
+	program *ast.Program
+	env     *object.Environment
+	frames  []*debugFrame
+}
+
+// NewDebugger 准备在 env 中调试 program，之后用 Continue 或单步命令开始执行，
+// 执行期间不要再用 e 求值
+func NewDebugger(e *Evaluator, program *ast.Program, env *object.Environment) *Debugger {
+	d := &Debugger{
+		e:       e,
+		program: program,
+		env:     env,
+		frames:  []*debugFrame{{name: "<main>", env: env, entered: true}},
+	}
+	d.Controller = debug.NewController(func() int { return len(d.frames) }, d.run)
+	e.debugger = d
+	return d
+}
+
+// Close 中止还没有结束的程序，程序以 debug.ErrClosed 结束
+func (d *Debugger) Close() {
+	d.Controller.Close()
+	d.e.debugger = nil
+}
+
+func (d *Debugger) run() debug.Stop {
+	stop := debug.Stop{Reason: debug.StopExit}
+	result := d.e.Eval(d.program, d.env)
+	if errObj, ok := result.(*object.Error); ok {
+		stop.Err = errors.New(errObj.Message)
+		if d.e.halt != nil {
+			stop.Err = d.e.halt
+		}
+	} else {
+		stop.Result = result
+	}
+	return stop
+}
+
+// check 在 stmt 求值之前调用，需要暂停时阻塞到下一条命令
+func (d *Debugger) check(stmt ast.Statement) *object.Error {
+	frame := d.frames[len(d.frames)-1]
+	frame.line = statementLine(stmt)
+	entering := ""
+	if frame.entered {
+		entering = frame.name
+	}
+	frame.entered = false
+	// 求值器只在语句之前检查，所以总是语句的开始
+	reason, ok := d.ShouldStop(len(d.frames), entering, frame.line, true)
+	if !ok {
+		return nil
+	}
+	return d.pause(reason)
+}
+
+func (d *Debugger) pause(reason debug.StopReason) *object.Error {
+	frame := d.frames[len(d.frames)-1]
+	if err := d.Pause(debug.Stop{Reason: reason, Function: frame.name, Line: frame.line}); err != nil {
+		d.e.halt = err
+		return newError("%s", err)
+	}
+	return nil
+}
+
+// enter 在调用 fn 之前压入一帧，env 是函数体的环境
+func (d *Debugger) enter(fn *object.Function, env *object.Environment) {
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	d.frames = append(d.frames, &debugFrame{name: name, env: env, line: fn.Body.Token.Line, entered: true})
+}
+
+// leave 在函数返回之后弹出一帧，单步执行时回到调用者就暂停
+func (d *Debugger) leave() *object.Error {
+	d.frames = d.frames[:len(d.frames)-1]
+	if d.Returned(len(d.frames)) {
+		return d.pause(debug.StopStep)
+	}
+	return nil
+}
+
+// statementLine 返回语句的起始行
+func statementLine(stmt ast.Statement) int {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		return stmt.Token.Line
+	case *ast.ReturnStatement:
+		return stmt.Token.Line
+	case *ast.ExpressionStatement:
+		return stmt.Token.Line
+	}
+	return 0
+}
+
+// Frames 返回调用栈，最内层的帧在最前面
+func (d *Debugger) Frames() []debug.FrameInfo {
+	frames := make([]debug.FrameInfo, 0, len(d.frames))
+	for i := len(d.frames) - 1; i >= 0; i-- {
+		frames = append(frames, debug.FrameInfo{Function: d.frames[i].name, Line: d.frames[i].line})
+	}
+	return frames
+}
+
+// Globals 返回全局环境中的变量，按名字排列
+func (d *Debugger) Globals() []debug.Variable {
+	return variables(d.env, nil)
+}
+
+// Locals 返回第 frame 帧（0 是最内层）中的局部变量和闭包捕获的外层变量，
+// 内层的名字遮住外层的同名变量，主程序没有局部变量
+func (d *Debugger) Locals(frame int) []debug.Variable {
+	index := len(d.frames) - 1 - frame
+	if index <= 0 || index >= len(d.frames) {
+		return nil
+	}
+	var locals []debug.Variable
+	seen := map[string]bool{}
+	for env := d.frames[index].env; env != nil && env != d.env; env = env.Outer() {
+		locals = append(locals, variables(env, seen)...)
+	}
+	return locals
+}
+
+func variables(env *object.Environment, seen map[string]bool) []debug.Variable {
+	var vars []debug.Variable
+	for _, name := range env.Names() {
+		if seen[name] {
+			continue
+		}
+		if seen != nil {
+			seen[name] = true
+		}
+		value, _ := env.Get(name)
+		vars = append(vars, debug.Variable{Name: name, Value: value})
+	}
+	return vars
+}
+
+// Lookup 在第 frame 帧的环境中查找名字
+func (d *Debugger) Lookup(frame int, name string) (object.Object, bool) {
+	env := d.frameEnv(frame)
+	if env == nil {
+		return nil, false
+	}
+	return env.Get(name)
+}
+
+func (d *Debugger) frameEnv(frame int) *object.Environment {
+	index := len(d.frames) - 1 - frame
+	if index < 0 || index >= len(d.frames) {
+		return nil
+	}
+	return d.frames[index].env
+}
+
+// Evaluate 在第 frame 帧的环境中对 program 求值。program 中的 let 定义在新的内层作用域中，
+// 不会改变被调试的程序，但是通过内置函数修改数组等值的副作用会保留
+func (d *Debugger) Evaluate(frame int, program *ast.Program) (object.Object, error) {
+	env := d.frameEnv(frame)
+	if env == nil {
+		return nil, errors.New("no such frame")
+	}
+	e := New()
+	e.Limits.MaxSteps = debug.EvaluateSteps
+	e.Out = d.e.Out
+	result := e.Eval(program, object.NewEnclosedEnvironment(env))
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errors.New(errObj.Message)
+	}
+	if result == nil {
+		result = NULL
+	}
+	return result, nil
+}
@@ -1,39 +1,127 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"interpreter/ast"
 	"interpreter/object"
+	"interpreter/profile"
+	"io"
+	"os"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
+// ErrStepLimit 表示求值的节点数超过了 Limits.MaxSteps
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// Limits 限制一次求值使用的资源，零值表示不限制
+type Limits struct {
+	// MaxSteps 是最多求值的节点数
+	MaxSteps int
+	// MaxDepth 是函数调用的最大嵌套深度，超过时报告 stack overflow
+	MaxDepth int
+	// Context 被取消后求值会尽快停止
+	Context context.Context
+}
+
+// Evaluator 保存一次求值的状态。零值可以直接使用，
+// 同一个 Evaluator 不能在多个 goroutine 中同时使用。
+type Evaluator struct {
+	Limits Limits
+	// Tracer 不为 nil 时在每个节点求值的前后被调用
+	Tracer Tracer
+	// Profiler 不为 nil 时在每个节点求值之前记录所在的函数和行
+	Profiler *profile.Profiler
+	// Out 是 put 写出的位置，为 nil 时写到标准输出
+	Out io.Writer
+
+	steps int
+	depth int
+	// halt 记录超出限制或被取消的原因，之后的求值都会立即返回错误
+	halt error
+	// debugger 不为 nil 时每条语句求值之前都会询问它是否需要暂停
+	debugger *Debugger
+	// nodeDepth 是正在求值的节点的嵌套深度，只在跟踪时使用
+	nodeDepth int
+	// profileFrames 是性能分析使用的调用栈，只在设置了 Profiler 时使用
+	profileFrames []profileFrame
+}
+
+func New() *Evaluator {
+	return &Evaluator{}
+}
+
+// Eval 用一个没有任何限制的 Evaluator 对节点求值
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return New().Eval(node, env)
+}
+
+// Err 返回使求值停止的错误，例如 ErrStepLimit 或者 Context 的错误
+func (e *Evaluator) Err() error {
+	return e.halt
+}
+
+// step 在每个节点求值之前检查限制，每 1024 步检查一次 Context
+func (e *Evaluator) step() *object.Error {
+	if e.halt == nil {
+		e.steps++
+		if e.Limits.MaxSteps > 0 && e.steps > e.Limits.MaxSteps {
+			e.halt = ErrStepLimit
+		} else if e.Limits.Context != nil && e.steps%1024 == 0 {
+			e.halt = e.Limits.Context.Err()
+		}
+	}
+	if e.halt != nil {
+		return newError("%s", e.halt)
+	}
+	return nil
+}
+
+func (e *Evaluator) Eval(node ast.Node, env *object.Environment) object.Object {
+	if e.Tracer == nil {
+		return e.eval(node, env)
+	}
+	e.nodeDepth++
+	depth := e.nodeDepth
+	e.Tracer.EnterNode(node, depth)
+	result := e.eval(node, env)
+	e.Tracer.ExitNode(node, depth, result)
+	e.nodeDepth--
+	return result
+}
+
+func (e *Evaluator) eval(node ast.Node, env *object.Environment) object.Object {
+	if err := e.step(); err != nil {
+		return err
+	}
+	if e.Profiler != nil {
+		e.profile()
+	}
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node.Statements, env)
+		return e.evalProgram(node.Statements, env)
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.Eval(node.Expression, env)
 	case *ast.IntegerLiteral:
-		return &object.Integer{
-			Value: node.Value,
-		}
+		return object.NewInteger(node.Value)
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
+		right := e.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
+		left := e.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(node.Right, env)
+		right := e.Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
@@ -41,17 +129,17 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return e.evalIfExpression(node, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
+		val := e.Eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
+		val := e.Eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
@@ -65,24 +153,25 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			Parameters: params,
 			Body:       body,
 			Env:        env,
+			Name:       node.Name,
 		}
 	case *ast.CallExpression:
 		if node.Function.TokenLiteral() == "quote" {
-			return quote(node.Arguments[0], env)
+			return e.quote(node.Arguments[0], env)
 		}
-		function := Eval(node.Function, env)
+		function := e.Eval(node.Function, env)
 		if isError(function) {
 			return function
 		}
-		args := evalExpression(node.Arguments, env)
+		args := e.evalExpression(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args)
+		return e.applyFunction(function, args)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.ArrayLiteral:
-		elements := evalExpression(node.Elements, env)
+		elements := e.evalExpression(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
@@ -90,17 +179,17 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			Element: elements,
 		}
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
+		left := e.Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		index := Eval(node.Index, env)
+		index := e.Eval(node.Index, env)
 		if isError(index) {
 			return index
 		}
 		return evalIndexExpression(left, index)
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return e.evalHashLiteral(node, env)
 	}
 	return nil
 }
@@ -112,10 +201,18 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return FALSE
 }
 
-func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
+func (e *Evaluator) evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 	for _, stmt := range stmts {
-		result = Eval(stmt, env)
+		if e.debugger != nil {
+			if err := e.debugger.check(stmt); err != nil {
+				return err
+			}
+		}
+		if e.Profiler != nil {
+			e.profileStatement(stmt)
+		}
+		result = e.Eval(stmt, env)
 		//if resultValue, ok := result.(*object.ReturnValue); ok {
 		//	//fmt.Print(resultValue.Value.Inspect())
 		//	return resultValue.Value
@@ -130,10 +227,18 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	return result
 }
 
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (e *Evaluator) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 	for _, stmt := range block.Statements {
-		result = Eval(stmt, env)
+		if e.debugger != nil {
+			if err := e.debugger.check(stmt); err != nil {
+				return err
+			}
+		}
+		if e.Profiler != nil {
+			e.profileStatement(stmt)
+		}
+		result = e.Eval(stmt, env)
 		if result != nil {
 			rt := result.Type()
 			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
@@ -178,15 +283,14 @@ func evalArrayIndexExpression(left object.Object, index object.Object) object.Ob
 
 func evalHashIndexExpression(left object.Object, index object.Object) object.Object {
 	hashObject := left.(*object.Hash)
-	key, ok := index.(object.Hashable)
-	if !ok {
-		return newError("unusable as hash key: %s", index.Type())
+	value, ok, err := hashObject.Get(index)
+	if err != nil {
+		return newError("%s", err)
 	}
-	pair, ok := hashObject.Pairs[key.HashKey()]
 	if !ok {
 		return NULL
 	}
-	return pair.Value
+	return value
 }
 
 func evalBangOperatorExpression(right object.Object) object.Object {
@@ -206,7 +310,7 @@ func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
 		return newError("unknown operator: -%s", right.Type())
 	}
 	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	return object.NewInteger(-value)
 }
 
 func evalInfixExpression(operator string, left object.Object, right object.Object) object.Object {
@@ -231,13 +335,16 @@ func evalIntegerInfixExpression(operator string, left object.Object, right objec
 	rightVal := right.(*object.Integer).Value
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return object.NewInteger(leftVal + rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return object.NewInteger(leftVal - rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return object.NewInteger(leftVal * rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(leftVal / rightVal)
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
@@ -258,20 +365,28 @@ func evalStringInfixExpression(operator string, left object.Object, right object
 	switch operator {
 	case "+":
 		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
+func (e *Evaluator) evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := e.Eval(ie.Condition, env)
 	if isError(condition) {
 		return condition
 	}
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return e.Eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return e.Eval(ie.Alternative, env)
 	} else {
 		return NULL
 	}
@@ -305,7 +420,7 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 	if val, ok := env.Get(node.Value); ok {
 		return val
 	}
-	if builtin, ok := builtins[node.Value]; ok {
+	if builtin := object.GetBuiltinByName(node.Value); builtin != nil {
 		return builtin
 	}
 	//if !ok {
@@ -314,10 +429,10 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 	return newError("identifier not found: " + node.Value)
 }
 
-func evalExpression(exps []ast.Expression, env *object.Environment) []object.Object {
+func (e *Evaluator) evalExpression(exps []ast.Expression, env *object.Environment) []object.Object {
 	var results []object.Object
-	for _, e := range exps {
-		evaluated := Eval(e, env)
+	for _, exp := range exps {
+		evaluated := e.Eval(exp, env)
 		if isError(evaluated) {
 			return []object.Object{evaluated}
 		}
@@ -326,14 +441,64 @@ func evalExpression(exps []ast.Expression, env *object.Environment) []object.Obj
 	return results
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// Call 让内置函数通过 applyFunction 回调 Monkey 函数
+func (e *Evaluator) Call(fn object.Object, args ...object.Object) object.Object {
+	result := e.applyFunction(fn, args)
+	if result == nil {
+		return NULL
+	}
+	return result
+}
+
+// Output 实现 object.Caller
+func (e *Evaluator) Output() io.Writer {
+	if e.Out == nil {
+		return os.Stdout
+	}
+	return e.Out
+}
+
+// Apply 调用一个 Monkey 函数，与 Call 不同的是错误以 Go error 的形式返回
+func (e *Evaluator) Apply(fn object.Object, args ...object.Object) (object.Object, error) {
+	result := e.Call(fn, args...)
+	if e.halt != nil {
+		return nil, e.halt
+	}
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errors.New(errObj.Message)
+	}
+	return result, nil
+}
+
+func (e *Evaluator) applyFunction(fn object.Object, args []object.Object) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		if len(args) != len(fn.Parameters) {
+			return newError("wrong number of arguments: want=%d, got=%d",
+				len(fn.Parameters), len(args))
+		}
+		if e.Limits.MaxDepth > 0 && e.depth >= e.Limits.MaxDepth {
+			return newError("stack overflow")
+		}
+		e.depth++
+		defer func() { e.depth-- }()
 		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
+		if e.debugger != nil {
+			e.debugger.enter(fn, extendedEnv)
+		}
+		if e.Profiler != nil {
+			e.profileEnter(fn)
+			defer e.profileLeave()
+		}
+		evaluated := e.Eval(fn.Body, extendedEnv)
+		if e.debugger != nil {
+			if err := e.debugger.leave(); err != nil {
+				return err
+			}
+		}
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
-		return fn.Fn(args...)
+		return fn.Fn(e, args...)
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
@@ -357,31 +522,28 @@ func extendFunctionEnv(fn *object.Function, args []object.Object) *object.Enviro
 
 func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
-		return returnValue
+		return returnValue.Value
 	}
 	return obj
 }
 
-func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
-	for keyNode, valueNode := range node.Pairs {
-		key := Eval(keyNode, env)
+func (e *Evaluator) evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+	hash := object.NewHash()
+	for _, pairNode := range node.Pairs {
+		key := e.Eval(pairNode.Key, env)
 		if isError(key) {
 			return key
 		}
-		hashKey, ok := key.(object.Hashable)
-		if !ok {
-			return newError("unusable as hash key: %s", key.Type())
+		if _, err := object.HashKeyOf(key); err != nil {
+			return newError("%s", err)
 		}
-		value := Eval(valueNode, env)
+		value := e.Eval(pairNode.Value, env)
 		if isError(value) {
 			return value
 		}
-		hashed := hashKey.HashKey()
-		pairs[hashed] = object.HashPair{
-			Key:   key,
-			Value: value,
+		if err := hash.Set(key, value); err != nil {
+			return newError("%s", err)
 		}
 	}
-	return &object.Hash{Pairs: pairs}
+	return hash
 }
@@ -311,6 +311,79 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestStringComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`"a" == "a"`, true},
+		{`"a" == "b"`, false},
+		{`"a" != "b"`, true},
+		{`"a" != "a"`, false},
+		{`"a" < "b"`, true},
+		{`"b" < "a"`, false},
+		{`"abc" > "abb"`, true},
+		{`"" < "a"`, true},
+		{`"a" + "b" == "ab"`, true},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestStringBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`split("a,b,,c", ",")`, "[a, b, , c]"},
+		{`split("abc", "")`, "[a, b, c]"},
+		{`join(split("a b c", " "), "-")`, "a-b-c"},
+		{`trim("  monkey  ")`, "monkey"},
+		{`trim("xxmonkeyx", "x")`, "monkey"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`upper("Monkey")`, "MONKEY"},
+		{`lower("Monkey")`, "monkey"},
+		{`startsWith("monkey", "mon")`, "true"},
+		{`endsWith("monkey", "mon")`, "false"},
+		{`indexOf("monkey", "key")`, "3"},
+		{`indexOf("monkey", "x")`, "-1"},
+		{`indexOf([1, "a", [2]], [2])`, "2"},
+		{`substring("monkey", 3)`, "key"},
+		{`substring("monkey", 0, 3)`, "mon"},
+		// 下标和长度按字符计算
+		{`indexOf("héllo wörld", "wö")`, "6"},
+		{`substring("héllo wörld", 6)`, "wörld"},
+		{`substring("日本語", 1, 2)`, "本"},
+		{`len("日本語")`, "3"},
+		{`substring("日本語", 1, 4)`, "Error: substring bounds out of range: [1:4] with length 3"},
+		{`format("%s is %d years, %5.2s|%-4d|%x|%t|%q|%v|100%%", "bob", 42, "abc", 7, 255, true, "hi", [1, 2])`,
+			`bob is 42 years,    ab|7   |ff|true|"hi"|[1, 2]|100%`},
+		{`substring("monkey", 4, 10)`, "Error: substring bounds out of range: [4:10] with length 6"},
+		{`upper(1)`, "Error: arguments to `upper` must be STRING, got INTEGER"},
+		{`format("%d", "a")`, "Error: format: wrong type for %d: STRING"},
+		{`format("%d %d", 1)`, "Error: format: missing argument for %d"},
+		{`format("%d", 1, 2)`, "Error: format: 1 unused arguments"},
+		{`format("%z", 1)`, "Error: format: unknown verb %z"},
+		{`format("%999999999d", 1)`, "Error: format: width of %999999999d exceeds the limit of 1000"},
+		{`format("%.99999999999999999999s", "a")`,
+			"Error: format: precision of %.99999999999999999999s exceeds the limit of 1000"},
+		{`len(format("%1000d", 1))`, "1000"},
+		{`format("%1.2.3d", 1)`, "Error: format: unknown verb %1.2."},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated == nil {
+			t.Errorf("%s evaluated to nil", tt.input)
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -340,6 +413,51 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, "[2, 4, 6]"},
+		{`let n = 10; map([1, 2], fn(x) { return x + n; })`, "[11, 12]"},
+		{`filter(range(10), fn(x) { x / 2 * 2 == x })`, "[0, 2, 4, 6, 8]"},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, "10"},
+		{`sort([3, 1, 2])`, "[1, 2, 3]"},
+		{`sort([[2, "b"], [1, "a"], [2, "a"]], fn(x, y) { x[0] < y[0] })`, "[[1, a], [2, b], [2, a]]"},
+		{`range(10, 0, -3)`, "[10, 7, 4, 1]"},
+		{`range(9223372036854775806, 9223372036854775807, 2)`, "[9223372036854775806]"},
+		{`range(-9223372036854775807 - 1, 9223372036854775807, 4611686018427387904)`,
+			"[-9223372036854775808, -4611686018427387904, 0, 4611686018427387904]"},
+		{`zip([1, 2, 3], ["a", "b"])`, "[[1, a], [2, b]]"},
+		{`keys({"b": 1, "a": 2})`, "[b, a]"},
+		{`values({"b": 1, "a": 2})`, "[1, 2]"},
+		{`contains([[1], [2]], [2])`, "true"},
+		{`contains({"a": 1}, "b")`, "false"},
+		{`reverse([1, 2, 3])`, "[3, 2, 1]"},
+		{`join(["a", 1, true])`, "a1true"},
+		{`len(filter(range(100000), fn(x) { x > 49999 }))`, "50000"},
+		{`map([1], fn(a, b) { a })`, "Error: wrong number of arguments: want=2, got=1"},
+		{`map([1, 2], fn(x) { x + true })`, "Error: type mismatch: INTEGER + BOOLEAN"},
+		{`sort([1, 2], fn(a, b) { 1 })`, "Error: comparator passed to `sort` must return BOOLEAN, got INTEGER"},
+		{`range(1, 2, 0)`, "Error: step argument to `range` must not be zero"},
+		{`range(9223372036854775807)`, "Error: `range` would produce 9223372036854775807 elements, the limit is 16777216"},
+		{`range(9223372036854775807, -9223372036854775807 - 1, -1)`,
+			"Error: `range` would produce 18446744073709551615 elements, the limit is 16777216"},
+		{`map(1, fn(x) { x })`, "Error: first argument to `map` must be ARRAY, got INTEGER"},
+		{`map([1], 1)`, "Error: not a function: INTEGER"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated == nil {
+			t.Errorf("%s evaluated to nil", tt.input)
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("%s: want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestArrayLiteral(t *testing.T) {
 	input := "[1, 2 + 2, 3 * 3]"
 	evaluated := testEval(input)
@@ -413,23 +531,72 @@ func TestHashLiterals(t *testing.T) {
 	if !ok {
 		t.Fatalf("Eval didn't return Hash. got=%T(%+v)", evaluated, evaluated)
 	}
-	expected := map[object.HashKey]int64{
-		(&object.String{Value: "one"}).HashKey():   1,
-		(&object.String{Value: "two"}).HashKey():   2,
-		(&object.String{Value: "three"}).HashKey(): 3,
-		(&object.Integer{Value: 4}).HashKey():      4,
-		TRUE.HashKey():                             5,
-		FALSE.HashKey():                            6,
+	expected := []struct {
+		key   object.Object
+		value int64
+	}{
+		{&object.String{Value: "one"}, 1},
+		{&object.String{Value: "two"}, 2},
+		{&object.String{Value: "three"}, 3},
+		{&object.Integer{Value: 4}, 4},
+		{TRUE, 5},
+		{FALSE, 6},
+	}
+	if result.Len() != len(expected) {
+		t.Fatalf("Hash has wrong num of pairs.got=%d", result.Len())
+	}
+	for _, tt := range expected {
+		value, ok, err := result.Get(tt.key)
+		if err != nil || !ok {
+			t.Errorf("no pair for giver key in Pairs")
+			continue
+		}
+		testIntegerObject(t, value, tt.value)
 	}
-	if len(result.Pairs) != len(expected) {
-		t.Fatalf("Hash has wrong num of pairs.got=%d", len(result.Pairs))
+}
+
+func TestCompositeHashKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`{[1, 2]: 5}[[1, 2]]`, 5},
+		{`let key = [1, "a", true]; {key: 5}[[1, "a", true]]`, 5},
+		{`{[1, 2]: 5}[[2, 1]]`, nil},
+		{`{{"a": 1, "b": 2}: 5}[{"b": 2, "a": 1}]`, 5},
+		{`{[1, {"a": [2]}]: 5}[[1, {"a": [2]}]]`, 5},
+		{`{[1, 2]: 5, [1, 2]: 6}[[1, 2]]`, 6},
+		{`{[fn(x) { x }]: 5}`, "unusable as hash key: FUNCTION"},
+		{`{"a": 1}[[fn(x) { x }]]`, "unusable as hash key: FUNCTION"},
 	}
-	for expectedKey, expectedValue := range expected {
-		pair, ok := result.Pairs[expectedKey]
-		if !ok {
-			t.Errorf("no pair for giver key in Pairs")
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestHashLiteralOrder(t *testing.T) {
+	input := `{"zeta": 1, "alpha": 2, 3: 3, true: 4, "alpha": 5}`
+	expected := `{zeta: 1,alpha: 5,3: 3,true: 4}`
+	for i := 0; i < 10; i++ {
+		evaluated := testEval(input)
+		if evaluated.Inspect() != expected {
+			t.Fatalf("wrong Inspect output. want=%q, got=%q", expected, evaluated.Inspect())
 		}
-		testIntegerObject(t, pair.Value, expectedValue)
 	}
 }
 
@@ -1,6 +1,7 @@
 package evaluator
 
 import (
+	"fmt"
 	"interpreter/ast"
 	"interpreter/object"
 )
@@ -45,8 +46,9 @@ func addMacro(stmt ast.Statement, env *object.Environment) {
 	env.Set(letStatement.Name.Value, macro)
 }
 
-func ExpandMacro(program ast.Node, env *object.Environment) ast.Node {
-	return ast.Modify(program, func(node ast.Node) ast.Node {
+func ExpandMacro(program ast.Node, env *object.Environment) (ast.Node, error) {
+	var expandErr error
+	expanded, err := ast.Modify(program, func(node ast.Node) ast.Node {
 		callExpression, ok := node.(*ast.CallExpression)
 		if !ok {
 			return node
@@ -61,10 +63,21 @@ func ExpandMacro(program ast.Node, env *object.Environment) ast.Node {
 		evaluated := Eval(macro.Body, evalEnv)
 		quote, ok := evaluated.(*object.Quote)
 		if !ok {
-			panic("we only support returning ast-node from macros")
+			if expandErr == nil {
+				expandErr = fmt.Errorf("we only support returning ast-node from macros, got %T",
+					evaluated)
+			}
+			return node
 		}
 		return quote.Node
 	})
+	if err != nil {
+		return nil, err
+	}
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	return expanded, nil
 }
 
 func isMacroCall(exp *ast.CallExpression, env *object.Environment) (*object.Macro, bool) {
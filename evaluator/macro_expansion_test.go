@@ -45,7 +45,10 @@ unless(10 > 5, puts("not greater"), puts("greater"));
 		program := testParseProgram(tt.input)
 		env := object.NewEnvironment()
 		DefineMacros(program, env)
-		expanded := ExpandMacro(program, env)
+		expanded, err := ExpandMacro(program, env)
+		if err != nil {
+			t.Fatalf("ExpandMacro returned error: %s", err)
+		}
 		if expected.String() != expanded.String() {
 			t.Errorf("not equal. want=%q, got=%q", expected.String(), expanded.String())
 		}
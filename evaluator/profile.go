@@ -0,0 +1,49 @@
+package evaluator
+
+import (
+	"interpreter/ast"
+	"interpreter/object"
+	"interpreter/profile"
+)
+
+// profileFrame 是性能分析中的一个调用帧，line 是正在求值的语句所在的行
+type profileFrame struct {
+	frame profile.Frame
+	line  int
+}
+
+// profile 在每个节点求值之前记录一次所在的函数和行
+func (e *Evaluator) profile() {
+	if len(e.profileFrames) == 0 {
+		e.profileFrames = append(e.profileFrames, profileFrame{frame: profile.Main})
+	}
+	top := e.profileFrames[len(e.profileFrames)-1]
+	e.Profiler.Record(len(e.profileFrames), top.frame, top.line)
+}
+
+// profileStatement 在语句求值之前更新当前帧正在执行的行
+func (e *Evaluator) profileStatement(stmt ast.Statement) {
+	if len(e.profileFrames) == 0 {
+		e.profileFrames = append(e.profileFrames, profileFrame{frame: profile.Main})
+	}
+	e.profileFrames[len(e.profileFrames)-1].line = statementLine(stmt)
+}
+
+// profileEnter 在调用函数时压入一帧，函数的起始行是它第一条语句所在的行，与虚拟机一致
+func (e *Evaluator) profileEnter(fn *object.Function) {
+	frame := profile.Frame{Function: fn.Name}
+	if frame.Function == "" {
+		frame.Function = "<anonymous>"
+	}
+	if len(fn.Body.Statements) > 0 {
+		frame.StartLine = statementLine(fn.Body.Statements[0])
+	}
+	if len(e.profileFrames) == 0 {
+		e.profileFrames = append(e.profileFrames, profileFrame{frame: profile.Main})
+	}
+	e.profileFrames = append(e.profileFrames, profileFrame{frame: frame, line: frame.StartLine})
+}
+
+func (e *Evaluator) profileLeave() {
+	e.profileFrames = e.profileFrames[:len(e.profileFrames)-1]
+}
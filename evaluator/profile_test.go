@@ -0,0 +1,52 @@
+package evaluator
+
+import (
+	"interpreter/object"
+	"interpreter/profile"
+	"testing"
+)
+
+func TestProfiler(t *testing.T) {
+	e := New()
+	p := profile.New("nodes")
+	e.Profiler = p
+	if result := e.Eval(parseProgram(t, debugSource), object.NewEnvironment()); isError(result) {
+		t.Fatalf("eval error: %s", result.Inspect())
+	}
+	p.Stop()
+
+	want := map[profile.Frame]bool{
+		profile.Main:                             true,
+		{Function: "add", StartLine: 3}:          true,
+		{Function: "twice", StartLine: 7}:        true,
+		{Function: "<anonymous>", StartLine: 11}: true,
+	}
+	var flat int64
+	for _, e := range p.Functions() {
+		frame := profile.Frame{Function: e.Function, StartLine: e.StartLine}
+		if !want[frame] {
+			t.Errorf("unexpected function %+v", e)
+		}
+		delete(want, frame)
+		if frame == profile.Main && e.Cum != p.Total() {
+			t.Errorf("<main> must include every node. want=%d, got=%d", p.Total(), e.Cum)
+		}
+		flat += e.Flat
+	}
+	for frame := range want {
+		t.Errorf("missing function %+v", frame)
+	}
+	if flat != p.Total() || p.Total() != int64(e.steps) {
+		t.Errorf("counts do not add up. total=%d, sum=%d, steps=%d", p.Total(), flat, e.steps)
+	}
+
+	lines := map[int]bool{}
+	for _, e := range p.Lines() {
+		if e.Function == "add" {
+			lines[e.Line] = true
+		}
+	}
+	if len(lines) != 2 || !lines[3] || !lines[4] {
+		t.Errorf("wrong lines for add. want=[3 4], got=%v", lines)
+	}
+}
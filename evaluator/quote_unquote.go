@@ -7,12 +7,15 @@ import (
 	"interpreter/token"
 )
 
-func quote(node ast.Node, env *object.Environment) object.Object {
-	node = evalUnquoteCalls(node, env)
+func (e *Evaluator) quote(node ast.Node, env *object.Environment) object.Object {
+	node, err := e.evalUnquoteCalls(node, env)
+	if err != nil {
+		return newError("%s", err)
+	}
 	return &object.Quote{Node: node}
 }
 
-func evalUnquoteCalls(quote ast.Node, env *object.Environment) ast.Node {
+func (e *Evaluator) evalUnquoteCalls(quote ast.Node, env *object.Environment) (ast.Node, error) {
 	return ast.Modify(quote, func(node ast.Node) ast.Node {
 		if !isUnquoteCall(node) {
 			return node
@@ -24,7 +27,7 @@ func evalUnquoteCalls(quote ast.Node, env *object.Environment) ast.Node {
 		if len(call.Arguments) != 1 {
 			return node
 		}
-		unquoted := Eval(call.Arguments[0], env)
+		unquoted := e.Eval(call.Arguments[0], env)
 		return convertObjectToASTNode(unquoted)
 	})
 }
@@ -0,0 +1,14 @@
+package evaluator
+
+import (
+	"interpreter/ast"
+	"interpreter/object"
+)
+
+// Tracer 观察求值器对每个节点的求值
+type Tracer interface {
+	// EnterNode 在节点求值之前调用，depth 是节点的嵌套深度，最外层为 1
+	EnterNode(node ast.Node, depth int)
+	// ExitNode 在节点求值之后调用，result 是节点的值，语句等没有值的节点为 nil
+	ExitNode(node ast.Node, depth int, result object.Object)
+}
@@ -0,0 +1,654 @@
+// Package format 把 Monkey 源码打印成统一的格式。
+//
+// 格式只由语法树决定：缩进为四个空格，运算符两边各有一个空格，
+// 只在优先级需要时加括号，放不进一行的参数、数组和哈希拆成每项一行。
+// 注释和语句之间的单个空行会被保留。
+package format
+
+import (
+	"fmt"
+	"interpreter/ast"
+	"interpreter/lexer"
+	"interpreter/parser"
+	"interpreter/token"
+	"strings"
+)
+
+// Width 是一行的最大宽度，超过时拆成多行
+const Width = 80
+
+const indentUnit = "    "
+
+// atom 是字面量、标识符等不需要括号的表达式的优先级
+const atom = parser.INDEX + 1
+
+// Source 格式化一段源码，源码有语法错误时返回错误
+func Source(src []byte) ([]byte, error) {
+	l := lexer.New(string(src))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	pr := &printer{comments: l.Comments()}
+	return []byte(pr.statements(program.Statements, 0, nil)), nil
+}
+
+type printer struct {
+	// comments 是还没有输出的注释，按位置排列
+	comments []token.Token
+}
+
+func indentation(indent int) string {
+	return strings.Repeat(indentUnit, indent)
+}
+
+// before 判断 a 是否出现在 b 之前
+func before(a, b token.Token) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// commentBefore 判断下一条注释是否在 tok 之前，tok 为 nil 表示源码结尾
+func (p *printer) commentBefore(tok *token.Token) bool {
+	return len(p.comments) > 0 && (tok == nil || before(p.comments[0], *tok))
+}
+
+func (p *printer) popComment() token.Token {
+	c := p.comments[0]
+	p.comments = p.comments[1:]
+	return c
+}
+
+// hasComment 判断 from 和 to 之间是否有注释，有注释的块不能写在一行中
+func (p *printer) hasComment(from, to token.Token) bool {
+	for _, c := range p.comments {
+		if before(from, c) && before(c, to) {
+			return true
+		}
+	}
+	return false
+}
+
+// statements 打印一组语句，每条语句占一行或多行并以换行结尾。
+// end 是块的右花括号，在它之前剩下的注释打印在最后；为 nil 时打印所有剩下的注释。
+func (p *printer) statements(list []ast.Statement, indent int, end *token.Token) string {
+	var out strings.Builder
+	prefix := indentation(indent)
+	// previous 是上一个输出的语句或注释在源码中结束的行，用于保留空行
+	previous := 0
+	blankLine := func(line int) {
+		if previous > 0 && line > previous+1 {
+			out.WriteString("\n")
+		}
+	}
+	for i, s := range list {
+		start := statementToken(s)
+		for p.commentBefore(&start) {
+			c := p.popComment()
+			blankLine(c.Line)
+			out.WriteString(prefix + c.Literal + "\n")
+			previous = c.Line
+		}
+		blankLine(start.Line)
+
+		var next ast.Statement
+		if i+1 < len(list) {
+			next = list[i+1]
+		}
+		out.WriteString(prefix)
+		out.WriteString(p.statement(s, next, end != nil, indent))
+		previous = lastLine(s)
+		if p.commentBefore(end) && p.comments[0].Line == previous {
+			out.WriteString(" " + p.popComment().Literal)
+		}
+		out.WriteString("\n")
+	}
+	for p.commentBefore(end) {
+		c := p.popComment()
+		blankLine(c.Line)
+		out.WriteString(prefix + c.Literal + "\n")
+		previous = c.Line
+	}
+	return out.String()
+}
+
+// statement 打印一条语句，不包含缩进和换行。
+// inBlock 表示语句在花括号中，块的最后一个表达式语句不加分号。
+func (p *printer) statement(s ast.Statement, next ast.Statement, inBlock bool, indent int) string {
+	column := len(indentation(indent))
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		head := "let " + s.Name.Value + " = "
+		return head + p.expr(s.Value, indent, column+len(head)) + ";"
+	case *ast.ReturnStatement:
+		return "return " + p.expr(s.ReturnValue, indent, column+len("return ")) + ";"
+	case *ast.ExpressionStatement:
+		text := p.expr(s.Expression, indent, column)
+		if needsSemicolon(s, next, inBlock) {
+			text += ";"
+		}
+		return text
+	}
+	return s.String()
+}
+
+// needsSemicolon 决定表达式语句之后是否需要分号。if 表达式之后的语句如果以
+// "("、"[" 或 "-" 开头，会被解析成调用、下标或者减法，所以这时必须保留分号。
+func needsSemicolon(s *ast.ExpressionStatement, next ast.Statement, inBlock bool) bool {
+	if next == nil && inBlock {
+		return false
+	}
+	if _, ok := s.Expression.(*ast.IfExpression); !ok {
+		return true
+	}
+	following, ok := next.(*ast.ExpressionStatement)
+	if !ok {
+		return false
+	}
+	return strings.ContainsRune("([-", rune(firstChar(following.Expression)))
+}
+
+// firstChar 返回表达式打印出来的第一个字符
+func firstChar(e ast.Expression) byte {
+	switch e := e.(type) {
+	case *ast.InfixExpression:
+		if precedence(e.Left) < parser.Precedence(token.TokenType(e.Operator)) {
+			return '('
+		}
+		return firstChar(e.Left)
+	case *ast.CallExpression:
+		if precedence(e.Function) < parser.CALL {
+			return '('
+		}
+		return firstChar(e.Function)
+	case *ast.IndexExpression:
+		if precedence(e.Left) < parser.CALL {
+			return '('
+		}
+		return firstChar(e.Left)
+	case *ast.PrefixExpression:
+		return e.Operator[0]
+	case *ast.ArrayLiteral:
+		return '['
+	case *ast.HashLiteral:
+		return '{'
+	}
+	return 0
+}
+
+func statementToken(s ast.Statement) token.Token {
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		return s.Token
+	case *ast.ReturnStatement:
+		return s.Token
+	case *ast.ExpressionStatement:
+		return s.Token
+	}
+	return token.Token{}
+}
+
+// lastLine 返回节点在源码中的最后一行，块、列表和下标以结束的括号为准
+func lastLine(node ast.Node) int {
+	line := 0
+	ast.Inspect(node, func(n ast.Node) bool {
+		var toks []token.Token
+		switch n := n.(type) {
+		case *ast.BlockStatement:
+			toks = []token.Token{n.Rbrace}
+		case *ast.LetStatement:
+			toks = []token.Token{n.Token}
+		case *ast.ReturnStatement:
+			toks = []token.Token{n.Token}
+		case *ast.ExpressionStatement:
+			toks = []token.Token{n.Token}
+		case *ast.Identifier:
+			toks = []token.Token{n.Token}
+		case *ast.IntegerLiteral:
+			toks = []token.Token{n.Token}
+		case *ast.StringLiteral:
+			toks = []token.Token{n.Token}
+		case *ast.Boolean:
+			toks = []token.Token{n.Token}
+		case *ast.PrefixExpression:
+			toks = []token.Token{n.Token}
+		case *ast.InfixExpression:
+			toks = []token.Token{n.Token}
+		case *ast.CallExpression:
+			toks = []token.Token{n.Token, n.Rparen}
+		case *ast.IndexExpression:
+			toks = []token.Token{n.Token, n.Rbracket}
+		case *ast.ArrayLiteral:
+			toks = []token.Token{n.Token, n.Rbracket}
+		case *ast.HashLiteral:
+			toks = []token.Token{n.Token, n.Rbrace}
+		}
+		for _, tok := range toks {
+			if tok.Line > line {
+				line = tok.Line
+			}
+		}
+		return n != nil
+	})
+	return line
+}
+
+// startToken 返回表达式在源码中的第一个记号
+func startToken(e ast.Expression) token.Token {
+	switch e := e.(type) {
+	case *ast.InfixExpression:
+		return startToken(e.Left)
+	case *ast.CallExpression:
+		return startToken(e.Function)
+	case *ast.IndexExpression:
+		return startToken(e.Left)
+	case *ast.Identifier:
+		return e.Token
+	case *ast.IntegerLiteral:
+		return e.Token
+	case *ast.StringLiteral:
+		return e.Token
+	case *ast.Boolean:
+		return e.Token
+	case *ast.PrefixExpression:
+		return e.Token
+	case *ast.ArrayLiteral:
+		return e.Token
+	case *ast.HashLiteral:
+		return e.Token
+	case *ast.IfExpression:
+		return e.Token
+	case *ast.FunctionLiteral:
+		return e.Token
+	case *ast.MacroLiteral:
+		return e.Token
+	}
+	return token.Token{}
+}
+
+// endToken 返回表达式在源码中的最后一个记号
+func endToken(e ast.Expression) token.Token {
+	switch e := e.(type) {
+	case *ast.PrefixExpression:
+		return endToken(e.Right)
+	case *ast.InfixExpression:
+		return endToken(e.Right)
+	case *ast.CallExpression:
+		return e.Rparen
+	case *ast.IndexExpression:
+		return e.Rbracket
+	case *ast.ArrayLiteral:
+		return e.Rbracket
+	case *ast.HashLiteral:
+		return e.Rbrace
+	case *ast.IfExpression:
+		if e.Alternative != nil {
+			return e.Alternative.Rbrace
+		}
+		return e.Consequence.Rbrace
+	case *ast.FunctionLiteral:
+		return e.Body.Rbrace
+	case *ast.MacroLiteral:
+		return e.Body.Rbrace
+	}
+	return startToken(e)
+}
+
+// prefixOperandNeedsParens 判断前缀表达式的运算数是否需要括号。
+// 除了优先级之外，-(-1) 不能写成 --1
+func prefixOperandNeedsParens(e *ast.PrefixExpression) bool {
+	if precedence(e.Right) < parser.PREFIX {
+		return true
+	}
+	right, ok := e.Right.(*ast.PrefixExpression)
+	return ok && e.Operator == "-" && right.Operator == "-"
+}
+
+// precedence 返回表达式作为运算数时的优先级
+func precedence(e ast.Expression) int {
+	switch e := e.(type) {
+	case *ast.InfixExpression:
+		return parser.Precedence(token.TokenType(e.Operator))
+	case *ast.PrefixExpression:
+		return parser.PREFIX
+	case *ast.CallExpression:
+		return parser.CALL
+	case *ast.IndexExpression:
+		return parser.INDEX
+	}
+	return atom
+}
+
+// operand 打印运算数，need 为真时加上括号
+func (p *printer) operand(e ast.Expression, need bool, indent, column int) string {
+	if need {
+		return "(" + p.expr(e, indent, column+1) + ")"
+	}
+	return p.expr(e, indent, column)
+}
+
+// endColumn 返回在 column 处写下 s 之后所在的列
+func endColumn(column int, s string) int {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return column + len(s)
+}
+
+// expr 打印表达式。column 是表达式开始的列，indent 是当前的缩进层数，
+// 能放进一行时使用单行的形式，否则把其中的块、参数和元素拆成多行。
+func (p *printer) expr(e ast.Expression, indent, column int) string {
+	// 留出一列给之后的分号或者逗号
+	if flat, ok := p.flat(e); ok && column+len(flat) < Width {
+		return flat
+	}
+	switch e := e.(type) {
+	case *ast.PrefixExpression:
+		return e.Operator + p.operand(e.Right, prefixOperandNeedsParens(e), indent, column+len(e.Operator))
+	case *ast.InfixExpression:
+		prec := parser.Precedence(token.TokenType(e.Operator))
+		left := p.operand(e.Left, precedence(e.Left) < prec, indent, column)
+		column = endColumn(column, left+" "+e.Operator+" ")
+		return left + " " + e.Operator + " " + p.operand(e.Right, precedence(e.Right) <= prec, indent, column)
+	case *ast.CallExpression:
+		callee := p.operand(e.Function, precedence(e.Function) < parser.CALL, indent, column)
+		return callee + p.list(e.Token, e.Arguments, e.Rparen, indent, endColumn(column, callee))
+	case *ast.IndexExpression:
+		left := p.operand(e.Left, precedence(e.Left) < parser.CALL, indent, column)
+		column = endColumn(column, left) + 1
+		return left + "[" + p.expr(e.Index, indent, column) + "]"
+	case *ast.ArrayLiteral:
+		return p.list(e.Token, e.Elements, e.Rbracket, indent, column)
+	case *ast.HashLiteral:
+		return p.hash(e, indent)
+	case *ast.IfExpression:
+		head := "if (" + p.expr(e.Condition, indent, column+len("if (")) + ") "
+		out := head + p.block(e.Consequence, indent)
+		if e.Alternative == nil {
+			return out
+		}
+		// } 和 else 之间的注释留在原处，else 另起一行
+		if !p.commentBefore(&e.Alternative.Token) {
+			return out + " else " + p.block(e.Alternative, indent)
+		}
+		if p.comments[0].Line == e.Consequence.Rbrace.Line {
+			out += " " + p.popComment().Literal
+		}
+		out += "\n" + p.leading(&e.Alternative.Token, indentation(indent))
+		return out + indentation(indent) + "else " + p.block(e.Alternative, indent)
+	case *ast.FunctionLiteral:
+		return "fn" + parameters(e.Parameters) + " " + p.block(e.Body, indent)
+	case *ast.MacroLiteral:
+		return "macro" + parameters(e.Parameters) + " " + p.block(e.Body, indent)
+	}
+	flat, _ := p.flat(e)
+	return flat
+}
+
+// list 打印参数或者数组元素。放不进一行时，如果最后一项是函数、数组或哈希，
+// 先尝试只展开最后一项，例如 map(xs, fn(x) { ... })，否则每项一行。
+// 项之间有注释时总是每项一行，注释留在原来的位置。
+func (p *printer) list(open token.Token, items []ast.Expression, close token.Token, indent, column int) string {
+	if len(items) == 0 && !p.commentBefore(&close) {
+		return open.Literal + close.Literal
+	}
+	if len(items) > 0 {
+		last := items[len(items)-1]
+		if !p.hasComment(open, startToken(last)) && !p.hasComment(endToken(last), close) {
+			if out, ok := p.expandLast(open.Literal, items, close.Literal, indent, column); ok {
+				return out
+			}
+		}
+	}
+	return p.lines(open, len(items), close, indent, func(i int) (token.Token, token.Token) {
+		return startToken(items[i]), endToken(items[i])
+	}, func(i int, column int) string {
+		return p.expr(items[i], indent+1, column)
+	})
+}
+
+// expandLast 尝试把前面的项写在一行中，只展开最后一项
+func (p *printer) expandLast(open string, items []ast.Expression, close string, indent, column int) (string, bool) {
+	var heads []string
+	for _, item := range items[:len(items)-1] {
+		flat, ok := p.flat(item)
+		if !ok {
+			return "", false
+		}
+		heads = append(heads, flat)
+	}
+	last := items[len(items)-1]
+	head := open + strings.Join(append(heads, ""), ", ")
+	if flat, ok := p.flat(last); ok && column+len(head+flat+close) < Width {
+		return head + flat + close, true
+	}
+	switch last.(type) {
+	case *ast.FunctionLiteral, *ast.MacroLiteral, *ast.ArrayLiteral, *ast.HashLiteral:
+		if column+len(head) < Width {
+			return head + p.expr(last, indent, column+len(head)) + close, true
+		}
+	}
+	return "", false
+}
+
+func (p *printer) hash(h *ast.HashLiteral, indent int) string {
+	if len(h.Pairs) == 0 && !p.commentBefore(&h.Rbrace) {
+		return "{}"
+	}
+	return p.lines(h.Token, len(h.Pairs), h.Rbrace, indent, func(i int) (token.Token, token.Token) {
+		return startToken(h.Pairs[i].Key), endToken(h.Pairs[i].Value)
+	}, func(i int, column int) string {
+		key := p.expr(h.Pairs[i].Key, indent+1, column)
+		return key + ": " + p.expr(h.Pairs[i].Value, indent+1, endColumn(column, key+": "))
+	})
+}
+
+// lines 把 n 项写成每项一行，bounds 返回第 i 项在源码中的第一个和最后一个记号，
+// item 打印第 i 项。项前面的注释各占一行，和项在同一行的注释跟在逗号后面。
+func (p *printer) lines(open token.Token, n int, close token.Token, indent int,
+	bounds func(i int) (token.Token, token.Token), item func(i int, column int) string) string {
+	inner := indentation(indent + 1)
+	next := func(i int) token.Token {
+		if i < n {
+			start, _ := bounds(i)
+			return start
+		}
+		return close
+	}
+	var out strings.Builder
+	first := next(0)
+	out.WriteString(open.Literal + p.trailing(open.Line, &first) + "\n")
+	for i := 0; i < n; i++ {
+		start, end := bounds(i)
+		out.WriteString(p.leading(&start, inner))
+		out.WriteString(inner + item(i, len(inner)))
+		if i < n-1 {
+			out.WriteString(",")
+		}
+		following := next(i + 1)
+		out.WriteString(p.trailing(end.Line, &following) + "\n")
+	}
+	out.WriteString(p.leading(&close, inner))
+	out.WriteString(indentation(indent) + close.Literal)
+	return out.String()
+}
+
+// trailing 返回在第 line 行、next 之前的下一条注释，前面加一个空格，没有时返回空字符串
+func (p *printer) trailing(line int, next *token.Token) string {
+	if p.commentBefore(next) && p.comments[0].Line == line {
+		return " " + p.popComment().Literal
+	}
+	return ""
+}
+
+// leading 把 next 之前的注释各打印成一行，prefix 是缩进
+func (p *printer) leading(next *token.Token, prefix string) string {
+	var out string
+	for p.commentBefore(next) {
+		out += prefix + p.popComment().Literal + "\n"
+	}
+	return out
+}
+
+// block 打印多行的块，块中的注释在这里输出，和左花括号在同一行的注释仍然跟在它后面
+func (p *printer) block(b *ast.BlockStatement, indent int) string {
+	if len(b.Statements) == 0 && !p.commentBefore(&b.Rbrace) {
+		return "{}"
+	}
+	open := "{"
+	if p.commentBefore(&b.Rbrace) && p.comments[0].Line == b.Token.Line && before(b.Token, p.comments[0]) {
+		open += " " + p.popComment().Literal
+	}
+	return open + "\n" + p.statements(b.Statements, indent+1, &b.Rbrace) + indentation(indent) + "}"
+}
+
+func parameters(params []*ast.Identifier) string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.Value
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// flat 打印单行的形式。含有注释的表达式和含有多条语句的块不能写在一行中，这时返回 false。
+// flat 不会输出注释，所以可以随意尝试。
+func (p *printer) flat(e ast.Expression) (string, bool) {
+	if p.hasComment(startToken(e), endToken(e)) {
+		return "", false
+	}
+	switch e := e.(type) {
+	case *ast.Identifier:
+		return e.Value, true
+	case *ast.IntegerLiteral:
+		return e.Token.Literal, true
+	case *ast.StringLiteral:
+		return `"` + e.Value + `"`, true
+	case *ast.Boolean:
+		return e.Token.Literal, true
+	case *ast.PrefixExpression:
+		right, ok := p.flatOperand(e.Right, prefixOperandNeedsParens(e))
+		return e.Operator + right, ok
+	case *ast.InfixExpression:
+		prec := parser.Precedence(token.TokenType(e.Operator))
+		left, ok := p.flatOperand(e.Left, precedence(e.Left) < prec)
+		if !ok {
+			return "", false
+		}
+		right, ok := p.flatOperand(e.Right, precedence(e.Right) <= prec)
+		return left + " " + e.Operator + " " + right, ok
+	case *ast.CallExpression:
+		callee, ok := p.flatOperand(e.Function, precedence(e.Function) < parser.CALL)
+		if !ok {
+			return "", false
+		}
+		args, ok := p.flatList(e.Arguments)
+		return callee + "(" + args + ")", ok
+	case *ast.IndexExpression:
+		left, ok := p.flatOperand(e.Left, precedence(e.Left) < parser.CALL)
+		if !ok {
+			return "", false
+		}
+		index, ok := p.flat(e.Index)
+		return left + "[" + index + "]", ok
+	case *ast.ArrayLiteral:
+		elements, ok := p.flatList(e.Elements)
+		return "[" + elements + "]", ok
+	case *ast.HashLiteral:
+		pairs := make([]string, len(e.Pairs))
+		for i, pair := range e.Pairs {
+			key, ok := p.flat(pair.Key)
+			if !ok {
+				return "", false
+			}
+			value, ok := p.flat(pair.Value)
+			if !ok {
+				return "", false
+			}
+			pairs[i] = key + ": " + value
+		}
+		return "{" + strings.Join(pairs, ", ") + "}", true
+	case *ast.IfExpression:
+		condition, ok := p.flat(e.Condition)
+		if !ok {
+			return "", false
+		}
+		consequence, ok := p.flatBlock(e.Consequence)
+		if !ok {
+			return "", false
+		}
+		out := "if (" + condition + ") " + consequence
+		if e.Alternative != nil {
+			alternative, ok := p.flatBlock(e.Alternative)
+			if !ok {
+				return "", false
+			}
+			out += " else " + alternative
+		}
+		return out, true
+	case *ast.FunctionLiteral:
+		body, ok := p.flatBlock(e.Body)
+		return "fn" + parameters(e.Parameters) + " " + body, ok
+	case *ast.MacroLiteral:
+		body, ok := p.flatBlock(e.Body)
+		return "macro" + parameters(e.Parameters) + " " + body, ok
+	}
+	return "", false
+}
+
+func (p *printer) flatOperand(e ast.Expression, need bool) (string, bool) {
+	s, ok := p.flat(e)
+	if need {
+		s = "(" + s + ")"
+	}
+	return s, ok
+}
+
+func (p *printer) flatList(items []ast.Expression) (string, bool) {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		s, ok := p.flat(item)
+		if !ok {
+			return "", false
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, ", "), true
+}
+
+// flatBlock 把只有一条语句且没有注释的块打印成 { stmt } 的形式
+func (p *printer) flatBlock(b *ast.BlockStatement) (string, bool) {
+	if p.hasComment(b.Token, b.Rbrace) {
+		return "", false
+	}
+	switch len(b.Statements) {
+	case 0:
+		return "{}", true
+	case 1:
+	default:
+		return "", false
+	}
+	var text string
+	switch s := b.Statements[0].(type) {
+	case *ast.LetStatement:
+		value, ok := p.flat(s.Value)
+		if !ok {
+			return "", false
+		}
+		text = "let " + s.Name.Value + " = " + value + ";"
+	case *ast.ReturnStatement:
+		value, ok := p.flat(s.ReturnValue)
+		if !ok {
+			return "", false
+		}
+		text = "return " + value + ";"
+	case *ast.ExpressionStatement:
+		value, ok := p.flat(s.Expression)
+		if !ok {
+			return "", false
+		}
+		text = value
+	default:
+		return "", false
+	}
+	return "{ " + text + " }", true
+}
@@ -0,0 +1,240 @@
+package format
+
+import (
+	"interpreter/lexer"
+	"interpreter/parser"
+	"strings"
+	"testing"
+)
+
+func formatString(t *testing.T, input string) string {
+	t.Helper()
+	out, err := Source([]byte(input))
+	if err != nil {
+		t.Fatalf("format %q: %s", input, err)
+	}
+	return string(out)
+}
+
+// checkFormatted 检查格式化结果是否稳定，并且和原来的程序语义相同
+func checkFormatted(t *testing.T, input, output string) {
+	t.Helper()
+	if again := formatString(t, output); again != output {
+		t.Errorf("format is not idempotent for %q:\nfirst=\n%s\nsecond=\n%s", input, output, again)
+	}
+	want := parser.New(lexer.New(input)).ParseProgram().String()
+	got := parser.New(lexer.New(output)).ParseProgram().String()
+	if got != want {
+		t.Errorf("format changed the program %q:\nwant=%s\ngot=%s", input, want, got)
+	}
+}
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x=1+2*3", "let x = 1 + 2 * 3;\n"},
+		{"let x = (1 + 2) * 3;", "let x = (1 + 2) * 3;\n"},
+		{"((1 - 2)) - 3", "1 - 2 - 3;\n"},
+		{"1 - (2 - 3)", "1 - (2 - 3);\n"},
+		{"-(1 + 2) * -a", "-(1 + 2) * -a;\n"},
+		{"-(-1)", "-(-1);\n"},
+		{"!(!a) - (-b)", "!!a - -b;\n"},
+		{"!(a == b)", "!(a == b);\n"},
+		{"(fn(x) { x })(1)", "fn(x) { x }(1);\n"},
+		{"(a + b)[0]", "(a + b)[0];\n"},
+		{"a[(0)]", "a[0];\n"},
+		{"return   x", "return x;\n"},
+		{`let h = {"a":1,true:[1,2]}`, "let h = {\"a\": 1, true: [1, 2]};\n"},
+		{"let f = fn(a,b) { }", "let f = fn(a, b) {};\n"},
+		{
+			"let f = fn(a) { let b = a * 2; b + 1 };",
+			"let f = fn(a) {\n    let b = a * 2;\n    b + 1\n};\n",
+		},
+		{"if (x > 1) { x } else { 0 }", "if (x > 1) { x } else { 0 }\n"},
+		{
+			// if 之后以括号开头的语句需要分号隔开，否则会变成函数调用
+			"if (x) { 1 }; (a + b) * 2; if (x) { 1 } let y = 2;",
+			"if (x) { 1 };\n(a + b) * 2;\nif (x) { 1 }\nlet y = 2;\n",
+		},
+		{
+			"let x = 1;\n\n\n\nlet y = 2;\nlet z = 3;",
+			"let x = 1;\n\nlet y = 2;\nlet z = 3;\n",
+		},
+		{
+			"let x = macro(a) { quote(unquote(a) + 1) };",
+			"let x = macro(a) { quote(unquote(a) + 1) };\n",
+		},
+	}
+	for _, tt := range tests {
+		got := formatString(t, tt.input)
+		if got != tt.expected {
+			t.Errorf("format %q:\nwant=%q\ngot=%q", tt.input, tt.expected, got)
+		}
+		checkFormatted(t, tt.input, got)
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// 计算阶乘
+let fact = fn(n) {   // 递归版本
+  // 终止条件
+  if (n < 2) { return 1; }
+
+
+  n * fact(n - 1)   // 尾部
+  // 块结尾的注释
+};
+
+fact(5) // 120
+// 文件结尾
+`
+	expected := `// 计算阶乘
+let fact = fn(n) { // 递归版本
+    // 终止条件
+    if (n < 2) { return 1; }
+
+    n * fact(n - 1) // 尾部
+    // 块结尾的注释
+};
+
+fact(5); // 120
+// 文件结尾
+`
+	got := formatString(t, input)
+	if got != expected {
+		t.Errorf("wrong output:\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+	checkFormatted(t, input, got)
+
+	// 只有注释的块不能写成一行
+	got = formatString(t, "let f = fn() { // 以后实现\n};")
+	if got != "let f = fn() { // 以后实现\n};\n" {
+		t.Errorf("wrong output for empty block: %q", got)
+	}
+}
+
+func TestWrapping(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`let names = ["alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta"];`,
+			`let names = [
+    "alpha",
+    "beta",
+    "gamma",
+    "delta",
+    "epsilon",
+    "zeta",
+    "eta",
+    "theta"
+];
+`,
+		},
+		{
+			// 最后一个参数是函数时只展开函数体
+			`let doubled = map([1, 2, 3], fn(x) { let y = x * 2; y });`,
+			`let doubled = map([1, 2, 3], fn(x) {
+    let y = x * 2;
+    y
+});
+`,
+		},
+		{
+			`configure("a very long string argument", "another long string argument", 123456789);`,
+			`configure(
+    "a very long string argument",
+    "another long string argument",
+    123456789
+);
+`,
+		},
+		{
+			`let h = {"first": "a long value for the key", "second": fn(x) { x + 1 }, "third": 3};`,
+			`let h = {
+    "first": "a long value for the key",
+    "second": fn(x) { x + 1 },
+    "third": 3
+};
+`,
+		},
+	}
+	for _, tt := range tests {
+		got := formatString(t, tt.input)
+		if got != tt.expected {
+			t.Errorf("format %q:\nwant=\n%s\ngot=\n%s", tt.input, tt.expected, got)
+		}
+		checkFormatted(t, tt.input, got)
+	}
+}
+
+// 表达式中的注释留在原来的位置，所在的列表拆成每项一行
+func TestCommentsInExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let h = {\n \"a\": 1, // one\n // middle\n \"b\": 2\n};",
+			"let h = {\n    \"a\": 1, // one\n    // middle\n    \"b\": 2\n};\n",
+		},
+		{
+			"let a = [ // numbers\n1,\n2 // two\n// end\n];",
+			"let a = [ // numbers\n    1,\n    2 // two\n    // end\n];\n",
+		},
+		{
+			"add(1, // first\n2);",
+			"add(\n    1, // first\n    2\n);\n",
+		},
+		{
+			"let xs = [];\nmap(xs, fn(x) {\n// double\nx * 2\n});",
+			"let xs = [];\nmap(xs, fn(x) {\n    // double\n    x * 2\n});\n",
+		},
+		{
+			"if (x) { 1 } // yes\n// otherwise\nelse { 2 }",
+			"if (x) {\n    1\n} // yes\n// otherwise\nelse {\n    2\n}\n",
+		},
+		{
+			"let f = fn() {\nif (x) {\n1\n}\n// otherwise\nelse {\n2\n}\n};",
+			"let f = fn() {\n    if (x) {\n        1\n    }\n    // otherwise\n    else {\n        2\n    }\n};\n",
+		},
+	}
+	for _, tt := range tests {
+		got := formatString(t, tt.input)
+		if got != tt.expected {
+			t.Errorf("format %q:\nwant=\n%s\ngot=\n%s", tt.input, tt.expected, got)
+		}
+		checkFormatted(t, tt.input, got)
+	}
+}
+
+// 展开成多行的字面量、调用和下标之后紧跟的语句，第二次格式化时不能多出空行
+func TestFormatTwice(t *testing.T) {
+	inputs := []string{
+		"let names = [\"alpha\", \"beta\", \"gamma\", \"delta\", \"epsilon\", \"zeta\", \"eta\", \"theta\"];\nlet x = 1;",
+		"let h = {\"first\": \"a long value for the key\", \"second\": \"another long value\", \"third\": 3};\nlet x = 1;",
+		"configure(\"a very long string argument\", \"another long string argument\", 123456789);\nlet x = 1;",
+		"let v = table[\"a very long string index into the table\" + \"another long string to split it\"];\nlet x = 1;",
+		"let h = {\"first\": \"a long value for the key\", \"second\": \"another long value\", \"third\": 3};\n\nlet x = 1;",
+	}
+	for _, input := range inputs {
+		first := formatString(t, input)
+		second := formatString(t, first)
+		if second != first {
+			t.Errorf("format %q twice:\nfirst=\n%s\nsecond=\n%s", input, first, second)
+		}
+		if want := strings.Count(input, "\n\n"); strings.Count(first, "\n\n") != want {
+			t.Errorf("format %q: want %d blank lines, got=\n%s", input, want, first)
+		}
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	_, err := Source([]byte("let = 1;"))
+	if err == nil || !strings.HasPrefix(err.Error(), "parse errors:") {
+		t.Fatalf("expected parse errors, got=%v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package fuzz
+
+import (
+	"fmt"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/evaluator"
+	"interpreter/object"
+	"interpreter/vm"
+	"strings"
+)
+
+// 执行时的资源限制。求值器按节点计数，虚拟机按指令计数，
+// 两者的步数不能直接比较，所以任何一个引擎超出限制时都不比较结果
+const (
+	maxEvalSteps = 1000000
+	maxVMSteps   = 1000000
+	maxEvalDepth = 200
+)
+
+// Outcome 是一个引擎执行程序的结果，成功时 Value 是结果的 Inspect()，失败时 Error 是错误信息
+type Outcome struct {
+	Engine string
+	Value  string
+	Error  string
+}
+
+// 错误的类别。两种引擎的错误信息写法不同，例如求值器报告
+// "type mismatch: INTEGER + STRING"，虚拟机报告 "unsupported types for binary operation"，
+// 所以只比较类别
+const (
+	CategoryNone     = ""
+	CategoryType     = "type"
+	CategoryArity    = "arity"
+	CategoryDivision = "division"
+	CategoryName     = "name"
+	CategoryLimit    = "limit"
+	CategoryOther    = "other"
+)
+
+// categories 按顺序匹配错误信息中的片段
+var categories = []struct {
+	fragment string
+	category string
+}{
+	{"division by zero", CategoryDivision},
+	{"wrong number of arguments", CategoryArity},
+	{"stack overflow", CategoryLimit},
+	{evaluator.ErrStepLimit.Error(), CategoryLimit},
+	{vm.ErrStepLimit.Error(), CategoryLimit},
+	{"identifier not found", CategoryName},
+	{"undefined variable", CategoryName},
+	{"type mismatch", CategoryType},
+	{"unknown operator", CategoryType},
+	{"unsupported type", CategoryType},
+	{"not supported", CategoryType},
+	{"not a function", CategoryType},
+	{"unusable as hash key", CategoryType},
+	{"must be", CategoryType},
+	{"cannot compare", CategoryType},
+}
+
+// Category 返回错误的类别，没有出错时返回 CategoryNone
+func (o Outcome) Category() string {
+	if o.Error == "" {
+		return CategoryNone
+	}
+	for _, c := range categories {
+		if strings.Contains(o.Error, c.fragment) {
+			return c.category
+		}
+	}
+	return CategoryOther
+}
+
+func (o Outcome) String() string {
+	if o.Error != "" {
+		return fmt.Sprintf("%s: error (%s): %s", o.Engine, o.Category(), o.Error)
+	}
+	return fmt.Sprintf("%s: %s", o.Engine, o.Value)
+}
+
+// Evaluate 用求值器执行程序
+func Evaluate(program *ast.Program) Outcome {
+	e := evaluator.New()
+	e.Limits = evaluator.Limits{MaxSteps: maxEvalSteps, MaxDepth: maxEvalDepth}
+	result := e.Eval(program, object.NewEnvironment())
+	outcome := Outcome{Engine: "eval"}
+	switch {
+	case result == nil:
+		outcome.Value = object.NULL.Inspect()
+	case result.Type() == object.ERROR_OBJ:
+		outcome.Error = result.(*object.Error).Message
+	default:
+		outcome.Value = result.Inspect()
+	}
+	return outcome
+}
+
+// Execute 用指定的优化级别编译程序，再用虚拟机执行
+func Execute(program *ast.Program, level compiler.OptimizationLevel) Outcome {
+	outcome := Outcome{Engine: fmt.Sprintf("vm -O=%d", level)}
+	comp := compiler.New()
+	comp.SetOptimization(level)
+	if err := comp.Compile(program); err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	// 编译器生成的字节码都应该通过校验，否则当作一种差异报告
+	if err := vm.Verify(comp.ByteCode()); err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	machine := vm.New(comp.ByteCode())
+	machine.SetLimits(vm.Limits{MaxSteps: maxVMSteps, MaxFrames: vm.MaxFrames})
+	if err := machine.Run(); err != nil {
+		outcome.Error = err.Error()
+		return outcome
+	}
+	result := machine.LastPoppedStackElem()
+	if result == nil {
+		outcome.Value = object.NULL.Inspect()
+	} else {
+		outcome.Value = result.Inspect()
+	}
+	return outcome
+}
+
+// Check 用求值器和不优化、完全优化的虚拟机执行程序，
+// 结果的 Inspect() 或者错误的类别不同时返回描述差异的错误。
+// 任何一个引擎超出资源限制时无法判断，返回 nil
+func Check(program *ast.Program) error {
+	outcomes := []Outcome{
+		Evaluate(program),
+		Execute(program, compiler.OptimizeNone),
+		Execute(program, compiler.OptimizeFull),
+	}
+	for _, o := range outcomes {
+		if o.Category() == CategoryLimit {
+			return nil
+		}
+	}
+	want := outcomes[0]
+	for _, got := range outcomes[1:] {
+		if got.Value != want.Value || got.Category() != want.Category() {
+			return fmt.Errorf("engines disagree on\n%s\n%s\n%s", Source(program), want, got)
+		}
+	}
+	return nil
+}
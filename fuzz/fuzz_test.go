@@ -0,0 +1,82 @@
+package fuzz
+
+import (
+	"interpreter/lexer"
+	"interpreter/parser"
+	"math/rand"
+	"testing"
+)
+
+func randomData(seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	data := make([]byte, 64+r.Intn(192))
+	r.Read(data)
+	return data
+}
+
+func TestGenerate(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		data := randomData(seed)
+		program := Generate(data)
+		if again := Source(Generate(data)); again != Source(program) {
+			t.Fatalf("seed %d: Generate is not deterministic", seed)
+		}
+		// Source 写出的源码重新解析之后必须是同一个程序
+		p := parser.New(lexer.New(Source(program)))
+		reparsed := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("seed %d: parse errors %v in\n%s", seed, p.Errors(), Source(program))
+		}
+		if reparsed.String() != program.String() {
+			t.Fatalf("seed %d: source does not match the program.\nwant=%s\ngot=%s", seed, program.String(), reparsed.String())
+		}
+	}
+	if got := Source(Generate(nil)); got != "0;\n" {
+		t.Errorf("empty input must generate the simplest program, got=%q", got)
+	}
+}
+
+func TestCategory(t *testing.T) {
+	tests := []struct {
+		message  string
+		category string
+	}{
+		{"", CategoryNone},
+		{"type mismatch: INTEGER + STRING", CategoryType},
+		{"unsupported types for binary operation: INTEGER STRING", CategoryType},
+		{"unknown operator: -NULL", CategoryType},
+		{"unsupported type for negation: NULL", CategoryType},
+		{"index operator not supported: INTEGER", CategoryType},
+		{"argument to `len` not supported, got INTEGER", CategoryType},
+		{"wrong number of arguments: want=1, got=2", CategoryArity},
+		{"division by zero", CategoryDivision},
+		{"identifier not found: x", CategoryName},
+		{"stack overflow", CategoryLimit},
+		{"step limit exceeded", CategoryLimit},
+		{"something else", CategoryOther},
+	}
+	for _, tt := range tests {
+		if got := (Outcome{Error: tt.message}).Category(); got != tt.category {
+			t.Errorf("wrong category for %q. want=%q, got=%q", tt.message, tt.category, got)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for seed := int64(0); seed < 2000; seed++ {
+		if err := Check(Generate(randomData(seed))); err != nil {
+			t.Fatalf("seed %d: %s", seed, err)
+		}
+	}
+}
+
+func FuzzEngines(f *testing.F) {
+	for seed := int64(0); seed < 16; seed++ {
+		f.Add(randomData(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := Check(Generate(data)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,417 @@
+// Package fuzz 对比求值器和虚拟机的执行结果。Generate 用语法树的类型构造类型正确的随机程序，
+// Check 用两种引擎执行同一个程序，结果的 Inspect() 或者错误的类别不同时报告差异。
+package fuzz
+
+import (
+	"interpreter/ast"
+	"interpreter/token"
+	"strconv"
+)
+
+const (
+	// maxDepth 是表达式的最大嵌套深度，超过后只生成字面量和变量
+	maxDepth = 5
+	// maxStatements 是主程序和函数体中 let 语句的最大个数
+	maxStatements = 6
+)
+
+// kind 是生成的表达式的类型
+type kind int
+
+const (
+	intKind kind = iota
+	boolKind
+	stringKind
+	// arrayKind 是元素为整数的数组
+	arrayKind
+	// hashKind 是键为字符串、值为整数的哈希
+	hashKind
+	// funcKind 是参数和返回值都是整数的函数
+	funcKind
+)
+
+// valueKinds 是程序最后一个表达式可以使用的类型。函数的 Inspect() 在两种引擎中不同，不参与比较
+var valueKinds = []kind{intKind, boolKind, stringKind, arrayKind, hashKind}
+
+type variable struct {
+	name string
+	kind kind
+	// arity 是函数的参数个数
+	arity int
+}
+
+// generator 从 data 中依次读出每一次选择，data 用完之后总是选择第一种，
+// 也就是字面量，所以任意的输入都能生成有限的程序
+type generator struct {
+	data   []byte
+	pos    int
+	depth  int
+	scopes [][]variable
+	names  int
+}
+
+// Generate 根据 data 生成一个程序，相同的 data 总是生成相同的程序。
+// 程序由若干 let 语句和最后一个表达式组成，除了除以零、下标越界得到 null
+// 之类的情况之外不会出现类型错误，也不会无限递归
+func Generate(data []byte) *ast.Program {
+	g := &generator{data: data, scopes: [][]variable{nil}}
+	program := &ast.Program{}
+	n := g.choose(maxStatements + 1)
+	for i := 0; i < n; i++ {
+		program.Statements = append(program.Statements, g.letStatement())
+	}
+	k := valueKinds[g.choose(len(valueKinds))]
+	program.Statements = append(program.Statements, expressionStatement(g.expression(k)))
+	return program
+}
+
+func (g *generator) choose(n int) int {
+	if g.pos >= len(g.data) {
+		return 0
+	}
+	b := g.data[g.pos]
+	g.pos++
+	return int(b) % n
+}
+
+// newName 返回一个没有用过的名字。标识符中不能有数字，所以用字母计数
+func (g *generator) newName() string {
+	n := g.names
+	g.names++
+	name := ""
+	for {
+		name = string(rune('a'+n%26)) + name
+		n /= 26
+		if n == 0 {
+			break
+		}
+		n--
+	}
+	return "v" + name
+}
+
+func (g *generator) define(v variable) {
+	g.scopes[len(g.scopes)-1] = append(g.scopes[len(g.scopes)-1], v)
+}
+
+// lookup 返回所有作用域中类型为 k 的变量
+func (g *generator) lookup(k kind) []variable {
+	var found []variable
+	for _, scope := range g.scopes {
+		for _, v := range scope {
+			if v.kind == k {
+				found = append(found, v)
+			}
+		}
+	}
+	return found
+}
+
+func (g *generator) letStatement() ast.Statement {
+	k := kind(g.choose(int(funcKind) + 1))
+	v := variable{name: g.newName(), kind: k}
+	var value ast.Expression
+	if k == funcKind {
+		fn := g.function(1 + g.choose(2))
+		fn.Name = v.name
+		v.arity = len(fn.Parameters)
+		value = fn
+	} else {
+		value = g.expression(k)
+	}
+	// 变量在值生成之后才定义，所以函数不会调用自己
+	g.define(v)
+	return &ast.LetStatement{Token: tok(token.LET, "let"), Name: identifier(v.name), Value: value}
+}
+
+func (g *generator) expression(k kind) ast.Expression {
+	g.depth++
+	defer func() { g.depth-- }()
+	if g.depth > maxDepth {
+		if g.choose(2) == 1 {
+			if vars := g.lookup(k); len(vars) > 0 && k != funcKind {
+				return identifier(vars[g.choose(len(vars))].name)
+			}
+		}
+		return g.literal(k)
+	}
+	switch k {
+	case intKind:
+		return g.intExpression()
+	case boolKind:
+		return g.boolExpression()
+	case stringKind:
+		return g.stringExpression()
+	case arrayKind:
+		return g.arrayExpression()
+	case hashKind:
+		return g.hashExpression()
+	}
+	return g.function(1 + g.choose(2))
+}
+
+// variableOr 返回一个类型为 k 的变量，没有这样的变量时返回字面量
+func (g *generator) variableOr(k kind) ast.Expression {
+	vars := g.lookup(k)
+	if len(vars) == 0 {
+		return g.literal(k)
+	}
+	return identifier(vars[g.choose(len(vars))].name)
+}
+
+func (g *generator) literal(k kind) ast.Expression {
+	switch k {
+	case intKind:
+		values := []int64{0, 1, 2, 3, 5, 7, 10, 42, 100, 1 << 31, 1<<63 - 1}
+		v := values[g.choose(len(values))]
+		return &ast.IntegerLiteral{Token: tok(token.INT, strconv.FormatInt(v, 10)), Value: v}
+	case boolKind:
+		if g.choose(2) == 0 {
+			return &ast.Boolean{Token: tok(token.TRUE, "true"), Value: true}
+		}
+		return &ast.Boolean{Token: tok(token.FALSE, "false"), Value: false}
+	case stringKind:
+		values := []string{"", "a", "b", "ab", "monkey", "Hello World"}
+		v := values[g.choose(len(values))]
+		return &ast.StringLiteral{Token: tok(token.STRING, v), Value: v}
+	case arrayKind:
+		array := &ast.ArrayLiteral{Token: tok(token.LBRACKET, "[")}
+		n := g.choose(4)
+		for i := 0; i < n; i++ {
+			array.Elements = append(array.Elements, g.expression(intKind))
+		}
+		return array
+	case hashKind:
+		hash := &ast.HashLiteral{Token: tok(token.LBRACE, "{")}
+		n := g.choose(4)
+		for i := 0; i < n; i++ {
+			hash.Pairs = append(hash.Pairs, ast.HashPair{Key: g.expression(stringKind), Value: g.expression(intKind)})
+		}
+		return hash
+	}
+	return g.function(1)
+}
+
+func (g *generator) intExpression() ast.Expression {
+	switch g.choose(11) {
+	case 1:
+		return g.variableOr(intKind)
+	case 2:
+		return prefix("-", g.expression(intKind))
+	case 3:
+		operators := []string{"+", "-", "*", "/"}
+		return infix(g.expression(intKind), operators[g.choose(len(operators))], g.expression(intKind))
+	case 4:
+		return g.ifExpression(intKind)
+	case 5:
+		return g.call()
+	case 6:
+		if g.choose(2) == 0 {
+			return builtin("len", g.expression(stringKind))
+		}
+		return builtin("len", g.expression(arrayKind))
+	case 7:
+		fn := g.function(1)
+		return &ast.CallExpression{Token: tok(token.LPAREN, "("), Function: fn, Arguments: []ast.Expression{g.expression(intKind)}}
+	case 8:
+		return builtin("reduce", g.expression(arrayKind), g.expression(intKind), g.lambda(intKind, 2))
+	case 9:
+		// 下标多数时候是较小的字面量，越界得到的 null 会让后面的运算都变成类型错误
+		if g.choose(4) == 0 {
+			return index(g.expression(arrayKind), g.expression(intKind))
+		}
+		i := int64(g.choose(3))
+		return index(g.expression(arrayKind), &ast.IntegerLiteral{Token: tok(token.INT, strconv.FormatInt(i, 10)), Value: i})
+	case 10:
+		return index(g.expression(hashKind), g.expression(stringKind))
+	}
+	return g.literal(intKind)
+}
+
+func (g *generator) boolExpression() ast.Expression {
+	switch g.choose(7) {
+	case 1:
+		return g.variableOr(boolKind)
+	case 2:
+		return prefix("!", g.expression(boolKind))
+	case 3:
+		operators := []string{"<", ">", "==", "!="}
+		return infix(g.expression(intKind), operators[g.choose(len(operators))], g.expression(intKind))
+	case 4:
+		operators := []string{"<", ">", "==", "!="}
+		return infix(g.expression(stringKind), operators[g.choose(len(operators))], g.expression(stringKind))
+	case 5:
+		operators := []string{"==", "!="}
+		return infix(g.expression(boolKind), operators[g.choose(len(operators))], g.expression(boolKind))
+	case 6:
+		return g.ifExpression(boolKind)
+	}
+	return g.literal(boolKind)
+}
+
+func (g *generator) stringExpression() ast.Expression {
+	switch g.choose(6) {
+	case 1:
+		return g.variableOr(stringKind)
+	case 2:
+		return infix(g.expression(stringKind), "+", g.expression(stringKind))
+	case 3:
+		return g.ifExpression(stringKind)
+	case 4:
+		return builtin("upper", g.expression(stringKind))
+	case 5:
+		return builtin("lower", g.expression(stringKind))
+	}
+	return g.literal(stringKind)
+}
+
+func (g *generator) arrayExpression() ast.Expression {
+	switch g.choose(9) {
+	case 1:
+		return g.variableOr(arrayKind)
+	case 2:
+		return builtin("push", g.expression(arrayKind), g.expression(intKind))
+	case 3:
+		return builtin("rest", g.expression(arrayKind))
+	case 4:
+		return builtin("map", g.expression(arrayKind), g.lambda(intKind, 1))
+	case 5:
+		return builtin("filter", g.expression(arrayKind), g.lambda(boolKind, 1))
+	case 6:
+		return builtin("reverse", g.expression(arrayKind))
+	case 7:
+		return builtin("sort", g.expression(arrayKind))
+	case 8:
+		return g.ifExpression(arrayKind)
+	}
+	return g.literal(arrayKind)
+}
+
+func (g *generator) hashExpression() ast.Expression {
+	switch g.choose(3) {
+	case 1:
+		return g.variableOr(hashKind)
+	case 2:
+		return g.ifExpression(hashKind)
+	}
+	return g.literal(hashKind)
+}
+
+func (g *generator) ifExpression(k kind) ast.Expression {
+	return &ast.IfExpression{
+		Token:       tok(token.IF, "if"),
+		Condition:   g.expression(boolKind),
+		Consequence: block(expressionStatement(g.expression(k))),
+		Alternative: block(expressionStatement(g.expression(k))),
+	}
+}
+
+// call 调用一个函数变量，没有函数变量时调用一个函数字面量
+func (g *generator) call() ast.Expression {
+	vars := g.lookup(funcKind)
+	var fn ast.Expression
+	arity := 1
+	if len(vars) == 0 {
+		f := g.function(arity)
+		fn = f
+	} else {
+		v := vars[g.choose(len(vars))]
+		fn, arity = identifier(v.name), v.arity
+	}
+	call := &ast.CallExpression{Token: tok(token.LPAREN, "("), Function: fn}
+	for i := 0; i < arity; i++ {
+		call.Arguments = append(call.Arguments, g.expression(intKind))
+	}
+	return call
+}
+
+// function 生成一个有 arity 个整数参数、返回整数的函数。函数体中可以定义局部变量、
+// 提前返回，也可以引用外层的变量，也就是闭包
+func (g *generator) function(arity int) *ast.FunctionLiteral {
+	fn := &ast.FunctionLiteral{Token: tok(token.FUNCTION, "fn")}
+	g.scopes = append(g.scopes, nil)
+	g.depth++
+	defer func() {
+		g.scopes = g.scopes[:len(g.scopes)-1]
+		g.depth--
+	}()
+	for i := 0; i < arity; i++ {
+		name := g.newName()
+		fn.Parameters = append(fn.Parameters, identifier(name))
+		g.define(variable{name: name, kind: intKind})
+	}
+	body := block()
+	n := 0
+	if g.depth <= maxDepth {
+		n = g.choose(3)
+	}
+	for i := 0; i < n; i++ {
+		body.Statements = append(body.Statements, g.letStatement())
+	}
+	if g.choose(3) == 1 {
+		// if (cond) { return x; } 提前返回
+		early := &ast.IfExpression{
+			Token:       tok(token.IF, "if"),
+			Condition:   g.expression(boolKind),
+			Consequence: block(returnStatement(g.expression(intKind))),
+		}
+		body.Statements = append(body.Statements, expressionStatement(early))
+	}
+	if g.choose(2) == 1 {
+		body.Statements = append(body.Statements, returnStatement(g.expression(intKind)))
+	} else {
+		body.Statements = append(body.Statements, expressionStatement(g.expression(intKind)))
+	}
+	fn.Body = body
+	return fn
+}
+
+// lambda 生成传给 map、filter 和 reduce 的函数，参数都是整数
+func (g *generator) lambda(result kind, arity int) *ast.FunctionLiteral {
+	fn := &ast.FunctionLiteral{Token: tok(token.FUNCTION, "fn")}
+	g.scopes = append(g.scopes, nil)
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+	for i := 0; i < arity; i++ {
+		name := g.newName()
+		fn.Parameters = append(fn.Parameters, identifier(name))
+		g.define(variable{name: name, kind: intKind})
+	}
+	fn.Body = block(expressionStatement(g.expression(result)))
+	return fn
+}
+
+func tok(t token.TokenType, literal string) token.Token {
+	return token.Token{Type: t, Literal: literal}
+}
+
+func identifier(name string) *ast.Identifier {
+	return &ast.Identifier{Token: tok(token.IDENT, name), Value: name}
+}
+
+func builtin(name string, args ...ast.Expression) ast.Expression {
+	return &ast.CallExpression{Token: tok(token.LPAREN, "("), Function: identifier(name), Arguments: args}
+}
+
+func prefix(operator string, right ast.Expression) ast.Expression {
+	return &ast.PrefixExpression{Token: tok(token.TokenType(operator), operator), Operator: operator, Right: right}
+}
+
+func infix(left ast.Expression, operator string, right ast.Expression) ast.Expression {
+	return &ast.InfixExpression{Token: tok(token.TokenType(operator), operator), Left: left, Operator: operator, Right: right}
+}
+
+func index(left, idx ast.Expression) ast.Expression {
+	return &ast.IndexExpression{Token: tok(token.LBRACKET, "["), Left: left, Index: idx}
+}
+
+func block(stmts ...ast.Statement) *ast.BlockStatement {
+	return &ast.BlockStatement{Token: tok(token.LBRACE, "{"), Statements: stmts, Rbrace: tok(token.RBRACE, "}")}
+}
+
+func expressionStatement(expr ast.Expression) ast.Statement {
+	return &ast.ExpressionStatement{Token: token.Token{Literal: expr.TokenLiteral()}, Expression: expr}
+}
+
+func returnStatement(expr ast.Expression) ast.Statement {
+	return &ast.ReturnStatement{Token: tok(token.RETURN, "return"), ReturnValue: expr}
+}
@@ -0,0 +1,129 @@
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/format"
+	"strconv"
+)
+
+// Source 把生成的程序写成可以重新解析的 Monkey 源码，用于报告差异。
+// ast.Node 的 String() 不给字符串加引号，不能直接用
+func Source(program *ast.Program) string {
+	var out bytes.Buffer
+	for _, stmt := range program.Statements {
+		writeStatement(&out, stmt)
+		out.WriteString("\n")
+	}
+	if formatted, err := format.Source(out.Bytes()); err == nil {
+		return string(formatted)
+	}
+	return out.String()
+}
+
+func writeStatement(out *bytes.Buffer, stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		fmt.Fprintf(out, "let %s = ", stmt.Name.Value)
+		writeExpression(out, stmt.Value)
+	case *ast.ReturnStatement:
+		out.WriteString("return ")
+		writeExpression(out, stmt.ReturnValue)
+	case *ast.ExpressionStatement:
+		writeExpression(out, stmt.Expression)
+	}
+	out.WriteString(";")
+}
+
+func writeBlock(out *bytes.Buffer, block *ast.BlockStatement) {
+	out.WriteString("{ ")
+	for _, stmt := range block.Statements {
+		writeStatement(out, stmt)
+		out.WriteString(" ")
+	}
+	out.WriteString("}")
+}
+
+func writeExpression(out *bytes.Buffer, expr ast.Expression) {
+	switch expr := expr.(type) {
+	case *ast.Identifier:
+		out.WriteString(expr.Value)
+	case *ast.IntegerLiteral:
+		out.WriteString(strconv.FormatInt(expr.Value, 10))
+	case *ast.Boolean:
+		out.WriteString(strconv.FormatBool(expr.Value))
+	case *ast.StringLiteral:
+		// 生成的字符串中没有引号，Monkey 的字符串也没有转义
+		out.WriteString(`"` + expr.Value + `"`)
+	case *ast.PrefixExpression:
+		out.WriteString("(" + expr.Operator)
+		writeExpression(out, expr.Right)
+		out.WriteString(")")
+	case *ast.InfixExpression:
+		out.WriteString("(")
+		writeExpression(out, expr.Left)
+		out.WriteString(" " + expr.Operator + " ")
+		writeExpression(out, expr.Right)
+		out.WriteString(")")
+	case *ast.IfExpression:
+		out.WriteString("if (")
+		writeExpression(out, expr.Condition)
+		out.WriteString(") ")
+		writeBlock(out, expr.Consequence)
+		if expr.Alternative != nil {
+			out.WriteString(" else ")
+			writeBlock(out, expr.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		out.WriteString("fn(")
+		for i, p := range expr.Parameters {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			out.WriteString(p.Value)
+		}
+		out.WriteString(") ")
+		writeBlock(out, expr.Body)
+	case *ast.CallExpression:
+		if _, ok := expr.Function.(*ast.FunctionLiteral); ok {
+			out.WriteString("(")
+			writeExpression(out, expr.Function)
+			out.WriteString(")")
+		} else {
+			writeExpression(out, expr.Function)
+		}
+		writeList(out, "(", expr.Arguments, ")")
+	case *ast.ArrayLiteral:
+		writeList(out, "[", expr.Elements, "]")
+	case *ast.HashLiteral:
+		out.WriteString("{")
+		for i, pair := range expr.Pairs {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			writeExpression(out, pair.Key)
+			out.WriteString(": ")
+			writeExpression(out, pair.Value)
+		}
+		out.WriteString("}")
+	case *ast.IndexExpression:
+		// 左边可能是 if 表达式，加上括号才能正确解析
+		out.WriteString("(")
+		writeExpression(out, expr.Left)
+		out.WriteString(")[")
+		writeExpression(out, expr.Index)
+		out.WriteString("]")
+	}
+}
+
+func writeList(out *bytes.Buffer, open string, exprs []ast.Expression, close string) {
+	out.WriteString(open)
+	for i, e := range exprs {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		writeExpression(out, e)
+	}
+	out.WriteString(close)
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for _, msg := range []interface{}{map[string]int{"seq": 1}, "second"} {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.HasPrefix(buf.String(), "Content-Length: 9\r\n\r\n{\"seq\":1}") {
+		t.Fatalf("wrong framing. got=%q", buf.String())
+	}
+	r := bufio.NewReader(&buf)
+	for _, want := range []string{`{"seq":1}`, `"second"`} {
+		body, err := ReadMessage(r)
+		if err != nil || string(body) != want {
+			t.Errorf("want=%s, got=%s (%v)", want, body, err)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Content-Type: json\r\n\r\n{}", "missing Content-Length header"},
+		{"Content-Length: -1\r\n\r\n", `invalid Content-Length "-1"`},
+		{"Content-Length: x\r\n\r\n", `invalid Content-Length "x"`},
+		{"no colon\r\n\r\n", `invalid header "no colon"`},
+		{"Content-Length: 5\r\n\r\n{}", "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		_, err := ReadMessage(bufio.NewReader(strings.NewReader(tt.input)))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%q: want error %q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
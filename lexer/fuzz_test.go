@@ -0,0 +1,39 @@
+package lexer
+
+import (
+	"interpreter/token"
+	"testing"
+)
+
+func FuzzNextToken(f *testing.F) {
+	for _, seed := range []string{
+		"let five = 5; let add = fn(x, y) { x + y; };",
+		"!-/*5; 5 < 10 > 5; 10 == 10; 10 != 9;",
+		`"foobar" "foo bar" [1, 2]; {"foo": "bar"}`,
+		"macro(x, y) { x + y; }; // comment\n",
+		`"unterminated`,
+		"a\x00b",
+		"// only a comment",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		l := New(input)
+		// 除了 EOF 之外每个记号至少消耗一个字节
+		for i := 0; ; i++ {
+			if i > len(input) {
+				t.Fatalf("no EOF after %d tokens", i)
+			}
+			tok := l.NextToken()
+			if tok.Type == token.EOF {
+				break
+			}
+			if tok.Line < 1 || tok.Column < 1 {
+				t.Fatalf("invalid position %d:%d for %q", tok.Line, tok.Column, tok.Literal)
+			}
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Fatalf("expected EOF after EOF, got %s", tok.Type)
+		}
+	})
+}
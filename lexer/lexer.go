@@ -1,21 +1,33 @@
 package lexer
 
-import "interpreter/token"
+import (
+	"interpreter/token"
+	"strings"
+)
 
 type Lexer struct {
 	input        string
 	position     int
 	readPosition int
 	ch           byte
+	line         int
+	column       int
+	comments     []token.Token
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -28,6 +40,7 @@ func (l *Lexer) readChar() {
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 	l.skipWhitespace()
+	line, column := l.line, l.column
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
@@ -70,8 +83,14 @@ func (l *Lexer) NextToken() token.Token {
 	case '>':
 		tok = newToken(token.GT, l.ch)
 	case '"':
+		str, ok := l.readString()
+		if !ok {
+			// 没有结束引号时整个剩余部分作为非法记号，字面量保留开始的引号
+			tok = token.Token{Type: token.ILLEGAL, Literal: l.input[l.position-len(str)-1:]}
+			break
+		}
 		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok.Literal = str
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
@@ -79,22 +98,30 @@ func (l *Lexer) NextToken() token.Token {
 	case ':':
 		tok = newToken(token.COLON, l.ch)
 	case 0:
-		tok.Literal = ""
-		tok.Type = token.EOF
+		if l.atEnd() {
+			tok.Literal = ""
+			tok.Type = token.EOF
+		} else {
+			// 输入中间的 NUL 字节不是输入的结束
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	default:
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = token.INT
 			tok.Literal = l.readDigit()
+			tok.Line, tok.Column = line, column
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 	l.readChar()
+	tok.Line, tok.Column = line, column
 	return tok
 }
 
@@ -114,10 +141,33 @@ func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
 
+// skipWhitespace 跳过空白和注释，注释被保存下来供格式化工具使用
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r':
+			l.readChar()
+		case l.ch == '/' && l.peekChar() == '/':
+			l.readComment()
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) readComment() {
+	tok := token.Token{Type: token.COMMENT, Line: l.line, Column: l.column}
+	position := l.position
+	for l.ch != '\n' && !l.atEnd() {
 		l.readChar()
 	}
+	tok.Literal = strings.TrimRight(l.input[position:l.position], " \t\r")
+	l.comments = append(l.comments, tok)
+}
+
+// Comments 返回到目前为止跳过的所有注释，按出现的顺序排列
+func (l *Lexer) Comments() []token.Token {
+	return l.comments
 }
 
 func (l *Lexer) readDigit() string {
@@ -128,15 +178,23 @@ func (l *Lexer) readDigit() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readString() string {
+// readString 读出引号之间的内容，到输入结束也没有遇到结束引号时 ok 为 false
+func (l *Lexer) readString() (str string, ok bool) {
 	position := l.position + 1
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		if l.atEnd() {
+			return l.input[position:], false
+		}
+		if l.ch == '"' {
+			return l.input[position:l.position], true
 		}
 	}
-	return l.input[position:l.position]
+}
+
+// atEnd 报告是否已经读完输入，输入中的 NUL 字节不算结束
+func (l *Lexer) atEnd() bool {
+	return l.position >= len(l.input)
 }
 
 func (l *Lexer) peekChar() byte {
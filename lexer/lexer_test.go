@@ -147,3 +147,95 @@ macro(x, y) { x + y; };
 		}
 	}
 }
+
+func TestTokenPosition(t *testing.T) {
+	input := "let x = 5;\n  x == \"a b\"\n\tfn"
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"x", 1, 5},
+		{"=", 1, 7},
+		{"5", 1, 9},
+		{";", 1, 10},
+		{"x", 2, 3},
+		{"==", 2, 5},
+		{"a b", 2, 8},
+		{"fn", 3, 2},
+		{"", 3, 4},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Errorf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := "// header\nlet x = 10 / 2; // five  \n//\nx"
+	l := New(input)
+	var types []token.TokenType
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		types = append(types, tok.Type)
+	}
+	expectedTypes := []token.TokenType{token.LET, token.IDENT, token.ASSIGN, token.INT, token.SLASH, token.INT, token.SEMICOLON, token.IDENT}
+	if len(types) != len(expectedTypes) {
+		t.Fatalf("wrong tokens. expected=%v, got=%v", expectedTypes, types)
+	}
+	for i := range types {
+		if types[i] != expectedTypes[i] {
+			t.Fatalf("wrong tokens. expected=%v, got=%v", expectedTypes, types)
+		}
+	}
+
+	expected := []token.Token{
+		{Type: token.COMMENT, Literal: "// header", Line: 1, Column: 1},
+		{Type: token.COMMENT, Literal: "// five", Line: 2, Column: 17},
+		{Type: token.COMMENT, Literal: "//", Line: 3, Column: 1},
+	}
+	comments := l.Comments()
+	if len(comments) != len(expected) {
+		t.Fatalf("wrong number of comments. expected=%d, got=%d", len(expected), len(comments))
+	}
+	for i, c := range comments {
+		if c != expected[i] {
+			t.Errorf("comments[%d] wrong. expected=%+v, got=%+v", i, expected[i], c)
+		}
+	}
+}
+
+func TestIllegalInput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{`"abc`, []token.Token{{Type: token.ILLEGAL, Literal: `"abc`}}},
+		{`x "a`, []token.Token{{Type: token.IDENT, Literal: "x"}, {Type: token.ILLEGAL, Literal: `"a`}}},
+		{`"`, []token.Token{{Type: token.ILLEGAL, Literal: `"`}}},
+		{"a\x00b", []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.ILLEGAL, Literal: "\x00"}, {Type: token.IDENT, Literal: "b"}}},
+		{"\"a\x00b\"", []token.Token{{Type: token.STRING, Literal: "a\x00b"}}},
+		{"// a\x00b\nx", []token.Token{{Type: token.IDENT, Literal: "x"}}},
+	}
+	for _, tt := range tests {
+		l := New(tt.input)
+		for i, want := range tt.expected {
+			tok := l.NextToken()
+			if tok.Type != want.Type || tok.Literal != want.Literal {
+				t.Fatalf("%q: tokens[%d] wrong. expected=%s %q, got=%s %q", tt.input, i, want.Type, want.Literal, tok.Type, tok.Literal)
+			}
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Fatalf("%q: expected EOF, got=%s %q", tt.input, tok.Type, tok.Literal)
+		}
+	}
+}
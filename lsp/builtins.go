@@ -0,0 +1,50 @@
+package lsp
+
+import (
+	"fmt"
+	"interpreter/object"
+)
+
+// builtinDocs 是悬停时显示的内置函数签名和说明，问号表示可以省略的参数
+var builtinDocs = map[string][2]string{
+	"len":        {"len(value)", "Returns the length of a string, array or hash."},
+	"put":        {"put(values...)", "Prints each value on its own line and returns null."},
+	"first":      {"first(array)", "Returns the first element of an array, or null when it is empty."},
+	"last":       {"last(array)", "Returns the last element of an array, or null when it is empty."},
+	"rest":       {"rest(array)", "Returns a new array without the first element."},
+	"push":       {"push(array, value)", "Returns a new array with value appended."},
+	"map":        {"map(array, fn)", "Returns a new array with fn applied to every element."},
+	"filter":     {"filter(array, fn)", "Returns the elements for which fn returns a truthy value."},
+	"reduce":     {"reduce(array, initial, fn)", "Folds the array from the left with fn(accumulator, element)."},
+	"sort":       {"sort(array, less?)", "Returns a sorted copy of the array, optionally ordered by less(a, b)."},
+	"range":      {"range(start?, stop, step?)", "Returns at most 16777216 integers from start up to but not including stop."},
+	"zip":        {"zip(arrays...)", "Returns an array of arrays pairing up the elements of each argument."},
+	"keys":       {"keys(hash)", "Returns the keys of a hash in insertion order."},
+	"values":     {"values(hash)", "Returns the values of a hash in insertion order."},
+	"contains":   {"contains(collection, value)", "Reports whether a string, array or hash contains value."},
+	"reverse":    {"reverse(value)", "Returns a reversed copy of a string or array."},
+	"join":       {"join(array, separator?)", "Joins the elements of an array into a string."},
+	"split":      {"split(string, separator)", "Splits a string into an array of strings."},
+	"trim":       {"trim(string, cutset?)", "Removes leading and trailing whitespace or the characters in cutset."},
+	"replace":    {"replace(string, old, new)", "Replaces every occurrence of old with new."},
+	"upper":      {"upper(string)", "Returns the string in upper case."},
+	"lower":      {"lower(string)", "Returns the string in lower case."},
+	"startsWith": {"startsWith(string, prefix)", "Reports whether the string begins with prefix."},
+	"endsWith":   {"endsWith(string, suffix)", "Reports whether the string ends with suffix."},
+	"indexOf":    {"indexOf(string, substring)", "Returns the index of the first occurrence of substring, or -1."},
+	"substring":  {"substring(string, start, end?)", "Returns the part of the string between start and end."},
+	"format":     {"format(template, values...)", "Formats values according to a printf style template."},
+}
+
+// builtinSignature 返回内置函数的签名，没有文档的内置函数只显示参数个数
+func builtinSignature(name string) (signature, doc string) {
+	if d, ok := builtinDocs[name]; ok {
+		return d[0], d[1]
+	}
+	for _, b := range object.Builtins {
+		if b.Name == name {
+			return name + "(...)", fmt.Sprintf("Takes %s arguments.", b.Arity)
+		}
+	}
+	return name, ""
+}
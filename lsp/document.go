@@ -0,0 +1,436 @@
+package lsp
+
+import (
+	"interpreter/analysis"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/lexer"
+	"interpreter/parser"
+	"interpreter/token"
+	"strings"
+)
+
+// binding 是一个 let 或者参数定义的名字，uses 是所有读取它的标识符
+type binding struct {
+	decl  *ast.Identifier
+	param bool
+	// value 是 let 的右边，参数为 nil
+	value ast.Expression
+	uses  []*ast.Identifier
+}
+
+// scope 对应编译器的一层符号表，也就是主程序或者一个函数体
+type scope struct {
+	parent   *scope
+	table    *compiler.SymbolTable
+	bindings map[string]*binding
+	// defined 按定义的顺序保存这一层的绑定，用于补全
+	defined []*binding
+	// function 是通过 let 命名的函数自己的绑定，函数体中可以递归调用
+	function *binding
+	// start 和 end 是函数字面量的 fn 和右花括号，主程序没有范围
+	start, end token.Token
+}
+
+// document 是一个打开的文件和对它的分析结果。
+// 记号的列是字节偏移，LSP 的 Character 是 UTF-16 编码单元的偏移，
+// 在 tokenRange 和 bytePosition 中相互转换。
+type document struct {
+	uri         string
+	text        string
+	lines       []string
+	program     *ast.Program
+	parseErrors []parser.Error
+
+	// idents 是文档中所有的标识符，包括定义和使用
+	idents   []*ast.Identifier
+	refs     map[*ast.Identifier]*binding
+	builtins map[*ast.Identifier]string
+	bindings []*binding
+	scopes   []*scope
+}
+
+func newDocument(uri, text string) *document {
+	p := parser.New(lexer.New(text))
+	d := &document{
+		uri:      uri,
+		text:     text,
+		lines:    strings.Split(text, "\n"),
+		program:  p.ParseProgram(),
+		refs:     map[*ast.Identifier]*binding{},
+		builtins: map[*ast.Identifier]string{},
+	}
+	d.parseErrors = p.ErrorDetails()
+	r := &resolver{doc: d}
+	r.enterScope(compiler.New().SymbolTable())
+	r.statements(d.program.Statements)
+	return d
+}
+
+// diagnostics 返回语法错误，没有语法错误时返回静态分析的结果
+func (d *document) diagnostics() []Diagnostic {
+	result := []Diagnostic{}
+	for _, e := range d.parseErrors {
+		result = append(result, Diagnostic{
+			Range:    d.tokenRange(e.Token),
+			Severity: SeverityError,
+			Code:     "syntax",
+			Source:   "monkey",
+			Message:  e.Message,
+		})
+	}
+	if len(d.parseErrors) != 0 {
+		return result
+	}
+	for _, diag := range analysis.Analyze(d.program) {
+		severity := SeverityWarning
+		if diag.Severity == analysis.Error {
+			severity = SeverityError
+		}
+		length := 1
+		if ident := d.identAt(Position{Line: diag.Line - 1, Character: diag.Column - 1}); ident != nil {
+			length = len(ident.Value)
+		}
+		line := diag.Line - 1
+		result = append(result, Diagnostic{
+			Range: Range{
+				Start: Position{Line: line, Character: d.utf16Column(line, diag.Column-1)},
+				End:   Position{Line: line, Character: d.utf16Column(line, diag.Column-1+length)},
+			},
+			Severity: severity,
+			Code:     diag.Code,
+			Source:   "monkey",
+			Message:  diag.Message,
+		})
+	}
+	return result
+}
+
+// identAt 返回覆盖 pos 的标识符，光标紧跟在标识符之后也算。pos 的列是字节偏移
+func (d *document) identAt(pos Position) *ast.Identifier {
+	for _, ident := range d.idents {
+		start := ident.Token.Column - 1
+		if ident.Token.Line-1 == pos.Line && start <= pos.Character && pos.Character <= start+len(ident.Value) {
+			return ident
+		}
+	}
+	return nil
+}
+
+// visible 返回在 pos 处可以访问的绑定，内层的名字遮蔽外层的同名绑定。pos 的列是字节偏移
+func (d *document) visible(pos Position) []*binding {
+	var innermost *scope
+	for _, s := range d.scopes {
+		if s.parent == nil || contains(s, pos) {
+			innermost = s
+		}
+	}
+	var result []*binding
+	seen := map[string]bool{}
+	add := func(b *binding) {
+		if !seen[b.decl.Value] && before(b.decl.Token, pos) {
+			seen[b.decl.Value] = true
+			result = append(result, b)
+		}
+	}
+	for s := innermost; s != nil; s = s.parent {
+		for i := len(s.defined) - 1; i >= 0; i-- {
+			add(s.defined[i])
+		}
+		if s.function != nil {
+			add(s.function)
+		}
+	}
+	return result
+}
+
+// contains 判断 pos 是否在函数字面量的范围之内
+func contains(s *scope, pos Position) bool {
+	return before(s.start, pos) && !before(s.end, pos)
+}
+
+// before 判断记号是否在 pos 之前开始
+func before(tok token.Token, pos Position) bool {
+	line, column := tok.Line-1, tok.Column-1
+	return line < pos.Line || line == pos.Line && column < pos.Character
+}
+
+// tokenRange 返回记号在 LSP 中的范围
+func (d *document) tokenRange(tok token.Token) Range {
+	line, column := tok.Line-1, tok.Column-1
+	if line < 0 {
+		line, column = 0, 0
+	}
+	length := len(tok.Literal)
+	if length == 0 {
+		length = 1
+	}
+	return Range{
+		Start: Position{Line: line, Character: d.utf16Column(line, column)},
+		End:   Position{Line: line, Character: d.utf16Column(line, column+length)},
+	}
+}
+
+// utf16Column 把第 line 行的字节偏移转换成 UTF-16 编码单元的偏移
+func (d *document) utf16Column(line, column int) int {
+	if line >= len(d.lines) {
+		return column
+	}
+	text := d.lines[line]
+	if column > len(text) {
+		// 超出行尾的部分（例如文件结尾的记号）按一个字节一个单元计算
+		return d.utf16Column(line, len(text)) + column - len(text)
+	}
+	units := 0
+	for _, r := range text[:column] {
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+	}
+	return units
+}
+
+// bytePosition 把客户端发来的 UTF-16 位置转换成字节偏移的位置
+func (d *document) bytePosition(pos Position) Position {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return pos
+	}
+	units := 0
+	for i, r := range d.lines[pos.Line] {
+		if units >= pos.Character {
+			return Position{Line: pos.Line, Character: i}
+		}
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+	}
+	return Position{Line: pos.Line, Character: len(d.lines[pos.Line]) + pos.Character - units}
+}
+
+func (d *document) location(ident *ast.Identifier) Location {
+	return Location{URI: d.uri, Range: d.tokenRange(ident.Token)}
+}
+
+// end 返回节点中最后一个记号结束的位置
+func (d *document) end(node ast.Node) Position {
+	var last Position
+	ast.Inspect(node, func(n ast.Node) bool {
+		var toks []token.Token
+		switch n := n.(type) {
+		case *ast.BlockStatement:
+			toks = []token.Token{n.Token, n.Rbrace}
+		case *ast.LetStatement:
+			toks = []token.Token{n.Token}
+		case *ast.ReturnStatement:
+			toks = []token.Token{n.Token}
+		case *ast.Identifier:
+			toks = []token.Token{n.Token}
+		case *ast.IntegerLiteral:
+			toks = []token.Token{n.Token}
+		case *ast.StringLiteral:
+			// 记号的字面量不包括两边的引号
+			tok := n.Token
+			tok.Literal = `"` + tok.Literal + `"`
+			toks = []token.Token{tok}
+		case *ast.Boolean:
+			toks = []token.Token{n.Token}
+		case *ast.PrefixExpression:
+			toks = []token.Token{n.Token}
+		}
+		for _, tok := range toks {
+			pos := d.tokenRange(tok).End
+			if pos.Line > last.Line || pos.Line == last.Line && pos.Character > last.Character {
+				last = pos
+			}
+		}
+		return n != nil
+	})
+	return last
+}
+
+// symbols 返回语句列表中 let 定义的名字，函数中的 let 作为子符号
+func (d *document) symbols(list []ast.Statement) []DocumentSymbol {
+	result := []DocumentSymbol{}
+	for _, s := range list {
+		let, ok := s.(*ast.LetStatement)
+		if !ok {
+			continue
+		}
+		symbol := DocumentSymbol{
+			Name:           let.Name.Value,
+			Kind:           SymbolVariable,
+			Range:          Range{Start: d.tokenRange(let.Token).Start, End: d.end(let)},
+			SelectionRange: d.tokenRange(let.Name.Token),
+		}
+		if fn, ok := let.Value.(*ast.FunctionLiteral); ok {
+			symbol.Kind = SymbolFunction
+			symbol.Detail = "fn" + parameterList(fn.Parameters)
+			if fn.Body != nil {
+				if children := d.symbols(fn.Body.Statements); len(children) != 0 {
+					symbol.Children = children
+				}
+			}
+		}
+		result = append(result, symbol)
+	}
+	return result
+}
+
+func parameterList(params []*ast.Identifier) string {
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = p.Value
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// resolver 按照编译器的作用域规则把每个标识符对应到它的定义
+type resolver struct {
+	doc    *document
+	scopes []*scope
+	// naming 是正在处理的 let，它的值是函数字面量时函数可以递归调用自己
+	naming *binding
+}
+
+func (r *resolver) current() *scope {
+	return r.scopes[len(r.scopes)-1]
+}
+
+func (r *resolver) enterScope(table *compiler.SymbolTable) *scope {
+	s := &scope{table: table, bindings: map[string]*binding{}}
+	if len(r.scopes) > 0 {
+		s.parent = r.current()
+	}
+	r.scopes = append(r.scopes, s)
+	r.doc.scopes = append(r.doc.scopes, s)
+	return s
+}
+
+func (r *resolver) leaveScope() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+func (r *resolver) define(b *binding) {
+	s := r.current()
+	s.table.Define(b.decl.Value)
+	s.bindings[b.decl.Value] = b
+	s.defined = append(s.defined, b)
+	r.doc.bindings = append(r.doc.bindings, b)
+	r.doc.idents = append(r.doc.idents, b.decl)
+	r.doc.refs[b.decl] = b
+}
+
+// use 解析一个被读取的名字，符号表找不到的名字不记录
+func (r *resolver) use(ident *ast.Identifier) {
+	r.doc.idents = append(r.doc.idents, ident)
+	symbol, ok := r.current().table.Resolve(ident.Value)
+	if !ok {
+		return
+	}
+	if symbol.Scope == compiler.BuiltinScope {
+		r.doc.builtins[ident] = ident.Value
+		return
+	}
+	for s := r.current(); s != nil; s = s.parent {
+		b, ok := s.bindings[ident.Value]
+		if !ok && s.function != nil && s.function.decl.Value == ident.Value {
+			b, ok = s.function, true
+		}
+		if ok {
+			b.uses = append(b.uses, ident)
+			r.doc.refs[ident] = b
+			return
+		}
+	}
+}
+
+func (r *resolver) statements(list []ast.Statement) {
+	for _, s := range list {
+		r.node(s)
+	}
+}
+
+func (r *resolver) node(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		// 与编译器一样先处理右边的值再定义名字
+		b := &binding{decl: node.Name, value: node.Value}
+		r.naming = b
+		r.expression(node.Value)
+		r.naming = nil
+		r.define(b)
+	case *ast.ReturnStatement:
+		r.expression(node.ReturnValue)
+	case *ast.ExpressionStatement:
+		r.expression(node.Expression)
+	case *ast.BlockStatement:
+		r.statements(node.Statements)
+	case *ast.Identifier:
+		r.use(node)
+	case *ast.PrefixExpression:
+		r.expression(node.Right)
+	case *ast.InfixExpression:
+		r.expression(node.Left)
+		r.expression(node.Right)
+	case *ast.IfExpression:
+		r.expression(node.Condition)
+		if node.Consequence != nil {
+			r.node(node.Consequence)
+		}
+		if node.Alternative != nil {
+			r.node(node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		naming := r.naming
+		r.naming = nil
+		s := r.enterScope(compiler.NewEnclosedSymbolTable(r.current().table))
+		s.start = node.Token
+		if node.Name != "" && naming != nil && naming.decl.Value == node.Name {
+			s.table.DefineFunctionName(node.Name)
+			s.function = naming
+		}
+		r.function(node.Parameters, node.Body)
+	case *ast.MacroLiteral:
+		r.naming = nil
+		s := r.enterScope(compiler.NewEnclosedSymbolTable(r.current().table))
+		s.start = node.Token
+		r.function(node.Parameters, node.Body)
+	case *ast.CallExpression:
+		r.expression(node.Function)
+		for _, arg := range node.Arguments {
+			r.expression(arg)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			r.expression(el)
+		}
+	case *ast.HashLiteral:
+		for _, pair := range node.Pairs {
+			r.expression(pair.Key)
+			r.expression(pair.Value)
+		}
+	case *ast.IndexExpression:
+		r.expression(node.Left)
+		r.expression(node.Index)
+	}
+}
+
+// function 在已经进入的函数作用域中定义参数并处理函数体
+func (r *resolver) function(params []*ast.Identifier, body *ast.BlockStatement) {
+	for _, p := range params {
+		r.define(&binding{decl: p, param: true})
+	}
+	if body != nil {
+		r.current().end = body.Rbrace
+		r.node(body)
+	}
+	r.leaveScope()
+}
+
+func (r *resolver) expression(e ast.Expression) {
+	if e != nil {
+		r.node(e)
+	}
+}
@@ -0,0 +1,344 @@
+// Package lsp 实现 Monkey 的 Language Server Protocol 服务器，通过标准输入输出
+// 与编辑器通信。它提供诊断、跳转到定义、查找引用、悬停提示、补全、
+// 文档符号和格式化，名字的解析规则与编译器的符号表相同。
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/format"
+	"interpreter/internal/transport"
+	"interpreter/object"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrNoShutdown 表示客户端没有先发送 shutdown 就发送了 exit，按协议应该以非零状态退出
+var ErrNoShutdown = errors.New("exit without shutdown")
+
+var keywords = []string{"fn", "let", "true", "false", "if", "else", "return", "macro"}
+
+type handler func(s *Server, params json.RawMessage) (interface{}, error)
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"initialize":                  (*Server).initialize,
+		"shutdown":                    (*Server).shutdown,
+		"textDocument/definition":     (*Server).definition,
+		"textDocument/references":     (*Server).references,
+		"textDocument/hover":          (*Server).hover,
+		"textDocument/completion":     (*Server).completion,
+		"textDocument/documentSymbol": (*Server).documentSymbol,
+		"textDocument/formatting":     (*Server).formatting,
+	}
+}
+
+// Server 保存打开的文档，一次处理一条消息
+type Server struct {
+	in           *bufio.Reader
+	out          io.Writer
+	docs         map[string]*document
+	shuttingDown bool
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{in: bufio.NewReader(in), out: out, docs: map[string]*document{}}
+}
+
+// Run 处理消息直到收到 exit 或者输入结束。正常退出返回 nil，
+// 没有 shutdown 就退出时返回 ErrNoShutdown
+func (s *Server) Run() error {
+	for {
+		body, err := transport.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			if err := s.replyError(nil, codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shuttingDown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+		if err := s.handle(&req); err != nil {
+			return err
+		}
+	}
+}
+
+// handle 分派一条消息，返回的错误只表示写出响应失败
+func (s *Server) handle(req *request) error {
+	if req.ID == nil {
+		return s.notify(req.Method, req.Params)
+	}
+	if s.shuttingDown {
+		return s.replyError(req.ID, codeInvalidRequest, "server is shutting down")
+	}
+	h, ok := handlers[req.Method]
+	if !ok {
+		return s.replyError(req.ID, codeMethodNotFound, fmt.Sprintf("method not found: %s", req.Method))
+	}
+	result, err := h(s, req.Params)
+	if err != nil {
+		var rerr *responseError
+		if errors.As(err, &rerr) {
+			return s.replyError(req.ID, rerr.Code, rerr.Message)
+		}
+		return s.replyError(req.ID, codeInternalError, err.Error())
+	}
+	return transport.WriteMessage(s.out, response{JSONRPC: "2.0", ID: req.ID, Result: result})
+}
+
+func (s *Server) replyError(id *json.RawMessage, code int, msg string) error {
+	return transport.WriteMessage(s.out, errorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   &responseError{Code: code, Message: msg},
+	})
+}
+
+// notify 处理通知，通知没有响应，所以无法解析的通知直接忽略。
+// 返回的错误只表示写出诊断失败
+func (s *Server) notify(method string, params json.RawMessage) error {
+	switch method {
+	case "textDocument/didOpen":
+		var p DidOpenTextDocumentParams
+		if json.Unmarshal(params, &p) == nil {
+			return s.update(p.TextDocument.URI, p.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var p DidChangeTextDocumentParams
+		if json.Unmarshal(params, &p) == nil && len(p.ContentChanges) > 0 {
+			return s.update(p.TextDocument.URI, p.ContentChanges[len(p.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var p DidCloseTextDocumentParams
+		if json.Unmarshal(params, &p) == nil {
+			delete(s.docs, p.TextDocument.URI)
+			return s.publish(p.TextDocument.URI, []Diagnostic{})
+		}
+	}
+	return nil
+}
+
+// update 重新分析文档并发布诊断
+func (s *Server) update(uri, text string) error {
+	doc := newDocument(uri, text)
+	s.docs[uri] = doc
+	return s.publish(uri, doc.diagnostics())
+}
+
+func (s *Server) publish(uri string, diagnostics []Diagnostic) error {
+	return transport.WriteMessage(s.out, notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  PublishDiagnosticsParams{URI: uri, Diagnostics: diagnostics},
+	})
+}
+
+func decode(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) document(uri string) (*document, error) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		return nil, &responseError{Code: codeInvalidParams, Message: fmt.Sprintf("unknown document %s", uri)}
+	}
+	return doc, nil
+}
+
+func (s *Server) initialize(params json.RawMessage) (interface{}, error) {
+	var result InitializeResult
+	result.ServerInfo.Name = "monkey"
+	result.Capabilities = ServerCapabilities{
+		TextDocumentSync:           syncFull,
+		DefinitionProvider:         true,
+		ReferencesProvider:         true,
+		HoverProvider:              true,
+		CompletionProvider:         json.RawMessage(`{}`),
+		DocumentSymbolProvider:     true,
+		DocumentFormattingProvider: true,
+	}
+	return result, nil
+}
+
+func (s *Server) shutdown(params json.RawMessage) (interface{}, error) {
+	s.shuttingDown = true
+	return nil, nil
+}
+
+// lookup 找到光标处的标识符和它的定义，任何一个找不到时返回 nil
+func (s *Server) lookup(params json.RawMessage, p *TextDocumentPositionParams) (*document, *binding, error) {
+	if err := decode(params, p); err != nil {
+		return nil, nil, err
+	}
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, nil, err
+	}
+	ident := doc.identAt(doc.bytePosition(p.Position))
+	if ident == nil {
+		return doc, nil, nil
+	}
+	return doc, doc.refs[ident], nil
+}
+
+func (s *Server) definition(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+	doc, b, err := s.lookup(params, &p)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	return doc.location(b.decl), nil
+}
+
+func (s *Server) references(params json.RawMessage) (interface{}, error) {
+	var p ReferenceParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	doc, b, err := s.lookup(params, &p.TextDocumentPositionParams)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	locations := []Location{}
+	if p.Context.IncludeDeclaration {
+		locations = append(locations, doc.location(b.decl))
+	}
+	for _, use := range b.uses {
+		locations = append(locations, doc.location(use))
+	}
+	return locations, nil
+}
+
+func (s *Server) hover(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	ident := doc.identAt(doc.bytePosition(p.Position))
+	if ident == nil {
+		return nil, nil
+	}
+	var text string
+	if name, ok := doc.builtins[ident]; ok {
+		signature, description := builtinSignature(name)
+		text = fmt.Sprintf("```monkey\n%s\n```\n%s", signature, description)
+	} else if b, ok := doc.refs[ident]; ok {
+		text = fmt.Sprintf("```monkey\n%s\n```", describe(b))
+	} else {
+		return nil, nil
+	}
+	r := doc.tokenRange(ident.Token)
+	return Hover{Contents: MarkupContent{Kind: "markdown", Value: text}, Range: &r}, nil
+}
+
+// describe 返回悬停时显示的定义，值很长的 let 只显示名字
+func describe(b *binding) string {
+	if b.param {
+		return "(parameter) " + b.decl.Value
+	}
+	if fn, ok := b.value.(*ast.FunctionLiteral); ok {
+		return "let " + b.decl.Value + " = fn" + parameterList(fn.Parameters)
+	}
+	if b.value != nil {
+		if value := b.value.String(); len(value) <= 60 && !strings.Contains(value, "\n") {
+			return "let " + b.decl.Value + " = " + value
+		}
+	}
+	return "let " + b.decl.Value
+}
+
+// completion 返回光标处可见的绑定、内置函数和关键字，内层的绑定排在前面
+func (s *Server) completion(params json.RawMessage) (interface{}, error) {
+	var p TextDocumentPositionParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	items := []CompletionItem{}
+	seen := map[string]bool{}
+	for _, b := range doc.visible(doc.bytePosition(p.Position)) {
+		kind := CompletionVariable
+		if _, ok := b.value.(*ast.FunctionLiteral); ok {
+			kind = CompletionFunction
+		}
+		seen[b.decl.Value] = true
+		items = append(items, CompletionItem{Label: b.decl.Value, Kind: kind, Detail: describe(b)})
+	}
+	var builtins []CompletionItem
+	for _, b := range object.Builtins {
+		if !seen[b.Name] {
+			signature, _ := builtinSignature(b.Name)
+			builtins = append(builtins, CompletionItem{Label: b.Name, Kind: CompletionFunction, Detail: signature})
+		}
+	}
+	sort.Slice(builtins, func(i, j int) bool { return builtins[i].Label < builtins[j].Label })
+	items = append(items, builtins...)
+	for _, k := range keywords {
+		items = append(items, CompletionItem{Label: k, Kind: CompletionKeyword})
+	}
+	return items, nil
+}
+
+func (s *Server) documentSymbol(params json.RawMessage) (interface{}, error) {
+	var p DocumentParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	return doc.symbols(doc.program.Statements), nil
+}
+
+// formatting 用一次编辑替换整个文档，有语法错误时不修改
+func (s *Server) formatting(params json.RawMessage) (interface{}, error) {
+	var p DocumentParams
+	if err := decode(params, &p); err != nil {
+		return nil, err
+	}
+	doc, err := s.document(p.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+	formatted, err := format.Source([]byte(doc.text))
+	if err != nil {
+		return nil, nil
+	}
+	edits := []TextEdit{}
+	if string(formatted) != doc.text {
+		edits = append(edits, TextEdit{
+			Range:   Range{End: Position{Line: strings.Count(doc.text, "\n") + 1}},
+			NewText: string(formatted),
+		})
+	}
+	return edits, nil
+}
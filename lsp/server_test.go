@@ -0,0 +1,332 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"interpreter/internal/transport"
+	"strings"
+	"testing"
+)
+
+const testURI = "file:///test.mk"
+
+const testSource = `let add = fn(a, b) { a + b };
+let total = add(1, 2);
+let unused = 3;
+len(total, 1)
+`
+
+// client 按顺序写出请求，服务器处理完之后再逐条读取响应
+type client struct {
+	t     *testing.T
+	input bytes.Buffer
+	id    int
+}
+
+func (c *client) request(method string, params interface{}) int {
+	c.id++
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+	return c.id
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (c *client) send(msg interface{}) {
+	if err := transport.WriteMessage(&c.input, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply 是服务器发出的响应或通知
+type reply struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+func (c *client) run() []reply {
+	var output bytes.Buffer
+	if err := NewServer(&c.input, &output).Run(); err != nil {
+		c.t.Fatalf("server failed: %s", err)
+	}
+	var replies []reply
+	r := bufio.NewReader(&output)
+	for {
+		body, err := transport.ReadMessage(r)
+		if err != nil {
+			break
+		}
+		var rep reply
+		if err := json.Unmarshal(body, &rep); err != nil {
+			c.t.Fatalf("invalid message %s: %s", body, err)
+		}
+		replies = append(replies, rep)
+	}
+	return replies
+}
+
+func position(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": testURI},
+		"position":     Position{Line: line, Character: character},
+	}
+}
+
+func find(t *testing.T, replies []reply, id int) reply {
+	t.Helper()
+	for _, r := range replies {
+		if r.ID != nil && *r.ID == id {
+			return r
+		}
+	}
+	t.Fatalf("no response for request %d", id)
+	return reply{}
+}
+
+func decodeResult(t *testing.T, r reply, v interface{}) {
+	t.Helper()
+	if r.Error != nil {
+		t.Fatalf("unexpected error: %s", r.Error.Message)
+	}
+	if err := json.Unmarshal(r.Result, v); err != nil {
+		t.Fatalf("cannot decode %s: %s", r.Result, err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	c := &client{t: t}
+	initialize := c.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}})
+	c.notify("initialized", map[string]interface{}{})
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": TextDocumentItem{URI: testURI, LanguageID: "monkey", Version: 1, Text: testSource},
+	})
+	definition := c.request("textDocument/definition", position(1, 13))
+	references := c.request("textDocument/references", map[string]interface{}{
+		"textDocument": map[string]string{"uri": testURI},
+		"position":     Position{Line: 0, Character: 5},
+		"context":      map[string]bool{"includeDeclaration": true},
+	})
+	hoverBuiltin := c.request("textDocument/hover", position(3, 1))
+	hoverParam := c.request("textDocument/hover", position(0, 21))
+	hoverNothing := c.request("textDocument/hover", position(0, 1))
+	completion := c.request("textDocument/completion", position(0, 21))
+	symbols := c.request("textDocument/documentSymbol", map[string]interface{}{
+		"textDocument": map[string]string{"uri": testURI},
+	})
+	formatting := c.request("textDocument/formatting", map[string]interface{}{
+		"textDocument": map[string]string{"uri": testURI},
+		"options":      map[string]interface{}{"tabSize": 4, "insertSpaces": true},
+	})
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": testURI, "version": 2},
+		"contentChanges": []map[string]string{{"text": "let x = ;"}},
+	})
+	unknown := c.request("textDocument/rename", position(0, 5))
+	shutdown := c.request("shutdown", nil)
+	afterShutdown := c.request("textDocument/hover", position(0, 5))
+	c.notify("exit", nil)
+	replies := c.run()
+
+	var init InitializeResult
+	decodeResult(t, find(t, replies, initialize), &init)
+	if !init.Capabilities.DefinitionProvider || init.Capabilities.TextDocumentSync != syncFull {
+		t.Errorf("wrong capabilities %+v", init.Capabilities)
+	}
+
+	// 打开和修改文档之后各发布一次诊断
+	var published []PublishDiagnosticsParams
+	for _, r := range replies {
+		if r.Method == "textDocument/publishDiagnostics" {
+			var p PublishDiagnosticsParams
+			if err := json.Unmarshal(r.Params, &p); err != nil {
+				t.Fatal(err)
+			}
+			published = append(published, p)
+		}
+	}
+	if len(published) != 2 {
+		t.Fatalf("expected 2 diagnostics notifications, got=%d", len(published))
+	}
+	var messages []string
+	for _, d := range published[0].Diagnostics {
+		messages = append(messages, d.Message)
+	}
+	expected := []string{
+		"unused declared and not used",
+		"wrong number of arguments to `len`: got=2, want=1",
+	}
+	if strings.Join(messages, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("wrong diagnostics. want=%q, got=%q", expected, messages)
+	}
+	if d := published[0].Diagnostics[0]; d.Severity != SeverityWarning || d.Range != (Range{Start: Position{2, 4}, End: Position{2, 10}}) {
+		t.Errorf("wrong unused diagnostic %+v", d)
+	}
+	if d := published[0].Diagnostics[1]; d.Severity != SeverityError || d.Code != "arity" {
+		t.Errorf("wrong arity diagnostic %+v", d)
+	}
+	syntax := published[1].Diagnostics
+	if len(syntax) == 0 || syntax[0].Code != "syntax" || syntax[0].Range.Start != (Position{0, 8}) {
+		t.Errorf("wrong syntax diagnostics %+v", syntax)
+	}
+
+	var loc Location
+	decodeResult(t, find(t, replies, definition), &loc)
+	if loc.URI != testURI || loc.Range != (Range{Start: Position{0, 4}, End: Position{0, 7}}) {
+		t.Errorf("wrong definition %+v", loc)
+	}
+
+	var refs []Location
+	decodeResult(t, find(t, replies, references), &refs)
+	if len(refs) != 2 || refs[0].Range.Start != (Position{0, 4}) || refs[1].Range.Start != (Position{1, 12}) {
+		t.Errorf("wrong references %+v", refs)
+	}
+
+	var hover Hover
+	decodeResult(t, find(t, replies, hoverBuiltin), &hover)
+	if !strings.Contains(hover.Contents.Value, "len(value)") {
+		t.Errorf("builtin hover should show the signature, got=%q", hover.Contents.Value)
+	}
+	decodeResult(t, find(t, replies, hoverParam), &hover)
+	if !strings.Contains(hover.Contents.Value, "(parameter) a") {
+		t.Errorf("wrong parameter hover %q", hover.Contents.Value)
+	}
+	if r := find(t, replies, hoverNothing); string(r.Result) != "null" {
+		t.Errorf("expected null hover on a keyword, got=%s", r.Result)
+	}
+
+	var items []CompletionItem
+	decodeResult(t, find(t, replies, completion), &items)
+	labels := map[string]int{}
+	for _, item := range items {
+		labels[item.Label] = item.Kind
+	}
+	if labels["a"] != CompletionVariable || labels["b"] != CompletionVariable {
+		t.Errorf("parameters should be completed inside the function: %v", labels)
+	}
+	if labels["len"] != CompletionFunction || labels["let"] != CompletionKeyword {
+		t.Errorf("builtins and keywords should be completed: %v", labels)
+	}
+	if _, ok := labels["total"]; ok {
+		t.Errorf("bindings defined later should not be completed")
+	}
+
+	var syms []DocumentSymbol
+	decodeResult(t, find(t, replies, symbols), &syms)
+	if len(syms) != 3 || syms[0].Name != "add" || syms[0].Kind != SymbolFunction || syms[0].Detail != "fn(a, b)" || syms[1].Kind != SymbolVariable {
+		t.Errorf("wrong symbols %+v", syms)
+	}
+
+	var edits []TextEdit
+	decodeResult(t, find(t, replies, formatting), &edits)
+	want := "let add = fn(a, b) { a + b };\nlet total = add(1, 2);\nlet unused = 3;\nlen(total, 1);\n"
+	if len(edits) != 1 || edits[0].NewText != want || edits[0].Range.End.Line != 5 {
+		t.Errorf("wrong formatting edits %+v", edits)
+	}
+
+	if r := find(t, replies, unknown); r.Error == nil || r.Error.Code != codeMethodNotFound {
+		t.Errorf("expected method not found, got=%+v", r)
+	}
+	if r := find(t, replies, shutdown); r.Error != nil || string(r.Result) != "null" {
+		t.Errorf("wrong shutdown response %+v", r)
+	}
+	if r := find(t, replies, afterShutdown); r.Error == nil || r.Error.Code != codeInvalidRequest {
+		t.Errorf("requests after shutdown should fail, got=%+v", r)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	src := `let x = 1;
+let f = fn(x) {
+    let g = fn() { f(x) };
+    g() + x
+};
+let x = x + f(2);
+`
+	doc := newDocument(testURI, src)
+	tests := []struct {
+		line, character int
+		declLine        int
+		declCharacter   int
+	}{
+		// 函数中的 x 是参数
+		{2, 21, 1, 11},
+		{3, 10, 1, 11},
+		// 递归调用指向 let f
+		{2, 19, 1, 4},
+		// 重新定义之前读取的是旧的 x
+		{5, 8, 0, 4},
+		{5, 4, 5, 4},
+	}
+	for _, tt := range tests {
+		ident := doc.identAt(Position{tt.line, tt.character})
+		if ident == nil {
+			t.Fatalf("no identifier at %d:%d", tt.line, tt.character)
+		}
+		b := doc.refs[ident]
+		if b == nil {
+			t.Fatalf("%s at %d:%d is not resolved", ident.Value, tt.line, tt.character)
+		}
+		got := doc.tokenRange(b.decl.Token).Start
+		if got != (Position{tt.declLine, tt.declCharacter}) {
+			t.Errorf("%s at %d:%d resolves to %d:%d, want %d:%d", ident.Value, tt.line, tt.character,
+				got.Line, got.Character, tt.declLine, tt.declCharacter)
+		}
+	}
+}
+
+// 记号的列是字节偏移，LSP 的位置按 UTF-16 编码单元计算
+func TestUTF16Positions(t *testing.T) {
+	doc := newDocument(testURI, "let s = \"é😀\"; s;\nlet t = s;\n")
+	tests := []struct {
+		position Position
+		bytes    Position
+		name     string
+		start    Position
+		end      Position
+	}{
+		{Position{0, 15}, Position{0, 18}, "s", Position{0, 15}, Position{0, 16}},
+		{Position{0, 16}, Position{0, 19}, "s", Position{0, 15}, Position{0, 16}},
+		{Position{1, 8}, Position{1, 8}, "s", Position{1, 8}, Position{1, 9}},
+	}
+	for _, tt := range tests {
+		pos := doc.bytePosition(tt.position)
+		if pos != tt.bytes {
+			t.Errorf("bytePosition(%v) = %v, want %v", tt.position, pos, tt.bytes)
+		}
+		ident := doc.identAt(pos)
+		if ident == nil || ident.Value != tt.name {
+			t.Fatalf("no identifier %s at %v", tt.name, tt.position)
+		}
+		if r := doc.tokenRange(ident.Token); r.Start != tt.start || r.End != tt.end {
+			t.Errorf("range of %s at %v = %v, want %v-%v", tt.name, tt.position, r, tt.start, tt.end)
+		}
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c := &client{t: t}
+	c.notify("exit", nil)
+	var output bytes.Buffer
+	if err := NewServer(&c.input, &output).Run(); err != ErrNoShutdown {
+		t.Errorf("expected ErrNoShutdown, got=%v", err)
+	}
+}
+
+// 输入过程中的文档大多有语法错误，分析时不能崩溃
+func TestIncompleteDocuments(t *testing.T) {
+	src := `let make = fn(n) { let h = {"a": [1, n]}; if (n > 1) { return h["a"]; } else { fn(x) { x + n } } };
+let m = macro(a) { quote(unquote(a) + 1) };
+put(make(2), m(3), -len("abc"));
+`
+	for i := 0; i <= len(src); i++ {
+		doc := newDocument(testURI, src[:i])
+		doc.diagnostics()
+		doc.symbols(doc.program.Statements)
+		doc.visible(Position{Line: 0, Character: i})
+	}
+}
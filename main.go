@@ -3,16 +3,101 @@ package main
 import (
 	"fmt"
 	"interpreter/repl"
+	"io"
 	"os"
-	"os/user"
+	"path/filepath"
+)
+
+const usage = `Usage:
+  monkey [--engine=eval|vm]              start the interactive REPL
+  monkey run [--engine=eval|vm] file     run a .mk script or a .mbc bytecode file
+  monkey compile [-o out.mbc] file.mk    compile a script to bytecode
+  monkey disasm file                     print the bytecode of a .mk or .mbc file
+  monkey check file...                   report unused bindings, dead code and other mistakes
+  monkey fmt [--check] file...           rewrite scripts in the canonical format
+  monkey lsp                             start a language server on standard input and output
+  monkey debug file.mk                   step through a script with breakpoints
+  monkey dap                             start a debug adapter on standard input and output
+  monkey bench [--engine=eval|vm] [name|file...]
+                                         time the built-in workloads or scripts on both engines
+  monkey [--engine=eval|vm] -e 'expr'    run a one-liner and print its value
+
+run, compile, disasm and -e accept -O=0|1|2 to choose the optimisation level
+of the compiler: 0 disables it, 1 folds constants and prunes dead branches,
+2 (the default) also threads jumps.
+run and -e accept --trace=text|json to write every VM instruction, or every node
+the evaluator visits, to standard error.
+run accepts --profile=file to count the instructions (or evaluated nodes) and
+time spent in each function and line: the report goes to standard error and
+file is written in the profile.proto format read by go tool pprof.
+bench runs fib, arith, push, wordcount and concat by default and prints ns/op, bytes and
+allocations per run; --time=1s sets how long each benchmark runs.
+run checks .mbc files with the bytecode verifier and refuses to execute invalid ones.
+fmt --check lists the files that are not formatted instead of rewriting them.
+Use "-" as the file name to read the script from standard input.
+The REPL keeps its history in $MONKEY_HISTORY, or ~/.monkey_history by default.
+`
+
+// 退出码：脚本出错返回 exitError，命令行用法错误返回 exitUsage
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
 )
 
 func main() {
-	user, err := user.Current()
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return startREPL(repl.EngineVM, stdin, stdout)
+	}
+	switch args[0] {
+	case "run":
+		return runCommand(args[1:], stdin, stdout, stderr)
+	case "compile":
+		return compileCommand(args[1:], stdin, stdout, stderr)
+	case "disasm":
+		return disasmCommand(args[1:], stdin, stdout, stderr)
+	case "check":
+		return checkCommand(args[1:], stdin, stdout, stderr)
+	case "fmt":
+		return fmtCommand(args[1:], stdin, stdout, stderr)
+	case "lsp":
+		return lspCommand(args[1:], stdin, stdout, stderr)
+	case "debug":
+		return debugCommand(args[1:], stdin, stdout, stderr)
+	case "dap":
+		return dapCommand(args[1:], stdin, stdout, stderr)
+	case "bench":
+		return benchCommand(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	default:
+		return evalCommand(args, stdin, stdout, stderr)
+	}
+}
+
+func startREPL(engine string, stdin io.Reader, stdout io.Writer) int {
+	fmt.Fprintf(stdout, "Hello! This is the Monkey programming language!\n")
+	fmt.Fprintf(stdout, "Feel free to type in commands, or :help for a list of meta-commands\n")
+	repl.StartWithOptions(stdin, stdout, repl.Options{
+		Engine:      engine,
+		HistoryFile: historyFile(),
+	})
+	return exitOK
+}
+
+// historyFile 返回 REPL 历史文件的路径，找不到主目录时不保存历史
+func historyFile() string {
+	if path, ok := os.LookupEnv("MONKEY_HISTORY"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		panic(err)
+		return ""
 	}
-	fmt.Printf("Hello %s!This is the Monkey programing language!\n", user.Username)
-	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	return filepath.Join(home, ".monkey_history")
 }
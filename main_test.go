@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"interpreter/code"
+	"interpreter/compiler"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runCLI(args []string, stdin string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestEvalOneLiner(t *testing.T) {
+	tests := []struct {
+		args     []string
+		code     int
+		expected string
+	}{
+		{[]string{"-e", "1 + 2 * 3"}, exitOK, "7\n"},
+		{[]string{"--engine=eval", "-e", `upper("monkey")`}, exitOK, "MONKEY\n"},
+		{[]string{"-e", `let a = [1, 2]; a[1]`, "--engine=vm"}, exitOK, "2\n"},
+		{[]string{"-e", `1 + true`}, exitError, ""},
+		{[]string{"-e", `put("hi"); 1`}, exitOK, "hi\n1\n"},
+		{[]string{"--engine=eval", "-e", `put("hi"); 1`}, exitOK, "hi\n1\n"},
+		{[]string{"--engine=eval", "-e", `1 + true`}, exitError, ""},
+		{[]string{"-e", `let = 1`}, exitError, ""},
+		{[]string{"-e", `x`}, exitError, ""},
+		{[]string{"--engine=jit", "-e", "1"}, exitUsage, ""},
+		{[]string{"-e"}, exitUsage, ""},
+		{[]string{"--bogus"}, exitUsage, ""},
+		{[]string{"-O=0", "-e", "if (1 > 2) { 1 } else { 2 + 3 }"}, exitOK, "5\n"},
+		{[]string{"-O=3", "-e", "1"}, exitUsage, ""},
+	}
+	for _, tt := range tests {
+		code, stdout, _ := runCLI(tt.args, "")
+		if code != tt.code {
+			t.Errorf("%v: wrong exit code. want=%d, got=%d", tt.args, tt.code, code)
+		}
+		if stdout != tt.expected {
+			t.Errorf("%v: wrong output. want=%q, got=%q", tt.args, tt.expected, stdout)
+		}
+	}
+}
+
+func TestRunCompileAndDisasm(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "double.mk")
+	err := ioutil.WriteFile(script, []byte("let double = fn(x) { x * 2 };\ndouble(21);\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, engine := range []string{"eval", "vm"} {
+		if code, _, stderr := runCLI([]string{"run", script, "--engine=" + engine}, ""); code != exitOK {
+			t.Errorf("run with %s failed: %d %s", engine, code, stderr)
+		}
+	}
+
+	if code, _, stderr := runCLI([]string{"compile", script}, ""); code != exitOK {
+		t.Fatalf("compile failed: %d %s", code, stderr)
+	}
+	compiled := filepath.Join(dir, "double.mbc")
+	if code, _, stderr := runCLI([]string{"run", compiled}, ""); code != exitOK {
+		t.Errorf("run bytecode failed: %d %s", code, stderr)
+	}
+
+	code, stdout, stderr := runCLI([]string{"disasm", compiled}, "")
+	if code != exitOK {
+		t.Fatalf("disasm failed: %d %s", code, stderr)
+	}
+	expected := `== main ==
+0000 OpClosure 1 0
+0005 OpSetGlobal 0
+0008 OpGetGlobal 0
+0011 OpConstant 2
+0014 OpCall 1
+0017 OpPop
+== constants ==
+0000 INTEGER 2
+0001 COMPILED_FUNCTION double params=1 locals=1
+     0000 OpGetLocal 0
+     0003 OpConstant 0
+     0006 OpMul
+     0007 OpReturnValue
+0002 INTEGER 21
+`
+	if stdout != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot=%q", expected, stdout)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.mk")
+	if err := ioutil.WriteFile(broken, []byte(`len(1)`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 格式正确但是跳转目标越界的字节码在执行之前被拒绝
+	invalid := filepath.Join(dir, "invalid.mbc")
+	data, err := compiler.Marshal(&compiler.ByteCode{Instructions: code.Make(code.OpJump, 100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(invalid, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+	}{
+		{[]string{"run", broken}, "", exitError, broken + ": runtime error: argument to `len` not supported, got INTEGER\n"},
+		{[]string{"run", "--engine=eval", broken}, "", exitError, broken + ": runtime error: argument to `len` not supported, got INTEGER\n"},
+		{[]string{"run", "-"}, `let x = 1; x / 0`, exitError, "-: runtime error: division by zero\n"},
+		{[]string{"run", "-"}, `1 + 1`, exitOK, ""},
+		{[]string{"run"}, "", exitUsage, "run: expected exactly one file\n"},
+		{[]string{"run", filepath.Join(dir, "missing.mk")}, "", exitError, ""},
+		{[]string{"run", filepath.Join(dir, "bad.mbc")}, "", exitError, ""},
+		{[]string{"run", invalid}, "", exitError, invalid + ": invalid bytecode at 0000: jump target 100 is not the start of an instruction\n"},
+	}
+	for _, tt := range tests {
+		code, _, stderr := runCLI(tt.args, tt.stdin)
+		if code != tt.code {
+			t.Errorf("%v: wrong exit code. want=%d, got=%d (%s)", tt.args, tt.code, code, stderr)
+		}
+		if tt.stderr != "" && stderr != tt.stderr {
+			t.Errorf("%v: wrong stderr. want=%q, got=%q", tt.args, tt.stderr, stderr)
+		}
+	}
+}
+
+func TestStartREPL(t *testing.T) {
+	old, had := os.LookupEnv("MONKEY_HISTORY")
+	os.Setenv("MONKEY_HISTORY", "")
+	defer func() {
+		if had {
+			os.Setenv("MONKEY_HISTORY", old)
+		} else {
+			os.Unsetenv("MONKEY_HISTORY")
+		}
+	}()
+
+	code, stdout, _ := runCLI([]string{"--engine=eval"}, "let a = 2;\n:engine\na * 3\n")
+	if code != exitOK {
+		t.Fatalf("wrong exit code. want=%d, got=%d", exitOK, code)
+	}
+	if !strings.HasSuffix(stdout, ">> >> engine: eval\n>> 6\n>> ") {
+		t.Errorf("wrong REPL output. got=%q", stdout)
+	}
+}
+
+func TestOptimizationFlag(t *testing.T) {
+	src := "if (1 < 2) { 10 * 2 } else { 0 }"
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"disasm", "-O=0", "-"}, `== main ==
+0000 OpConstant 0
+0003 OpConstant 1
+0006 OpGreaterThan
+0007 OpJumpNotTruthy 20
+0010 OpConstant 2
+0013 OpConstant 0
+0016 OpMul
+0017 OpJump 23
+0020 OpConstant 3
+0023 OpPop
+== constants ==
+0000 INTEGER 2
+0001 INTEGER 1
+0002 INTEGER 10
+0003 INTEGER 0
+`},
+		{[]string{"disasm", "-"}, `== main ==
+0000 OpConstant 0
+0003 OpPop
+== constants ==
+0000 INTEGER 20
+`},
+	}
+	for _, tt := range tests {
+		code, stdout, stderr := runCLI(tt.args, src)
+		if code != exitOK {
+			t.Fatalf("%v failed: %d %s", tt.args, code, stderr)
+		}
+		if stdout != tt.expected {
+			t.Errorf("%v: wrong output.\nwant=%s\ngot=%s", tt.args, tt.expected, stdout)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		stdin    string
+		code     int
+		expected string
+	}{
+		{"let a = 1; a", exitOK, ""},
+		{"let a = 1;\nlen(1, 2)", exitError, "-:1:5: warning: a declared and not used\n-:2:1: error: wrong number of arguments to `len`: got=2, want=1\n"},
+		{"let = 1", exitError, ""},
+	}
+	for _, tt := range tests {
+		code, stdout, _ := runCLI([]string{"check", "-"}, tt.stdin)
+		if code != tt.code {
+			t.Errorf("%q: wrong exit code. want=%d, got=%d", tt.stdin, tt.code, code)
+		}
+		if stdout != tt.expected {
+			t.Errorf("%q: wrong output. want=%q, got=%q", tt.stdin, tt.expected, stdout)
+		}
+	}
+	if code, _, _ := runCLI([]string{"check"}, ""); code != exitUsage {
+		t.Errorf("expected usage error without files, got=%d", code)
+	}
+}
+
+func TestLSP(t *testing.T) {
+	message := func(body string) string {
+		return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	session := message(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`) +
+		message(`{"jsonrpc":"2.0","id":2,"method":"shutdown"}`) +
+		message(`{"jsonrpc":"2.0","method":"exit"}`)
+	code, stdout, _ := runCLI([]string{"lsp"}, session)
+	if code != exitOK {
+		t.Errorf("wrong exit code. want=%d, got=%d", exitOK, code)
+	}
+	if !strings.Contains(stdout, `"id":1`) || !strings.Contains(stdout, `"id":2,"result":null`) {
+		t.Errorf("missing responses in %q", stdout)
+	}
+	if code, _, _ := runCLI([]string{"lsp"}, message(`{"jsonrpc":"2.0","method":"exit"}`)); code != exitError {
+		t.Errorf("exit without shutdown should fail, got=%d", code)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	code, stdout, stderr := runCLI([]string{"--trace=text", "-O=0", "-e", "1 + 2"}, "")
+	if code != exitOK || stdout != "3\n" || !strings.Contains(stderr, "OpAdd") {
+		t.Errorf("wrong text trace. code=%d, stdout=%q, stderr=%q", code, stdout, stderr)
+	}
+	code, _, stderr = runCLI([]string{"--engine=eval", "--trace=json", "-e", "1 + 2"}, "")
+	if code != exitOK || !strings.Contains(stderr, `{"engine":"eval","event":"exit","depth":1,"node":"Program","value":"3","type":"INTEGER"}`) {
+		t.Errorf("wrong json trace. code=%d, stderr=%q", code, stderr)
+	}
+	if code, _, _ := runCLI([]string{"--trace=xml", "-e", "1"}, ""); code != exitUsage {
+		t.Errorf("expected usage error, got=%d", code)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.mk")
+	src := "let double = fn(x) {\n  x * 2\n};\ndouble(21);\n"
+	if err := ioutil.WriteFile(script, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		engine string
+		unit   string
+	}{
+		{"vm", "instructions"},
+		{"eval", "nodes"},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, tt.engine+".pprof")
+		code, _, stderr := runCLI([]string{"run", "--engine=" + tt.engine, "--profile=" + out, script}, "")
+		if code != exitOK {
+			t.Fatalf("wrong exit code with %s. code=%d, stderr=%q", tt.engine, code, stderr)
+		}
+		if !strings.Contains(stderr, "Total: ") || !strings.Contains(stderr, tt.unit) || !strings.Contains(stderr, "double@2:2") {
+			t.Errorf("wrong report with %s: %q", tt.engine, stderr)
+		}
+		data, err := ioutil.ReadFile(out)
+		// profile.proto 文件是 gzip 压缩的
+		if err != nil || len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			t.Errorf("wrong profile with %s. err=%v", tt.engine, err)
+		}
+	}
+}
+
+func TestDAP(t *testing.T) {
+	message := func(body string) string {
+		return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	session := message(`{"seq":1,"type":"request","command":"initialize","arguments":{}}`) +
+		message(`{"seq":2,"type":"request","command":"disconnect"}`)
+	code, stdout, _ := runCLI([]string{"dap"}, session)
+	if code != exitOK {
+		t.Errorf("wrong exit code. want=%d, got=%d", exitOK, code)
+	}
+	if !strings.Contains(stdout, `"request_seq":1,"success":true`) || !strings.Contains(stdout, `"command":"disconnect"`) {
+		t.Errorf("missing responses in %q", stdout)
+	}
+	if code, _, _ := runCLI([]string{"dap", "extra"}, ""); code != exitUsage {
+		t.Errorf("expected usage error, got=%d", code)
+	}
+}
+
+func TestFmt(t *testing.T) {
+	code, stdout, _ := runCLI([]string{"fmt"}, "let x=1+2 // sum\nx")
+	if code != exitOK || stdout != "let x = 1 + 2; // sum\nx;\n" {
+		t.Errorf("wrong output from stdin. code=%d, got=%q", code, stdout)
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.mk")
+	if err := ioutil.WriteFile(script, []byte("let f=fn(x){x*2};f(1)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, _ = runCLI([]string{"fmt", "--check", script}, "")
+	if code != exitError || stdout != script+"\n" {
+		t.Errorf("--check should list the unformatted file. code=%d, got=%q", code, stdout)
+	}
+	if code, _, stderr := runCLI([]string{"fmt", script}, ""); code != exitOK {
+		t.Fatalf("fmt failed: %s", stderr)
+	}
+	data, err := ioutil.ReadFile(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "let f = fn(x) { x * 2 };\nf(1);\n" {
+		t.Errorf("wrong formatted file: %q", data)
+	}
+	if code, stdout, _ := runCLI([]string{"fmt", "--check", script}, ""); code != exitOK || stdout != "" {
+		t.Errorf("formatted file should pass --check. code=%d, got=%q", code, stdout)
+	}
+	if code, _, _ := runCLI([]string{"fmt"}, "let = 1"); code != exitError {
+		t.Errorf("expected error for invalid source, got=%d", code)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.mk")
+	src := "let double = fn(x) {\n    let y = x * 2;\n    y\n};\nlet a = double(3);\na\n"
+	if err := ioutil.WriteFile(script, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	commands := "locals\nbreak 3\nb double\nbreakpoints\nc\nbt\nc\nlocals\np a\nn\nn\nglobals\nc\nc\nquit\n"
+	code, stdout, stderr := runCLI([]string{"debug", script}, commands)
+	if code != exitOK {
+		t.Fatalf("wrong exit code %d: %s", code, stderr)
+	}
+	expected := []string{
+		"the program is not running",
+		"line 3\nfunction double\n",
+		"stopped in double at line 2 (function breakpoint)\n=>    2      let y = x * 2;\n",
+		"#0 double at line 2\n#1 <main> at line 5\n",
+		"stopped in double at line 3 (breakpoint)",
+		"x = 3\ny = 6\n",
+		"no variable named a\n",
+		"stopped in <main> at line 5 (step)",
+		"stopped in <main> at line 6 (step)",
+		"double = Closure[",
+		"a = 6\n",
+		"program exited: 6\n",
+		"the program has exited\n",
+	}
+	rest := stdout
+	for _, want := range expected {
+		i := strings.Index(rest, want)
+		if i < 0 {
+			t.Fatalf("missing %q in output:\n%s", want, stdout)
+		}
+		rest = rest[i+len(want):]
+	}
+
+	if code, _, _ := runCLI([]string{"debug", script}, "c\n"); code != exitOK {
+		t.Errorf("running to the end should succeed, got=%d", code)
+	}
+	if err := ioutil.WriteFile(script, []byte("let a = 1;\na / 0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code, stdout, _ := runCLI([]string{"debug", script}, "c\n"); code != exitError || !strings.Contains(stdout, "program exited with error: division by zero") {
+		t.Errorf("runtime errors should be reported. code=%d, got=%q", code, stdout)
+	}
+	if code, _, _ := runCLI([]string{"debug"}, ""); code != exitUsage {
+		t.Errorf("expected usage error, got=%d", code)
+	}
+}
+
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.mk")
+	if err := ioutil.WriteFile(script, []byte("1 + 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args  []string
+		code  int
+		lines []string
+	}{
+		{[]string{"bench", "--time=1ms", "fib"}, exitOK, []string{"fib eval", "fib vm"}},
+		{[]string{"bench", "--time=1ms", "--engine=vm", "concat", script}, exitOK, []string{"concat vm", script + " vm"}},
+		{[]string{"bench", "--engine=jit"}, exitUsage, nil},
+		{[]string{"bench", "--time=0s"}, exitUsage, nil},
+		{[]string{"bench", "--time=1ms", filepath.Join(dir, "missing.mk")}, exitError, nil},
+	}
+	for _, tt := range tests {
+		code, stdout, stderr := runCLI(tt.args, "")
+		if code != tt.code {
+			t.Fatalf("wrong exit code for %v. want=%d, got=%d, stderr=%q", tt.args, tt.code, code, stderr)
+		}
+		if code != exitOK {
+			continue
+		}
+		// 每行是表头或者一个程序的结果，只比较程序名和引擎
+		rows := strings.Split(strings.TrimSpace(stdout), "\n")
+		if len(rows) != len(tt.lines)+1 || !strings.Contains(rows[0], "ns/op") {
+			t.Fatalf("wrong table for %v: %q", tt.args, stdout)
+		}
+		for i, line := range tt.lines {
+			if fields := strings.Fields(rows[i+1]); len(fields) != 6 || strings.Join(fields[:2], " ") != line {
+				t.Errorf("wrong row %d for %v. want=%q, got=%q", i, tt.args, line, rows[i+1])
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package monkey
+
+import (
+	"fmt"
+	"interpreter/object"
+	"reflect"
+)
+
+// NewBuiltin 把任意 Go 函数包装成 Monkey 的内置函数，name 用于错误消息。
+//
+// 参数按 FromObject 的规则转换，个数不对或者类型不符时返回 Monkey 的错误。
+// 第一个参数的类型为 object.Caller 时会传入当前引擎，用来回调 Monkey 函数，
+// 它不占用 Monkey 一侧的参数。函数可以没有返回值，或者返回一个值、一个 error，
+// 或者一个值加一个 error；返回的 error 和 panic 都会变成 Monkey 的错误。
+func NewBuiltin(name string, fn interface{}) (*object.Builtin, error) {
+	return newBuiltin(name, reflect.ValueOf(fn))
+}
+
+func newBuiltin(name string, fn reflect.Value) (*object.Builtin, error) {
+	if fn.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s: cannot register %s as a function", name, fn.Kind())
+	}
+	t := fn.Type()
+	if err := checkResults(t); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	firstArg := 0
+	if t.NumIn() > 0 && t.In(0) == callerType {
+		firstArg = 1
+	}
+	numParams := t.NumIn() - firstArg
+
+	return &object.Builtin{Fn: func(caller object.Caller, args ...object.Object) (result object.Object) {
+		if t.IsVariadic() {
+			if len(args) < numParams-1 {
+				return newError("wrong number of arguments.got=%d, want>=%d", len(args), numParams-1)
+			}
+		} else if len(args) != numParams {
+			return newError("wrong number of arguments.got=%d, want=%d", len(args), numParams)
+		}
+
+		in := make([]reflect.Value, 0, firstArg+len(args))
+		if firstArg == 1 {
+			in = append(in, reflect.ValueOf(&caller).Elem())
+		}
+		for i, arg := range args {
+			param := firstArg + i
+			var paramType reflect.Type
+			if t.IsVariadic() && param >= t.NumIn()-1 {
+				paramType = t.In(t.NumIn() - 1).Elem()
+			} else {
+				paramType = t.In(param)
+			}
+			v, err := fromObject(arg, paramType)
+			if err != nil {
+				return newError("argument %d to `%s`: %s", i+1, name, err)
+			}
+			in = append(in, v)
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				result = newError("panic in `%s`: %v", name, r)
+			}
+		}()
+		return convertResults(name, fn.Call(in))
+	}}, nil
+}
+
+// checkResults 检查函数的返回值是否是支持的几种形式之一
+func checkResults(t reflect.Type) error {
+	switch t.NumOut() {
+	case 0, 1:
+		return nil
+	case 2:
+		if t.Out(1) == errorType {
+			return nil
+		}
+	}
+	return fmt.Errorf("functions must return at most one value and an optional error, got %s", t)
+}
+
+func convertResults(name string, out []reflect.Value) object.Object {
+	if len(out) > 0 && out[len(out)-1].Type() == errorType {
+		if err := out[len(out)-1]; !err.IsNil() {
+			return newError("%s", err.Interface().(error))
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return object.NULL
+	}
+	result, err := toObject(out[0])
+	if err != nil {
+		return newError("result of `%s`: %s", name, err)
+	}
+	return result
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
+// Register 把 Go 函数注册成名为 name 的全局函数，规则见 NewBuiltin
+func (in *Interpreter) Register(name string, fn interface{}) error {
+	builtin, err := NewBuiltin(name, fn)
+	if err != nil {
+		return err
+	}
+	in.SetGlobal(name, builtin)
+	return nil
+}
+
+// SetValue 把 Go 的值按 ToObject 的规则转换后设置为全局变量
+func (in *Interpreter) SetValue(name string, v interface{}) error {
+	obj, err := ToObject(v)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	in.SetGlobal(name, obj)
+	return nil
+}
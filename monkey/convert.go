@@ -0,0 +1,433 @@
+package monkey
+
+import (
+	"fmt"
+	"interpreter/object"
+	"math"
+	"reflect"
+	"sort"
+)
+
+var (
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+	callerType = reflect.TypeOf((*object.Caller)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ToObject 把 Go 的值转换成 Monkey 的值：
+//
+//	nil、nil 指针              -> null
+//	bool                       -> BOOLEAN
+//	整数                       -> INTEGER，超出 int64 范围的无符号整数会报错
+//	string、[]byte             -> STRING
+//	切片、数组                 -> ARRAY
+//	map                        -> HASH，按键排序后插入
+//	结构体                     -> HASH，键为字段名或者 monkey 标签
+//	函数                       -> BUILTIN，见 NewBuiltin
+//	object.Object              -> 原样返回
+//
+// 指针和接口会被解引用，其他类型（例如浮点数和通道）和带环的值会返回错误。
+func ToObject(v interface{}) (object.Object, error) {
+	if obj, ok := v.(object.Object); ok {
+		return obj, nil
+	}
+	return toObject(reflect.ValueOf(v))
+}
+
+func toObject(v reflect.Value) (object.Object, error) {
+	c := &converter{visiting: map[visit]bool{}}
+	return c.convert(v)
+}
+
+// converter 记录正在转换的指针、map 和切片，遇到环时返回错误而不是无限递归
+type converter struct {
+	visiting map[visit]bool
+}
+
+// visit 标识一个引用类型的值，切片还要区分长度
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// enter 把 v 标记为正在转换，v 已经在转换路径上时说明有环
+func (c *converter) enter(v reflect.Value) (visit, error) {
+	key := visit{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	if c.visiting[key] {
+		return key, fmt.Errorf("cannot convert cyclic %s", v.Type())
+	}
+	c.visiting[key] = true
+	return key, nil
+}
+
+func (c *converter) convert(v reflect.Value) (object.Object, error) {
+	if !v.IsValid() {
+		return object.NULL, nil
+	}
+	if v.Type().Implements(objectType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return object.NULL, nil
+		}
+		return v.Interface().(object.Object), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return object.TRUE, nil
+		}
+		return object.FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return object.NewInteger(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows INTEGER", v.Uint())
+		}
+		return object.NewInteger(int64(v.Uint())), nil
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+	case reflect.Interface:
+		if v.IsNil() {
+			return object.NULL, nil
+		}
+		return c.convert(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return object.NULL, nil
+		}
+		key, err := c.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer delete(c.visiting, key)
+		return c.convert(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return object.NULL, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return &object.String{Value: string(v.Bytes())}, nil
+		}
+		key, err := c.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer delete(c.visiting, key)
+		return c.sliceToArray(v)
+	case reflect.Array:
+		return c.sliceToArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			return object.NULL, nil
+		}
+		key, err := c.enter(v)
+		if err != nil {
+			return nil, err
+		}
+		defer delete(c.visiting, key)
+		return c.mapToHash(v)
+	case reflect.Struct:
+		return c.structToHash(v)
+	case reflect.Func:
+		if v.IsNil() {
+			return object.NULL, nil
+		}
+		return newBuiltin("<host function>", v)
+	default:
+		return nil, fmt.Errorf("cannot convert %s to a Monkey value", v.Type())
+	}
+}
+
+func (c *converter) sliceToArray(v reflect.Value) (object.Object, error) {
+	elements := make([]object.Object, v.Len())
+	for i := range elements {
+		el, err := c.convert(v.Index(i))
+		if err != nil {
+			return nil, fmt.Errorf("index %d: %s", i, err)
+		}
+		elements[i] = el
+	}
+	return &object.Array{Element: elements}, nil
+}
+
+// mapToHash 按照键排序后插入，使得 Go map 转换的结果顺序稳定
+func (c *converter) mapToHash(v reflect.Value) (object.Object, error) {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return lessValue(keys[i], keys[j]) })
+	hash := object.NewHash()
+	for _, k := range keys {
+		key, err := c.convert(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %s", k, err)
+		}
+		value, err := c.convert(v.MapIndex(k))
+		if err != nil {
+			return nil, fmt.Errorf("key %v: %s", k, err)
+		}
+		if err := hash.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
+
+func lessValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.String:
+		return a.String() < b.String()
+	default:
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	}
+}
+
+func (c *converter) structToHash(v reflect.Value) (object.Object, error) {
+	hash := object.NewHash()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := fieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+		value, err := c.convert(v.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", t.Field(i).Name, err)
+		}
+		if err := hash.Set(&object.String{Value: name}, value); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
+
+// fieldName 返回结构体字段在 HASH 中的键，优先使用 monkey 标签，
+// 未导出的字段和标签为 "-" 的字段会被忽略
+func fieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+	tag := field.Tag.Get("monkey")
+	if tag == "-" {
+		return "", false
+	}
+	if tag != "" {
+		return tag, true
+	}
+	return field.Name, true
+}
+
+// FromObject 把 Monkey 的值转换后存入 target 指向的 Go 变量，规则与 ToObject 相反。
+// target 为 *interface{} 时使用默认的类型：INTEGER 为 int64，ARRAY 为 []interface{}，
+// 键都是字符串的 HASH 为 map[string]interface{}，其他 HASH 为 map[interface{}]interface{}，
+// 函数保持为 object.Object。转换结构体时 HASH 中多余的键会报错。
+func FromObject(obj object.Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer, got %T", target)
+	}
+	converted, err := fromObject(obj, v.Type().Elem())
+	if err != nil {
+		return err
+	}
+	v.Elem().Set(converted)
+	return nil
+}
+
+func fromObject(obj object.Object, t reflect.Type) (reflect.Value, error) {
+	if obj == nil {
+		obj = object.NULL
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() > 0 {
+		if reflect.TypeOf(obj).Implements(t) {
+			return reflect.ValueOf(obj).Convert(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %s", obj.Type(), t)
+	}
+	if reflect.TypeOf(obj).AssignableTo(t) && t.Kind() != reflect.Interface {
+		return reflect.ValueOf(obj), nil
+	}
+	if obj == object.NULL {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, fmt.Errorf("cannot use NULL as %s", t)
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		return fromObjectDefault(obj)
+	case reflect.Ptr:
+		elem, err := fromObject(obj, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	case reflect.Bool:
+		if b, ok := obj.(*object.Boolean); ok {
+			return reflect.ValueOf(b.Value).Convert(t), nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := obj.(*object.Integer); ok {
+			v := reflect.New(t).Elem()
+			if v.OverflowInt(i.Value) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", i.Value, t)
+			}
+			v.SetInt(i.Value)
+			return v, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := obj.(*object.Integer); ok {
+			v := reflect.New(t).Elem()
+			if i.Value < 0 || v.OverflowUint(uint64(i.Value)) {
+				return reflect.Value{}, fmt.Errorf("%d overflows %s", i.Value, t)
+			}
+			v.SetUint(uint64(i.Value))
+			return v, nil
+		}
+	case reflect.String:
+		if s, ok := obj.(*object.String); ok {
+			return reflect.ValueOf(s.Value).Convert(t), nil
+		}
+	case reflect.Slice:
+		if s, ok := obj.(*object.String); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(s.Value)).Convert(t), nil
+		}
+		if arr, ok := obj.(*object.Array); ok {
+			v := reflect.MakeSlice(t, len(arr.Element), len(arr.Element))
+			return v, fillElements(v, arr)
+		}
+	case reflect.Array:
+		if arr, ok := obj.(*object.Array); ok {
+			if len(arr.Element) != t.Len() {
+				return reflect.Value{}, fmt.Errorf("cannot use ARRAY of length %d as %s", len(arr.Element), t)
+			}
+			v := reflect.New(t).Elem()
+			return v, fillElements(v, arr)
+		}
+	case reflect.Map:
+		if hash, ok := obj.(*object.Hash); ok {
+			v := reflect.MakeMapWithSize(t, hash.Len())
+			for _, pair := range hash.Pairs() {
+				key, err := fromObject(pair.Key, t.Key())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("key %s: %s", pair.Key.Inspect(), err)
+				}
+				if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+					return reflect.Value{}, fmt.Errorf("cannot use %s as a key of %s", pair.Key.Type(), t)
+				}
+				value, err := fromObject(pair.Value, t.Elem())
+				if err != nil {
+					return reflect.Value{}, fmt.Errorf("key %s: %s", pair.Key.Inspect(), err)
+				}
+				v.SetMapIndex(key, value)
+			}
+			return v, nil
+		}
+	case reflect.Struct:
+		if hash, ok := obj.(*object.Hash); ok {
+			return hashToStruct(hash, t)
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("cannot use %s as %s", obj.Type(), t)
+}
+
+func fillElements(v reflect.Value, arr *object.Array) error {
+	for i, el := range arr.Element {
+		converted, err := fromObject(el, v.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("index %d: %s", i, err)
+		}
+		v.Index(i).Set(converted)
+	}
+	return nil
+}
+
+func hashToStruct(hash *object.Hash, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := fieldName(t.Field(i)); ok {
+			fields[name] = i
+		}
+	}
+	for _, pair := range hash.Pairs() {
+		key, ok := pair.Key.(*object.String)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("cannot use %s key in %s", pair.Key.Type(), t)
+		}
+		index, ok := fields[key.Value]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("unknown field %q in %s", key.Value, t)
+		}
+		value, err := fromObject(pair.Value, t.Field(index).Type)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("field %s: %s", key.Value, err)
+		}
+		v.Field(index).Set(value)
+	}
+	return v, nil
+}
+
+func fromObjectDefault(obj object.Object) (reflect.Value, error) {
+	var result interface{}
+	switch obj := obj.(type) {
+	case *object.Integer:
+		result = obj.Value
+	case *object.Boolean:
+		result = obj.Value
+	case *object.String:
+		result = obj.Value
+	case *object.Array:
+		elements := make([]interface{}, len(obj.Element))
+		for i, el := range obj.Element {
+			v, err := fromObjectDefault(el)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if v.IsValid() {
+				elements[i] = v.Interface()
+			}
+		}
+		result = elements
+	case *object.Hash:
+		converted, err := hashToDefaultMap(obj)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		result = converted
+	case *object.Null:
+		return reflect.Zero(reflect.TypeOf((*interface{})(nil)).Elem()), nil
+	default:
+		result = obj
+	}
+	return reflect.ValueOf(&result).Elem(), nil
+}
+
+func hashToDefaultMap(hash *object.Hash) (interface{}, error) {
+	stringKeys := true
+	for _, pair := range hash.Pairs() {
+		if _, ok := pair.Key.(*object.String); !ok {
+			stringKeys = false
+		}
+	}
+	var t reflect.Type
+	if stringKeys {
+		t = reflect.TypeOf(map[string]interface{}{})
+	} else {
+		t = reflect.TypeOf(map[interface{}]interface{}{})
+	}
+	v, err := fromObject(hash, t)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
@@ -0,0 +1,238 @@
+package monkey
+
+import (
+	"errors"
+	"interpreter/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type order struct {
+	ID       int      `monkey:"id"`
+	Customer string   `monkey:"customer"`
+	Items    []string `monkey:"items"`
+	Paid     bool
+	Secret   string `monkey:"-"`
+	internal int
+}
+
+// node 用来构造带环的值
+type node struct {
+	Name string `monkey:"name"`
+	Next *node  `monkey:"next"`
+}
+
+func TestToObject(t *testing.T) {
+	// 同一个指针出现两次但没有环，可以转换
+	shared := &node{Name: "shared"}
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-3), "-3"},
+		{uint32(7), "7"},
+		{"hi", "hi"},
+		{[]byte("raw"), "raw"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{map[string]int{"b": 2, "a": 1}, "{a: 1,b: 2}"},
+		{map[int][]string{2: {"x"}, 1: nil}, "{1: null,2: [x]}"},
+		{(*order)(nil), "null"},
+		{&order{ID: 1, Customer: "ann", Items: []string{"tea"}, Paid: true, Secret: "s", internal: 2},
+			"{id: 1,customer: ann,items: [tea],Paid: true}"},
+		{&object.Integer{Value: 5}, "5"},
+		{[]*node{shared, shared}, "[{name: shared,next: null}, {name: shared,next: null}]"},
+	}
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Errorf("ToObject(%#v) returned error %s", tt.input, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v) want=%s, got=%s", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	loop := &node{Name: "loop"}
+	loop.Next = loop
+	cyclicMap := map[string]interface{}{}
+	cyclicMap["self"] = cyclicMap
+	cyclicSlice := []interface{}{1, nil}
+	cyclicSlice[1] = cyclicSlice
+
+	errorTests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{1.5, "cannot convert float64 to a Monkey value"},
+		{uint64(1) << 63, "9223372036854775808 overflows INTEGER"},
+		{[]interface{}{1, make(chan int)}, "index 1: cannot convert chan int to a Monkey value"},
+		{loop, "field Next: cannot convert cyclic *monkey.node"},
+		{cyclicMap, "key self: cannot convert cyclic map[string]interface {}"},
+		{cyclicSlice, "index 1: cannot convert cyclic []interface {}"},
+	}
+	for _, tt := range errorTests {
+		_, err := ToObject(tt.input)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("ToObject(%#v) want error %q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	in := New()
+	value, err := in.Eval(`{"id": 7, "customer": "bob", "items": ["a", "b"], "Paid": true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o order
+	if err := FromObject(value, &o); err != nil {
+		t.Fatal(err)
+	}
+	want := order{ID: 7, Customer: "bob", Items: []string{"a", "b"}, Paid: true}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("wrong struct. want=%+v, got=%+v", want, o)
+	}
+
+	var generic interface{}
+	value, _ = in.Eval(`[1, "two", true, if (false) { 1 }, {"k": [3]}, {1: 2}]`)
+	if err := FromObject(value, &generic); err != nil {
+		t.Fatal(err)
+	}
+	wantGeneric := []interface{}{
+		int64(1), "two", true, nil,
+		map[string]interface{}{"k": []interface{}{int64(3)}},
+		map[interface{}]interface{}{int64(1): int64(2)},
+	}
+	if !reflect.DeepEqual(generic, wantGeneric) {
+		t.Errorf("wrong generic value. want=%#v, got=%#v", wantGeneric, generic)
+	}
+
+	var counts map[string]uint8
+	value, _ = in.Eval(`{"a": 1, "b": 2}`)
+	if err := FromObject(value, &counts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]uint8{"a": 1, "b": 2}) {
+		t.Errorf("wrong map: %v", counts)
+	}
+
+	errorTests := []struct {
+		input    string
+		target   interface{}
+		expected string
+	}{
+		{"300", new(int8), "300 overflows int8"},
+		{"-1", new(uint), "-1 overflows uint"},
+		{`"x"`, new(int), "cannot use STRING as int"},
+		{"[1, 2]", new([3]int), "cannot use ARRAY of length 2 as [3]int"},
+		{`[1, "x"]`, new([]int), "index 1: cannot use STRING as int"},
+		{`{"id": 1, "extra": 2}`, new(order), `unknown field "extra" in monkey.order`},
+		{"if (false) { 1 }", new(int), "cannot use NULL as int"},
+		{"{[1]: 2}", new(map[interface{}]int), "cannot use ARRAY as a key of map[interface {}]int"},
+	}
+	for _, tt := range errorTests {
+		value, err := in.Eval(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+		err = FromObject(value, tt.target)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("FromObject(%s, %T) want error %q, got=%v", tt.input, tt.target, tt.expected, err)
+		}
+	}
+	if err := FromObject(object.NULL, o); err == nil {
+		t.Errorf("expected error for a non-pointer target")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	for _, engine := range engines {
+		in := New(WithEngine(engine))
+		register := func(name string, fn interface{}) {
+			t.Helper()
+			if err := in.Register(name, fn); err != nil {
+				t.Fatalf("%s: Register(%s) returned error %s", engine, name, err)
+			}
+		}
+		register("add", func(a, b int) int { return a + b })
+		register("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+		register("describe", func(o order) string { return o.Customer + " has " + strings.Join(o.Items, ",") })
+		register("checked", func(n int) (int, error) {
+			if n < 0 {
+				return 0, errors.New("negative input")
+			}
+			return n * 2, nil
+		})
+		register("explode", func() { panic("boom") })
+		register("twice", func(c object.Caller, fn object.Object, x int) (int, error) {
+			var n int
+			err := FromObject(c.Call(fn, &object.Integer{Value: int64(x)}), &n)
+			if err != nil {
+				return 0, err
+			}
+			return n * 2, nil
+		})
+		register("makeAdder", func(n int) func(int) int {
+			return func(x int) int { return x + n }
+		})
+		if err := in.SetValue("config", map[string]interface{}{"limit": 3, "tags": []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			input    string
+			expected string
+		}{
+			{"add(2, 3)", "5"},
+			{`join("-")`, ""},
+			{`join("-", "a", "b", "c")`, "a-b-c"},
+			{`describe({"customer": "ann", "items": ["tea", "cake"]})`, "ann has tea,cake"},
+			{"checked(4)", "8"},
+			{"twice(fn(x) { x + 1 }, 4)", "10"},
+			{"let addThree = makeAdder(3); addThree(4)", "7"},
+			{`config["limit"] + len(config["tags"])`, "4"},
+			{"map([1, 2], fn(x) { add(x, x) })", "[2, 4]"},
+		}
+		for _, tt := range tests {
+			result, err := in.Eval(tt.input)
+			if err != nil {
+				t.Errorf("%s: %q returned error %s", engine, tt.input, err)
+				continue
+			}
+			if result.Inspect() != tt.expected {
+				t.Errorf("%s: %q want=%s, got=%s", engine, tt.input, tt.expected, result.Inspect())
+			}
+		}
+
+		errorTests := []struct {
+			input    string
+			expected string
+		}{
+			{"add(1)", "runtime error: wrong number of arguments.got=1, want=2"},
+			{"join()", "runtime error: wrong number of arguments.got=0, want>=1"},
+			{`add(1, "2")`, "runtime error: argument 2 to `add`: cannot use STRING as int"},
+			{"checked(-1)", "runtime error: negative input"},
+			{"explode()", "runtime error: panic in `explode`: boom"},
+			{`twice(fn(x) { "s" }, 1)`, "runtime error: cannot use STRING as int"},
+		}
+		for _, tt := range errorTests {
+			_, err := in.Eval(tt.input)
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("%s: %q want error %q, got=%v", engine, tt.input, tt.expected, err)
+			}
+		}
+	}
+
+	in := New()
+	if err := in.Register("bad", 42); err == nil {
+		t.Errorf("expected error registering a non-function")
+	}
+	if err := in.Register("bad", func() (int, int) { return 1, 2 }); err == nil {
+		t.Errorf("expected error registering a function with two results")
+	}
+}
@@ -0,0 +1,357 @@
+// Package monkey 是在 Go 程序中嵌入 Monkey 的入口。
+//
+// 每个 Interpreter 拥有独立的全局变量，互不影响；
+// 它的方法可以在多个 goroutine 中调用，调用之间会互相等待。
+package monkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/compiler"
+	"interpreter/evaluator"
+	"interpreter/lexer"
+	"interpreter/object"
+	"interpreter/parser"
+	"interpreter/vm"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Engine 选择执行 Monkey 代码的方式
+type Engine string
+
+const (
+	// EngineVM 把代码编译成字节码后在虚拟机上执行，这是默认的引擎
+	EngineVM Engine = "vm"
+	// EngineEval 直接遍历 AST 求值，支持宏
+	EngineEval Engine = "eval"
+)
+
+// ErrStepLimit 表示执行的步数超过了 WithMaxSteps 设置的限制
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// ErrorKind 表示错误发生在哪个阶段
+type ErrorKind int
+
+const (
+	ParseError ErrorKind = iota + 1
+	CompileError
+	RuntimeError
+	// LimitError 表示超出了步数限制、超时或者 context 被取消
+	LimitError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ParseError:
+		return "parse error"
+	case CompileError:
+		return "compile error"
+	case RuntimeError:
+		return "runtime error"
+	case LimitError:
+		return "limit error"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// Error 是 Interpreter 返回的所有错误的类型。
+// 解析错误可能有多条消息，LimitError 的 Err 是 ErrStepLimit 或者 context 的错误。
+type Error struct {
+	Kind     ErrorKind
+	Messages []string
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, strings.Join(e.Messages, "; "))
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Option 配置 Interpreter
+type Option func(*Interpreter)
+
+// WithEngine 选择执行引擎，默认为 EngineVM
+func WithEngine(engine Engine) Option {
+	return func(in *Interpreter) { in.engine = engine }
+}
+
+// WithMaxSteps 限制每次 Eval 或 Call 执行的步数，
+// 虚拟机按指令计数，求值器按 AST 节点计数，0 表示不限制
+func WithMaxSteps(n int) Option {
+	return func(in *Interpreter) { in.maxSteps = n }
+}
+
+// WithMaxCallDepth 限制函数调用的嵌套深度，虚拟机最多支持 vm.MaxFrames 层
+func WithMaxCallDepth(n int) Option {
+	return func(in *Interpreter) { in.maxCallDepth = n }
+}
+
+// WithTimeout 限制每次 Eval 或 Call 的执行时间，0 表示不限制
+func WithTimeout(d time.Duration) Option {
+	return func(in *Interpreter) { in.timeout = d }
+}
+
+// WithOutput 设置 put 写出的位置，默认为标准输出
+func WithOutput(w io.Writer) Option {
+	return func(in *Interpreter) { in.out = w }
+}
+
+type Interpreter struct {
+	mu sync.Mutex
+
+	engine       Engine
+	maxSteps     int
+	maxCallDepth int
+	timeout      time.Duration
+	out          io.Writer
+
+	// 求值器的状态
+	env      *object.Environment
+	macroEnv *object.Environment
+
+	// 虚拟机的状态
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+}
+
+// New 创建一个 Interpreter，默认使用虚拟机，调用深度限制为 vm.MaxFrames
+func New(opts ...Option) *Interpreter {
+	in := &Interpreter{
+		engine:       EngineVM,
+		maxCallDepth: vm.MaxFrames,
+	}
+	for _, opt := range opts {
+		opt(in)
+	}
+	if in.engine == EngineEval {
+		in.env = object.NewEnvironment()
+		in.macroEnv = object.NewEnvironment()
+	} else {
+		in.engine = EngineVM
+		in.symbolTable = compiler.New().SymbolTable()
+		in.constants = []object.Object{}
+		in.globals = make([]object.Object, vm.GlobalSize)
+	}
+	return in
+}
+
+// Engine 返回 Interpreter 使用的引擎
+func (in *Interpreter) Engine() Engine {
+	return in.engine
+}
+
+// Eval 执行一段源码并返回最后一个表达式语句的值，
+// 程序为空或者以 let 语句结尾时返回 object.NULL
+func (in *Interpreter) Eval(src string) (object.Object, error) {
+	return in.EvalContext(context.Background(), src)
+}
+
+// EvalContext 与 Eval 相同，ctx 被取消时停止执行
+func (in *Interpreter) EvalContext(ctx context.Context, src string) (object.Object, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &Error{Kind: ParseError, Messages: p.Errors()}
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ctx, cancel := in.withTimeout(ctx)
+	defer cancel()
+
+	var result object.Object
+	var err error
+	if in.engine == EngineEval {
+		result, err = in.evalProgram(ctx, program)
+	} else {
+		result, err = in.runProgram(ctx, program)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(program.Statements) == 0 {
+		return object.NULL, nil
+	}
+	if _, ok := program.Statements[len(program.Statements)-1].(*ast.LetStatement); ok {
+		return object.NULL, nil
+	}
+	if result == nil {
+		return object.NULL, nil
+	}
+	return result, nil
+}
+
+func (in *Interpreter) evalProgram(ctx context.Context, program *ast.Program) (object.Object, error) {
+	evaluator.DefineMacros(program, in.macroEnv)
+	expanded, err := evaluator.ExpandMacro(program, in.macroEnv)
+	if err != nil {
+		return nil, &Error{Kind: CompileError, Messages: []string{err.Error()}}
+	}
+	e := in.newEvaluator(ctx)
+	result := e.Eval(expanded, in.env)
+	if err := e.Err(); err != nil {
+		return nil, limitError(err)
+	}
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, &Error{Kind: RuntimeError, Messages: []string{errObj.Message}}
+	}
+	return result, nil
+}
+
+func (in *Interpreter) runProgram(ctx context.Context, program *ast.Program) (object.Object, error) {
+	// 在副本上编译，编译失败时不留下已经定义、却没有赋值的全局变量
+	symbols := in.symbolTable.Copy()
+	constants := append([]object.Object(nil), in.constants...)
+	comp := compiler.NewWithState(symbols, constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, &Error{Kind: CompileError, Messages: []string{err.Error()}}
+	}
+	bytecode := comp.ByteCode()
+	in.symbolTable = symbols
+	in.constants = bytecode.Constants
+	machine := vm.NewWithGlobalsState(bytecode, in.globals)
+	machine.SetLimits(in.vmLimits(ctx))
+	machine.SetOutput(in.out)
+	if err := machine.Run(); err != nil {
+		if machine.Err() != nil {
+			return nil, limitError(machine.Err())
+		}
+		return nil, &Error{Kind: RuntimeError, Messages: []string{err.Error()}}
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Call 调用名为 fnName 的全局函数，可以是 Monkey 函数，也可以是内置函数
+func (in *Interpreter) Call(fnName string, args ...object.Object) (object.Object, error) {
+	return in.CallContext(context.Background(), fnName, args...)
+}
+
+// CallContext 与 Call 相同，ctx 被取消时停止执行
+func (in *Interpreter) CallContext(ctx context.Context, fnName string, args ...object.Object) (object.Object, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	fn, ok := in.getGlobal(fnName)
+	if !ok {
+		builtin := object.GetBuiltinByName(fnName)
+		if builtin == nil {
+			return nil, &Error{Kind: RuntimeError, Messages: []string{"undefined function " + fnName}}
+		}
+		fn = builtin
+	}
+	ctx, cancel := in.withTimeout(ctx)
+	defer cancel()
+
+	var result object.Object
+	var err error
+	var halt error
+	if in.engine == EngineEval {
+		e := in.newEvaluator(ctx)
+		result, err = e.Apply(fn, args...)
+		halt = e.Err()
+	} else {
+		machine := in.newVM(ctx)
+		result, err = machine.Apply(fn, args...)
+		halt = machine.Err()
+	}
+	if halt != nil {
+		return nil, limitError(halt)
+	}
+	if err != nil {
+		return nil, &Error{Kind: RuntimeError, Messages: []string{err.Error()}}
+	}
+	return result, nil
+}
+
+// SetGlobal 定义或者修改一个全局变量，之后执行的代码可以通过名字使用它
+func (in *Interpreter) SetGlobal(name string, value object.Object) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if value == nil {
+		value = object.NULL
+	}
+	if in.engine == EngineEval {
+		in.env.Set(name, value)
+		return
+	}
+	symbol, ok := in.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = in.symbolTable.Define(name)
+	}
+	in.globals[symbol.Index] = value
+}
+
+// GetGlobal 返回全局变量的值，变量不存在时第二个返回值为 false
+func (in *Interpreter) GetGlobal(name string) (object.Object, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.getGlobal(name)
+}
+
+func (in *Interpreter) getGlobal(name string) (object.Object, bool) {
+	if in.engine == EngineEval {
+		return in.env.Get(name)
+	}
+	symbol, ok := in.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		return nil, false
+	}
+	value := in.globals[symbol.Index]
+	return value, value != nil
+}
+
+func (in *Interpreter) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if in.timeout > 0 {
+		return context.WithTimeout(ctx, in.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (in *Interpreter) newEvaluator(ctx context.Context) *evaluator.Evaluator {
+	e := evaluator.New()
+	e.Limits = evaluator.Limits{
+		MaxSteps: in.maxSteps,
+		MaxDepth: in.maxCallDepth,
+		Context:  ctx,
+	}
+	e.Out = in.out
+	return e
+}
+
+// newVM 创建一个只用于调用函数的虚拟机，它与 Interpreter 共享常量池和全局变量
+func (in *Interpreter) newVM(ctx context.Context) *vm.VM {
+	machine := vm.NewWithGlobalsState(&compiler.ByteCode{Constants: in.constants}, in.globals)
+	machine.SetLimits(in.vmLimits(ctx))
+	machine.SetOutput(in.out)
+	return machine
+}
+
+// vmLimits 把调用深度换算成虚拟机的帧数，主程序本身占用一帧
+func (in *Interpreter) vmLimits(ctx context.Context) vm.Limits {
+	maxFrames := 0
+	if in.maxCallDepth > 0 {
+		maxFrames = in.maxCallDepth + 1
+	}
+	return vm.Limits{
+		MaxSteps:  in.maxSteps,
+		MaxFrames: maxFrames,
+		Context:   ctx,
+	}
+}
+
+func limitError(err error) *Error {
+	if errors.Is(err, vm.ErrStepLimit) || errors.Is(err, evaluator.ErrStepLimit) {
+		err = ErrStepLimit
+	}
+	return &Error{Kind: LimitError, Messages: []string{err.Error()}, Err: err}
+}
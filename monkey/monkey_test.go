@@ -0,0 +1,239 @@
+package monkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"interpreter/object"
+	"sync"
+	"testing"
+	"time"
+)
+
+var engines = []Engine{EngineVM, EngineEval}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2", "3"},
+		{"", "null"},
+		{"let a = 5;", "null"},
+		{"let a = 5; a * 2", "10"},
+		{`upper("rules")`, "RULES"},
+		{"let f = fn(x) { if (x > 1) { return x; } 0 }; f(3)", "3"},
+		{"return 7; 8", "7"},
+	}
+	for _, engine := range engines {
+		for _, tt := range tests {
+			in := New(WithEngine(engine))
+			result, err := in.Eval(tt.input)
+			if err != nil {
+				t.Errorf("%s: %q returned error %s", engine, tt.input, err)
+				continue
+			}
+			if result.Inspect() != tt.expected {
+				t.Errorf("%s: %q want=%s, got=%s", engine, tt.input, tt.expected, result.Inspect())
+			}
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input   string
+		kind    ErrorKind
+		message string
+	}{
+		{"let = 1;", ParseError, ""},
+		{"1 / 0", RuntimeError, "runtime error: division by zero"},
+		{"len(1)", RuntimeError, "runtime error: argument to `len` not supported, got INTEGER"},
+	}
+	for _, engine := range engines {
+		for _, tt := range tests {
+			_, err := New(WithEngine(engine)).Eval(tt.input)
+			var monkeyErr *Error
+			if !errors.As(err, &monkeyErr) {
+				t.Errorf("%s: %q expected *Error, got=%T (%v)", engine, tt.input, err, err)
+				continue
+			}
+			if monkeyErr.Kind != tt.kind {
+				t.Errorf("%s: %q wrong kind. want=%s, got=%s", engine, tt.input, tt.kind, monkeyErr.Kind)
+			}
+			if tt.message != "" && err.Error() != tt.message {
+				t.Errorf("%s: %q wrong message. want=%q, got=%q", engine, tt.input, tt.message, err)
+			}
+		}
+	}
+
+	_, err := New().Eval("undefinedName")
+	if monkeyErr, ok := err.(*Error); !ok || monkeyErr.Kind != CompileError {
+		t.Errorf("expected compile error from the vm, got=%v", err)
+	}
+
+	// 编译失败的程序中定义的变量不能留下来
+	in := New()
+	if _, err := in.Eval("let a = 1; b"); err == nil {
+		t.Fatal("expected compile error for b")
+	}
+	if _, err := in.Eval("a"); err == nil || err.Error() != "compile error: undefined variable a" {
+		t.Errorf("expected a to be undefined, got=%v", err)
+	}
+}
+
+func TestGlobalsAndCall(t *testing.T) {
+	for _, engine := range engines {
+		in := New(WithEngine(engine))
+		in.SetGlobal("threshold", &object.Integer{Value: 10})
+		_, err := in.Eval(`let check = fn(order) { order["total"] > threshold };
+let total = 0;`)
+		if err != nil {
+			t.Fatalf("%s: %s", engine, err)
+		}
+
+		order := object.NewHash()
+		order.Set(&object.String{Value: "total"}, &object.Integer{Value: 12})
+		result, err := in.Call("check", order)
+		if err != nil || result != object.TRUE {
+			t.Errorf("%s: check(order) want=true, got=%v %v", engine, result, err)
+		}
+
+		in.SetGlobal("threshold", &object.Integer{Value: 20})
+		result, err = in.Call("check", order)
+		if err != nil || result != object.FALSE {
+			t.Errorf("%s: check(order) after SetGlobal want=false, got=%v %v", engine, result, err)
+		}
+
+		if value, ok := in.GetGlobal("total"); !ok || value.Inspect() != "0" {
+			t.Errorf("%s: GetGlobal(total) want=0, got=%v %t", engine, value, ok)
+		}
+		if _, ok := in.GetGlobal("missing"); ok {
+			t.Errorf("%s: GetGlobal(missing) should not exist", engine)
+		}
+
+		result, err = in.Call("len", &object.String{Value: "abc"})
+		if err != nil || result.Inspect() != "3" {
+			t.Errorf("%s: len(abc) want=3, got=%v %v", engine, result, err)
+		}
+		if _, err := in.Call("missing"); err == nil || err.Error() != "runtime error: undefined function missing" {
+			t.Errorf("%s: wrong error for missing function: %v", engine, err)
+		}
+		if _, err := in.Call("check"); err == nil || err.Error() != "runtime error: wrong number of arguments: want=1, got=0" {
+			t.Errorf("%s: wrong error for bad arity: %v", engine, err)
+		}
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	for _, engine := range engines {
+		a := New(WithEngine(engine))
+		b := New(WithEngine(engine))
+		if _, err := a.Eval("let x = 1;"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := b.GetGlobal("x"); ok {
+			t.Errorf("%s: global leaked between interpreters", engine)
+		}
+		if _, err := b.Eval("x"); err == nil {
+			t.Errorf("%s: expected error for x in a separate interpreter", engine)
+		}
+	}
+}
+
+// 每个 Interpreter 的 put 写到自己的 Output
+func TestOutput(t *testing.T) {
+	for _, engine := range engines {
+		var outA, outB bytes.Buffer
+		a := New(WithEngine(engine), WithOutput(&outA))
+		b := New(WithEngine(engine), WithOutput(&outB))
+		if _, err := a.Eval(`let say = fn(x) { put(x) }; say("a")`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Eval(`put("b")`); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Call("say", &object.String{Value: "call"}); err != nil {
+			t.Fatal(err)
+		}
+		if outA.String() != "a\ncall\n" || outB.String() != "b\n" {
+			t.Errorf("%s: wrong output. a=%q, b=%q", engine, outA.String(), outB.String())
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	loop := "let loop = fn(n) { if (n == 0) { 0 } else { loop(n - 1) } };"
+	for _, engine := range engines {
+		in := New(WithEngine(engine), WithMaxSteps(1000))
+		if _, err := in.Eval(loop + "loop(10)"); err != nil {
+			t.Errorf("%s: small loop failed: %s", engine, err)
+		}
+		_, err := in.Eval("loop(500)")
+		if !errors.Is(err, ErrStepLimit) {
+			t.Errorf("%s: expected ErrStepLimit, got=%v", engine, err)
+		}
+		_, err = in.Call("map", &object.Array{Element: []object.Object{&object.Integer{Value: 400}}}, mustGet(t, in, "loop"))
+		if !errors.Is(err, ErrStepLimit) {
+			t.Errorf("%s: expected ErrStepLimit through a builtin callback, got=%v", engine, err)
+		}
+
+		in = New(WithEngine(engine), WithMaxCallDepth(50))
+		_, err = in.Eval(loop + "loop(100)")
+		if err == nil || err.Error() != "runtime error: stack overflow" {
+			t.Errorf("%s: expected stack overflow, got=%v", engine, err)
+		}
+
+		in = New(WithEngine(engine), WithTimeout(20*time.Millisecond))
+		spin := "let spin = fn(n) { if (n == 0) { 0 } else { spin(n - 1) + spin(n - 1) } }; spin(40)"
+		_, err = in.Eval(spin)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected deadline exceeded, got=%v", engine, err)
+		}
+		if monkeyErr, ok := err.(*Error); !ok || monkeyErr.Kind != LimitError {
+			t.Errorf("%s: expected LimitError, got=%v", engine, err)
+		}
+	}
+}
+
+func mustGet(t *testing.T, in *Interpreter, name string) object.Object {
+	t.Helper()
+	value, ok := in.GetGlobal(name)
+	if !ok {
+		t.Fatalf("global %s not found", name)
+	}
+	return value
+}
+
+func TestConcurrentUse(t *testing.T) {
+	for _, engine := range engines {
+		in := New(WithEngine(engine))
+		if _, err := in.Eval("let counter = 0; let add = fn(a, b) { a + b };"); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if _, err := in.Eval("let counter = add(counter, 1);"); err != nil {
+						t.Error(err)
+						return
+					}
+					own := New(WithEngine(engine))
+					result, err := own.Eval(fmt.Sprintf("let x = %d; x * 2", i))
+					if err != nil || result.Inspect() != fmt.Sprint(i*2) {
+						t.Errorf("wrong result %v %v", result, err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if value, _ := in.GetGlobal("counter"); value.Inspect() != "400" {
+			t.Errorf("%s: counter want=400, got=%s", engine, value.Inspect())
+		}
+	}
+}
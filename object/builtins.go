@@ -0,0 +1,494 @@
+package object
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Builtins 是求值器和虚拟机共用的内置函数表，
+// 编译器按照这里的顺序为 OpGetBuiltin 分配下标，只能在末尾追加
+var Builtins = []struct {
+	Name    string
+	Builtin *Builtin
+	Arity   Arity
+}{
+	{"len", &Builtin{Fn: builtinLen}, Arity{1, 1}},
+	{"put", &Builtin{Fn: builtinPut}, Arity{0, -1}},
+	{"first", &Builtin{Fn: builtinFirst}, Arity{1, 1}},
+	{"last", &Builtin{Fn: builtinLast}, Arity{1, 1}},
+	{"rest", &Builtin{Fn: builtinRest}, Arity{1, 1}},
+	{"push", &Builtin{Fn: builtinPush}, Arity{2, 2}},
+	{"map", &Builtin{Fn: builtinMap}, Arity{2, 2}},
+	{"filter", &Builtin{Fn: builtinFilter}, Arity{2, 2}},
+	{"reduce", &Builtin{Fn: builtinReduce}, Arity{3, 3}},
+	{"sort", &Builtin{Fn: builtinSort}, Arity{1, 2}},
+	{"range", &Builtin{Fn: builtinRange}, Arity{1, 3}},
+	{"zip", &Builtin{Fn: builtinZip}, Arity{1, -1}},
+	{"keys", &Builtin{Fn: builtinKeys}, Arity{1, 1}},
+	{"values", &Builtin{Fn: builtinValues}, Arity{1, 1}},
+	{"contains", &Builtin{Fn: builtinContains}, Arity{2, 2}},
+	{"reverse", &Builtin{Fn: builtinReverse}, Arity{1, 1}},
+	{"join", &Builtin{Fn: builtinJoin}, Arity{1, 2}},
+	{"split", &Builtin{Fn: builtinSplit}, Arity{2, 2}},
+	{"trim", &Builtin{Fn: builtinTrim}, Arity{1, 2}},
+	{"replace", &Builtin{Fn: builtinReplace}, Arity{3, 3}},
+	{"upper", &Builtin{Fn: builtinUpper}, Arity{1, 1}},
+	{"lower", &Builtin{Fn: builtinLower}, Arity{1, 1}},
+	{"startsWith", &Builtin{Fn: builtinStartsWith}, Arity{2, 2}},
+	{"endsWith", &Builtin{Fn: builtinEndsWith}, Arity{2, 2}},
+	{"indexOf", &Builtin{Fn: builtinIndexOf}, Arity{2, 2}},
+	{"substring", &Builtin{Fn: builtinSubstring}, Arity{2, 3}},
+	{"format", &Builtin{Fn: builtinFormat}, Arity{1, -1}},
+}
+
+// Arity 是内置函数接受的参数个数范围，Max 为 -1 表示没有上限，
+// 静态分析用它在执行之前检查调用的参数个数
+type Arity struct {
+	Min int
+	Max int
+}
+
+// Accepts 判断 n 个参数是否在范围之内
+func (a Arity) Accepts(n int) bool {
+	return n >= a.Min && (a.Max < 0 || n <= a.Max)
+}
+
+// String 使用与内置函数的错误消息相同的写法，例如 "1"、"1 or 2"、"1..3" 和 ">=1"
+func (a Arity) String() string {
+	switch {
+	case a.Max < 0:
+		return fmt.Sprintf(">=%d", a.Min)
+	case a.Min == a.Max:
+		return fmt.Sprintf("%d", a.Min)
+	case a.Max == a.Min+1:
+		return fmt.Sprintf("%d or %d", a.Min, a.Max)
+	default:
+		return fmt.Sprintf("%d..%d", a.Min, a.Max)
+	}
+}
+
+func GetBuiltinByName(name string) *Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+	return nil
+}
+
+func newError(format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, a...)}
+}
+
+func isError(obj Object) bool {
+	return obj != nil && obj.Type() == ERROR_OBJ
+}
+
+func isTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return false
+	default:
+		return true
+	}
+}
+
+func nativeBoolToBooleanObject(input bool) *Boolean {
+	if input {
+		return TRUE
+	}
+	return FALSE
+}
+
+func builtinLen(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1",
+			len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Array:
+		return NewInteger(int64(len(arg.Element)))
+	case *String:
+		// 与 reverse、substring 一样按字符计算
+		return NewInteger(int64(utf8.RuneCountInString(arg.Value)))
+	case *Hash:
+		return NewInteger(int64(arg.Len()))
+	default:
+		return newError("argument to `len` not supported, got %s", args[0].Type())
+	}
+}
+
+func builtinPut(caller Caller, args ...Object) Object {
+	for _, arg := range args {
+		fmt.Fprintln(caller.Output(), arg.Inspect())
+	}
+	return NULL
+}
+
+func builtinFirst(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d,want=1", len(args))
+	}
+	if args[0].Type() != ARRAY_OBJ {
+		return newError("argument to `first` must be ARRAY, got %s",
+			args[0].Type())
+	}
+	arg := args[0].(*Array)
+	if len(arg.Element) > 0 {
+		return arg.Element[0]
+	}
+	return NULL
+}
+
+func builtinLast(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1", len(args))
+	}
+	if args[0].Type() != ARRAY_OBJ {
+		return newError("arguments to `last` must be ARRAY, got %s",
+			args[0].Type())
+	}
+	arg := args[0].(*Array)
+	length := len(arg.Element)
+	if length > 0 {
+		return arg.Element[length-1]
+	}
+	return NULL
+}
+
+func builtinRest(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1", len(args))
+	}
+	if args[0].Type() != ARRAY_OBJ {
+		return newError("arguments to `rest` must be ARRAY, got %s",
+			args[0].Type())
+	}
+	arg := args[0].(*Array)
+	length := len(arg.Element)
+	if length > 0 {
+		newElements := make([]Object, length-1)
+		copy(newElements, arg.Element[1:length])
+		return &Array{Element: newElements}
+	}
+	return NULL
+}
+
+func builtinPush(caller Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=2", len(args))
+	}
+	if args[0].Type() != ARRAY_OBJ {
+		return newError("arguments to `push` must be ARRAY, got %s",
+			args[0].Type())
+	}
+	arr := args[0].(*Array)
+	length := len(arr.Element)
+	newElements := make([]Object, length+1)
+	copy(newElements, arr.Element)
+	newElements[length] = args[1]
+	return &Array{
+		Element: newElements,
+	}
+}
+
+// map(array, fn) 对每个元素调用 fn，返回结果组成的新数组
+func builtinMap(caller Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=2", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `map` must be ARRAY, got %s", args[0].Type())
+	}
+	result := make([]Object, len(arr.Element))
+	for i, el := range arr.Element {
+		mapped := caller.Call(args[1], el)
+		if isError(mapped) {
+			return mapped
+		}
+		result[i] = mapped
+	}
+	return &Array{Element: result}
+}
+
+// filter(array, fn) 保留 fn 返回真值的元素
+func builtinFilter(caller Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=2", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `filter` must be ARRAY, got %s", args[0].Type())
+	}
+	result := []Object{}
+	for _, el := range arr.Element {
+		keep := caller.Call(args[1], el)
+		if isError(keep) {
+			return keep
+		}
+		if isTruthy(keep) {
+			result = append(result, el)
+		}
+	}
+	return &Array{Element: result}
+}
+
+// reduce(array, initial, fn) 从 initial 开始依次计算 fn(acc, element)
+func builtinReduce(caller Caller, args ...Object) Object {
+	if len(args) != 3 {
+		return newError("wrong number of arguments.got=%d, want=3", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `reduce` must be ARRAY, got %s", args[0].Type())
+	}
+	acc := args[1]
+	for _, el := range arr.Element {
+		acc = caller.Call(args[2], acc, el)
+		if isError(acc) {
+			return acc
+		}
+	}
+	return acc
+}
+
+// sort(array) 对整数或字符串数组排序，sort(array, fn) 使用 fn(a, b) 判断 a 是否排在 b 前面。
+// 排序是稳定的，并且不修改原数组。
+func builtinSort(caller Caller, args ...Object) Object {
+	if len(args) != 1 && len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=1 or 2", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `sort` must be ARRAY, got %s", args[0].Type())
+	}
+	elements := make([]Object, len(arr.Element))
+	copy(elements, arr.Element)
+
+	var failed Object
+	less := func(a, b Object) bool {
+		if failed != nil {
+			return false
+		}
+		if len(args) == 2 {
+			result := caller.Call(args[1], a, b)
+			if isError(result) {
+				failed = result
+				return false
+			}
+			boolean, ok := result.(*Boolean)
+			if !ok {
+				failed = newError("comparator passed to `sort` must return BOOLEAN, got %s", result.Type())
+				return false
+			}
+			return boolean.Value
+		}
+		switch {
+		case a.Type() == INTEGER_OBJ && b.Type() == INTEGER_OBJ:
+			return a.(*Integer).Value < b.(*Integer).Value
+		case a.Type() == STRING_OBJ && b.Type() == STRING_OBJ:
+			return a.(*String).Value < b.(*String).Value
+		default:
+			failed = newError("cannot compare %s and %s in `sort`", a.Type(), b.Type())
+			return false
+		}
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		return less(elements[i], elements[j])
+	})
+	if failed != nil {
+		return failed
+	}
+	return &Array{Element: elements}
+}
+
+// MaxRangeLength 是 range 能生成的数组的最大长度
+const MaxRangeLength = 1 << 24
+
+// range(stop)、range(start, stop) 或 range(start, stop, step)，不包含 stop
+func builtinRange(caller Caller, args ...Object) Object {
+	if len(args) < 1 || len(args) > 3 {
+		return newError("wrong number of arguments.got=%d, want=1..3", len(args))
+	}
+	bounds := make([]int64, len(args))
+	for i, arg := range args {
+		integer, ok := arg.(*Integer)
+		if !ok {
+			return newError("arguments to `range` must be INTEGER, got %s", arg.Type())
+		}
+		bounds[i] = integer.Value
+	}
+	start, stop, step := int64(0), bounds[0], int64(1)
+	if len(bounds) >= 2 {
+		start, stop = bounds[0], bounds[1]
+	}
+	if len(bounds) == 3 {
+		step = bounds[2]
+	}
+	if step == 0 {
+		return newError("step argument to `range` must not be zero")
+	}
+	// 先用无符号数算出元素个数，两个 int64 之差总能放进 uint64
+	var distance, stride uint64
+	if step > 0 && start < stop {
+		distance, stride = uint64(stop)-uint64(start), uint64(step)
+	} else if step < 0 && start > stop {
+		distance, stride = uint64(start)-uint64(stop), -uint64(step)
+	}
+	count := uint64(0)
+	if distance > 0 {
+		count = (distance-1)/stride + 1
+	}
+	if count > MaxRangeLength {
+		return newError("`range` would produce %d elements, the limit is %d", count, MaxRangeLength)
+	}
+	result := make([]Object, count)
+	for i := range result {
+		result[i] = NewInteger(start + int64(i)*step)
+	}
+	return &Array{Element: result}
+}
+
+// zip(a, b, ...) 把多个数组按位置组合成数组的数组，长度取最短的那个
+func builtinZip(caller Caller, args ...Object) Object {
+	if len(args) < 1 {
+		return newError("wrong number of arguments.got=%d, want>=1", len(args))
+	}
+	arrays := make([]*Array, len(args))
+	length := -1
+	for i, arg := range args {
+		arr, ok := arg.(*Array)
+		if !ok {
+			return newError("arguments to `zip` must be ARRAY, got %s", arg.Type())
+		}
+		arrays[i] = arr
+		if length < 0 || len(arr.Element) < length {
+			length = len(arr.Element)
+		}
+	}
+	result := make([]Object, length)
+	for i := 0; i < length; i++ {
+		tuple := make([]Object, len(arrays))
+		for j, arr := range arrays {
+			tuple[j] = arr.Element[i]
+		}
+		result[i] = &Array{Element: tuple}
+	}
+	return &Array{Element: result}
+}
+
+func builtinKeys(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1", len(args))
+	}
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return newError("argument to `keys` must be HASH, got %s", args[0].Type())
+	}
+	result := make([]Object, 0, hash.Len())
+	for _, pair := range hash.pairs {
+		result = append(result, pair.Key)
+	}
+	return &Array{Element: result}
+}
+
+func builtinValues(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1", len(args))
+	}
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return newError("argument to `values` must be HASH, got %s", args[0].Type())
+	}
+	result := make([]Object, 0, hash.Len())
+	for _, pair := range hash.pairs {
+		result = append(result, pair.Value)
+	}
+	return &Array{Element: result}
+}
+
+// contains 判断数组中的元素、哈希中的键或者字符串中的子串是否存在
+func builtinContains(caller Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=2", len(args))
+	}
+	switch collection := args[0].(type) {
+	case *Array:
+		for _, el := range collection.Element {
+			if Equal(el, args[1]) {
+				return TRUE
+			}
+		}
+		return FALSE
+	case *Hash:
+		_, ok, err := collection.Get(args[1])
+		if err != nil {
+			return newError("%s", err)
+		}
+		return nativeBoolToBooleanObject(ok)
+	case *String:
+		sub, ok := args[1].(*String)
+		if !ok {
+			return newError("second argument to `contains` must be STRING, got %s", args[1].Type())
+		}
+		return nativeBoolToBooleanObject(strings.Contains(collection.Value, sub.Value))
+	default:
+		return newError("argument to `contains` not supported, got %s", args[0].Type())
+	}
+}
+
+func builtinReverse(caller Caller, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments.got=%d, want=1", len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Array:
+		length := len(arg.Element)
+		result := make([]Object, length)
+		for i, el := range arg.Element {
+			result[length-1-i] = el
+		}
+		return &Array{Element: result}
+	case *String:
+		runes := []rune(arg.Value)
+		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		return &String{Value: string(runes)}
+	default:
+		return newError("argument to `reverse` not supported, got %s", args[0].Type())
+	}
+}
+
+// join(array) 或 join(array, sep) 把元素拼接成字符串，非字符串元素使用 Inspect 的结果
+func builtinJoin(caller Caller, args ...Object) Object {
+	if len(args) != 1 && len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=1 or 2", len(args))
+	}
+	arr, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `join` must be ARRAY, got %s", args[0].Type())
+	}
+	sep := ""
+	if len(args) == 2 {
+		s, ok := args[1].(*String)
+		if !ok {
+			return newError("second argument to `join` must be STRING, got %s", args[1].Type())
+		}
+		sep = s.Value
+	}
+	parts := make([]string, len(arr.Element))
+	for i, el := range arr.Element {
+		if s, ok := el.(*String); ok {
+			parts[i] = s.Value
+		} else {
+			parts[i] = el.Inspect()
+		}
+	}
+	return &String{Value: strings.Join(parts, sep)}
+}
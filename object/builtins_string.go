@@ -0,0 +1,251 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// 字符串相关的内置函数，下标和长度与 len 一致按字节计算
+
+func stringArgs(name string, want int, args []Object) ([]string, *Error) {
+	if len(args) != want {
+		return nil, newError("wrong number of arguments.got=%d, want=%d", len(args), want)
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		str, ok := arg.(*String)
+		if !ok {
+			return nil, newError("arguments to `%s` must be STRING, got %s", name, arg.Type())
+		}
+		values[i] = str.Value
+	}
+	return values, nil
+}
+
+// split(str, sep) 按 sep 切分字符串，sep 为空时切分成单个字符
+func builtinSplit(caller Caller, args ...Object) Object {
+	values, err := stringArgs("split", 2, args)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(values[0], values[1])
+	result := make([]Object, len(parts))
+	for i, part := range parts {
+		result[i] = &String{Value: part}
+	}
+	return &Array{Element: result}
+}
+
+// trim(str) 去掉首尾的空白，trim(str, cutset) 去掉首尾属于 cutset 的字符
+func builtinTrim(caller Caller, args ...Object) Object {
+	if len(args) == 2 {
+		values, err := stringArgs("trim", 2, args)
+		if err != nil {
+			return err
+		}
+		return &String{Value: strings.Trim(values[0], values[1])}
+	}
+	values, err := stringArgs("trim", 1, args)
+	if err != nil {
+		return err
+	}
+	return &String{Value: strings.TrimSpace(values[0])}
+}
+
+func builtinReplace(caller Caller, args ...Object) Object {
+	values, err := stringArgs("replace", 3, args)
+	if err != nil {
+		return err
+	}
+	return &String{Value: strings.ReplaceAll(values[0], values[1], values[2])}
+}
+
+func builtinUpper(caller Caller, args ...Object) Object {
+	values, err := stringArgs("upper", 1, args)
+	if err != nil {
+		return err
+	}
+	return &String{Value: strings.ToUpper(values[0])}
+}
+
+func builtinLower(caller Caller, args ...Object) Object {
+	values, err := stringArgs("lower", 1, args)
+	if err != nil {
+		return err
+	}
+	return &String{Value: strings.ToLower(values[0])}
+}
+
+func builtinStartsWith(caller Caller, args ...Object) Object {
+	values, err := stringArgs("startsWith", 2, args)
+	if err != nil {
+		return err
+	}
+	return nativeBoolToBooleanObject(strings.HasPrefix(values[0], values[1]))
+}
+
+func builtinEndsWith(caller Caller, args ...Object) Object {
+	values, err := stringArgs("endsWith", 2, args)
+	if err != nil {
+		return err
+	}
+	return nativeBoolToBooleanObject(strings.HasSuffix(values[0], values[1]))
+}
+
+// indexOf 返回子串在字符串中或者元素在数组中第一次出现的下标，找不到时返回 -1。
+// 字符串的下标按字符计算，与 len 和 substring 一致
+func builtinIndexOf(caller Caller, args ...Object) Object {
+	if len(args) != 2 {
+		return newError("wrong number of arguments.got=%d, want=2", len(args))
+	}
+	if arr, ok := args[0].(*Array); ok {
+		for i, el := range arr.Element {
+			if Equal(el, args[1]) {
+				return NewInteger(int64(i))
+			}
+		}
+		return NewInteger(-1)
+	}
+	values, err := stringArgs("indexOf", 2, args)
+	if err != nil {
+		return err
+	}
+	i := strings.Index(values[0], values[1])
+	if i < 0 {
+		return NewInteger(-1)
+	}
+	return NewInteger(int64(utf8.RuneCountInString(values[0][:i])))
+}
+
+// substring(str, start) 或 substring(str, start, end)，不包含 end，下标按字符计算
+func builtinSubstring(caller Caller, args ...Object) Object {
+	if len(args) != 2 && len(args) != 3 {
+		return newError("wrong number of arguments.got=%d, want=2 or 3", len(args))
+	}
+	str, ok := args[0].(*String)
+	if !ok {
+		return newError("first argument to `substring` must be STRING, got %s", args[0].Type())
+	}
+	runes := []rune(str.Value)
+	bounds := []int64{0, int64(len(runes))}
+	for i, arg := range args[1:] {
+		integer, ok := arg.(*Integer)
+		if !ok {
+			return newError("arguments to `substring` must be INTEGER, got %s", arg.Type())
+		}
+		bounds[i] = integer.Value
+	}
+	start, end := bounds[0], bounds[1]
+	if start < 0 || end > int64(len(runes)) || start > end {
+		return newError("substring bounds out of range: [%d:%d] with length %d",
+			start, end, len(runes))
+	}
+	return &String{Value: string(runes[start:end])}
+}
+
+// format(fmt, args...) 支持 printf 风格的 %d %s %q %v %x %X %t %% 以及标志、宽度和精度
+func builtinFormat(caller Caller, args ...Object) Object {
+	if len(args) < 1 {
+		return newError("wrong number of arguments.got=%d, want>=1", len(args))
+	}
+	format, ok := args[0].(*String)
+	if !ok {
+		return newError("first argument to `format` must be STRING, got %s", args[0].Type())
+	}
+	var out strings.Builder
+	rest := args[1:]
+	s := format.Value
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			out.WriteByte(s[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(s) && strings.IndexByte("+-# 0", s[i]) >= 0 {
+			i++
+		}
+		var width, precision int
+		width, i = formatNumber(s, i)
+		if i < len(s) && s[i] == '.' {
+			precision, i = formatNumber(s, i+1)
+		}
+		if i >= len(s) {
+			return newError("format: missing verb at end of %q", s)
+		}
+		verb := s[i]
+		spec := s[start : i+1]
+		if width > maxFormatWidth {
+			return newError("format: width of %s exceeds the limit of %d", spec, maxFormatWidth)
+		}
+		if precision > maxFormatWidth {
+			return newError("format: precision of %s exceeds the limit of %d", spec, maxFormatWidth)
+		}
+		if verb == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if len(rest) == 0 {
+			return newError("format: missing argument for %s", spec)
+		}
+		arg := rest[0]
+		rest = rest[1:]
+		value, errObj := formatValue(spec, verb, arg)
+		if errObj != nil {
+			return errObj
+		}
+		out.WriteString(fmt.Sprintf(spec, value))
+	}
+	if len(rest) != 0 {
+		return newError("format: %d unused arguments", len(rest))
+	}
+	return &String{Value: out.String()}
+}
+
+// maxFormatWidth 是 format 允许的最大宽度和精度，避免一个很短的模板生成巨大的字符串
+const maxFormatWidth = 1000
+
+// formatNumber 读取从 i 开始的十进制数，返回它的值和之后的位置，
+// 值超过 maxFormatWidth 之后不再累加，所以不会溢出
+func formatNumber(s string, i int) (int, int) {
+	n := 0
+	for ; i < len(s) && '0' <= s[i] && s[i] <= '9'; i++ {
+		if n <= maxFormatWidth {
+			n = n*10 + int(s[i]-'0')
+		}
+	}
+	return n, i
+}
+
+func formatValue(spec string, verb byte, arg Object) (interface{}, *Error) {
+	switch verb {
+	case 'd':
+		if integer, ok := arg.(*Integer); ok {
+			return integer.Value, nil
+		}
+	case 'x', 'X':
+		switch arg := arg.(type) {
+		case *Integer:
+			return arg.Value, nil
+		case *String:
+			return arg.Value, nil
+		}
+	case 't':
+		if boolean, ok := arg.(*Boolean); ok {
+			return boolean.Value, nil
+		}
+	case 'q':
+		if str, ok := arg.(*String); ok {
+			return str.Value, nil
+		}
+	case 's', 'v':
+		if str, ok := arg.(*String); ok {
+			return str.Value, nil
+		}
+		return arg.Inspect(), nil
+	default:
+		return nil, newError("format: unknown verb %s", spec)
+	}
+	return nil, newError("format: wrong type for %s: %s", spec, arg.Type())
+}
@@ -1,5 +1,7 @@
 package object
 
+import "sort"
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
 	return &Environment{store: s, outer: nil}
@@ -24,7 +26,22 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// Outer 返回外层作用域，全局环境返回 nil
+func (e *Environment) Outer() *Environment {
+	return e.outer
+}
+
 func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
 	return val
 }
+
+// Names 返回当前作用域中定义的名字，不包括外层作用域，按字母顺序排列
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,205 @@
+package object
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+type HashKey struct {
+	Type  ObjectType
+	Value uint64
+}
+
+type HashPair struct {
+	Key   Object
+	Value Object
+}
+
+type Hashable interface {
+	HashKey() HashKey
+}
+
+// UnhashableError 表示对象（或者它包含的元素）不能作为哈希的键
+type UnhashableError struct {
+	Type ObjectType
+}
+
+func (e *UnhashableError) Error() string {
+	return fmt.Sprintf("unusable as hash key: %s", e.Type)
+}
+
+// Hash 按键第一次插入的顺序保存键值对，Inspect 的输出因此是确定的。
+// HashKey 只是摘要：摘要相同的键放在同一个桶里，再用 Equal 比较真正的值。
+type Hash struct {
+	buckets map[HashKey][]int
+	pairs   []HashPair
+}
+
+func NewHash() *Hash {
+	return &Hash{buckets: make(map[HashKey][]int)}
+}
+
+// Set 写入一个键值对，已存在的键保持原来的位置
+func (h *Hash) Set(key Object, value Object) error {
+	hashed, err := HashKeyOf(key)
+	if err != nil {
+		return err
+	}
+	h.insert(hashed, key, value)
+	return nil
+}
+
+// Get 查找 key 对应的值，key 不可哈希时返回 *UnhashableError
+func (h *Hash) Get(key Object) (Object, bool, error) {
+	hashed, err := HashKeyOf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := h.lookup(hashed, key)
+	return value, ok, nil
+}
+
+func (h *Hash) insert(hashed HashKey, key Object, value Object) {
+	for _, i := range h.buckets[hashed] {
+		if Equal(h.pairs[i].Key, key) {
+			h.pairs[i].Value = value
+			return
+		}
+	}
+	h.buckets[hashed] = append(h.buckets[hashed], len(h.pairs))
+	h.pairs = append(h.pairs, HashPair{Key: key, Value: value})
+}
+
+func (h *Hash) lookup(hashed HashKey, key Object) (Object, bool) {
+	for _, i := range h.buckets[hashed] {
+		if Equal(h.pairs[i].Key, key) {
+			return h.pairs[i].Value, true
+		}
+	}
+	return nil, false
+}
+
+// Len 返回键值对的数量
+func (h *Hash) Len() int {
+	return len(h.pairs)
+}
+
+// Pairs 按插入顺序返回所有键值对
+func (h *Hash) Pairs() []HashPair {
+	pairs := make([]HashPair, len(h.pairs))
+	copy(pairs, h.pairs)
+	return pairs
+}
+
+func (h *Hash) Type() ObjectType {
+	return HASH_OBJ
+}
+func (h *Hash) Inspect() string {
+	var out bytes.Buffer
+	var pairs []string
+	for _, pair := range h.pairs {
+		pairs = append(pairs, fmt.Sprintf("%s: %s",
+			pair.Key.Inspect(), pair.Value.Inspect()))
+	}
+	out.WriteString("{")
+	out.WriteString(strings.Join(pairs, ","))
+	out.WriteString("}")
+	return out.String()
+}
+
+// HashKeyOf 计算 obj 的哈希摘要。整数、布尔值和字符串使用自身的 HashKey，
+// 数组和哈希按内容结构化计算，只要其中的每个元素都可哈希。
+func HashKeyOf(obj Object) (HashKey, error) {
+	switch obj := obj.(type) {
+	case Hashable:
+		return obj.HashKey(), nil
+	case *Array:
+		h := fnv.New64a()
+		for _, el := range obj.Element {
+			key, err := HashKeyOf(el)
+			if err != nil {
+				return HashKey{}, err
+			}
+			writeHashKey(h, key)
+		}
+		return HashKey{Type: ARRAY_OBJ, Value: h.Sum64()}, nil
+	case *Hash:
+		// 两个哈希只要键值对相同就相等，与插入顺序无关，所以把每一对的摘要相加
+		var sum uint64
+		for _, pair := range obj.pairs {
+			h := fnv.New64a()
+			key, err := HashKeyOf(pair.Key)
+			if err != nil {
+				return HashKey{}, err
+			}
+			value, err := HashKeyOf(pair.Value)
+			if err != nil {
+				return HashKey{}, err
+			}
+			writeHashKey(h, key)
+			writeHashKey(h, value)
+			sum += h.Sum64()
+		}
+		return HashKey{Type: HASH_OBJ, Value: sum}, nil
+	case nil:
+		return HashKey{}, &UnhashableError{Type: NULL_OBJ}
+	default:
+		return HashKey{}, &UnhashableError{Type: obj.Type()}
+	}
+}
+
+func writeHashKey(w io.Writer, key HashKey) {
+	var buf [8]byte
+	_, _ = w.Write([]byte(key.Type))
+	binary.BigEndian.PutUint64(buf[:], key.Value)
+	_, _ = w.Write(buf[:])
+}
+
+// Equal 按值比较两个可哈希的对象，数组和哈希逐个比较其中的元素
+func Equal(a, b Object) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value == b.(*Integer).Value
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value
+	case *String:
+		return a.Value == b.(*String).Value
+	case *Null:
+		return true
+	case *Array:
+		other := b.(*Array)
+		if len(a.Element) != len(other.Element) {
+			return false
+		}
+		for i := range a.Element {
+			if !Equal(a.Element[i], other.Element[i]) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		other := b.(*Hash)
+		if a.Len() != other.Len() {
+			return false
+		}
+		for _, pair := range a.pairs {
+			value, ok, err := other.Get(pair.Key)
+			if err != nil || !ok || !Equal(pair.Value, value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
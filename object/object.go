@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"hash/fnv"
 	"interpreter/ast"
+	"interpreter/code"
+	"io"
 	"strings"
 )
 
@@ -23,6 +25,16 @@ const (
 	HASH_OBJ         = "HASH"
 	QUOTE_OBJ        = "QUOTE"
 	MACRO_OBJ        = "MACRO"
+
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+	CLOSURE_OBJ           = "CLOSURE"
+)
+
+// 两个引擎共用的单例，内置函数返回的布尔值和 null 都是它们
+var (
+	NULL  = &Null{}
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
 )
 
 type Object interface {
@@ -30,10 +42,33 @@ type Object interface {
 	Inspect() string
 }
 
+// Integer 创建后不能修改，小整数由 NewInteger 共用同一个对象
 type Integer struct {
 	Value int64
 }
 
+// 预先分配的小整数的范围，覆盖常见的计数器、下标和长度
+const (
+	MinSmallInteger = -128
+	MaxSmallInteger = 1023
+)
+
+var smallIntegers = func() []Integer {
+	integers := make([]Integer, MaxSmallInteger-MinSmallInteger+1)
+	for i := range integers {
+		integers[i].Value = int64(i + MinSmallInteger)
+	}
+	return integers
+}()
+
+// NewInteger 返回值为 value 的整数对象，范围内的小整数不分配内存
+func NewInteger(value int64) *Integer {
+	if value >= MinSmallInteger && value <= MaxSmallInteger {
+		return &smallIntegers[value-MinSmallInteger]
+	}
+	return &Integer{Value: value}
+}
+
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i *Integer) Inspect() string {
 	return fmt.Sprintf("%d", i.Value)
@@ -87,6 +122,8 @@ type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	// Name 是定义函数的 let 绑定的名字，只用于调试
+	Name string
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -120,7 +157,15 @@ func (s *String) HashKey() HashKey {
 	}
 }
 
-type BuiltinFunction func(args ...Object) Object
+// Caller 让内置函数回调当前引擎中的 Monkey 函数，
+// 求值器和虚拟机各自提供实现，因此 map、filter 等内置函数在两者中都能使用
+type Caller interface {
+	Call(fn Object, args ...Object) Object
+	// Output 是 put 等内置函数写出的位置
+	Output() io.Writer
+}
+
+type BuiltinFunction func(caller Caller, args ...Object) Object
 
 type Builtin struct {
 	Fn BuiltinFunction
@@ -147,40 +192,6 @@ func (a *Array) Inspect() string {
 	return out.String()
 }
 
-type HashKey struct {
-	Type  ObjectType
-	Value uint64
-}
-
-type HashPair struct {
-	Key   Object
-	Value Object
-}
-
-type Hash struct {
-	Pairs map[HashKey]HashPair
-}
-
-func (h *Hash) Type() ObjectType {
-	return HASH_OBJ
-}
-func (h *Hash) Inspect() string {
-	var out bytes.Buffer
-	var pairs []string
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s",
-			pair.Key.Inspect(), pair.Value.Inspect()))
-	}
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ","))
-	out.WriteString("}")
-	return out.String()
-}
-
-type Hashable interface {
-	HashKey() HashKey
-}
-
 type Quote struct {
 	Node ast.Node
 }
@@ -212,3 +223,30 @@ func (m *Macro) Inspect() string {
 
 	return out.String()
 }
+
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	// Name 和 Lines 是可选的调试信息
+	Name  string
+	Lines code.LineTable
+	// LocalNames 和 FreeNames 是局部变量和自由变量的名字，按下标排列，只供调试器使用
+	LocalNames []string
+	FreeNames  []string
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
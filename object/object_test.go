@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "hello"}
@@ -18,3 +21,192 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("string with different content have same value")
 	}
 }
+
+func TestNewInteger(t *testing.T) {
+	tests := []struct {
+		value  int64
+		shared bool
+	}{
+		{0, true},
+		{-1, true},
+		{MinSmallInteger, true},
+		{MaxSmallInteger, true},
+		{MinSmallInteger - 1, false},
+		{MaxSmallInteger + 1, false},
+		{1 << 40, false},
+	}
+	for _, tt := range tests {
+		a, b := NewInteger(tt.value), NewInteger(tt.value)
+		if a.Value != tt.value || b.Value != tt.value {
+			t.Errorf("wrong value for %d. got=%d, %d", tt.value, a.Value, b.Value)
+		}
+		if (a == b) != tt.shared {
+			t.Errorf("wrong sharing for %d. want=%t", tt.value, tt.shared)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { NewInteger(42) }); allocs != 0 {
+		t.Errorf("small integer allocated %v times", allocs)
+	}
+}
+
+func TestHashInsertionOrder(t *testing.T) {
+	hash := NewHash()
+	keys := []Object{
+		&String{Value: "zeta"},
+		&Integer{Value: 1},
+		&Boolean{Value: true},
+		&String{Value: "alpha"},
+	}
+	for i, key := range keys {
+		if err := hash.Set(key, &Integer{Value: int64(i)}); err != nil {
+			t.Fatalf("Set returned error: %s", err)
+		}
+	}
+	// 覆盖已有的键不改变它的位置
+	if err := hash.Set(&Integer{Value: 1}, &Integer{Value: 9}); err != nil {
+		t.Fatalf("Set returned error: %s", err)
+	}
+
+	expected := `{zeta: 0,1: 9,true: 2,alpha: 3}`
+	for i := 0; i < 10; i++ {
+		if hash.Inspect() != expected {
+			t.Fatalf("hash.Inspect() wrong. want=%q, got=%q", expected, hash.Inspect())
+		}
+	}
+}
+
+func TestHashDigestCollision(t *testing.T) {
+	hash := NewHash()
+	// 人为让两个不同的键得到相同的摘要
+	digest := HashKey{Type: STRING_OBJ, Value: 42}
+	hash.insert(digest, &String{Value: "a"}, &Integer{Value: 1})
+	hash.insert(digest, &String{Value: "b"}, &Integer{Value: 2})
+
+	if hash.Len() != 2 {
+		t.Fatalf("colliding keys overwrote each other. got %d pairs", hash.Len())
+	}
+	for key, expected := range map[string]int64{"a": 1, "b": 2} {
+		value, ok := hash.lookup(digest, &String{Value: key})
+		if !ok {
+			t.Fatalf("no value for key %q", key)
+		}
+		if value.(*Integer).Value != expected {
+			t.Errorf("wrong value for key %q. want=%d, got=%d", key, expected, value.(*Integer).Value)
+		}
+	}
+	if _, ok := hash.lookup(digest, &String{Value: "c"}); ok {
+		t.Errorf("lookup of missing key with colliding digest succeeded")
+	}
+}
+
+func TestCompositeHashKeys(t *testing.T) {
+	inner1 := NewHash()
+	_ = inner1.Set(&String{Value: "x"}, &Integer{Value: 1})
+	_ = inner1.Set(&String{Value: "y"}, &Integer{Value: 2})
+	inner2 := NewHash()
+	_ = inner2.Set(&String{Value: "y"}, &Integer{Value: 2})
+	_ = inner2.Set(&String{Value: "x"}, &Integer{Value: 1})
+
+	arr1 := &Array{Element: []Object{&Integer{Value: 1}, &String{Value: "a"}}}
+	arr2 := &Array{Element: []Object{&Integer{Value: 1}, &String{Value: "a"}}}
+	arr3 := &Array{Element: []Object{&String{Value: "a"}, &Integer{Value: 1}}}
+
+	hash := NewHash()
+	if err := hash.Set(arr1, &String{Value: "array"}); err != nil {
+		t.Fatalf("Set returned error: %s", err)
+	}
+	if err := hash.Set(inner1, &String{Value: "hash"}); err != nil {
+		t.Fatalf("Set returned error: %s", err)
+	}
+
+	tests := []struct {
+		key      Object
+		expected string
+		found    bool
+	}{
+		{arr2, "array", true},
+		{arr3, "", false},
+		{inner2, "hash", true},
+	}
+	for _, tt := range tests {
+		value, ok, err := hash.Get(tt.key)
+		if err != nil {
+			t.Fatalf("Get returned error: %s", err)
+		}
+		if ok != tt.found {
+			t.Errorf("Get(%s) found=%t, want %t", tt.key.Inspect(), ok, tt.found)
+			continue
+		}
+		if ok && value.(*String).Value != tt.expected {
+			t.Errorf("Get(%s) = %s, want %s", tt.key.Inspect(), value.Inspect(), tt.expected)
+		}
+	}
+
+	unhashable := &Array{Element: []Object{&Builtin{}}}
+	err := hash.Set(unhashable, &Integer{Value: 1})
+	if err == nil || err.Error() != "unusable as hash key: BUILTIN" {
+		t.Errorf("wrong error for unhashable key. got=%v", err)
+	}
+}
+
+// TestBuiltinArity 检查 Builtins 中声明的参数个数与内置函数的实现一致
+func TestBuiltinArity(t *testing.T) {
+	nulls := func(n int) []Object {
+		args := make([]Object, n)
+		for i := range args {
+			args[i] = NULL
+		}
+		return args
+	}
+	for _, b := range Builtins {
+		var counts []int
+		if b.Arity.Min > 0 {
+			counts = append(counts, b.Arity.Min-1)
+		}
+		if b.Arity.Max >= 0 {
+			counts = append(counts, b.Arity.Max+1)
+		}
+		for _, n := range counts {
+			result := b.Builtin.Fn(nil, nulls(n)...)
+			err, ok := result.(*Error)
+			if !ok || !strings.HasPrefix(err.Message, "wrong number of arguments") {
+				t.Errorf("%s with %d arguments: expected arity error, got=%v", b.Name, n, result)
+			}
+		}
+	}
+
+	tests := []struct {
+		arity    Arity
+		expected string
+	}{
+		{Arity{1, 1}, "1"},
+		{Arity{1, 2}, "1 or 2"},
+		{Arity{1, 3}, "1..3"},
+		{Arity{0, -1}, ">=0"},
+	}
+	for _, tt := range tests {
+		if tt.arity.String() != tt.expected {
+			t.Errorf("wrong string. want=%q, got=%q", tt.expected, tt.arity.String())
+		}
+	}
+}
+
+var integerSink *Integer
+
+// go test -bench NewInteger 对比共用的小整数和每次分配的大整数
+func BenchmarkNewInteger(b *testing.B) {
+	for _, bm := range []struct {
+		name  string
+		value int64
+	}{
+		{"small", MaxSmallInteger - 1},
+		{"large", MaxSmallInteger + 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				integerSink = NewInteger(bm.value + int64(i&1))
+			}
+		})
+	}
+}
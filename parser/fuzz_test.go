@@ -0,0 +1,89 @@
+package parser
+
+import (
+	"interpreter/ast"
+	"interpreter/lexer"
+	"testing"
+)
+
+func FuzzParseProgram(f *testing.F) {
+	for _, seed := range []string{
+		"let x = 5; return x;",
+		"let add = fn(a, b) { a + b }; add(1, 2 * 3);",
+		"if (a < b) { a } else { b }",
+		`{"one": 1, true: [1, 2][0]}["one"]`,
+		"macro(x) { quote(unquote(x)) }",
+		"fn(,) {}",
+		"{1: }",
+		"a[",
+		`"unterminated`,
+		"((((((((((1",
+		"99999999999999999999",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		p := New(lexer.New(input))
+		program := p.ParseProgram()
+		if len(p.Errors()) != len(p.ErrorDetails()) {
+			t.Fatalf("errors and details disagree: %d != %d", len(p.Errors()), len(p.ErrorDetails()))
+		}
+		if len(p.Errors()) != 0 {
+			return
+		}
+		// 没有错误时语法树必须完整
+		if err := checkComplete(program); err != "" {
+			t.Fatalf("incomplete AST without errors for %q: %s", input, err)
+		}
+		_ = program.String()
+	})
+}
+
+// checkComplete 检查语法树中没有缺失的子节点，返回第一个问题的描述
+func checkComplete(program *ast.Program) string {
+	var problem string
+	ast.Inspect(program, func(node ast.Node) bool {
+		if problem != "" {
+			return false
+		}
+		missing := false
+		switch n := node.(type) {
+		case *ast.LetStatement:
+			missing = n.Name == nil || n.Value == nil
+		case *ast.ReturnStatement:
+			missing = n.ReturnValue == nil
+		case *ast.ExpressionStatement:
+			missing = n.Expression == nil
+		case *ast.PrefixExpression:
+			missing = n.Right == nil
+		case *ast.InfixExpression:
+			missing = n.Left == nil || n.Right == nil
+		case *ast.IfExpression:
+			missing = n.Condition == nil || n.Consequence == nil
+		case *ast.FunctionLiteral:
+			missing = n.Body == nil
+		case *ast.MacroLiteral:
+			missing = n.Body == nil
+		case *ast.CallExpression:
+			missing = n.Function == nil
+			for _, arg := range n.Arguments {
+				missing = missing || arg == nil
+			}
+		case *ast.ArrayLiteral:
+			for _, e := range n.Elements {
+				missing = missing || e == nil
+			}
+		case *ast.IndexExpression:
+			missing = n.Left == nil || n.Index == nil
+		case *ast.HashLiteral:
+			for _, pair := range n.Pairs {
+				missing = missing || pair.Key == nil || pair.Value == nil
+			}
+		}
+		if missing {
+			problem = "missing child in " + node.String()
+		}
+		return true
+	})
+	return problem
+}
@@ -6,6 +6,7 @@ import (
 	"interpreter/lexer"
 	"interpreter/token"
 	"strconv"
+	"strings"
 )
 
 type (
@@ -25,14 +26,25 @@ const (
 	INDEX
 )
 
+// maxNesting 是表达式的最大嵌套深度。解析是递归的，没有限制时
+// 几 MB 的 "((((" 就会耗尽 goroutine 的栈，这种错误无法恢复
+const maxNesting = 1000
+
 type Parser struct {
 	l         *lexer.Lexer
 	curToken  token.Token
 	peekToken token.Token
 	errors    []string
+	// errorTokens 与 errors 一一对应，记录出错的位置
+	errorTokens []token.Token
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	// nesting 是 parseExpression 当前的递归深度
+	nesting int
+	// tooDeep 表示已经报告了嵌套过深，之后外层报告的错误都是它引起的，不再记录
+	tooDeep bool
 }
 
 func New(l *lexer.Lexer) *Parser {
@@ -54,6 +66,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.MACRO, p.parseMacroLiteral)
+	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
@@ -79,12 +92,43 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// Error 是带位置的语法错误
+type Error struct {
+	Token   token.Token
+	Message string
+}
+
+// ErrorDetails 返回与 Errors 相同的错误，并带上出错的记号
+func (p *Parser) ErrorDetails() []Error {
+	details := make([]Error, len(p.errors))
+	for i, msg := range p.errors {
+		details[i] = Error{Token: p.errorTokens[i], Message: msg}
+	}
+	return details
+}
+
+func (p *Parser) addError(tok token.Token, msg string) {
+	if p.tooDeep {
+		return
+	}
+	p.errors = append(p.errors, msg)
+	p.errorTokens = append(p.errorTokens, tok)
+}
+
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
 	msg := fmt.Sprintf("no prefix parse function for %s found.", t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken, msg)
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
+	if p.nesting >= maxNesting {
+		p.addError(p.curToken, fmt.Sprintf("expression nested more than %d levels deep", maxNesting))
+		p.tooDeep = true
+		p.skipToEOF()
+		return nil
+	}
+	p.nesting++
+	defer func() { p.nesting-- }()
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		p.noPrefixParseFnError(p.curToken.Type)
@@ -110,13 +154,31 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken, msg)
 		return nil
 	}
 	lit.Value = value
 	return lit
 }
 
+// parseIllegal 报告词法分析器无法识别的输入
+func (p *Parser) parseIllegal() ast.Expression {
+	if strings.HasPrefix(p.curToken.Literal, `"`) {
+		p.addError(p.curToken, "unterminated string literal")
+	} else {
+		p.addError(p.curToken, fmt.Sprintf("illegal character %q", p.curToken.Literal))
+	}
+	return nil
+}
+
+// skipToEOF 丢弃剩余的记号，嵌套过深时外层的每一层都会直接遇到 EOF 而返回
+func (p *Parser) skipToEOF() {
+	for !p.curTokenIs(token.EOF) {
+		p.nextToken()
+	}
+	p.peekToken = p.curToken
+}
+
 func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{
 		Token: p.curToken,
@@ -137,7 +199,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{
 		Token: p.curToken,
 	}
-	hash.Pairs = make(map[ast.Expression]ast.Expression)
+	hash.Pairs = []ast.HashPair{}
 	for !p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
 		key := p.parseExpression(LOWEST)
@@ -146,7 +208,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		}
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
-		hash.Pairs[key] = value
+		hash.Pairs = append(hash.Pairs, ast.HashPair{Key: key, Value: value})
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
 		}
@@ -154,6 +216,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.Rbrace = p.curToken
 	return hash
 }
 
@@ -210,6 +273,7 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 		Token: p.curToken,
 	}
 	array.Elements = p.parseExpressionList(token.RBRACKET)
+	array.Rbracket = p.curToken
 	return array
 }
 
@@ -238,12 +302,16 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 		p.nextToken()
 		return identifiers
 	}
-	p.nextToken()
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
 	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 	identifiers = append(identifiers, ident)
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
-		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		identifiers = append(identifiers, ident)
 	}
@@ -266,6 +334,7 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		}
 		p.nextToken()
 	}
+	block.Rbrace = p.curToken
 	return block
 }
 
@@ -279,7 +348,7 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) peekError(t token.TokenType) {
 	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
 		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.addError(p.peekToken, msg)
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -298,7 +367,11 @@ func (p *Parser) ParseProgram() *ast.Program {
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
+		// 解析失败时返回 nil 接口，而不是值为 nil 的 *ast.LetStatement
+		if stmt := p.parseLetStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
 	case token.RETURN:
 		return p.parseReturnStatement()
 	default:
@@ -327,6 +400,9 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	}
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -388,6 +464,7 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	}
 	//exp.Arguments = p.parseCallArguments()
 	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	exp.Rparen = p.curToken
 	return exp
 }
 
@@ -430,6 +507,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	exp.Rbracket = p.curToken
 	return exp
 }
 
@@ -446,6 +524,15 @@ var precedences = map[token.TokenType]int{
 	token.LBRACKET: INDEX,
 }
 
+// Precedence 返回中缀运算符的优先级，不是中缀运算符时返回 LOWEST。
+// 格式化工具用它决定哪里需要括号。
+func Precedence(operator token.TokenType) int {
+	if p, ok := precedences[operator]; ok {
+		return p
+	}
+	return LOWEST
+}
+
 func (p *Parser) peekPrecedence() int {
 	if p, ok := precedences[p.peekToken.Type]; ok {
 		return p
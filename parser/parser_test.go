@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"interpreter/ast"
 	"interpreter/lexer"
+	"strings"
 	"testing"
 )
 
@@ -662,13 +663,32 @@ func TestParsingHashLiteralsStringKeys(t *testing.T) {
 		"two":   2,
 		"three": 3,
 	}
-	for key, value := range hash.Pairs {
-		literal, ok := key.(*ast.StringLiteral)
+	expectedOrder := []string{"one", "two", "three"}
+	for i, pair := range hash.Pairs {
+		literal, ok := pair.Key.(*ast.StringLiteral)
 		if !ok {
-			t.Errorf("key is not ast.StringLiteral. got=%T", key)
+			t.Errorf("key is not ast.StringLiteral. got=%T", pair.Key)
+			continue
+		}
+		if literal.String() != expectedOrder[i] {
+			t.Errorf("key %d is not %q. got=%q", i, expectedOrder[i], literal.String())
 		}
 		expectedValue := expected[literal.String()]
-		testIntegerLiteral(t, value, expectedValue)
+		testIntegerLiteral(t, pair.Value, expectedValue)
+	}
+}
+
+func TestHashLiteralString(t *testing.T) {
+	input := `{"zeta": 1, "alpha": 2 + 3, true: fn(x) { x }}`
+	expected := `{zeta:1, alpha:(2 + 3), true:fn(x) x}`
+	for i := 0; i < 10; i++ {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if program.String() != expected {
+			t.Fatalf("program.String() wrong. want=%q, got=%q", expected, program.String())
+		}
 	}
 }
 
@@ -712,16 +732,16 @@ func TestParsingHashLiteralsIntegerKeys(t *testing.T) {
 		t.Errorf("hash.Pairs has wrong length. got=%d", len(hash.Pairs))
 	}
 
-	for key, value := range hash.Pairs {
-		integer, ok := key.(*ast.IntegerLiteral)
+	for _, pair := range hash.Pairs {
+		integer, ok := pair.Key.(*ast.IntegerLiteral)
 		if !ok {
-			t.Errorf("key is not ast.IntegerLiteral. got=%T", key)
+			t.Errorf("key is not ast.IntegerLiteral. got=%T", pair.Key)
 			continue
 		}
 
 		expectedValue := expected[integer.String()]
 
-		testIntegerLiteral(t, value, expectedValue)
+		testIntegerLiteral(t, pair.Value, expectedValue)
 	}
 }
 
@@ -748,15 +768,15 @@ func TestParsingHashLiteralsBooleanKeys(t *testing.T) {
 		t.Errorf("hash.Pairs has wrong length. got=%d", len(hash.Pairs))
 	}
 
-	for key, value := range hash.Pairs {
-		boolean, ok := key.(*ast.Boolean)
+	for _, pair := range hash.Pairs {
+		boolean, ok := pair.Key.(*ast.Boolean)
 		if !ok {
-			t.Errorf("key is not ast.BooleanLiteral. got=%T", key)
+			t.Errorf("key is not ast.BooleanLiteral. got=%T", pair.Key)
 			continue
 		}
 
 		expectedValue := expected[boolean.String()]
-		testIntegerLiteral(t, value, expectedValue)
+		testIntegerLiteral(t, pair.Value, expectedValue)
 	}
 }
 
@@ -796,3 +816,59 @@ func TestMacroLiteralParsint(t *testing.T) {
 	}
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
+
+func TestErrorDetails(t *testing.T) {
+	p := New(lexer.New("let x = 1;\nlet = 2;\n5 + ;"))
+	p.ParseProgram()
+	details := p.ErrorDetails()
+	if len(details) == 0 || len(details) != len(p.Errors()) {
+		t.Fatalf("wrong number of details. want=%d, got=%d", len(p.Errors()), len(details))
+	}
+	first, last := details[0], details[len(details)-1]
+	if first.Token.Line != 2 || first.Token.Column != 5 || first.Message != "expected next token to be IDENT, got = instead" {
+		t.Errorf("wrong first error %d:%d %q", first.Token.Line, first.Token.Column, first.Message)
+	}
+	if last.Token.Line != 3 || last.Token.Column != 5 || last.Message != "no prefix parse function for ; found." {
+		t.Errorf("wrong last error %d:%d %q", last.Token.Line, last.Token.Column, last.Message)
+	}
+}
+
+func TestInvalidLetStatementIsDropped(t *testing.T) {
+	p := New(lexer.New("let = 1; let x 2; y"))
+	program := p.ParseProgram()
+	for i, stmt := range program.Statements {
+		if let, ok := stmt.(*ast.LetStatement); ok && let == nil {
+			t.Fatalf("statement %d is a nil *ast.LetStatement", i)
+		}
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	tests := []struct {
+		input string
+		error string
+	}{
+		{`let s = "abc`, "unterminated string literal"},
+		{"1 # 2", `illegal character "#"`},
+		{"fn(1) { 1 }", "expected next token to be IDENT, got INT instead"},
+		{"fn(,) { 1 }", "expected next token to be IDENT, got , instead"},
+		{"fn(a, 2) { 1 }", "expected next token to be IDENT, got INT instead"},
+		{strings.Repeat("(", 100000), "expression nested more than 1000 levels deep"},
+		{strings.Repeat("[", 5000) + strings.Repeat("]", 5000), "expression nested more than 1000 levels deep"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.error {
+			t.Errorf("wrong errors for %.20q. want first=%q, got=%q", tt.input, tt.error, errors)
+		}
+	}
+
+	// 嵌套过深只报告一个错误
+	p := New(lexer.New(strings.Repeat("(", 100000)))
+	p.ParseProgram()
+	if len(p.Errors()) != 1 {
+		t.Errorf("expected one error for deep nesting, got=%d", len(p.Errors()))
+	}
+}
@@ -0,0 +1,195 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// profile.proto 中用到的字段编号，见
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// encoder 按 protobuf 的线格式编码消息，只支持 varint 和 length-delimited 两种类型
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) varint(v uint64) {
+	for v >= 0x80 {
+		e.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) tag(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// int64 省略零值，与 proto3 的默认行为一致
+func (e *encoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, 0)
+	e.varint(uint64(v))
+}
+
+func (e *encoder) bytes(field int, b []byte) {
+	e.tag(field, 2)
+	e.varint(uint64(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) packed(field int, values []int64) {
+	var inner encoder
+	for _, v := range values {
+		inner.varint(uint64(v))
+	}
+	e.bytes(field, inner.Bytes())
+}
+
+func (e *encoder) message(field int, build func(m *encoder)) {
+	var inner encoder
+	build(&inner)
+	e.bytes(field, inner.Bytes())
+}
+
+// WriteProto 把记录的调用栈按 profile.proto 的格式压缩后写出，
+// 每个样本有两个值：次数（单位为 Unit）和时间（纳秒）
+func (p *Profiler) WriteProto(w io.Writer) error {
+	table := []string{""}
+	index := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		i, ok := index[s]
+		if !ok {
+			i = int64(len(table))
+			table = append(table, s)
+			index[s] = i
+		}
+		return i
+	}
+
+	functions := map[Frame]int64{}
+	var frames []Frame
+	locations := map[location]int64{}
+	var locs []location
+	locationIDOf := func(loc location) int64 {
+		id, ok := locations[loc]
+		if !ok {
+			if _, ok := functions[loc.frame]; !ok {
+				frames = append(frames, loc.frame)
+				functions[loc.frame] = int64(len(frames))
+			}
+			locs = append(locs, loc)
+			id = int64(len(locs))
+			locations[loc] = id
+		}
+		return id
+	}
+
+	type sample struct {
+		ids    []int64
+		values []int64
+	}
+	var samples []sample
+	p.walk(func(n *node, stack []location) {
+		ids := make([]int64, len(stack))
+		for i, loc := range stack {
+			ids[i] = locationIDOf(loc)
+		}
+		samples = append(samples, sample{ids: ids, values: []int64{n.count, n.nanos}})
+	})
+	var e encoder
+	unit := str(p.Unit)
+	count := str("count")
+	e.message(profileSampleType, func(m *encoder) {
+		m.int64(valueTypeType, unit)
+		m.int64(valueTypeUnit, count)
+	})
+	e.message(profileSampleType, func(m *encoder) {
+		m.int64(valueTypeType, str("time"))
+		m.int64(valueTypeUnit, str("nanoseconds"))
+	})
+	for _, s := range samples {
+		e.message(profileSample, func(m *encoder) {
+			m.packed(sampleLocationID, s.ids)
+			m.packed(sampleValue, s.values)
+		})
+	}
+	for i, loc := range locs {
+		e.message(profileLocation, func(m *encoder) {
+			m.int64(locationID, int64(i+1))
+			m.message(locationLine, func(l *encoder) {
+				l.int64(lineFunctionID, functions[loc.frame])
+				l.int64(lineLine, int64(loc.line))
+			})
+		})
+	}
+	file := str(p.File)
+	for i, f := range frames {
+		e.message(profileFunction, func(m *encoder) {
+			name := str(pprofName(displayName(Entry{Function: f.Function, StartLine: f.StartLine})))
+			m.int64(functionID, int64(i+1))
+			m.int64(functionName, name)
+			m.int64(functionSystemName, name)
+			m.int64(functionFilename, file)
+			m.int64(functionStartLine, int64(f.StartLine))
+		})
+	}
+	e.int64(profileTimeNanos, p.start.UnixNano())
+	e.int64(profileDurationNanos, int64(p.duration))
+	e.message(profilePeriodType, func(m *encoder) {
+		m.int64(valueTypeType, unit)
+		m.int64(valueTypeUnit, count)
+	})
+	e.int64(profilePeriod, 1)
+	e.int64(profileDefaultSampleType, unit)
+	// 字符串表在最后编码，这时所有字符串都已经加入
+	for _, s := range table {
+		e.bytes(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(e.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// pprofName 把 <main> 和 <anonymous> 写成 (main) 和 (anonymous)，
+// 因为 pprof 会把尖括号当作 C++ 的模板参数去掉
+func pprofName(name string) string {
+	return strings.NewReplacer("<", "(", ">", ")").Replace(name)
+}
@@ -0,0 +1,292 @@
+// Package profile 统计 Monkey 程序在每个函数和每一行上花费的执行次数和时间，
+// 虚拟机按指令计数，求值器按求值的节点计数。结果可以输出成文本报告，
+// 也可以输出成 go tool pprof 能读取的 profile.proto 文件，样本的调用栈是 Monkey 的调用栈。
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// clockInterval 是两次读取时钟之间记录的次数。每次读取时钟时，
+// 距离上一次读取经过的时间都算在当前的调用栈上，也就是按次数采样
+const clockInterval = 64
+
+// Frame 标识一个函数，同名的匿名函数用起始行区分
+type Frame struct {
+	Function  string
+	StartLine int
+}
+
+// Main 是主程序的帧
+var Main = Frame{Function: "<main>"}
+
+type location struct {
+	frame Frame
+	line  int
+}
+
+// node 是调用栈前缀树中的一个节点，从根到节点的路径就是一个调用栈
+type node struct {
+	parent   *node
+	loc      location
+	children map[location]*node
+	count    int64
+	nanos    int64
+}
+
+func (n *node) child(loc location) *node {
+	c, ok := n.children[loc]
+	if !ok {
+		if n.children == nil {
+			n.children = map[location]*node{}
+		}
+		c = &node{parent: n, loc: loc}
+		n.children[loc] = c
+	}
+	return c
+}
+
+// Profiler 记录执行的位置，同一个 Profiler 不能在多个 goroutine 中同时使用
+type Profiler struct {
+	// Unit 是计数的单位，例如 instructions 或者 nodes
+	Unit string
+	// File 是写入 pprof 文件的源码文件名
+	File string
+
+	root node
+	// nodes[d-1] 是深度为 d 的帧当前所在的节点
+	nodes   []*node
+	current *node
+	records int64
+
+	start    time.Time
+	last     time.Time
+	duration time.Duration
+}
+
+// New 创建一个 Profiler，计时从这时开始
+func New(unit string) *Profiler {
+	now := time.Now()
+	return &Profiler{Unit: unit, start: now, last: now}
+}
+
+// Record 记录一次执行。depth 是调用栈的深度，主程序为 1，
+// frame 是深度为 depth 的函数，line 是正在执行的行
+func (p *Profiler) Record(depth int, frame Frame, line int) {
+	if depth > len(p.nodes)+1 {
+		// 开始记录时已经在函数中，缺少的外层帧合并到最外层
+		depth = len(p.nodes) + 1
+	}
+	parent := &p.root
+	if depth > 1 {
+		parent = p.nodes[depth-2]
+	}
+	loc := location{frame: frame, line: line}
+	var n *node
+	if depth <= len(p.nodes) {
+		if prev := p.nodes[depth-1]; prev.parent == parent && prev.loc == loc {
+			n = prev
+		}
+	}
+	if n == nil {
+		n = parent.child(loc)
+	}
+	p.nodes = append(p.nodes[:depth-1], n)
+	n.count++
+	p.current = n
+	p.records++
+	if p.records%clockInterval == 0 {
+		p.tick()
+	}
+}
+
+func (p *Profiler) tick() {
+	now := time.Now()
+	if p.current != nil {
+		p.current.nanos += int64(now.Sub(p.last))
+	}
+	p.last = now
+	p.duration = now.Sub(p.start)
+}
+
+// Stop 把最后一次读取时钟之后的时间算在当前的调用栈上，在输出结果之前调用
+func (p *Profiler) Stop() {
+	p.tick()
+}
+
+// Total 返回记录的总次数
+func (p *Profiler) Total() int64 {
+	return p.records
+}
+
+// Entry 是报告中的一行。Flat 是正好在这个位置执行的次数，
+// Cum 还包括在这里调用的函数中执行的次数
+type Entry struct {
+	Function  string
+	StartLine int
+	// Line 在函数的统计中为 0
+	Line     int
+	Flat     int64
+	Cum      int64
+	FlatTime time.Duration
+	CumTime  time.Duration
+}
+
+// walk 按确定的顺序对每个记录过的调用栈调用 fn，stack 从最内层开始
+func (p *Profiler) walk(fn func(n *node, stack []location)) {
+	var visit func(n *node, stack []location)
+	visit = func(n *node, stack []location) {
+		stack = append([]location{n.loc}, stack...)
+		if n.count > 0 || n.nanos > 0 {
+			fn(n, stack)
+		}
+		for _, c := range n.sortedChildren() {
+			visit(c, stack)
+		}
+	}
+	for _, c := range p.root.sortedChildren() {
+		visit(c, nil)
+	}
+}
+
+func (n *node) sortedChildren() []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i].loc, children[j].loc
+		if a.frame.Function != b.frame.Function {
+			return a.frame.Function < b.frame.Function
+		}
+		if a.frame.StartLine != b.frame.StartLine {
+			return a.frame.StartLine < b.frame.StartLine
+		}
+		return a.line < b.line
+	})
+	return children
+}
+
+// Functions 按函数汇总，Flat 多的排在前面
+func (p *Profiler) Functions() []Entry {
+	entries := map[Frame]*Entry{}
+	get := func(f Frame) *Entry {
+		e, ok := entries[f]
+		if !ok {
+			e = &Entry{Function: f.Function, StartLine: f.StartLine}
+			entries[f] = e
+		}
+		return e
+	}
+	p.walk(func(n *node, stack []location) {
+		leaf := get(n.loc.frame)
+		leaf.Flat += n.count
+		leaf.FlatTime += time.Duration(n.nanos)
+		// 递归调用时同一个函数在调用栈中出现多次，只算一次
+		seen := map[Frame]bool{}
+		for _, loc := range stack {
+			if !seen[loc.frame] {
+				seen[loc.frame] = true
+				e := get(loc.frame)
+				e.Cum += n.count
+				e.CumTime += time.Duration(n.nanos)
+			}
+		}
+	})
+	return sortEntries(entries)
+}
+
+// Lines 按源码行汇总，Flat 多的排在前面
+func (p *Profiler) Lines() []Entry {
+	entries := map[location]*Entry{}
+	get := func(loc location) *Entry {
+		e, ok := entries[loc]
+		if !ok {
+			e = &Entry{Function: loc.frame.Function, StartLine: loc.frame.StartLine, Line: loc.line}
+			entries[loc] = e
+		}
+		return e
+	}
+	p.walk(func(n *node, stack []location) {
+		leaf := get(n.loc)
+		leaf.Flat += n.count
+		leaf.FlatTime += time.Duration(n.nanos)
+		seen := map[location]bool{}
+		for _, loc := range stack {
+			if !seen[loc] {
+				seen[loc] = true
+				e := get(loc)
+				e.Cum += n.count
+				e.CumTime += time.Duration(n.nanos)
+			}
+		}
+	})
+	return sortEntries(entries)
+}
+
+func sortEntries(m interface{}) []Entry {
+	var entries []Entry
+	switch m := m.(type) {
+	case map[Frame]*Entry:
+		for _, e := range m {
+			entries = append(entries, *e)
+		}
+	case map[location]*Entry:
+		for _, e := range m {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Flat != b.Flat {
+			return a.Flat > b.Flat
+		}
+		if a.Cum != b.Cum {
+			return a.Cum > b.Cum
+		}
+		if a.Function != b.Function {
+			return a.Function < b.Function
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.Line < b.Line
+	})
+	return entries
+}
+
+// WriteText 输出按函数和按行汇总的文本报告
+func (p *Profiler) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Total: %d %s, %s\n\n", p.records, p.Unit, p.duration)
+	fmt.Fprintf(tw, "flat\tflat%%\tcum\tcum%%\tflat time\tcum time\t\tfunction\n")
+	for _, e := range p.Functions() {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\t\t%s\n", e.Flat, p.percent(e.Flat), e.Cum, p.percent(e.Cum),
+			time.Duration(e.FlatTime), time.Duration(e.CumTime), displayName(e))
+	}
+	fmt.Fprintf(tw, "\nflat\tflat%%\tcum\tcum%%\tflat time\tcum time\t\tline\n")
+	for _, e := range p.Lines() {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\t\t%s:%d\n", e.Flat, p.percent(e.Flat), e.Cum, p.percent(e.Cum),
+			time.Duration(e.FlatTime), time.Duration(e.CumTime), displayName(e), e.Line)
+	}
+	return tw.Flush()
+}
+
+func (p *Profiler) percent(n int64) string {
+	if p.records == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(p.records))
+}
+
+// displayName 在报告中区分同名的函数，例如两个匿名函数
+func displayName(e Entry) string {
+	if e.StartLine == 0 {
+		return e.Function
+	}
+	return fmt.Sprintf("%s@%d", e.Function, e.StartLine)
+}
@@ -0,0 +1,190 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var (
+	fib   = Frame{Function: "fib", StartLine: 2}
+	inner = Frame{Function: "<anonymous>", StartLine: 5}
+)
+
+// record 模拟 main 调用 fib，fib 递归调用自己一次，再调用一个匿名函数
+func record() *Profiler {
+	p := New("instructions")
+	p.File = "fib.mk"
+	p.Record(1, Main, 1)
+	p.Record(1, Main, 1)
+	p.Record(2, fib, 2)
+	p.Record(2, fib, 3)
+	p.Record(3, fib, 2)
+	p.Record(2, fib, 3)
+	p.Record(3, inner, 5)
+	p.Record(1, Main, 7)
+	p.Stop()
+	return p
+}
+
+func TestFunctions(t *testing.T) {
+	tests := []Entry{
+		{Function: "fib", StartLine: 2, Flat: 4, Cum: 5},
+		{Function: "<main>", Flat: 3, Cum: 8},
+		{Function: "<anonymous>", StartLine: 5, Flat: 1, Cum: 1},
+	}
+	p := record()
+	if p.Total() != 8 {
+		t.Errorf("wrong total. want=8, got=%d", p.Total())
+	}
+	got := p.Functions()
+	if len(got) != len(tests) {
+		t.Fatalf("wrong number of functions. want=%d, got=%d (%+v)", len(tests), len(got), got)
+	}
+	for i, want := range tests {
+		e := got[i]
+		if e.Function != want.Function || e.StartLine != want.StartLine || e.Flat != want.Flat || e.Cum != want.Cum {
+			t.Errorf("functions[%d] wrong. want=%+v, got=%+v", i, want, e)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []Entry{
+		{Function: "<main>", Line: 1, Flat: 2, Cum: 7},
+		{Function: "fib", StartLine: 2, Line: 3, Flat: 2, Cum: 4},
+		{Function: "fib", StartLine: 2, Line: 2, Flat: 2, Cum: 2},
+		{Function: "<anonymous>", StartLine: 5, Line: 5, Flat: 1, Cum: 1},
+		{Function: "<main>", Line: 7, Flat: 1, Cum: 1},
+	}
+	got := record().Lines()
+	if len(got) != len(tests) {
+		t.Fatalf("wrong number of lines. want=%d, got=%d (%+v)", len(tests), len(got), got)
+	}
+	for i, want := range tests {
+		e := got[i]
+		if e.Function != want.Function || e.Line != want.Line || e.Flat != want.Flat || e.Cum != want.Cum {
+			t.Errorf("lines[%d] wrong. want=%+v, got=%+v", i, want, e)
+		}
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var out bytes.Buffer
+	if err := record().WriteText(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Total: 8 instructions", "fib@2", "<anonymous>@5:5", "<main>:7", "50.0%"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// field 是解码后的一个 protobuf 字段，varint 字段只有 value，其他字段只有 data
+type field struct {
+	number int
+	value  uint64
+	data   []byte
+}
+
+func varint(t *testing.T, data []byte) (uint64, []byte) {
+	t.Helper()
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(data) == 0 {
+			t.Fatalf("truncated varint")
+		}
+		b := data[0]
+		data = data[1:]
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, data
+		}
+	}
+}
+
+func decode(t *testing.T, data []byte) []field {
+	t.Helper()
+	var fields []field
+	for len(data) > 0 {
+		var tag uint64
+		tag, data = varint(t, data)
+		f := field{number: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			f.value, data = varint(t, data)
+		case 2:
+			var n uint64
+			n, data = varint(t, data)
+			f.data, data = data[:n], data[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func TestWriteProto(t *testing.T) {
+	var out bytes.Buffer
+	if err := record().WriteProto(&out); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var table []string
+	counts := map[int]int{}
+	var samples [][]field
+	for _, f := range decode(t, data) {
+		counts[f.number]++
+		switch f.number {
+		case profileStringTable:
+			table = append(table, string(f.data))
+		case profileSample:
+			samples = append(samples, decode(t, f.data))
+		}
+	}
+	if len(table) == 0 || table[0] != "" {
+		t.Fatalf("string table must start with an empty string, got=%q", table)
+	}
+	for _, want := range []string{"instructions", "count", "time", "nanoseconds", "fib@2", "(anonymous)@5", "(main)", "fib.mk"} {
+		found := false
+		for _, s := range table {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("string table does not contain %q: %q", want, table)
+		}
+	}
+	// 6 个不同的调用栈，5 个不同的位置，3 个函数，2 种样本值
+	want := map[int]int{profileSampleType: 2, profileSample: 6, profileLocation: 5, profileFunction: 3}
+	for number, n := range want {
+		if counts[number] != n {
+			t.Errorf("wrong number of field %d. want=%d, got=%d", number, n, counts[number])
+		}
+	}
+
+	var total uint64
+	for _, sample := range samples {
+		for _, f := range sample {
+			if f.number == sampleValue {
+				// 第一个值是次数，第二个值是时间
+				count, _ := varint(t, f.data)
+				total += count
+			}
+		}
+	}
+	if total != 8 {
+		t.Errorf("wrong total of sample counts. want=8, got=%d", total)
+	}
+}
@@ -0,0 +1,239 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errInterrupt 表示用户按下了 Ctrl-C，当前的输入应该被丢弃
+var errInterrupt = errors.New("interrupted")
+
+// lineReader 读取一行输入，读到结尾时返回 io.EOF
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+}
+
+// plainReader 用于输入不是终端的情况，例如管道和测试
+type plainReader struct {
+	r   *bufio.Reader
+	out io.Writer
+}
+
+func (p *plainReader) ReadLine(prompt string) (string, error) {
+	io.WriteString(p.out, prompt)
+	line, err := p.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// completer 返回 line 中光标前的单词可以补全成的所有候选
+type completer func(line string) (word string, candidates []string)
+
+// editor 是终端上的行编辑器，支持光标移动、历史记录和 Tab 补全。
+// 每次读取一行之前由 raw 把终端切换到原始模式，读完后恢复。
+type editor struct {
+	r        *bufio.Reader
+	out      io.Writer
+	raw      func() (func(), error)
+	history  *history
+	complete completer
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// lineState 是正在编辑的一行
+type lineState struct {
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func (e *editor) ReadLine(prompt string) (string, error) {
+	if e.raw != nil {
+		restore, err := e.raw()
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+
+	s := &lineState{prompt: prompt}
+	// historyIndex 等于 len(entries) 时表示正在编辑新的一行，saved 保存它的内容
+	historyIndex := len(e.history.entries)
+	saved := ""
+	e.refresh(s)
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(s.buf) > 0 {
+				io.WriteString(e.out, "\n")
+				return string(s.buf), nil
+			}
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			io.WriteString(e.out, "\n")
+			return string(s.buf), nil
+		case keyCtrlC:
+			io.WriteString(e.out, "^C\n")
+			return "", errInterrupt
+		case keyCtrlD:
+			if len(s.buf) == 0 {
+				io.WriteString(e.out, "\n")
+				return "", io.EOF
+			}
+			s.deleteAt(s.pos)
+		case keyBackspace, keyDelete:
+			if s.pos > 0 {
+				s.pos--
+				s.deleteAt(s.pos)
+			}
+		case keyTab:
+			e.completeWord(s)
+		case keyCtrlA:
+			s.pos = 0
+		case keyCtrlE:
+			s.pos = len(s.buf)
+		case keyCtrlK:
+			s.buf = s.buf[:s.pos]
+		case keyCtrlU:
+			s.buf = s.buf[s.pos:]
+			s.pos = 0
+		case keyEscape:
+			switch e.readEscape() {
+			case "[A":
+				if historyIndex > 0 {
+					if historyIndex == len(e.history.entries) {
+						saved = string(s.buf)
+					}
+					historyIndex--
+					s.set(e.history.entries[historyIndex])
+				}
+			case "[B":
+				if historyIndex < len(e.history.entries) {
+					historyIndex++
+					if historyIndex == len(e.history.entries) {
+						s.set(saved)
+					} else {
+						s.set(e.history.entries[historyIndex])
+					}
+				}
+			case "[C":
+				if s.pos < len(s.buf) {
+					s.pos++
+				}
+			case "[D":
+				if s.pos > 0 {
+					s.pos--
+				}
+			case "[H", "OH", "[1~":
+				s.pos = 0
+			case "[F", "OF", "[4~":
+				s.pos = len(s.buf)
+			case "[3~":
+				s.deleteAt(s.pos)
+			}
+		default:
+			if r >= ' ' {
+				s.insert([]rune{r})
+			}
+		}
+		e.refresh(s)
+	}
+}
+
+// readEscape 读取 ESC 之后的控制序列，例如方向键的 "[A"
+func (e *editor) readEscape() string {
+	var seq []rune
+	for {
+		r, _, err := e.r.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		if len(seq) > 1 && (r >= 'A' && r <= 'Z' || r == '~') {
+			return string(seq)
+		}
+		if len(seq) == 1 && r != '[' && r != 'O' {
+			return string(seq)
+		}
+	}
+}
+
+// completeWord 补全光标前的单词：唯一候选直接补全，
+// 多个候选时补全到公共前缀，无法继续补全时列出所有候选
+func (e *editor) completeWord(s *lineState) {
+	if e.complete == nil {
+		return
+	}
+	word, candidates := e.complete(string(s.buf[:s.pos]))
+	if len(candidates) == 0 {
+		return
+	}
+	prefix := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		prefix += " "
+	}
+	if len(prefix) > len(word) {
+		s.insert([]rune(prefix[len(word):]))
+		return
+	}
+	fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+}
+
+func (e *editor) refresh(s *lineState) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", s.prompt, string(s.buf))
+	if back := len(s.buf) - s.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (s *lineState) insert(runes []rune) {
+	buf := make([]rune, 0, len(s.buf)+len(runes))
+	buf = append(buf, s.buf[:s.pos]...)
+	buf = append(buf, runes...)
+	s.buf = append(buf, s.buf[s.pos:]...)
+	s.pos += len(runes)
+}
+
+func (s *lineState) deleteAt(pos int) {
+	if pos < len(s.buf) {
+		s.buf = append(s.buf[:pos], s.buf[pos+1:]...)
+	}
+}
+
+// set 替换整行内容，多行的历史记录合并成一行显示
+func (s *lineState) set(line string) {
+	s.buf = []rune(strings.ReplaceAll(line, "\n", " "))
+	s.pos = len(s.buf)
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,107 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const MaxHistory = 1000
+
+// history 保存输入过的内容，path 不为空时每条记录都会追加到文件中。
+// 多行输入作为一条记录，在文件中以 Go 字符串字面量的形式占一行。
+// 文件超过 MaxHistory 条记录时在读入时改写，会话中超过两倍时也会改写，只保留最后 MaxHistory 条。
+type history struct {
+	entries []string
+	path    string
+	// lines 是文件中的记录数
+	lines int
+}
+
+// loadHistory 读取历史文件，文件不存在时得到空的历史
+func loadHistory(path string) (*history, error) {
+	h := &history{path: path}
+	if path == "" {
+		return h, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		h.lines++
+		line := scanner.Text()
+		if entry, err := strconv.Unquote(line); err == nil {
+			line = entry
+		}
+		if line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if len(h.entries) > MaxHistory {
+		h.entries = h.entries[len(h.entries)-MaxHistory:]
+	}
+	if err := scanner.Err(); err != nil {
+		return h, err
+	}
+	if h.lines > MaxHistory {
+		return h, h.rewrite()
+	}
+	return h, nil
+}
+
+// add 记录一条输入，空输入和与上一条相同的输入会被忽略
+func (h *history) add(entry string) error {
+	if entry == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return nil
+	}
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > MaxHistory {
+		h.entries = h.entries[1:]
+	}
+	if h.path == "" {
+		return nil
+	}
+	if h.lines >= 2*MaxHistory {
+		return h.rewrite()
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, strconv.Quote(entry))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		h.lines++
+	}
+	return err
+}
+
+// rewrite 用内存中的记录替换历史文件，先写临时文件再改名，中途出错不会丢掉原来的文件
+func (h *history) rewrite() error {
+	var out bytes.Buffer
+	for _, entry := range h.entries {
+		fmt.Fprintln(&out, strconv.Quote(entry))
+	}
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, out.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.lines = len(h.entries)
+	return nil
+}
@@ -3,61 +3,395 @@ package repl
 import (
 	"bufio"
 	"fmt"
+	"interpreter/ast"
 	"interpreter/compiler"
+	"interpreter/evaluator"
 	"interpreter/lexer"
+	"interpreter/object"
 	"interpreter/parser"
+	"interpreter/token"
 	"interpreter/vm"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
 )
 
 const PROMPT = ">> "
 
+// CONTINUATION_PROMPT 在括号没有闭合、需要继续输入时显示
+const CONTINUATION_PROMPT = ".. "
+
+const (
+	EngineEval = "eval"
+	EngineVM   = "vm"
+)
+
+const help = `Meta-commands:
+  :tokens <code>     show the lexer output
+  :ast <code>        show the parsed AST
+  :bytecode <code>   show the compiled instructions and constant pool
+  :env               list the bindings of the current engine
+  :engine [eval|vm]  show or switch the execution engine
+  :load <file>       run a file in the current session
+  :reset             forget all bindings
+  :help              show this message
+`
+
+// session 保存两种引擎在多次输入之间的状态，两种引擎的变量互不共享
+type session struct {
+	out    io.Writer
+	engine string
+
+	env      *object.Environment
+	macroEnv *object.Environment
+
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+}
+
+func newSession(out io.Writer) *session {
+	s := &session{out: out, engine: EngineVM}
+	s.reset()
+	return s
+}
+
+func (s *session) reset() {
+	s.env = object.NewEnvironment()
+	s.macroEnv = object.NewEnvironment()
+	s.symbolTable = compiler.New().SymbolTable()
+	s.constants = []object.Object{}
+	s.globals = make([]object.Object, vm.GlobalSize)
+}
+
+// Options 配置 REPL，零值表示使用虚拟机并且不保存历史记录
+type Options struct {
+	// Engine 是初始的执行引擎，EngineEval 或 EngineVM
+	Engine string
+	// HistoryFile 是保存输入历史的文件
+	HistoryFile string
+}
+
 func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
-	//env := object.NewEnvironment()
-	//macroEnv := object.NewEnvironment()
+	StartWithOptions(in, out, Options{})
+}
+
+// StartWithOptions 启动 REPL。in 和 out 都是终端时支持行编辑、历史记录和 Tab 补全，
+// 否则逐行读取输入。括号没有闭合时会继续读取下一行。
+func StartWithOptions(in io.Reader, out io.Writer, opts Options) {
+	s := newSession(out)
+	if opts.Engine != "" {
+		s.engine = opts.Engine
+	}
+	hist, err := loadHistory(opts.HistoryFile)
+	if err != nil {
+		fmt.Fprintf(out, "could not read history: %s\n", err)
+	}
+	reader := newLineReader(in, out, hist, s.complete)
+
+	var lines []string
 	for {
-		fmt.Print(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		prompt := PROMPT
+		if len(lines) > 0 {
+			prompt = CONTINUATION_PROMPT
+		}
+		line, err := reader.ReadLine(prompt)
+		if err == errInterrupt {
+			lines = nil
+			continue
+		}
+		if err != nil {
 			return
 		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParseErrors(out, p.Errors())
+		if len(lines) == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			hist.add(strings.TrimSpace(line))
+			s.metaCommand(strings.TrimSpace(line))
+			continue
+		}
+		lines = append(lines, line)
+		input := strings.Join(lines, "\n")
+		if needsMoreInput(input) {
+			continue
+		}
+		lines = nil
+		if strings.TrimSpace(input) == "" {
 			continue
 		}
-		//evaluator.DefineMacros(program, macroEnv)
-		//expanded := evaluator.ExpandMacro(program, macroEnv)
-		//evaluated := evaluator.Eval(expanded, env)
-		//if evaluated != nil {
-		//	_, _ = io.WriteString(out, evaluated.Inspect())
-		//	_, _ = io.WriteString(out, "\n")
-		//}
-		comp := compiler.New()
+		if err := hist.add(input); err != nil {
+			fmt.Fprintf(out, "could not save history: %s\n", err)
+		}
+		s.run(input, true)
+	}
+}
+
+func newLineReader(in io.Reader, out io.Writer, hist *history, complete completer) lineReader {
+	inFile, inOK := in.(*os.File)
+	outFile, outOK := out.(*os.File)
+	if inOK && outOK && isTerminal(inFile.Fd()) && isTerminal(outFile.Fd()) {
+		return &editor{
+			r:        bufio.NewReader(in),
+			out:      out,
+			raw:      func() (func(), error) { return makeRaw(inFile.Fd()) },
+			history:  hist,
+			complete: complete,
+		}
+	}
+	return &plainReader{r: bufio.NewReader(in), out: out}
+}
+
+// needsMoreInput 根据词法单元判断圆括号、花括号或方括号是否还没有闭合
+func needsMoreInput(input string) bool {
+	depth := 0
+	l := lexer.New(input)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth--
+			if depth < 0 {
+				// 多余的右括号交给解析器报错
+				return false
+			}
+		}
+	}
+	return depth > 0
+}
+
+var metaCommands = []string{":ast", ":bytecode", ":engine", ":env", ":help", ":load", ":reset", ":tokens"}
+
+var keywords = []string{"else", "false", "fn", "if", "let", "macro", "return", "true"}
+
+// complete 找出光标前的单词可以补全成的关键字、内置函数和当前引擎中绑定的名字，
+// 行首的冒号命令补全成元命令
+func (s *session) complete(line string) (string, []string) {
+	start := len(line)
+	for start > 0 && isIdentifierChar(line[start-1]) {
+		start--
+	}
+	word := line[start:]
+	var names []string
+	if strings.TrimSpace(line[:start]) == ":" {
+		word = ":" + word
+		names = metaCommands
+	} else {
+		if word == "" {
+			return word, nil
+		}
+		names = append(names, keywords...)
+		for _, b := range object.Builtins {
+			names = append(names, b.Name)
+		}
+		names = append(names, s.boundNames()...)
+	}
+
+	seen := map[string]bool{}
+	var candidates []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) && !seen[name] {
+			seen[name] = true
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return word, candidates
+}
+
+func (s *session) boundNames() []string {
+	if s.engine == EngineEval {
+		return append(s.env.Names(), s.macroEnv.Names()...)
+	}
+	var names []string
+	for _, symbol := range s.symbolTable.Symbols(compiler.GlobalScope) {
+		names = append(names, symbol.Name)
+	}
+	return names
+}
+
+func isIdentifierChar(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+}
+
+// metaCommand 处理以冒号开头的命令，命令名之后的部分作为参数
+func (s *session) metaCommand(line string) {
+	command, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		command, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch command {
+	case ":tokens":
+		s.printTokens(arg)
+	case ":ast":
+		if program, ok := s.parse(arg); ok {
+			printAST(s.out, program)
+		}
+	case ":bytecode":
+		s.printByteCode(arg)
+	case ":env":
+		s.printEnv()
+	case ":engine":
+		switch arg {
+		case "":
+			fmt.Fprintf(s.out, "engine: %s\n", s.engine)
+		case EngineEval, EngineVM:
+			s.engine = arg
+			fmt.Fprintf(s.out, "switched to the %s engine\n", arg)
+		default:
+			fmt.Fprintf(s.out, "unknown engine %q, want eval or vm\n", arg)
+		}
+	case ":load":
+		if arg == "" {
+			fmt.Fprintf(s.out, "usage: :load <file>\n")
+			return
+		}
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintf(s.out, "%s\n", err)
+			return
+		}
+		if s.run(string(data), false) {
+			fmt.Fprintf(s.out, "loaded %s\n", arg)
+		}
+	case ":reset":
+		s.reset()
+		fmt.Fprintf(s.out, "all bindings cleared\n")
+	case ":help":
+		io.WriteString(s.out, help)
+	default:
+		fmt.Fprintf(s.out, "unknown command %s, type :help for a list of commands\n", command)
+	}
+}
+
+// run 用当前引擎执行一段代码，printResult 为真时打印结果，返回是否执行成功
+func (s *session) run(input string, printResult bool) bool {
+	program, ok := s.parse(input)
+	if !ok {
+		return false
+	}
+	var result object.Object
+	if s.engine == EngineEval {
+		evaluator.DefineMacros(program, s.macroEnv)
+		expanded, err := evaluator.ExpandMacro(program, s.macroEnv)
+		if err != nil {
+			fmt.Fprintf(s.out, "Woops! Macro expansion failed:\n %s\n", err)
+			return false
+		}
+		e := evaluator.New()
+		e.Out = s.out
+		result = e.Eval(expanded, s.env)
+		if errObj, ok := result.(*object.Error); ok {
+			fmt.Fprintf(s.out, "Woops! Evaluation failed:\n %s\n", errObj.Message)
+			return false
+		}
+	} else {
+		comp := compiler.NewWithState(s.symbolTable, s.constants)
 		err := comp.Compile(program)
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
-			continue
+			fmt.Fprintf(s.out, "Woops! Compilation failed:\n %s\n", err)
+			return false
 		}
-		machine := vm.New(comp.ByteCode())
+		bytecode := comp.ByteCode()
+		s.constants = bytecode.Constants
+		machine := vm.NewWithGlobalsState(bytecode, s.globals)
+		machine.SetOutput(s.out)
 		err = machine.Run()
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
+			fmt.Fprintf(s.out, "Woops! Executing bytecode failed:\n %s\n", err)
+			return false
 		}
-		stackTop := machine.LastPoppedStackElem()
-		io.WriteString(out, stackTop.Inspect())
-		io.WriteString(out, "\n")
+		result = machine.LastPoppedStackElem()
+	}
+	if printResult && result != nil {
+		io.WriteString(s.out, result.Inspect())
+		io.WriteString(s.out, "\n")
+	}
+	return true
+}
+
+func (s *session) parse(input string) (*ast.Program, bool) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParseErrors(s.out, p.Errors())
+		return nil, false
 	}
+	return program, true
 }
+
+func (s *session) printTokens(input string) {
+	l := lexer.New(input)
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(s.out, "%d:%d\t%-10s %q\n", tok.Line, tok.Column, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			return
+		}
+	}
+}
+
+// printByteCode 在当前符号表的副本上编译，只展示结果而不执行，也不会留下定义
+func (s *session) printByteCode(input string) {
+	program, ok := s.parse(input)
+	if !ok {
+		return
+	}
+	comp := compiler.NewWithState(s.symbolTable.Copy(), s.constants)
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(s.out, "Woops! Compilation failed:\n %s\n", err)
+		return
+	}
+	io.WriteString(s.out, compiler.Disassemble(comp.ByteCode()))
+}
+
+func (s *session) printEnv() {
+	if s.engine == EngineEval {
+		for _, name := range s.env.Names() {
+			value, _ := s.env.Get(name)
+			fmt.Fprintf(s.out, "%s = %s\n", name, value.Inspect())
+		}
+		for _, name := range s.macroEnv.Names() {
+			fmt.Fprintf(s.out, "%s = macro\n", name)
+		}
+		return
+	}
+	for _, symbol := range s.symbolTable.Symbols(compiler.GlobalScope) {
+		value := s.globals[symbol.Index]
+		if value == nil {
+			// 编译成功但还没有执行到的定义
+			continue
+		}
+		fmt.Fprintf(s.out, "%s = %s\n", symbol.Name, value.Inspect())
+	}
+}
+
+// astPrinter 按照层级缩进打印每个节点的类型和源码形式
+type astPrinter struct {
+	out   io.Writer
+	depth int
+}
+
+func (p *astPrinter) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		p.depth--
+		return nil
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+	fmt.Fprintf(p.out, "%s%s %s\n", strings.Repeat("  ", p.depth), name, node.String())
+	p.depth++
+	return p
+}
+
+func printAST(out io.Writer, program *ast.Program) {
+	ast.Walk(&astPrinter{out: out}, program)
+}
+
 func printParseErrors(out io.Writer, errors []string) {
 	io.WriteString(out, "Woops!We ran into some errors here!\n")
 	io.WriteString(out, " parse errors:\n")
 	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\t")
+		io.WriteString(out, "\t"+msg+"\n")
 	}
 }
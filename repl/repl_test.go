@@ -0,0 +1,301 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func runSession(t *testing.T, lines ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	Start(strings.NewReader(strings.Join(lines, "\n")+"\n"), &out)
+	return stripPrompts(out.String())
+}
+
+func stripPrompts(s string) string {
+	s = strings.ReplaceAll(s, PROMPT, "")
+	return strings.ReplaceAll(s, CONTINUATION_PROMPT, "")
+}
+
+func TestMetaCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		expected string
+	}{
+		{
+			"tokens",
+			[]string{":tokens x == 1"},
+			"1:1\tIDENT      \"x\"\n1:3\t==         \"==\"\n1:6\tINT        \"1\"\n1:7\tEOF        \"\"\n",
+		},
+		{
+			"ast",
+			[]string{":ast -a"},
+			"Program (-a)\n  ExpressionStatement (-a)\n    PrefixExpression (-a)\n      Identifier a\n",
+		},
+		{
+			"bytecode does not define",
+			[]string{":bytecode let a = 1;", "a"},
+			"== main ==\n0000 OpConstant 0\n0003 OpSetGlobal 0\n== constants ==\n0000 INTEGER 1\n" +
+				"Woops! Compilation failed:\n undefined variable a\n",
+		},
+		{
+			"env vm",
+			[]string{"let b = 2;", "let a = [1];", ":env"},
+			"2\n[1]\nb = 2\na = [1]\n",
+		},
+		{
+			"env eval",
+			[]string{":engine eval", "let b = 2;", "let a = b * 2;", ":env"},
+			"switched to the eval engine\na = 4\nb = 2\n",
+		},
+		{
+			"engines keep separate bindings",
+			[]string{"let a = 1;", ":engine eval", "a", ":engine", ":engine vm", "a"},
+			"1\nswitched to the eval engine\nWoops! Evaluation failed:\n identifier not found: a\n" +
+				"engine: eval\nswitched to the vm engine\n1\n",
+		},
+		{
+			"reset",
+			[]string{":engine eval", "let a = 1;", ":reset", "a"},
+			"switched to the eval engine\nall bindings cleared\nWoops! Evaluation failed:\n identifier not found: a\n",
+		},
+		{
+			"errors",
+			[]string{":engine js", ":load", ":nope"},
+			"unknown engine \"js\", want eval or vm\nusage: :load <file>\n" +
+				"unknown command :nope, type :help for a list of commands\n",
+		},
+	}
+	for _, tt := range tests {
+		got := runSession(t, tt.lines...)
+		if got != tt.expected {
+			t.Errorf("%s: wrong output.\nwant=%q\ngot=%q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lib.mk")
+	err := ioutil.WriteFile(file, []byte("let square = fn(x) { x * x };\nlet n = 3;\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, engine := range []string{EngineEval, EngineVM} {
+		got := runSession(t, ":engine "+engine, ":load "+file, "square(n)")
+		expected := "switched to the " + engine + " engine\nloaded " + file + "\n9\n"
+		if got != expected {
+			t.Errorf("%s: wrong output.\nwant=%q\ngot=%q", engine, expected, got)
+		}
+	}
+}
+
+func TestPromptsGoToOut(t *testing.T) {
+	var out bytes.Buffer
+	Start(strings.NewReader("let f = fn(x) {\n  x * 2\n};\nf(4)\n"), &out)
+	if !strings.HasPrefix(out.String(), ">> .. .. Closure[") || !strings.HasSuffix(out.String(), "]\n>> 8\n>> ") {
+		t.Errorf("wrong output. got=%q", out.String())
+	}
+}
+
+// put 写到 REPL 的输出，而不是进程的标准输出
+func TestPutGoesToOut(t *testing.T) {
+	for _, engine := range []string{EngineEval, EngineVM} {
+		got := runSession(t, ":engine "+engine, `put("hi", 1 + 2)`, `map([1], fn(x) { put(x) })`)
+		expected := "switched to the " + engine + " engine\nhi\n3\nnull\n1\n[null]\n"
+		if got != expected {
+			t.Errorf("%s: wrong output.\nwant=%q\ngot=%q", engine, expected, got)
+		}
+	}
+}
+
+func TestMultiLineInput(t *testing.T) {
+	got := runSession(t,
+		"let add = fn(a, b) {",
+		"  a + b",
+		"};",
+		"add(",
+		"  [1, 2][0],",
+		"  {\"k\": 2}[\"k\"]",
+		")",
+		"add(1, 2))",
+	)
+	expected := "]\n3\nWoops!We ran into some errors here!\n parse errors:\n\tno prefix parse function for ) found.\n"
+	if !strings.HasSuffix(got, expected) {
+		t.Errorf("wrong output. got=%q", got)
+	}
+}
+
+func TestNeedsMoreInput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"fn(x) {", true},
+		{"fn(x) { x }", false},
+		{"[1, [2,", true},
+		{"put(\"(\")", false},
+		{"put(\")\"", true},
+		{")(", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := needsMoreInput(tt.input); got != tt.expected {
+			t.Errorf("needsMoreInput(%q): want=%t, got=%t", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	s := newSession(&bytes.Buffer{})
+	s.run("let reducer = 1; let zed = 2;", false)
+	tests := []struct {
+		line       string
+		word       string
+		candidates []string
+	}{
+		{"re", "re", []string{"reduce", "reducer", "replace", "rest", "return", "reverse"}},
+		{"let a = zi", "zi", []string{"zip"}},
+		{"1 + ze", "ze", []string{"zed"}},
+		{":e", ":e", []string{":engine", ":env"}},
+		{"1 + ", "", nil},
+		{"qq", "qq", nil},
+	}
+	for _, tt := range tests {
+		word, candidates := s.complete(tt.line)
+		if word != tt.word || strings.Join(candidates, ",") != strings.Join(tt.candidates, ",") {
+			t.Errorf("complete(%q): want=%q %v, got=%q %v", tt.line, tt.word, tt.candidates, word, candidates)
+		}
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"let a = 1;", "let a = 1;", "", "fn(x) {\n  x\n}"} {
+		if err := h.add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"let a = 1;", "fn(x) {\n  x\n}"}
+	if strings.Join(loaded.entries, "|") != strings.Join(expected, "|") {
+		t.Errorf("wrong history. want=%q, got=%q", expected, loaded.entries)
+	}
+
+	var out bytes.Buffer
+	StartWithOptions(strings.NewReader("1 + 1\n:env\n"), &out, Options{HistoryFile: path})
+	loaded, _ = loadHistory(path)
+	if len(loaded.entries) != 4 || loaded.entries[2] != "1 + 1" || loaded.entries[3] != ":env" {
+		t.Errorf("wrong history after session. got=%q", loaded.entries)
+	}
+}
+
+// 历史文件超过 MaxHistory 条时改写成最后 MaxHistory 条
+func TestHistoryTrim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	var content strings.Builder
+	for i := 0; i < MaxHistory+10; i++ {
+		fmt.Fprintln(&content, strconv.Quote(strconv.Itoa(i)))
+	}
+	if err := ioutil.WriteFile(path, []byte(content.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	countLines := func() int {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+
+	h, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := countLines(); lines != MaxHistory {
+		t.Fatalf("history file not trimmed on load, has %d lines", lines)
+	}
+	if h.entries[0] != "10" {
+		t.Errorf("wrong first entry after load. got=%q", h.entries[0])
+	}
+
+	for i := 0; i < MaxHistory+1; i++ {
+		if err := h.add("x" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := countLines(); lines > 2*MaxHistory {
+		t.Errorf("history file grows without limit, has %d lines", lines)
+	}
+	loaded, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != MaxHistory || loaded.entries[MaxHistory-1] != "x"+strconv.Itoa(MaxHistory) {
+		t.Errorf("wrong entries after trimming. got %d, last=%q", len(loaded.entries), loaded.entries[len(loaded.entries)-1])
+	}
+}
+
+func TestEditor(t *testing.T) {
+	s := newSession(&bytes.Buffer{})
+	s.run("let counter = 1;", false)
+	hist := &history{entries: []string{"first", "second"}}
+	tests := []struct {
+		keys     string
+		expected string
+	}{
+		{"abc\r", "abc"},
+		{"abd\x7fc\r", "abc"},
+		{"bc\x01a\x05d\r", "abcd"},
+		{"ac\x1b[Db\r", "abc"},
+		{"\x1b[A\r", "second"},
+		{"\x1b[A\x1b[A\x1b[B\r", "second"},
+		{"new\x1b[A\x1b[B\r", "new"},
+		{"cou\t+ 1\r", "counter + 1"},
+		{"len(fir\t\r", "len(first "},
+		{"len(fi\t\r", "len(fi"},
+		{"hello\x01\x0b\r", ""},
+		{"xyz\x1b[D\x1b[D\x1b[3~\r", "xz"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		e := &editor{
+			r:        bufio.NewReader(strings.NewReader(tt.keys)),
+			out:      &out,
+			history:  hist,
+			complete: s.complete,
+		}
+		line, err := e.ReadLine(PROMPT)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tt.keys, err)
+			continue
+		}
+		if line != tt.expected {
+			t.Errorf("%q: want=%q, got=%q", tt.keys, tt.expected, line)
+		}
+	}
+
+	e := &editor{r: bufio.NewReader(strings.NewReader("abc\x03")), out: &bytes.Buffer{}, history: hist}
+	if _, err := e.ReadLine(PROMPT); err != errInterrupt {
+		t.Errorf("Ctrl-C should interrupt, got=%v", err)
+	}
+	e = &editor{r: bufio.NewReader(strings.NewReader("\x04")), out: &bytes.Buffer{}, history: hist}
+	if _, err := e.ReadLine(PROMPT); err != io.EOF {
+		t.Errorf("Ctrl-D on an empty line should return EOF, got=%v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package repl
+
+import "errors"
+
+// 其他平台上不支持行编辑，REPL 退回到逐行读取
+
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+func makeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
@@ -5,6 +5,9 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	// Line 和 Column 是词法单元第一个字符的位置，从 1 开始计数
+	Line   int
+	Column int
 }
 
 var keywords = map[string]TokenType{
@@ -28,6 +31,8 @@ func LookupIdent(ident string) TokenType {
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	// COMMENT 是以 // 开头直到行尾的注释，词法分析器不把它交给解析器
+	COMMENT = "COMMENT"
 
 	IDENT = "IDENT"
 	INT   = "INT"
@@ -0,0 +1,230 @@
+// Package trace 提供同时实现 vm.Tracer 和 evaluator.Tracer 的跟踪器，
+// 以文本或者 JSON Lines 的形式记录两种引擎的执行过程，方便对比它们的差异。
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/code"
+	"interpreter/evaluator"
+	"interpreter/object"
+	"interpreter/vm"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxValue 是记录中一个值或者一段源码的最大长度，超出的部分用 ... 代替
+const maxValue = 60
+
+var (
+	_ vm.Tracer        = (*Text)(nil)
+	_ evaluator.Tracer = (*Text)(nil)
+	_ vm.Tracer        = (*JSON)(nil)
+	_ evaluator.Tracer = (*JSON)(nil)
+)
+
+// Text 每个事件输出一行人能读懂的文本。求值器的事件按节点的嵌套深度缩进
+type Text struct {
+	w   io.Writer
+	err error
+}
+
+func NewText(w io.Writer) *Text {
+	return &Text{w: w}
+}
+
+// Err 返回第一次写出失败的原因，之后的事件都会被丢弃
+func (t *Text) Err() error {
+	return t.err
+}
+
+func (t *Text) printf(format string, a ...interface{}) {
+	if t.err == nil {
+		_, t.err = fmt.Fprintf(t.w, format, a...)
+	}
+}
+
+func (t *Text) Instruction(event vm.InstructionEvent) {
+	t.printf("%-12s %04d  %-20s %s\n", event.Function, event.IP, instruction(event.Op, event.Operands), stack(event.Stack))
+}
+
+func (t *Text) EnterNode(node ast.Node, depth int) {
+	t.printf("%s> %s %s\n", strings.Repeat("  ", depth-1), nodeName(node), source(node))
+}
+
+func (t *Text) ExitNode(node ast.Node, depth int, result object.Object) {
+	if result == nil {
+		t.printf("%s< %s\n", strings.Repeat("  ", depth-1), nodeName(node))
+		return
+	}
+	t.printf("%s< %s = %s\n", strings.Repeat("  ", depth-1), nodeName(node), value(result))
+}
+
+// JSON 每个事件输出一个 JSON 对象，对象之间用换行分隔
+type JSON struct {
+	enc *json.Encoder
+	err error
+}
+
+func NewJSON(w io.Writer) *JSON {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &JSON{enc: enc}
+}
+
+// Err 返回第一次写出失败的原因，之后的事件都会被丢弃
+func (j *JSON) Err() error {
+	return j.err
+}
+
+type instructionRecord struct {
+	Engine   string   `json:"engine"`
+	Function string   `json:"function"`
+	Depth    int      `json:"depth"`
+	IP       int      `json:"ip"`
+	Op       string   `json:"op"`
+	Operands []int    `json:"operands"`
+	Stack    []string `json:"stack"`
+}
+
+type nodeRecord struct {
+	Engine string `json:"engine"`
+	Event  string `json:"event"`
+	Depth  int    `json:"depth"`
+	Node   string `json:"node"`
+	Source string `json:"source,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Type   string `json:"type,omitempty"`
+}
+
+func (j *JSON) encode(v interface{}) {
+	if j.err == nil {
+		j.err = j.enc.Encode(v)
+	}
+}
+
+func (j *JSON) Instruction(event vm.InstructionEvent) {
+	values := make([]string, len(event.Stack))
+	for i, obj := range event.Stack {
+		values[i] = value(obj)
+	}
+	j.encode(instructionRecord{
+		Engine:   "vm",
+		Function: event.Function,
+		Depth:    event.Depth,
+		IP:       event.IP,
+		Op:       opName(event.Op),
+		Operands: event.Operands,
+		Stack:    values,
+	})
+}
+
+func (j *JSON) EnterNode(node ast.Node, depth int) {
+	j.encode(nodeRecord{Engine: "eval", Event: "enter", Depth: depth, Node: nodeName(node), Source: source(node)})
+}
+
+func (j *JSON) ExitNode(node ast.Node, depth int, result object.Object) {
+	record := nodeRecord{Engine: "eval", Event: "exit", Depth: depth, Node: nodeName(node)}
+	if result != nil {
+		record.Value = value(result)
+		record.Type = string(result.Type())
+	}
+	j.encode(record)
+}
+
+func opName(op code.Opcode) string {
+	if def, err := code.LookUp(byte(op)); err == nil {
+		return def.Name
+	}
+	return fmt.Sprintf("Op(%d)", op)
+}
+
+func instruction(op code.Opcode, operands []int) string {
+	parts := []string{opName(op)}
+	for _, operand := range operands {
+		parts = append(parts, strconv.Itoa(operand))
+	}
+	return strings.Join(parts, " ")
+}
+
+func stack(values []object.Object) string {
+	parts := make([]string, len(values))
+	for i, obj := range values {
+		parts[i] = value(obj)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// nodeName 返回节点的类型名，例如 InfixExpression
+func nodeName(node ast.Node) string {
+	return reflect.TypeOf(node).Elem().Name()
+}
+
+// source 返回节点的源码，换行被替换成空格
+func source(node ast.Node) string {
+	return truncate(strings.Join(strings.Fields(node.String()), " "))
+}
+
+// value 返回值在记录中的形式。它不依赖对象的地址，所以两种引擎、
+// 两次执行得到的记录可以直接比较：字符串带引号，函数只记录参数个数
+func value(obj object.Object) string {
+	var out bytes.Buffer
+	writeValue(&out, obj)
+	return truncate(out.String())
+}
+
+func writeValue(out *bytes.Buffer, obj object.Object) {
+	switch obj := obj.(type) {
+	case nil:
+		out.WriteString("nil")
+	case *object.String:
+		out.WriteString(strconv.Quote(obj.Value))
+	case *object.Array:
+		out.WriteString("[")
+		for i, e := range obj.Element {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			writeValue(out, e)
+			if out.Len() > maxValue {
+				break
+			}
+		}
+		out.WriteString("]")
+	case *object.Hash:
+		out.WriteString("{")
+		for i, pair := range obj.Pairs() {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			writeValue(out, pair.Key)
+			out.WriteString(": ")
+			writeValue(out, pair.Value)
+			if out.Len() > maxValue {
+				break
+			}
+		}
+		out.WriteString("}")
+	case *object.Function:
+		fmt.Fprintf(out, "fn/%d", len(obj.Parameters))
+	case *object.Closure:
+		fmt.Fprintf(out, "fn/%d", obj.Fn.NumParameters)
+	case *object.CompiledFunction:
+		fmt.Fprintf(out, "fn/%d", obj.NumParameters)
+	case *object.Builtin:
+		out.WriteString("builtin")
+	default:
+		out.WriteString(obj.Inspect())
+	}
+}
+
+func truncate(s string) string {
+	if len(s) <= maxValue {
+		return s
+	}
+	return s[:maxValue-3] + "..."
+}
@@ -0,0 +1,155 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"interpreter/compiler"
+	"interpreter/evaluator"
+	"interpreter/lexer"
+	"interpreter/object"
+	"interpreter/parser"
+	"interpreter/vm"
+	"strings"
+	"testing"
+)
+
+const program = `let f = fn(x) { x * 2 }; f(1 + 2)`
+
+func runVM(t *testing.T, input string, tracer vm.Tracer) {
+	t.Helper()
+	comp := compiler.New()
+	if err := comp.Compile(parser.New(lexer.New(input)).ParseProgram()); err != nil {
+		t.Fatal(err)
+	}
+	machine := vm.New(comp.ByteCode())
+	machine.SetTracer(tracer)
+	if err := machine.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func runEval(input string, tracer evaluator.Tracer) {
+	e := evaluator.New()
+	e.Tracer = tracer
+	e.Eval(parser.New(lexer.New(input)).ParseProgram(), object.NewEnvironment())
+}
+
+func TestTextVM(t *testing.T) {
+	var out bytes.Buffer
+	runVM(t, program, NewText(&out))
+	expected := `<main>       0000  OpClosure 1 0        []
+<main>       0005  OpSetGlobal 0        [fn/1]
+<main>       0008  OpGetGlobal 0        []
+<main>       0011  OpConstant 2         [fn/1]
+<main>       0014  OpConstant 0         [fn/1, 1]
+<main>       0017  OpAdd                [fn/1, 1, 2]
+<main>       0018  OpCall 1             [fn/1, 3]
+f            0000  OpGetLocal 0         [fn/1, 3]
+f            0003  OpConstant 0         [fn/1, 3, 3]
+f            0006  OpMul                [fn/1, 3, 3, 2]
+f            0007  OpReturnValue        [fn/1, 3, 6]
+<main>       0021  OpPop                [6]
+`
+	if out.String() != expected {
+		t.Errorf("wrong trace.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
+
+func TestTextEval(t *testing.T) {
+	var out bytes.Buffer
+	runEval(`let x = 1; x + 2`, NewText(&out))
+	expected := `> Program let x = 1;(x + 2)
+  > LetStatement let x = 1;
+    > IntegerLiteral 1
+    < IntegerLiteral = 1
+  < LetStatement
+  > ExpressionStatement (x + 2)
+    > InfixExpression (x + 2)
+      > Identifier x
+      < Identifier = 1
+      > IntegerLiteral 2
+      < IntegerLiteral = 2
+    < InfixExpression = 3
+  < ExpressionStatement = 3
+< Program = 3
+`
+	if out.String() != expected {
+		t.Errorf("wrong trace.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	tracer := NewJSON(&out)
+	runVM(t, program, tracer)
+	runEval(program, tracer)
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 12+28 {
+		t.Fatalf("wrong number of records %d", len(records))
+	}
+	call := records[7]
+	if call["engine"] != "vm" || call["function"] != "f" || call["depth"] != 2.0 || call["op"] != "OpGetLocal" {
+		t.Errorf("wrong instruction record %v", call)
+	}
+	if ops, ok := records[5]["operands"].([]interface{}); !ok || len(ops) != 0 {
+		t.Errorf("operands should be an empty array, got=%v", records[5]["operands"])
+	}
+	last := records[len(records)-1]
+	if last["engine"] != "eval" || last["event"] != "exit" || last["node"] != "Program" || last["value"] != "6" || last["type"] != "INTEGER" {
+		t.Errorf("wrong node record %v", last)
+	}
+	if _, ok := records[16]["value"]; ok || records[16]["node"] != "LetStatement" {
+		t.Errorf("statements have no value, got=%v", records[16])
+	}
+}
+
+func TestValue(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"two words"`, `"two words"`},
+		{`[1, "two", fn(a, b) { a }, len]`, `[1, "two", fn/2, builtin]`},
+		{`{"k": [true]}`, `{"k": [true]}`},
+		{`range(100)`, `[0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16...`},
+	}
+	for _, tt := range tests {
+		obj := evaluator.Eval(parser.New(lexer.New(tt.input)).ParseProgram(), object.NewEnvironment())
+		if got := value(obj); got != tt.expected {
+			t.Errorf("value(%s): want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+	if got := value(nil); got != "nil" {
+		t.Errorf("nil should be shown as nil, got=%q", got)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteErrors(t *testing.T) {
+	text := NewText(failingWriter{})
+	runEval(program, text)
+	if text.Err() == nil || !strings.Contains(text.Err().Error(), "disk full") {
+		t.Errorf("expected the write error, got=%v", text.Err())
+	}
+	j := NewJSON(failingWriter{})
+	runVM(t, program, j)
+	if j.Err() == nil {
+		t.Errorf("expected the write error")
+	}
+}
@@ -0,0 +1,218 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"interpreter/ast"
+	"interpreter/code"
+	"interpreter/compiler"
+	"interpreter/debug"
+	"interpreter/object"
+	"sort"
+)
+
+// Debugger 控制虚拟机的执行。虚拟机在单独的 goroutine 中运行，
+// 在每条语句开始之前检查断点和单步条件，暂停时等待下一条命令。
+// 断点和单步命令由嵌入的 debug.Controller 提供，
+// Debugger 的方法不能并发调用，检查状态的方法只能在暂停时使用。
+type Debugger struct {
+	*debug.Controller
+	vm          *VM
+	globalNames map[int]string
+	symbols     *compiler.SymbolTable
+}
+
+// NewDebugger 把调试器挂到虚拟机上，之后用 Continue 或单步命令开始执行，不要再调用 vm.Run
+func NewDebugger(vm *VM) *Debugger {
+	d := &Debugger{vm: vm}
+	d.Controller = debug.NewController(func() int { return vm.framesIndex }, d.run)
+	vm.debugger = d
+	return d
+}
+
+// SetGlobalNames 用编译器的全局符号表给全局变量命名，Evaluate 也用它解析全局变量
+func (d *Debugger) SetGlobalNames(symbols *compiler.SymbolTable) {
+	d.symbols = symbols
+	d.globalNames = map[int]string{}
+	for _, s := range symbols.Symbols(compiler.GlobalScope) {
+		d.globalNames[s.Index] = s.Name
+	}
+}
+
+// Close 中止还没有结束的程序，程序以 debug.ErrClosed 结束
+func (d *Debugger) Close() {
+	d.Controller.Close()
+	d.vm.debugger = nil
+}
+
+func (d *Debugger) run() debug.Stop {
+	stop := debug.Stop{Reason: debug.StopExit}
+	stop.Err = d.vm.Run()
+	if stop.Err == nil {
+		stop.Result = d.vm.LastPoppedStackElem()
+	}
+	return stop
+}
+
+// check 在当前帧执行 offset 处的指令之前调用，需要暂停时阻塞到下一条命令
+func (d *Debugger) check(offset int) error {
+	frame := d.vm.currentFrame()
+	fn := frame.cl.Fn
+	depth := d.vm.framesIndex
+	entering := ""
+	if offset == 0 {
+		entering = fn.Name
+	}
+	line := fn.Lines.Line(offset)
+	// 只在语句开始的位置暂停，同一行的其他指令不算
+	reason, ok := d.ShouldStop(depth, entering, line, isStatementStart(fn.Lines, offset))
+	if !ok {
+		return nil
+	}
+	err := d.Pause(debug.Stop{Reason: reason, Function: functionName(fn, depth-1), Line: line})
+	if err != nil {
+		d.vm.halt = err
+	}
+	return err
+}
+
+// isStatementStart 判断 offset 是否是行号表中某一项的起点
+func isStatementStart(lines code.LineTable, offset int) bool {
+	i := sort.Search(len(lines), func(i int) bool { return lines[i].Offset >= offset })
+	return i < len(lines) && lines[i].Offset == offset
+}
+
+// functionName 返回帧的函数名，index 是帧在调用栈中的位置
+func functionName(fn *object.CompiledFunction, index int) string {
+	if index == 0 {
+		return "<main>"
+	}
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
+
+// Frames 返回调用栈，最内层的帧在最前面
+func (d *Debugger) Frames() []debug.FrameInfo {
+	frames := make([]debug.FrameInfo, 0, d.vm.framesIndex)
+	for i := d.vm.framesIndex - 1; i >= 0; i-- {
+		f := d.vm.frames[i]
+		offset := f.ip
+		if i == d.vm.framesIndex-1 {
+			// 当前帧暂停在下一条指令之前
+			offset++
+		}
+		frames = append(frames, debug.FrameInfo{
+			Function: functionName(f.cl.Fn, i),
+			Line:     f.cl.Fn.Lines.Line(offset),
+			Offset:   offset,
+		})
+	}
+	return frames
+}
+
+// Stack 返回操作数栈中的所有值，栈底在最前面
+func (d *Debugger) Stack() []object.Object {
+	stack := make([]object.Object, d.vm.sp)
+	copy(stack, d.vm.stack[:d.vm.sp])
+	return stack
+}
+
+// Globals 返回已经赋值的全局变量，没有名字的全局变量以下标命名
+func (d *Debugger) Globals() []debug.Variable {
+	var globals []debug.Variable
+	for i, value := range d.vm.globals {
+		if value == nil {
+			continue
+		}
+		name, ok := d.globalNames[i]
+		if !ok {
+			name = fmt.Sprintf("global%d", i)
+		}
+		globals = append(globals, debug.Variable{Name: name, Value: value})
+	}
+	return globals
+}
+
+// Locals 返回第 frame 帧（0 是最内层）中已经赋值的局部变量和闭包捕获的自由变量，
+// 主程序没有局部变量
+func (d *Debugger) Locals(frame int) []debug.Variable {
+	index := d.vm.framesIndex - 1 - frame
+	if index <= 0 || index >= d.vm.framesIndex {
+		return nil
+	}
+	f := d.vm.frames[index]
+	fn := f.cl.Fn
+	var locals []debug.Variable
+	for i := 0; i < fn.NumLocals; i++ {
+		value := d.vm.stack[f.basePointer+i]
+		name := fmt.Sprintf("local%d", i)
+		if i < len(fn.LocalNames) {
+			name = fn.LocalNames[i]
+		}
+		if value == nil || name == "" {
+			// 还没有赋值，或者是被同名的 let 重新定义过的旧变量
+			continue
+		}
+		locals = append(locals, debug.Variable{Name: name, Value: value})
+	}
+	for i, value := range f.cl.Free {
+		name := fmt.Sprintf("free%d", i)
+		if i < len(fn.FreeNames) {
+			name = fn.FreeNames[i]
+		}
+		locals = append(locals, debug.Variable{Name: name, Value: value})
+	}
+	return locals
+}
+
+// Lookup 按照局部变量、自由变量、全局变量的顺序在第 frame 帧中查找名字
+func (d *Debugger) Lookup(frame int, name string) (object.Object, bool) {
+	for _, v := range d.Locals(frame) {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	for _, v := range d.Globals() {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Evaluate 在第 frame 帧中编译并执行 program。帧中的局部变量作为新的全局变量，
+// 所有全局变量都是副本，所以 let 和赋值不会改变被调试的程序，
+// 但是通过内置函数修改数组等值的副作用会保留。没有调用 SetGlobalNames 时只能使用局部变量
+func (d *Debugger) Evaluate(frame int, program *ast.Program) (object.Object, error) {
+	if frame < 0 || frame >= d.vm.framesIndex {
+		return nil, errors.New("no such frame")
+	}
+	symbols := compiler.New().SymbolTable()
+	if d.symbols != nil {
+		symbols = d.symbols.Copy()
+	}
+	globals := make([]object.Object, GlobalSize)
+	copy(globals, d.vm.globals)
+	for _, v := range d.Locals(frame) {
+		globals[symbols.Define(v.Name).Index] = v.Value
+	}
+	// 常量池也要复制，被调试程序中的函数按原来的下标引用常量
+	constants := append([]object.Object(nil), d.vm.constants...)
+	comp := compiler.NewWithState(symbols, constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+	machine := NewWithGlobalsState(comp.ByteCode(), globals)
+	machine.SetLimits(Limits{MaxSteps: debug.EvaluateSteps, MaxFrames: MaxFrames})
+	machine.SetOutput(d.vm.out)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+	result := machine.LastPoppedStackElem()
+	if result == nil {
+		result = Null
+	}
+	return result, nil
+}
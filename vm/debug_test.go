@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"interpreter/compiler"
+	"interpreter/debug"
+	"testing"
+)
+
+const debugSource = `let scale = 10;
+let add = fn(a, b) {
+    let sum = a + b;
+    sum * scale
+};
+let twice = fn(x) {
+    let once = add(x, 1);
+    add(once, 2)
+};
+let result = twice(1);
+map([1, 2], fn(n) { add(n, 0) });
+result
+`
+
+func newDebugger(t *testing.T, input string) *Debugger {
+	t.Helper()
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	d := NewDebugger(New(comp.ByteCode()))
+	d.SetGlobalNames(comp.SymbolTable())
+	t.Cleanup(d.Close)
+	return d
+}
+
+func expectStop(t *testing.T, got debug.Stop, reason debug.StopReason, function string, line int) {
+	t.Helper()
+	if got.Reason != reason || got.Function != function || got.Line != line {
+		t.Fatalf("wrong stop. want=%s in %s at line %d, got=%s in %s at line %d (err=%v)",
+			reason, function, line, got.Reason, got.Function, got.Line, got.Err)
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := newDebugger(t, debugSource)
+	d.SetBreakpoint(3)
+	d.SetFunctionBreakpoint("twice")
+
+	expectStop(t, d.Continue(), debug.StopFunction, "twice", 7)
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "add", 3)
+
+	frames := d.Frames()
+	if len(frames) != 3 || frames[0].Function != "add" || frames[1].Function != "twice" ||
+		frames[1].Line != 7 || frames[2].Function != "<main>" || frames[2].Line != 10 {
+		t.Fatalf("wrong frames %+v", frames)
+	}
+	locals := d.Locals(0)
+	if len(locals) != 2 || locals[0].Name != "a" || locals[1].Name != "b" {
+		t.Fatalf("wrong locals %+v", locals)
+	}
+	if err := testIntegerObject(1, locals[0].Value); err != nil {
+		t.Error(err)
+	}
+	if value, ok := d.Lookup(0, "scale"); !ok || testIntegerObject(10, value) != nil {
+		t.Errorf("cannot look up global scale, got=%v", value)
+	}
+	globals := d.Globals()
+	if len(globals) != 3 || globals[0].Name != "scale" || globals[2].Name != "twice" {
+		t.Errorf("wrong globals %+v", globals)
+	}
+
+	// 第二次调用 add 再次停在断点，之后 map 的回调中也会调用 add
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "add", 3)
+	d.ClearFunctionBreakpoint("twice")
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "add", 3)
+	frames = d.Frames()
+	if frames[1].Function != "<anonymous>" {
+		t.Errorf("expected add to be called from the map callback, got=%+v", frames)
+	}
+	d.ClearBreakpoint(3)
+	stop := d.Continue()
+	if stop.Reason != debug.StopExit || stop.Err != nil || testIntegerObject(220, stop.Result) != nil {
+		t.Fatalf("wrong exit %+v", stop)
+	}
+	if !d.Exited() || d.Continue().Reason != debug.StopExit {
+		t.Errorf("debugger should stay exited")
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	d := newDebugger(t, debugSource)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 1)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 2)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 6)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 10)
+	expectStop(t, d.StepInto(), debug.StopStep, "twice", 7)
+	expectStop(t, d.StepInto(), debug.StopStep, "add", 3)
+	expectStop(t, d.StepOver(), debug.StopStep, "add", 4)
+	if locals := d.Locals(0); len(locals) != 3 || locals[2].Name != "sum" || testIntegerObject(2, locals[2].Value) != nil {
+		t.Errorf("sum should be assigned, got=%+v", locals)
+	}
+	// 返回到调用者之后停在 twice 中还没有执行完的语句
+	expectStop(t, d.StepOut(), debug.StopStep, "twice", 7)
+	if top := d.Stack()[len(d.Stack())-1]; testIntegerObject(20, top) != nil {
+		t.Errorf("return value should be on the stack, got=%v", top)
+	}
+	expectStop(t, d.StepOver(), debug.StopStep, "twice", 8)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 10)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 11)
+	expectStop(t, d.StepOver(), debug.StopStep, "<main>", 12)
+	if stop := d.StepOver(); stop.Reason != debug.StopExit {
+		t.Errorf("expected exit, got=%+v", stop)
+	}
+}
+
+func TestDebuggerClosures(t *testing.T) {
+	d := newDebugger(t, `let make = fn(step) {
+    fn(x) {
+        x + step
+    }
+};
+make(5)(1)`)
+	d.SetBreakpoint(3)
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "<anonymous>", 3)
+	locals := d.Locals(0)
+	if len(locals) != 2 || locals[0].Name != "x" || locals[1].Name != "step" || testIntegerObject(5, locals[1].Value) != nil {
+		t.Errorf("wrong locals %+v", locals)
+	}
+	if d.Locals(1) != nil {
+		t.Errorf("main program has no locals")
+	}
+}
+
+func TestDebuggerEvaluate(t *testing.T) {
+	d := newDebugger(t, debugSource)
+	d.SetBreakpoint(4)
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "add", 4)
+	tests := []struct {
+		frame    int
+		input    string
+		expected interface{}
+	}{
+		{0, "sum * 2", 4},
+		{0, "a + scale", 11},
+		{0, "add(sum, 1)", 30},
+		{0, "let scale = 1; scale", 1},
+		{1, "x", 1},
+		{0, "x", "undefined variable x"},
+		{0, "a / 0", "division by zero"},
+		{3, "1", "no such frame"},
+	}
+	for _, tt := range tests {
+		value, err := d.Evaluate(tt.frame, parse(tt.input))
+		switch expected := tt.expected.(type) {
+		case int:
+			if err != nil {
+				t.Errorf("%q: unexpected error %s", tt.input, err)
+			} else if err := testIntegerObject(int64(expected), value); err != nil {
+				t.Errorf("%q: %s", tt.input, err)
+			}
+		case string:
+			if err == nil || err.Error() != expected {
+				t.Errorf("%q: expected error %q, got=%v", tt.input, expected, err)
+			}
+		}
+	}
+	// 求值使用全局变量的副本，不会影响被调试的程序
+	if value, _ := d.Lookup(0, "scale"); testIntegerObject(10, value) != nil {
+		t.Errorf("evaluate should not change scale, got=%v", value)
+	}
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "add", 4)
+}
+
+func TestDebuggerClose(t *testing.T) {
+	d := newDebugger(t, "let f = fn(n) { n + 1 };\nf(1);\nf(2)")
+	d.SetBreakpoint(1)
+	expectStop(t, d.Continue(), debug.StopBreakpoint, "<main>", 1)
+	d.Close()
+	if stop := d.Continue(); !d.Exited() || stop.Err != debug.ErrClosed {
+		t.Errorf("expected the program to be aborted, got=%+v", stop)
+	}
+}
+
+func TestDebuggerRuntimeError(t *testing.T) {
+	d := newDebugger(t, "let x = 1;\nx / 0")
+	stop := d.Continue()
+	if stop.Reason != debug.StopExit || stop.Err == nil || stop.Err.Error() != "division by zero" {
+		t.Errorf("expected the runtime error, got=%+v", stop)
+	}
+}
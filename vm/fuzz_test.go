@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"interpreter/code"
+	"interpreter/compiler"
+	"interpreter/object"
+	"math"
+	"testing"
+)
+
+// FuzzVerify 检查通过校验的任意字节码都能安全执行：可以返回错误，但不能 panic。
+// 主程序和常量池中一个函数的指令来自输入，常量池的其他内容固定
+func FuzzVerify(f *testing.F) {
+	f.Add(
+		instructions(code.Make(code.OpClosure, 2, 0), code.Make(code.OpConstant, 0), code.Make(code.OpCall, 1), code.Make(code.OpPop)),
+		instructions(code.Make(code.OpGetLocal, 0), code.Make(code.OpConstant, 0), code.Make(code.OpAdd), code.Make(code.OpReturnValue)),
+		int64(1),
+	)
+	f.Add(
+		instructions(code.Make(code.OpConstant, 1), code.Make(code.OpConstant, 0), code.Make(code.OpHash, 2), code.Make(code.OpConstant, 1), code.Make(code.OpIndex), code.Make(code.OpPop)),
+		[]byte(nil),
+		int64(0),
+	)
+	f.Add(
+		instructions(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 10), code.Make(code.OpConstant, 0), code.Make(code.OpJump, 11), code.Make(code.OpNull), code.Make(code.OpSetGlobal, 0), code.Make(code.OpGetGlobal, 0), code.Make(code.OpPop)),
+		instructions(code.Make(code.OpCurrentClosure), code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)),
+		int64(0),
+	)
+	f.Add(
+		instructions(code.MakeWide(code.OpConstant, 0), code.Make(code.OpGetBuiltin, 0), code.Make(code.OpArray, 0), code.Make(code.OpCall, 1), code.Make(code.OpReturnValue)),
+		instructions(code.Make(code.OpReturn)),
+		int64(3),
+	)
+	// 局部变量的个数大到会让栈的计算溢出
+	f.Add(
+		instructions(code.Make(code.OpClosure, 2, 0), code.Make(code.OpCall, 0), code.Make(code.OpPop)),
+		instructions(code.Make(code.OpReturn)),
+		int64(math.MaxInt64),
+	)
+	f.Fuzz(func(t *testing.T, main []byte, function []byte, numLocals int64) {
+		fn := &object.CompiledFunction{Instructions: function, NumLocals: int(numLocals)}
+		if fn.NumLocals > 0 && numLocals%2 == 0 {
+			fn.NumParameters = 1
+		}
+		bytecode := &compiler.ByteCode{
+			Instructions: main,
+			Constants:    []object.Object{&object.Integer{Value: 1}, &object.String{Value: "a"}, fn},
+		}
+		if Verify(bytecode) != nil {
+			return
+		}
+		machine := New(bytecode)
+		machine.SetLimits(Limits{MaxSteps: 10000})
+		machine.Run()
+	})
+}
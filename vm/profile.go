@@ -0,0 +1,29 @@
+package vm
+
+import (
+	"interpreter/object"
+	"interpreter/profile"
+)
+
+// SetProfiler 设置性能分析器，nil 表示不分析，应该在 Run 或 Call 之前调用。
+// 每条指令执行之前都会记录一次所在的函数和行
+func (vm *VM) SetProfiler(p *profile.Profiler) {
+	vm.profiler = p
+}
+
+func (vm *VM) profile(frame *Frame, ip int) {
+	fn := frame.cl.Fn
+	vm.profiler.Record(vm.framesIndex, profileFrame(fn, vm.framesIndex-1), fn.Lines.Line(ip))
+}
+
+// profileFrame 返回函数在性能分析中的帧，函数的起始行是它第一条语句所在的行
+func profileFrame(fn *object.CompiledFunction, index int) profile.Frame {
+	if index == 0 {
+		return profile.Main
+	}
+	frame := profile.Frame{Function: functionName(fn, index)}
+	if len(fn.Lines) > 0 {
+		frame.StartLine = fn.Lines[0].Line
+	}
+	return frame
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"interpreter/compiler"
+	"interpreter/profile"
+	"testing"
+)
+
+func TestProfiler(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse(debugSource)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.ByteCode())
+	p := profile.New("instructions")
+	vm.SetProfiler(p)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	p.Stop()
+
+	want := map[profile.Frame]bool{
+		profile.Main:                             true,
+		{Function: "add", StartLine: 3}:          true,
+		{Function: "twice", StartLine: 7}:        true,
+		{Function: "<anonymous>", StartLine: 11}: true,
+	}
+	var flat int64
+	for _, e := range p.Functions() {
+		frame := profile.Frame{Function: e.Function, StartLine: e.StartLine}
+		if !want[frame] {
+			t.Errorf("unexpected function %+v", e)
+		}
+		delete(want, frame)
+		if frame == profile.Main && e.Cum != p.Total() {
+			t.Errorf("<main> must include every instruction. want=%d, got=%d", p.Total(), e.Cum)
+		}
+		flat += e.Flat
+	}
+	for frame := range want {
+		t.Errorf("missing function %+v", frame)
+	}
+	if flat != p.Total() || p.Total() == 0 {
+		t.Errorf("flat counts do not add up. total=%d, sum=%d", p.Total(), flat)
+	}
+
+	lines := map[int]bool{}
+	for _, e := range p.Lines() {
+		if e.Function == "add" {
+			lines[e.Line] = true
+		}
+	}
+	if len(lines) != 2 || !lines[3] || !lines[4] {
+		t.Errorf("wrong lines for add. want=[3 4], got=%v", lines)
+	}
+}
@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"interpreter/code"
+	"interpreter/object"
+)
+
+// Tracer 观察虚拟机执行的每一条指令
+type Tracer interface {
+	// Instruction 在指令执行之前调用，event 中的切片在调用返回之后会被修改，不能保留
+	Instruction(event InstructionEvent)
+}
+
+// InstructionEvent 描述即将执行的一条指令
+type InstructionEvent struct {
+	// Function 是指令所在的函数，主程序是 "<main>"
+	Function string
+	// Depth 是调用栈的深度，主程序为 1
+	Depth    int
+	IP       int
+	Op       code.Opcode
+	Operands []int
+	// Stack 是执行之前的操作数栈，栈顶在最后
+	Stack []object.Object
+}
+
+// SetTracer 设置跟踪器，nil 表示不跟踪，应该在 Run 或 Call 之前调用
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+func (vm *VM) trace(frame *Frame, ip int) {
+	ins := frame.Instructions()
+	op := code.Opcode(ins[ip])
+	operands := []int{}
+	// 带 OpWide 前缀的指令报告为后面的指令
+	if instruction, err := code.ReadInstruction(ins, ip); err == nil {
+		op, operands = instruction.Op, instruction.Operands
+	}
+	vm.tracer.Instruction(InstructionEvent{
+		Function: functionName(frame.cl.Fn, vm.framesIndex-1),
+		Depth:    vm.framesIndex,
+		IP:       ip,
+		Op:       op,
+		Operands: operands,
+		Stack:    vm.stack[:vm.sp],
+	})
+}
@@ -0,0 +1,253 @@
+package vm
+
+import (
+	"fmt"
+	"interpreter/code"
+	"interpreter/compiler"
+	"interpreter/object"
+)
+
+// VerifyError 是校验字节码时发现的错误，Function 是出错的函数在常量池中的下标，主程序为 -1
+type VerifyError struct {
+	Function int
+	Offset   int
+	Message  string
+}
+
+func (e *VerifyError) Error() string {
+	if e.Function < 0 {
+		return fmt.Sprintf("invalid bytecode at %04d: %s", e.Offset, e.Message)
+	}
+	return fmt.Sprintf("invalid bytecode in constant %d at %04d: %s", e.Function, e.Offset, e.Message)
+}
+
+// Verify 在执行之前检查字节码，通过检查的字节码不会让虚拟机越界访问或者跳到指令中间：
+// 操作码和操作数完整有效，跳转目标是指令的开头，常量、全局变量、局部变量、内置函数和自由变量的下标都在范围内，
+// 每条指令执行时栈上有足够的值，从不同路径到达同一条指令时栈的深度相同，
+// 并且局部变量加上栈的最大深度放得进 StackSize。
+// 不信任的字节码，例如从 .mbc 文件读入的，应该先校验再交给 New，Load 会做这两步
+func Verify(bytecode *compiler.ByteCode) error {
+	v := &verifier{constants: bytecode.Constants, free: map[int]int{}}
+	if err := v.function(-1, bytecode.Instructions, 0); err != nil {
+		return err
+	}
+	for i, constant := range bytecode.Constants {
+		switch constant := constant.(type) {
+		case *object.CompiledFunction:
+			if constant.NumParameters < 0 || constant.NumLocals < constant.NumParameters {
+				return &VerifyError{Function: i, Message: fmt.Sprintf("%d parameters but %d locals", constant.NumParameters, constant.NumLocals)}
+			}
+			if constant.NumLocals > StackSize {
+				return &VerifyError{Function: i, Message: fmt.Sprintf("%d locals do not fit in a stack of %d", constant.NumLocals, StackSize)}
+			}
+			if err := v.function(i, constant.Instructions, constant.NumLocals); err != nil {
+				return err
+			}
+		case *object.Integer, *object.String:
+		default:
+			return &VerifyError{Function: i, Message: fmt.Sprintf("unsupported constant %T", constant)}
+		}
+	}
+	// 函数用到的自由变量必须由创建闭包的 OpClosure 提供
+	for _, site := range v.closures {
+		if need := v.free[site.constant]; site.numFree < need {
+			return &VerifyError{Function: site.function, Offset: site.offset,
+				Message: fmt.Sprintf("closure of constant %d has %d free variables, needs %d", site.constant, site.numFree, need)}
+		}
+	}
+	return nil
+}
+
+// Load 解析 compiler.Marshal 生成的数据并校验，读入 .mbc 文件等不信任的字节码时用它代替 compiler.Unmarshal
+func Load(data []byte) (*compiler.ByteCode, error) {
+	bytecode, err := compiler.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(bytecode); err != nil {
+		return nil, err
+	}
+	return bytecode, nil
+}
+
+type verifier struct {
+	constants []object.Object
+	// free 是常量池中的函数用到的自由变量的个数，主程序为 -1
+	free     map[int]int
+	closures []closureSite
+}
+
+// closureSite 是一条 OpClosure 指令
+type closureSite struct {
+	function int
+	offset   int
+	constant int
+	numFree  int
+}
+
+// function 检查一个函数（index 为 -1 时是主程序）的指令
+func (v *verifier) function(index int, ins code.Instructions, numLocals int) error {
+	fail := func(offset int, format string, args ...interface{}) error {
+		return &VerifyError{Function: index, Offset: offset, Message: fmt.Sprintf(format, args...)}
+	}
+	// 先顺序解码，得到每条指令的开头
+	instructions := map[int]code.Instruction{}
+	var offsets []int
+	for i := 0; i < len(ins); {
+		instruction, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return fail(i, "%s", err)
+		}
+		if err := v.operands(index, i, instruction, numLocals); err != nil {
+			return err
+		}
+		instructions[i] = instruction
+		offsets = append(offsets, i)
+		i += instruction.Width
+	}
+	for _, offset := range offsets {
+		instruction := instructions[offset]
+		if op := instruction.Op; op == code.OpJump || op == code.OpJumpNotTruthy {
+			target := instruction.Operands[0]
+			if _, ok := instructions[target]; !ok && target != len(ins) {
+				return fail(offset, "jump target %d is not the start of an instruction", target)
+			}
+		}
+	}
+	if index < 0 && v.free[index] > 0 {
+		return fail(0, "the main program has no free variables")
+	}
+	return v.stack(index, ins, instructions, numLocals, fail)
+}
+
+// operands 检查操作数引用的常量、变量和内置函数
+func (v *verifier) operands(index, offset int, instruction code.Instruction, numLocals int) error {
+	fail := func(format string, args ...interface{}) error {
+		return &VerifyError{Function: index, Offset: offset, Message: fmt.Sprintf(format, args...)}
+	}
+	if instruction.Wide && !code.Widenable(instruction.Op) {
+		return fail("OpWide cannot prefix %s", instruction.Def.Name)
+	}
+	operands := instruction.Operands
+	switch instruction.Op {
+	case code.OpConstant:
+		if operands[0] >= len(v.constants) {
+			return fail("constant %d out of range, have %d", operands[0], len(v.constants))
+		}
+	case code.OpClosure:
+		if operands[0] >= len(v.constants) {
+			return fail("constant %d out of range, have %d", operands[0], len(v.constants))
+		}
+		if _, ok := v.constants[operands[0]].(*object.CompiledFunction); !ok {
+			return fail("constant %d is not a function", operands[0])
+		}
+		v.closures = append(v.closures, closureSite{function: index, offset: offset, constant: operands[0], numFree: operands[1]})
+	case code.OpGetGlobal, code.OpSetGlobal:
+		if operands[0] >= GlobalSize {
+			return fail("global %d out of range, have %d", operands[0], GlobalSize)
+		}
+	case code.OpGetLocal, code.OpSetLocal:
+		if operands[0] >= numLocals {
+			return fail("local %d out of range, have %d", operands[0], numLocals)
+		}
+	case code.OpGetBuiltin:
+		if operands[0] >= len(object.Builtins) {
+			return fail("builtin %d out of range, have %d", operands[0], len(object.Builtins))
+		}
+	case code.OpGetFree:
+		if operands[0]+1 > v.free[index] {
+			v.free[index] = operands[0] + 1
+		}
+	case code.OpHash:
+		if operands[0]%2 != 0 {
+			return fail("hash with an odd number of keys and values %d", operands[0])
+		}
+	case code.OpReturn, code.OpCurrentClosure:
+		if index < 0 {
+			return fail("%s in the main program", instruction.Def.Name)
+		}
+	}
+	return nil
+}
+
+// stack 沿着所有可能的执行路径计算每条指令执行之前栈的深度，深度相对于函数的局部变量之上
+func (v *verifier) stack(index int, ins code.Instructions, instructions map[int]code.Instruction, numLocals int,
+	fail func(offset int, format string, args ...interface{}) error) error {
+	depths := map[int]int{}
+	pending := []int{}
+	// reach 记录到达 offset 时的深度，到达末尾只有主程序是正常结束
+	reach := func(from, offset, depth int) error {
+		if offset == len(ins) {
+			if index >= 0 {
+				return fail(from, "function can run past its last instruction")
+			}
+			return nil
+		}
+		if previous, ok := depths[offset]; ok {
+			if previous != depth {
+				return fail(offset, "stack depth %d differs from %d on another path", depth, previous)
+			}
+			return nil
+		}
+		depths[offset] = depth
+		pending = append(pending, offset)
+		return nil
+	}
+	if err := reach(0, 0, 0); err != nil {
+		return err
+	}
+	for len(pending) > 0 {
+		offset := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		instruction := instructions[offset]
+		pops, pushes := stackEffect(instruction)
+		depth := depths[offset]
+		if depth < pops {
+			return fail(offset, "%s needs %d values on the stack, has %d", instruction.Def.Name, pops, depth)
+		}
+		depth += pushes - pops
+		// 写成减法，numLocals 已经检查过不超过 StackSize
+		if depth > StackSize-numLocals {
+			return fail(offset, "stack depth %d with %d locals does not fit in a stack of %d", depth, numLocals, StackSize)
+		}
+		next := offset + instruction.Width
+		switch instruction.Op {
+		case code.OpJump:
+			next = instruction.Operands[0]
+		case code.OpJumpNotTruthy:
+			if err := reach(offset, instruction.Operands[0], depth); err != nil {
+				return err
+			}
+		case code.OpReturnValue, code.OpReturn:
+			continue
+		}
+		if err := reach(offset, next, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stackEffect 返回指令从栈上取走和放上的值的个数
+func stackEffect(instruction code.Instruction) (pops, pushes int) {
+	switch instruction.Op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull,
+		code.OpGetGlobal, code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree, code.OpCurrentClosure:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal, code.OpReturnValue:
+		return 1, 0
+	case code.OpArray, code.OpHash:
+		return instruction.Operands[0], 1
+	case code.OpCall:
+		// 被调用的函数和参数换成返回值
+		return instruction.Operands[0] + 1, 1
+	case code.OpClosure:
+		return instruction.Operands[1], 1
+	}
+	return 0, 0
+}
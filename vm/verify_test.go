@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"interpreter/code"
+	"interpreter/compiler"
+	"interpreter/object"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// instructions 连接多条指令，返回 []byte 以便同时用作 f.Add 的参数
+func instructions(ins ...[]byte) []byte {
+	var out []byte
+	for _, i := range ins {
+		out = append(out, i...)
+	}
+	return out
+}
+
+func TestVerify(t *testing.T) {
+	function := func(numLocals int, ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: instructions(ins...), NumLocals: numLocals}
+	}
+	tests := []struct {
+		name      string
+		main      code.Instructions
+		constants []object.Object
+		expected  string
+	}{
+		{
+			"valid",
+			instructions(code.Make(code.OpConstant, 0), code.Make(code.OpClosure, 1, 1), code.Make(code.OpCall, 0), code.Make(code.OpPop)),
+			[]object.Object{&object.Integer{Value: 1}, function(0, code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue))},
+			"",
+		},
+		{
+			"main may return or run to its end",
+			instructions(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 6), code.Make(code.OpTrue), code.Make(code.OpReturnValue)),
+			nil,
+			"",
+		},
+		{
+			"undefined opcode",
+			code.Instructions{255},
+			nil,
+			"invalid bytecode at 0000: opcode 255 undefined",
+		},
+		{
+			"truncated operand",
+			code.Instructions{byte(code.OpConstant), 0},
+			[]object.Object{&object.Integer{Value: 1}},
+			"invalid bytecode at 0000: OpConstant at 0 is truncated",
+		},
+		{
+			"jump into an instruction",
+			instructions(code.Make(code.OpJump, 4), code.Make(code.OpConstant, 0)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"invalid bytecode at 0000: jump target 4 is not the start of an instruction",
+		},
+		{
+			"jump past the end",
+			instructions(code.Make(code.OpJump, 100)),
+			nil,
+			"invalid bytecode at 0000: jump target 100 is not the start of an instruction",
+		},
+		{
+			"constant out of range",
+			instructions(code.Make(code.OpConstant, 1), code.Make(code.OpPop)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"invalid bytecode at 0000: constant 1 out of range, have 1",
+		},
+		{
+			"closure of a non-function",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"invalid bytecode at 0000: constant 0 is not a function",
+		},
+		{
+			"global out of range",
+			instructions(code.Make(code.OpGetGlobal, GlobalSize), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0000: global 65536 out of range, have 65536",
+		},
+		{
+			"builtin out of range",
+			instructions(code.Make(code.OpGetBuiltin, len(object.Builtins)), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0000: builtin " + strconv.Itoa(len(object.Builtins)) + " out of range, have " + strconv.Itoa(len(object.Builtins)),
+		},
+		{
+			"local in the main program",
+			instructions(code.Make(code.OpGetLocal, 0), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0000: local 0 out of range, have 0",
+		},
+		{
+			"local out of range",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(1, code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue))},
+			"invalid bytecode in constant 0 at 0000: local 1 out of range, have 1",
+		},
+		{
+			"missing free variables",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(0, code.Make(code.OpGetFree, 1), code.Make(code.OpReturnValue))},
+			"invalid bytecode at 0000: closure of constant 0 has 0 free variables, needs 2",
+		},
+		{
+			"free variable in the main program",
+			instructions(code.Make(code.OpGetFree, 0), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0000: the main program has no free variables",
+		},
+		{
+			"OpReturn in the main program",
+			instructions(code.Make(code.OpReturn)),
+			nil,
+			"invalid bytecode at 0000: OpReturn in the main program",
+		},
+		{
+			"odd hash",
+			instructions(code.Make(code.OpTrue), code.Make(code.OpHash, 1), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0001: hash with an odd number of keys and values 1",
+		},
+		{
+			"unsupported wide instruction",
+			code.Instructions{byte(code.OpWide), byte(code.OpCall), 0, 0, 0, 0},
+			nil,
+			"invalid bytecode at 0000: OpWide cannot prefix OpCall",
+		},
+		{
+			"stack underflow",
+			instructions(code.Make(code.OpTrue), code.Make(code.OpAdd), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0001: OpAdd needs 2 values on the stack, has 1",
+		},
+		{
+			"call without enough arguments",
+			instructions(code.Make(code.OpGetBuiltin, 0), code.Make(code.OpCall, 1), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0003: OpCall needs 2 values on the stack, has 1",
+		},
+		{
+			// 条件为真时多留下一个值，两条路径在 0005 处的深度不同
+			"unbalanced branches",
+			instructions(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 5), code.Make(code.OpTrue), code.Make(code.OpPop)),
+			nil,
+			"invalid bytecode at 0005: stack depth 1 differs from 0 on another path",
+		},
+		{
+			"function runs past its end",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(0, code.Make(code.OpNull), code.Make(code.OpPop))},
+			"invalid bytecode in constant 0 at 0001: function can run past its last instruction",
+		},
+		{
+			"empty function",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(0)},
+			"invalid bytecode in constant 0 at 0000: function can run past its last instruction",
+		},
+		{
+			"more parameters than locals",
+			nil,
+			[]object.Object{&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumParameters: 2, NumLocals: 1}},
+			"invalid bytecode in constant 0 at 0000: 2 parameters but 1 locals",
+		},
+		{
+			// 局部变量的个数很大时 callClosure 中的加法曾经溢出
+			"too many locals",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpCall, 0), code.Make(code.OpPop)),
+			[]object.Object{&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumLocals: math.MaxInt64}},
+			"invalid bytecode in constant 0 at 0000: 9223372036854775807 locals do not fit in a stack of 2048",
+		},
+		{
+			"too many parameters",
+			nil,
+			[]object.Object{&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumParameters: StackSize + 1, NumLocals: StackSize + 1}},
+			"invalid bytecode in constant 0 at 0000: 2049 locals do not fit in a stack of 2048",
+		},
+		{
+			"main stack too deep",
+			bytes.Repeat(code.Make(code.OpNull), StackSize+1),
+			nil,
+			"invalid bytecode at 2048: stack depth 2049 with 0 locals does not fit in a stack of 2048",
+		},
+		{
+			"locals and stack too deep",
+			instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(StackSize-1, code.Make(code.OpNull), code.Make(code.OpNull), code.Make(code.OpReturnValue))},
+			"invalid bytecode in constant 0 at 0001: stack depth 2 with 2047 locals does not fit in a stack of 2048",
+		},
+		{
+			"unsupported constant",
+			nil,
+			[]object.Object{&object.Array{}},
+			"invalid bytecode in constant 0 at 0000: unsupported constant *object.Array",
+		},
+	}
+	for _, tt := range tests {
+		err := Verify(&compiler.ByteCode{Instructions: tt.main, Constants: tt.constants})
+		switch {
+		case tt.expected == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+		case tt.expected != "" && (err == nil || err.Error() != tt.expected):
+			t.Errorf("%s: wrong error. want=%q, got=%v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+// Load 拒绝能够解析、但是不能通过校验的字节码
+func TestLoad(t *testing.T) {
+	data, err := compiler.Marshal(&compiler.ByteCode{Instructions: code.Make(code.OpPop)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiler.Unmarshal(data); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	var verifyErr *VerifyError
+	if _, err := Load(data); !errors.As(err, &verifyErr) {
+		t.Errorf("expected a VerifyError, got %v", err)
+	}
+	if _, err := Load([]byte("nope")); err != compiler.ErrBadMagic {
+		t.Errorf("expected ErrBadMagic, got %v", err)
+	}
+}
+
+// 没有校验的字节码中局部变量太多时报告栈溢出，不能 panic
+func TestHugeLocals(t *testing.T) {
+	bytecode := &compiler.ByteCode{
+		Instructions: instructions(code.Make(code.OpClosure, 0, 0), code.Make(code.OpCall, 0), code.Make(code.OpPop)),
+		Constants:    []object.Object{&object.CompiledFunction{Instructions: code.Make(code.OpReturn), NumLocals: math.MaxInt64}},
+	}
+	machine := New(bytecode)
+	if err := machine.Run(); err == nil || err.Error() != "stack overflow" {
+		t.Errorf("expected stack overflow, got %v", err)
+	}
+}
@@ -1,35 +1,141 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"interpreter/code"
 	"interpreter/compiler"
 	"interpreter/object"
+	"interpreter/profile"
+	"io"
+	"os"
 )
 
 const StackSize = 2048
 const GlobalSize = 65536
+const MaxFrames = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
+
+// ErrStepLimit 表示执行的指令数超过了 Limits.MaxSteps
+var ErrStepLimit = errors.New("step limit exceeded")
+
+// Limits 限制虚拟机使用的资源，零值表示不限制
+type Limits struct {
+	// MaxSteps 是最多执行的指令数
+	MaxSteps int
+	// MaxFrames 是调用栈的最大深度，不能超过 MaxFrames 常量
+	MaxFrames int
+	// Context 被取消后虚拟机会尽快停止
+	Context context.Context
+}
 
 type VM struct {
-	constants    []object.Object
-	instructions code.Instructions
-	stack        []object.Object
-	sp           int
-	globals      []object.Object
+	constants []object.Object
+	stack     []object.Object
+	sp        int
+	globals   []object.Object
+
+	frames      []*Frame
+	framesIndex int
+
+	limits Limits
+	steps  int
+	// halt 记录超出限制或被取消的原因，内置函数回调失败时用它保留原始错误
+	halt error
+	// debugger 不为 nil 时每条指令执行之前都会询问它是否需要暂停
+	debugger *Debugger
+	tracer   Tracer
+	profiler *profile.Profiler
+	// out 是 put 写出的位置，为 nil 时写到标准输出
+	out io.Writer
 }
 
 func New(bytecode *compiler.ByteCode) *VM {
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, Lines: bytecode.Lines}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = mainFrame
+
 	return &VM{
-		constants:    bytecode.Constants,
-		instructions: bytecode.Instructions,
-		stack:        make([]object.Object, StackSize),
-		sp:           0,
-		globals:      make([]object.Object, GlobalSize),
+		constants:   bytecode.Constants,
+		stack:       make([]object.Object, StackSize),
+		sp:          0,
+		globals:     make([]object.Object, GlobalSize),
+		frames:      frames,
+		framesIndex: 1,
+		limits:      Limits{MaxFrames: MaxFrames},
+	}
+}
+
+// NewWithGlobalsState 复用之前的全局变量，REPL 用它在多次输入之间保留状态
+func NewWithGlobalsState(bytecode *compiler.ByteCode, s []object.Object) *VM {
+	vm := New(bytecode)
+	vm.globals = s
+	return vm
+}
+
+// SetLimits 设置执行限制，应该在 Run 或 Call 之前调用
+func (vm *VM) SetLimits(limits Limits) {
+	if limits.MaxFrames <= 0 || limits.MaxFrames > MaxFrames {
+		limits.MaxFrames = MaxFrames
+	}
+	vm.limits = limits
+}
+
+// SetOutput 设置 put 写出的位置
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.out = w
+}
+
+// Output 实现 object.Caller
+func (vm *VM) Output() io.Writer {
+	if vm.out == nil {
+		return os.Stdout
+	}
+	return vm.out
+}
+
+// Err 返回使虚拟机停止的错误，例如 ErrStepLimit 或者 Context 的错误
+func (vm *VM) Err() error {
+	return vm.halt
+}
+
+// step 在每条指令执行之前检查限制，每 1024 条指令检查一次 Context
+func (vm *VM) step() error {
+	if vm.halt != nil {
+		return vm.halt
+	}
+	vm.steps++
+	if vm.limits.MaxSteps > 0 && vm.steps > vm.limits.MaxSteps {
+		vm.halt = ErrStepLimit
+	} else if vm.limits.Context != nil && vm.steps%1024 == 0 {
+		vm.halt = vm.limits.Context.Err()
 	}
+	return vm.halt
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= vm.limits.MaxFrames {
+		return fmt.Errorf("stack overflow")
+	}
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
 }
 
 // 获取栈顶元素
@@ -41,12 +147,43 @@ func (vm *VM) StackTop() object.Object {
 }
 
 func (vm *VM) Run() error {
-	for ip := 0; ip < len(vm.instructions); ip++ {
-		op := code.Opcode(vm.instructions[ip])
+	return vm.run(0)
+}
+
+// run 执行指令直到帧的数量回落到 depth，
+// 主程序的 depth 为 0，内置函数回调 Monkey 函数时为调用前的帧数
+func (vm *VM) run(depth int) error {
+	var ip int
+	var ins code.Instructions
+	var op code.Opcode
+	for vm.framesIndex > depth {
+		frame := vm.currentFrame()
+		if frame.ip >= len(frame.Instructions())-1 {
+			// 只有主程序会执行到指令末尾，函数总是以 OpReturn 或 OpReturnValue 结束
+			return nil
+		}
+		if err := vm.step(); err != nil {
+			return err
+		}
+		if vm.debugger != nil {
+			if err := vm.debugger.check(frame.ip + 1); err != nil {
+				return err
+			}
+		}
+		if vm.tracer != nil {
+			vm.trace(frame, frame.ip+1)
+		}
+		if vm.profiler != nil {
+			vm.profile(frame, frame.ip+1)
+		}
+		frame.ip++
+		ip = frame.ip
+		ins = frame.Instructions()
+		op = code.Opcode(ins[ip])
 		switch op {
 		case code.OpConstant:
-			constIndex := code.ReadUint16(vm.instructions[ip+1:])
-			ip += 2
+			constIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
 			err := vm.push(vm.constants[constIndex])
 			if err != nil {
 				return err
@@ -84,15 +221,15 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpJump:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip = pos - 1
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip = pos - 1
 		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 
 			condition := vm.pop()
 			if !isTruthy(condition) {
-				ip = pos - 1
+				frame.ip = pos - 1
 			}
 		case code.OpNull:
 			err := vm.push(Null)
@@ -100,14 +237,169 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpSetGlobal:
-			globalIndex := code.ReadUint16(vm.instructions[ip+1:])
-			ip += 2
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
 			vm.globals[globalIndex] = vm.pop()
+		case code.OpGetGlobal:
+			globalIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			// 只有不是由编译器生成的字节码才会读到还没有赋值的变量
+			if vm.globals[globalIndex] == nil {
+				return fmt.Errorf("global %d used before it is set", globalIndex)
+			}
+			err := vm.push(vm.globals[globalIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpSetLocal:
+			localIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		case code.OpGetLocal:
+			localIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			if vm.stack[frame.basePointer+int(localIndex)] == nil {
+				return fmt.Errorf("local %d used before it is set", localIndex)
+			}
+			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+		case code.OpGetBuiltin:
+			builtinIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			definition := object.Builtins[builtinIndex]
+			err := vm.push(definition.Builtin)
+			if err != nil {
+				return err
+			}
+		case code.OpGetFree:
+			freeIndex := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			err := vm.push(frame.cl.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpCurrentClosure:
+			err := vm.push(frame.cl)
+			if err != nil {
+				return err
+			}
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			array := vm.buildArray(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+			err := vm.push(array)
+			if err != nil {
+				return err
+			}
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
+			if err != nil {
+				return err
+			}
+			vm.sp = vm.sp - numElements
+			err = vm.push(hash)
+			if err != nil {
+				return err
+			}
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+			err := vm.executeIndexExpression(left, index)
+			if err != nil {
+				return err
+			}
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint16(ins[ip+3:])
+			frame.ip += 4
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case code.OpCall:
+			numArgs := code.ReadUint16(ins[ip+1:])
+			frame.ip += 2
+			err := vm.executeCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+		case code.OpReturnValue:
+			returnValue := vm.pop()
+			if vm.framesIndex == 1 {
+				// 主程序中的 return 结束整个程序，返回值作为最后弹出的元素
+				frame.ip = len(ins) - 1
+				continue
+			}
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+			err := vm.push(returnValue)
+			if err != nil {
+				return err
+			}
+		case code.OpReturn:
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+			err := vm.push(Null)
+			if err != nil {
+				return err
+			}
+		case code.OpWide:
+			err := vm.executeWide(frame, ins, ip)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown opcode %d", op)
 		}
 	}
 	return nil
 }
 
+// executeWide 执行 ip 处 OpWide 前缀后面的指令，它的操作数都是 4 个字节。
+// 编译器只为常量下标、全局变量和跳转目标生成这种形式，其他指令的操作数受栈的大小限制
+func (vm *VM) executeWide(frame *Frame, ins code.Instructions, ip int) error {
+	op := code.Opcode(ins[ip+1])
+	operand := int(code.ReadUint32(ins[ip+2:]))
+	frame.ip += 1 + code.WideWidth
+	switch op {
+	case code.OpConstant:
+		return vm.push(vm.constants[operand])
+	case code.OpJump:
+		frame.ip = operand - 1
+	case code.OpJumpNotTruthy:
+		condition := vm.pop()
+		if !isTruthy(condition) {
+			frame.ip = operand - 1
+		}
+	case code.OpSetGlobal:
+		if operand >= len(vm.globals) {
+			return fmt.Errorf("global index %d out of range", operand)
+		}
+		vm.globals[operand] = vm.pop()
+	case code.OpGetGlobal:
+		if operand >= len(vm.globals) {
+			return fmt.Errorf("global index %d out of range", operand)
+		}
+		if vm.globals[operand] == nil {
+			return fmt.Errorf("global %d used before it is set", operand)
+		}
+		return vm.push(vm.globals[operand])
+	case code.OpClosure:
+		numFree := int(code.ReadUint32(ins[ip+2+code.WideWidth:]))
+		frame.ip += code.WideWidth
+		return vm.pushClosure(operand, numFree)
+	default:
+		// 与 code.Widenable 一致，校验过的字节码不会到这里
+		return fmt.Errorf("unsupported wide opcode %d", op)
+	}
+	return nil
+}
+
 func isTruthy(condition object.Object) bool {
 	switch condition := condition.(type) {
 	case *object.Boolean:
@@ -124,8 +416,11 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	left := vm.pop()
 	leftType := left.Type()
 	rightType := right.Type()
-	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
+	switch {
+	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
+		return vm.executeBinaryStringOperation(op, left, right)
 	}
 	return fmt.Errorf("unsupported types for binary operation: %s %s",
 		leftType, rightType)
@@ -143,11 +438,23 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left object.Object,
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(object.NewInteger(result))
+}
+
+func (vm *VM) executeBinaryStringOperation(op code.Opcode, left object.Object, right object.Object) error {
+	if op != code.OpAdd {
+		return fmt.Errorf("unknown string operator: %d", op)
+	}
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+	return vm.push(&object.String{Value: leftValue + rightValue})
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
@@ -156,6 +463,9 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
+	}
 	switch op {
 	case code.OpEqual:
 		return vm.push(nativeBoolToBooleanObject(left == right))
@@ -182,6 +492,21 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left object.Object, right
 	}
 }
 
+func (vm *VM) executeStringComparison(op code.Opcode, left object.Object, right object.Object) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
 	switch operand {
@@ -198,10 +523,182 @@ func (vm *VM) executeBangOperator() error {
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 	if operand.Type() != object.INTEGER_OBJ {
-		fmt.Errorf("unsupported type for negation: %s", operand.Type())
+		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
 	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+	return vm.push(object.NewInteger(-value))
+}
+
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+	for i := startIndex; i < endIndex; i++ {
+		elements[i-startIndex] = vm.stack[i]
+	}
+	return &object.Array{Element: elements}
+}
+
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	hash := object.NewHash()
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+		if err := hash.Set(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
+
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.HASH_OBJ:
+		return vm.executeHashIndex(left, index)
+	default:
+		return fmt.Errorf("index operator not supported: %s", left.Type())
+	}
+}
+
+func (vm *VM) executeArrayIndex(array, index object.Object) error {
+	arrayObject := array.(*object.Array)
+	i := index.(*object.Integer).Value
+	max := int64(len(arrayObject.Element) - 1)
+	if i < 0 || i > max {
+		return vm.push(Null)
+	}
+	return vm.push(arrayObject.Element[i])
+}
+
+func (vm *VM) executeHashIndex(hash, index object.Object) error {
+	hashObject := hash.(*object.Hash)
+	value, ok, err := hashObject.Get(index)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return vm.push(Null)
+	}
+	return vm.push(value)
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i]
+	}
+	vm.sp = vm.sp - numFree
+	closure := &object.Closure{Fn: function, Free: free}
+	return vm.push(closure)
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return fmt.Errorf("not a function: %s", callee.Type())
+	}
+}
+
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
+			cl.Fn.NumParameters, numArgs)
+	}
+	frame := NewFrame(cl, vm.sp-numArgs)
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+	// 写成减法，NumLocals 很大时不会溢出
+	if cl.Fn.NumLocals >= StackSize-frame.basePointer {
+		return fmt.Errorf("stack overflow")
+	}
+	// 清掉上次使用留下的值，调试器据此判断局部变量是否已经赋值
+	for i := frame.basePointer + numArgs; i < frame.basePointer+cl.Fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+	return nil
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := make([]object.Object, numArgs)
+	copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+	result := builtin.Fn(vm, args...)
+	if vm.halt != nil {
+		return vm.halt
+	}
+	vm.sp = vm.sp - numArgs - 1
+	if result == nil {
+		return vm.push(Null)
+	}
+	if errObj, ok := result.(*object.Error); ok {
+		// 与求值器一致，内置函数返回的错误会终止执行
+		return fmt.Errorf("%s", errObj.Message)
+	}
+	return vm.push(result)
+}
+
+// Call 在当前虚拟机上调用一个 Monkey 函数并返回结果，执行出错时返回 *object.Error。
+// 内置函数通过它回调闭包，所以 map、filter 等可以在虚拟机里使用。
+func (vm *VM) Call(fn object.Object, args ...object.Object) object.Object {
+	switch fn := fn.(type) {
+	case *object.Closure:
+		base := vm.sp
+		depth := vm.framesIndex
+		if err := vm.push(fn); err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		for _, arg := range args {
+			if err := vm.push(arg); err != nil {
+				vm.sp = base
+				return &object.Error{Message: err.Error()}
+			}
+		}
+		if err := vm.callClosure(fn, len(args)); err != nil {
+			vm.framesIndex = depth
+			vm.sp = base
+			return &object.Error{Message: err.Error()}
+		}
+		if err := vm.run(depth); err != nil {
+			vm.framesIndex = depth
+			vm.sp = base
+			return &object.Error{Message: err.Error()}
+		}
+		result := vm.pop()
+		vm.sp = base
+		return result
+	case *object.Builtin:
+		result := fn.Fn(vm, args...)
+		if result == nil {
+			return Null
+		}
+		return result
+	default:
+		return &object.Error{Message: fmt.Sprintf("not a function: %s", fn.Type())}
+	}
+}
+
+// Apply 调用一个 Monkey 函数，与 Call 不同的是错误以 Go error 的形式返回
+func (vm *VM) Apply(fn object.Object, args ...object.Object) (object.Object, error) {
+	result := vm.Call(fn, args...)
+	if vm.halt != nil {
+		return nil, vm.halt
+	}
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, errors.New(errObj.Message)
+	}
+	return result, nil
 }
 
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
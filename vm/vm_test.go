@@ -7,6 +7,7 @@ import (
 	"interpreter/lexer"
 	"interpreter/object"
 	"interpreter/parser"
+	"strings"
 	"testing"
 )
 
@@ -48,23 +49,37 @@ func testBooleanObject(expected bool, actual object.Object) error {
 	return nil
 }
 
+// optimizationLevels 是测试中使用的所有优化级别，每个用例在每个级别下的结果都必须相同
+var optimizationLevels = []compiler.OptimizationLevel{
+	compiler.OptimizeNone,
+	compiler.OptimizeBasic,
+	compiler.OptimizeFull,
+}
+
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
-	for _, tt := range tests {
-		program := parse(tt.input)
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
+	for _, level := range optimizationLevels {
+		for _, tt := range tests {
+			program := parse(tt.input)
+			comp := compiler.New()
+			comp.SetOptimization(level)
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error at level %d: %s", level, err)
+			}
+			// 编译器生成的字节码都应该通过校验
+			if err := Verify(comp.ByteCode()); err != nil {
+				t.Fatalf("verify error at level %d: %s\n%s", level, err, tt.input)
+			}
+			vm := New(comp.ByteCode())
+			err = vm.Run()
+			if err != nil {
+				t.Fatalf("vm error at level %d: %s", level, err)
+			}
+			//stackElem := vm.StackTop()
+			stackElem := vm.LastPoppedStackElem()
+			testExpectedObject(t, tt.expected, stackElem)
 		}
-		vm := New(comp.ByteCode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
-		}
-		//stackElem := vm.StackTop()
-		stackElem := vm.LastPoppedStackElem()
-		testExpectedObject(t, tt.expected, stackElem)
 	}
 }
 
@@ -81,6 +96,50 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testBooleanObject failed: %s", err)
 		}
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Errorf("testStringObject failed: %s", err)
+		}
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Errorf("object not Array: %T (%+v)", actual, actual)
+			return
+		}
+		if len(array.Element) != len(expected) {
+			t.Errorf("wrong num of elements. want=%d, got=%d",
+				len(expected), len(array.Element))
+			return
+		}
+		for i, expectedElem := range expected {
+			err := testIntegerObject(int64(expectedElem), array.Element[i])
+			if err != nil {
+				t.Errorf("testIntegerObject failed: %s", err)
+			}
+		}
+	case map[string]int64:
+		hash, ok := actual.(*object.Hash)
+		if !ok {
+			t.Errorf("object is not Hash. got=%T (%+v)", actual, actual)
+			return
+		}
+		if hash.Len() != len(expected) {
+			t.Errorf("hash has wrong number of Pairs. want=%d, got=%d",
+				len(expected), hash.Len())
+			return
+		}
+		for key, expectedValue := range expected {
+			value, ok, err := hash.Get(&object.String{Value: key})
+			if err != nil || !ok {
+				t.Errorf("no pair for given key in Pairs")
+				continue
+			}
+			err = testIntegerObject(expectedValue, value)
+			if err != nil {
+				t.Errorf("testIntegerObject failed: %s", err)
+			}
+		}
 	case *object.Null:
 		if actual != Null {
 			t.Errorf("object is not null: %T(%+v)", actual, actual)
@@ -88,6 +147,18 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 	}
 }
 
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q",
+			result.Value, expected)
+	}
+	return nil
+}
+
 func TestIntegerArithmetic(t *testing.T) {
 	tests := []vmTestCase{
 		{"1", 1},
@@ -149,6 +220,10 @@ func TestConditionals(t *testing.T) {
 		{"if(10 < 4) {10}", Null},
 		{"if(false){10}", Null},
 		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{`if ("a" < "b") { 1 } else { 2 }`, 1},
+		{"if (!(1 == 2)) { let x = 3; x }", 3},
+		{"let f = fn(x) { if (x) { if (x > 1) { 1 } else { 2 } } else { 3 } }; f(5) + f(1) * 10 + f(false) * 100", 321},
+		{"let f = fn() { if (true) { return 4; } 5 }; f()", 4},
 	}
 	runVmTests(t, tests)
 }
@@ -161,3 +236,252 @@ func TestGlobalLetStatement(t *testing.T) {
 	}
 	runVmTests(t, tests)
 }
+
+func TestStringExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`"monkey"`, "monkey"},
+		{`"mon" + "key"`, "monkey"},
+		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" < "b"`, true},
+		{`"abc" > "abb"`, true},
+		{`upper(trim("  key "))`, "KEY"},
+		{`format("%s-%03d", "id", 7)`, "id-007"},
+		{`join(map(split("a,b", ","), fn(s) { upper(s) }), "")`, "AB"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"[]", []int{}},
+		{"[1, 2, 3]", []int{1, 2, 3}},
+		{"[1 + 2, 3 * 4, 5 + 6]", []int{3, 12, 11}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []vmTestCase{
+		{"{}", map[string]int64{}},
+		{`{"one": 1, "two": 2}`, map[string]int64{"one": 1, "two": 2}},
+		{`{"o" + "ne": 2 * 2, "two": 4 - 2}`, map[string]int64{"one": 4, "two": 2}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3][1]", 2},
+		{"[[1, 1, 1]][0][0]", 1},
+		{"[][0]", Null},
+		{"[1, 2, 3][99]", Null},
+		{"[1][-1]", Null},
+		{"{1: 1, 2: 2}[1]", 1},
+		{"{1: 1}[0]", Null},
+		{"{}[0]", Null},
+		{"{[1, 2]: 3}[[1, 2]]", 3},
+	}
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let fivePlusTen = fn() { 5 + 10; }; fivePlusTen();", 15},
+		{"let one = fn() { 1; }; let two = fn() { 2; }; one() + two()", 3},
+		{"let earlyExit = fn() { return 99; 100; }; earlyExit();", 99},
+		{"let noReturn = fn() { }; noReturn();", Null},
+		{"let noValue = fn() { let a = 1; }; noValue();", Null},
+		{"let identity = fn(a) { a; }; identity(4);", 4},
+		{"let sum = fn(a, b) { let c = a + b; c; }; sum(1, 2);", 3},
+		{"let globalNum = 10; let sum = fn(a, b) { let c = a + b; c + globalNum; }; sum(1, 2) + sum(3, 4);", 30},
+		{"if (true) { let a = 1; }", Null},
+		{"return 5; 10;", 5},
+	}
+	runVmTests(t, tests)
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{"let newClosure = fn(a) { fn() { a; }; }; let closure = newClosure(99); closure();", 99},
+		{"let newAdder = fn(a, b) { fn(c) { a + b + c }; }; let adder = newAdder(1, 2); adder(8);", 11},
+		{`
+		let newAdderOuter = fn(a, b) {
+			let c = a + b;
+			fn(d) {
+				let e = d + c;
+				fn(f) { e + f; };
+			};
+		};
+		let newAdderInner = newAdderOuter(1, 2)
+		let adder = newAdderInner(3);
+		adder(8);
+		`, 14},
+	}
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`
+		let countDown = fn(x) { if (x == 0) { return 0; } else { countDown(x - 1); } };
+		countDown(1);
+		`, 0},
+		{`
+		let wrapper = fn() {
+			let countDown = fn(x) { if (x == 0) { return 0; } else { countDown(x - 1); } };
+			countDown(1);
+		};
+		wrapper();
+		`, 0},
+		{`
+		let fibonacci = fn(x) {
+			if (x == 0) { return 0; }
+			if (x == 1) { return 1; }
+			fibonacci(x - 1) + fibonacci(x - 2);
+		};
+		fibonacci(15);
+		`, 610},
+	}
+	runVmTests(t, tests)
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len([1, 2, 3])`, 3},
+		{`len({"a": 1})`, 1},
+		{`first([1, 2, 3])`, 1},
+		{`last([1, 2, 3])`, 3},
+		{`rest([1, 2, 3])`, []int{2, 3}},
+		{`push([], 1)`, []int{1}},
+		{`map([1, 2, 3], fn(x) { x * 2 })`, []int{2, 4, 6}},
+		{`let n = 10; map([1, 2], fn(x) { x + n })`, []int{11, 12}},
+		{`filter(range(10), fn(x) { x / 2 * 2 == x })`, []int{0, 2, 4, 6, 8}},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, 10},
+		{`reduce([], 7, fn(acc, x) { acc + x })`, 7},
+		{`sort([3, 1, 2])`, []int{1, 2, 3}},
+		{`sort([3, 1, 2], fn(a, b) { a > b })`, []int{3, 2, 1}},
+		{`join(sort(["b", "c", "a"]), ",")`, "a,b,c"},
+		{`range(3)`, []int{0, 1, 2}},
+		{`range(1, 4)`, []int{1, 2, 3}},
+		{`range(10, 0, -3)`, []int{10, 7, 4, 1}},
+		{`range(9223372036854775806, 9223372036854775807, 2)`, []int{9223372036854775806}},
+		{`range(0, -5, 2)`, []int{}},
+		{`map(zip([1, 2, 3], [10, 20]), fn(p) { p[0] + p[1] })`, []int{11, 22}},
+		{`join(keys({"b": 1, "a": 2}), "")`, "ba"},
+		{`values({"b": 1, "a": 2})`, []int{1, 2}},
+		{`contains([1, 2, 3], 2)`, true},
+		{`contains({"a": 1}, "b")`, false},
+		{`contains("monkey", "key")`, true},
+		{`reverse([1, 2, 3])`, []int{3, 2, 1}},
+		{`reverse("abc")`, "cba"},
+		{`join([1, "a", true], "-")`, "1-a-true"},
+		{`map([fn(x) { x + 1 }, fn(x) { x * 3 }], fn(f) { f(2) })`, []int{3, 6}},
+		{`map([1, 2], fn(x) { reduce(range(x + 1), 0, fn(a, b) { a + b }) })`, []int{1, 3}},
+		{`len(filter(range(100000), fn(x) { x > 49999 }))`, 50000},
+	}
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`len(1)`, "argument to `len` not supported, got INTEGER"},
+		{`range(9223372036854775807)`, "`range` would produce 9223372036854775807 elements, the limit is 16777216"},
+		{`fn(a) { a }()`, "wrong number of arguments: want=1, got=0"},
+		{`map([1], fn(a, b) { a })`, "wrong number of arguments: want=2, got=1"},
+		{`map([1, 2], fn(x) { x + true })`, "unsupported types for binary operation: INTEGER BOOLEAN"},
+		{`sort([1, "a"])`, "cannot compare STRING and INTEGER in `sort`"},
+		{`1 / 0`, "division by zero"},
+		{`-"a"`, "unsupported type for negation: STRING"},
+		{`1 + "a"`, "unsupported types for binary operation: INTEGER STRING"},
+		{`if (1 > 0) { 2 / (1 - 1) }`, "division by zero"},
+		{`{fn() { 1 }: 2}`, "unusable as hash key: CLOSURE"},
+		{`let f = fn(x) { f(x + 1) }; f(0)`, "stack overflow"},
+	}
+	for _, level := range optimizationLevels {
+		for _, tt := range tests {
+			program := parse(tt.input)
+			comp := compiler.New()
+			comp.SetOptimization(level)
+			if err := comp.Compile(program); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			vm := New(comp.ByteCode())
+			err := vm.Run()
+			if err == nil {
+				t.Errorf("level %d: expected VM error for %q but resulted in none", level, tt.input)
+				continue
+			}
+			if err.Error() != tt.expected {
+				t.Errorf("level %d: wrong VM error for %q: want=%q, got=%q", level, tt.input, tt.expected, err)
+			}
+		}
+	}
+}
+
+func TestRunUnmarshaledByteCode(t *testing.T) {
+	input := `let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) };
+let names = map(["a", "b"], fn(s) { upper(s) });
+join(names, "") + format("%d", fib(10))`
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	data, err := compiler.Marshal(comp.ByteCode())
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	bytecode, err := compiler.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, "AB55", vm.LastPoppedStackElem())
+}
+
+// 超过 65535 个常量和 64KB 指令的程序需要带 OpWide 前缀的常量下标和跳转目标
+func TestLargePrograms(t *testing.T) {
+	statements := func(start, count int) string {
+		var out strings.Builder
+		for i := start; i < start+count; i++ {
+			fmt.Fprintf(&out, "%d; ", i)
+		}
+		return out.String()
+	}
+	input := `let x = true;
+let a = if (x) { ` + statements(100000, 35000) + `1 } else { 2 };
+let f = fn(y) { if (y) { ` + statements(200000, 35000) + `10 } else { 20 } };
+let g = fn() { 300 };
+a + f(true) + f(false) + g()`
+	runVmTests(t, []vmTestCase{{input, 331}})
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	data, err := compiler.Marshal(comp.ByteCode())
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	bytecode, err := compiler.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if len(bytecode.Constants) <= 65536 || len(bytecode.Instructions) <= 65536 {
+		t.Fatalf("program too small. constants=%d, instructions=%d", len(bytecode.Constants), len(bytecode.Instructions))
+	}
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 331, vm.LastPoppedStackElem())
+}